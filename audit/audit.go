@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/koshatul/auth-proxy/clientip"
+	"github.com/koshatul/auth-proxy/requestid"
+)
+
+// Outcome of an authentication attempt.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Reason an authentication attempt failed.
+const (
+	ReasonMalformed       = "malformed"
+	ReasonExpired         = "expired"
+	ReasonNotYetValid     = "not_yet_valid"
+	ReasonBadSignature    = "bad_signature"
+	ReasonInvalidAudience = "invalid_audience"
+	ReasonMissingSubject  = "missing_subject"
+	ReasonOnlineToken     = "online_token"
+	ReasonUnknownUser     = "unknown_user"
+	ReasonInvalidPassword = "invalid_password"
+	ReasonRevoked         = "revoked"
+	ReasonInvalid         = "invalid_credentials"
+	ReasonTimeout         = "timeout"
+	ReasonCanceled        = "canceled"
+
+	// ReasonMissingCredentials is given to clients refused without credentials, it isn't audited.
+	ReasonMissingCredentials = "missing_credentials"
+)
+
+// Event is a single authentication attempt.
+type Event struct {
+	Time      time.Time `json:"time"`
+	ClientIP  string    `json:"client_ip"`
+	Provider  string    `json:"provider"`
+	Outcome   string    `json:"outcome"`
+	Reason    string    `json:"reason,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	TokenID   string    `json:"token_id,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Cached    bool      `json:"cached,omitempty"`
+}
+
+// Logger writes events as JSON lines to a writer.
+//
+// All methods are safe to call on a nil *Logger, which discards events.
+type Logger struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewLogger returns a Logger that writes to w.
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{w: w}
+}
+
+// Record writes the event, the time, client IP and request ID are taken from the request
+// if they are not already set.
+func (l *Logger) Record(r *http.Request, e Event) {
+	if l == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	if r != nil {
+		if e.ClientIP == "" {
+			e.ClientIP = clientip.FromRequest(r)
+		}
+
+		if e.RequestID == "" {
+			e.RequestID = requestid.FromRequest(r)
+		}
+	}
+
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	buf = append(buf, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	_, _ = l.w.Write(buf)
+}
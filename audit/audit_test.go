@@ -0,0 +1,59 @@
+package audit_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/koshatul/auth-proxy/audit"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("audit", func() {
+
+	var (
+		buf *bytes.Buffer
+		req *http.Request
+	)
+
+	BeforeEach(func() {
+		buf = &bytes.Buffer{}
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.10:51234"
+	})
+
+	decode := func() map[string]interface{} {
+		line := map[string]interface{}{}
+		Expect(json.Unmarshal(buf.Bytes(), &line)).To(Succeed())
+
+		return line
+	}
+
+	It("should write events as JSON lines", func() {
+		audit.NewLogger(buf).Record(req, audit.Event{
+			Provider: "jwt",
+			Outcome:  audit.OutcomeFailure,
+			Reason:   audit.ReasonExpired,
+			TokenID:  "1234-5678",
+		})
+
+		Expect(buf.String()).To(HaveSuffix("}\n"))
+		line := decode()
+		Expect(line).To(HaveKey("time"))
+		Expect(line).To(HaveKeyWithValue("client_ip", "192.0.2.10"))
+		Expect(line).To(HaveKeyWithValue("provider", "jwt"))
+		Expect(line).To(HaveKeyWithValue("outcome", "failure"))
+		Expect(line).To(HaveKeyWithValue("reason", "expired"))
+		Expect(line).To(HaveKeyWithValue("token_id", "1234-5678"))
+		Expect(line).NotTo(HaveKey("subject"))
+		Expect(line).NotTo(HaveKey("cached"))
+	})
+
+	It("should discard events with a nil logger", func() {
+		var l *audit.Logger
+		l.Record(req, audit.Event{Provider: "jwt"})
+	})
+
+})
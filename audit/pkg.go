@@ -0,0 +1,3 @@
+// Package audit records a structured event for every authentication attempt, separate from
+// the application and access logs. Events never contain passwords or tokens.
+package audit
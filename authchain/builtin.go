@@ -0,0 +1,123 @@
+package authchain
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/koshatul/auth-proxy/httpauth"
+	"github.com/koshatul/auth-proxy/jwtauth"
+	"github.com/koshatul/auth-proxy/legacy"
+	"github.com/koshatul/jwt/v2"
+	"go.uber.org/zap"
+)
+
+// defaultQueueSize is the number of tokens that can wait for a jwt provider's workers.
+const defaultQueueSize = 10
+
+// JWTOptions are the options for the jwt provider type.
+type JWTOptions struct {
+	// Audience the tokens must be issued for.
+	Audience string `mapstructure:"audience"`
+
+	// CAFile is the certificate the tokens are signed with.
+	CAFile string `mapstructure:"ca-file"`
+
+	// Workers is the number of tokens verified concurrently (default: number of CPUs).
+	Workers int `mapstructure:"workers"`
+
+	// QueueSize is the number of tokens that can wait for a worker.
+	QueueSize int `mapstructure:"queue-size"`
+
+	// VerifyTimeout is the maximum time to wait for a token to be verified.
+	VerifyTimeout time.Duration `mapstructure:"verify-timeout"`
+}
+
+// LegacyOptions are the options for the legacy provider type.
+type LegacyOptions struct {
+	// Users is a list of "username:password" users, the password may be a bcrypt hash.
+	Users []string `mapstructure:"users"`
+
+	// Groups is a list of "username:group,group" entries setting the groups of the users.
+	Groups []string `mapstructure:"groups"`
+}
+
+// NewVerifier returns the RSA verifier for the audience and CA certificate file.
+func NewVerifier(audience, caFile string) (jwt.Verifier, error) {
+	cert, err := LoadCertificate(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: %T is not an RSA public key", caFile, cert.PublicKey)
+	}
+
+	return &jwt.RSAVerifier{Audience: audience, PublicKey: key}, nil
+}
+
+// LoadCertificate returns the first certificate in a PEM file.
+func LoadCertificate(filename string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM certificate found", filename)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	return cert, nil
+}
+
+func newJWTProvider(ctx context.Context, logger *zap.Logger, options map[string]interface{}) (httpauth.Authenticator, error) {
+	opts := JWTOptions{QueueSize: defaultQueueSize}
+	if err := DecodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+
+	if opts.CAFile == "" {
+		return nil, errors.New("ca-file is required")
+	}
+
+	verifier, err := NewVerifier(opts.Audience, opts.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	authChan := make(chan *jwtauth.AuthRequest, opts.QueueSize)
+
+	go jwtauth.AuthRunner(ctx, logger, verifier, authChan, opts.Workers)
+
+	return jwtauth.NewProvider(logger, authChan, opts.VerifyTimeout), nil
+}
+
+func newLegacyProvider(_ context.Context, logger *zap.Logger, options map[string]interface{}) (httpauth.Authenticator, error) {
+	opts := LegacyOptions{}
+	if err := DecodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+
+	if errs := legacy.ValidateUsers(opts.Users); len(errs) > 0 {
+		return nil, joinErrors(errs)
+	}
+
+	users := legacy.ParseUsers(logger, opts.Users)
+	if err := legacy.SetGroups(users, opts.Groups); err != nil {
+		return nil, err
+	}
+
+	return legacy.NewProvider(logger, users, nil), nil
+}
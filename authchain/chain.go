@@ -0,0 +1,94 @@
+package authchain
+
+import (
+	"context"
+	"errors"
+
+	"github.com/koshatul/auth-proxy/httpauth"
+)
+
+// Link is a single provider in a Chain.
+type Link struct {
+	// Name replaces the provider name reported in the Identity and errors, if set.
+	Name string
+
+	// StopOnFailure ends the chain when the provider rejects credentials it recognises,
+	// otherwise the next provider is tried.
+	StopOnFailure bool
+
+	Provider httpauth.Authenticator
+}
+
+// Chain is a httpauth.Authenticator that tries each provider in order, providers that don't
+// recognise the credentials (httpauth.ErrNoCredentials) always pass them to the next provider.
+// The result of each provider is reported with httpauth.RecordAttempt for the audit log.
+type Chain struct {
+	links []Link
+}
+
+// NewChain returns a Chain of the links.
+func NewChain(links ...Link) *Chain {
+	return &Chain{links: links}
+}
+
+// Links returns the links in the chain.
+func (c *Chain) Links() []Link {
+	return c.links
+}
+
+// Authenticate satisfies the httpauth.Authenticator interface for Chain, if no provider accepts the
+// credentials the error from the last provider that recognised them is returned.
+func (c *Chain) Authenticate(ctx context.Context, creds httpauth.Credentials) (*httpauth.Identity, error) {
+	var failure, last error
+
+	for _, link := range c.links {
+		id, err := link.Provider.Authenticate(ctx, creds)
+		if err == nil && id != nil {
+			if link.Name != "" {
+				id.Provider = link.Name
+			}
+
+			httpauth.RecordAttempt(ctx, id, nil)
+
+			return id, nil
+		}
+
+		if err == nil {
+			err = &httpauth.AuthError{Provider: link.Name, Err: httpauth.ErrInvalid}
+		}
+
+		err = rename(err, link.Name)
+		last = err
+
+		httpauth.RecordAttempt(ctx, nil, err)
+
+		if errors.Is(err, httpauth.ErrNoCredentials) {
+			continue
+		}
+
+		if link.StopOnFailure || ctx.Err() != nil {
+			return nil, err
+		}
+
+		failure = err
+	}
+
+	switch {
+	case failure != nil:
+		return nil, failure
+	case last != nil:
+		return nil, last
+	}
+
+	return nil, httpauth.ErrNoCredentials
+}
+
+// rename sets the provider name on the error if it is a *httpauth.AuthError.
+func rename(err error, name string) error {
+	var authErr *httpauth.AuthError
+	if name != "" && errors.As(err, &authErr) {
+		authErr.Provider = name
+	}
+
+	return err
+}
@@ -0,0 +1,152 @@
+package authchain_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/koshatul/auth-proxy/audit"
+	"github.com/koshatul/auth-proxy/authchain"
+	"github.com/koshatul/auth-proxy/httpauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	cache "github.com/patrickmn/go-cache"
+	"go.uber.org/zap"
+)
+
+var _ = Describe("Chain", func() {
+
+	var calls []string
+
+	provider := func(name string, err error) httpauth.Authenticator {
+		return httpauth.AuthenticatorFunc(func(ctx context.Context, creds httpauth.Credentials) (*httpauth.Identity, error) {
+			calls = append(calls, name)
+
+			if err != nil {
+				return nil, &httpauth.AuthError{Provider: name, Reason: audit.ReasonInvalidPassword, Err: err}
+			}
+
+			return &httpauth.Identity{Subject: creds.Username, Provider: name}, nil
+		})
+	}
+
+	authenticate := func(chain *authchain.Chain) (*httpauth.Identity, error) {
+		return chain.Authenticate(context.Background(), httpauth.Credentials{Username: "test", Password: "test"})
+	}
+
+	BeforeEach(func() {
+		calls = nil
+	})
+
+	It("should return the first identity in order", func() {
+		id, err := authenticate(authchain.NewChain(
+			authchain.Link{Provider: provider("first", httpauth.ErrNoCredentials)},
+			authchain.Link{Provider: provider("second", nil)},
+			authchain.Link{Provider: provider("third", nil)},
+		))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(id.Provider).To(Equal("second"))
+		Expect(calls).To(Equal([]string{"first", "second"}))
+	})
+
+	It("should try the next provider after a failure", func() {
+		id, err := authenticate(authchain.NewChain(
+			authchain.Link{Provider: provider("first", httpauth.ErrInvalid)},
+			authchain.Link{Provider: provider("second", nil)},
+		))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(id.Provider).To(Equal("second"))
+	})
+
+	It("should stop after a failure with stop-on-failure", func() {
+		_, err := authenticate(authchain.NewChain(
+			authchain.Link{Provider: provider("first", httpauth.ErrInvalid), StopOnFailure: true},
+			authchain.Link{Provider: provider("second", nil)},
+		))
+		Expect(err).To(MatchError(httpauth.ErrInvalid))
+		Expect(calls).To(Equal([]string{"first"}))
+	})
+
+	It("should pass unrecognised credentials on with stop-on-failure", func() {
+		_, err := authenticate(authchain.NewChain(
+			authchain.Link{Provider: provider("first", httpauth.ErrNoCredentials), StopOnFailure: true},
+			authchain.Link{Provider: provider("second", nil)},
+		))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(calls).To(Equal([]string{"first", "second"}))
+	})
+
+	It("should return the failure rather than unrecognised credentials", func() {
+		_, err := authenticate(authchain.NewChain(
+			authchain.Link{Provider: provider("first", httpauth.ErrExpired)},
+			authchain.Link{Provider: provider("second", httpauth.ErrNoCredentials)},
+		))
+		Expect(err).To(MatchError(httpauth.ErrExpired))
+	})
+
+	It("should return ErrNoCredentials when nothing recognises the credentials", func() {
+		_, err := authenticate(authchain.NewChain(
+			authchain.Link{Provider: provider("first", httpauth.ErrNoCredentials)},
+		))
+		Expect(err).To(MatchError(httpauth.ErrNoCredentials))
+
+		_, err = authenticate(authchain.NewChain())
+		Expect(err).To(MatchError(httpauth.ErrNoCredentials))
+	})
+
+	It("should report the configured name", func() {
+		id, err := authenticate(authchain.NewChain(
+			authchain.Link{Name: "staff", Provider: provider("first", httpauth.ErrInvalid)},
+			authchain.Link{Name: "partners", Provider: provider("second", nil)},
+		))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(id.Provider).To(Equal("partners"))
+
+		_, err = authenticate(authchain.NewChain(
+			authchain.Link{Name: "staff", Provider: provider("first", httpauth.ErrInvalid)},
+		))
+
+		authErr := &httpauth.AuthError{}
+		Expect(errors.As(err, &authErr)).To(BeTrue())
+		Expect(authErr.Provider).To(Equal("staff"))
+	})
+
+	It("should audit each provider that recognised the credentials", func() {
+		auditBuf := &bytes.Buffer{}
+		handler := &httpauth.BasicAuthHandler{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+			BasicAuthWrapper: &httpauth.BasicAuthWrapper{
+				Cache:  cache.New(time.Minute, time.Minute),
+				Logger: zap.NewNop(),
+				Audit:  audit.NewLogger(auditBuf),
+				Provider: authchain.NewChain(
+					authchain.Link{Provider: provider("first", httpauth.ErrNoCredentials)},
+					authchain.Link{Provider: provider("second", httpauth.ErrInvalid)},
+					authchain.Link{Provider: provider("third", nil)},
+				),
+			},
+		}
+
+		for i := 0; i < 2; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.SetBasicAuth("test", "test")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+		}
+
+		events := strings.Split(strings.TrimSpace(auditBuf.String()), "\n")
+		Expect(events).To(HaveLen(4))
+		Expect(events[0]).To(ContainSubstring(`"provider":"second","outcome":"failure","reason":"invalid_password"`))
+		Expect(events[1]).To(ContainSubstring(`"provider":"third","outcome":"success","subject":"test"`))
+		Expect(events[2]).To(ContainSubstring(`"provider":"second","outcome":"failure"`))
+		Expect(events[2]).To(ContainSubstring(`"cached":true`))
+		Expect(events[3]).To(ContainSubstring(`"provider":"third","outcome":"success"`))
+		Expect(events[3]).To(ContainSubstring(`"cached":true`))
+	})
+
+})
@@ -0,0 +1,176 @@
+package authchain
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/koshatul/auth-proxy/configtable"
+	"go.uber.org/zap"
+)
+
+// ProviderConfig is a single `[[auth.providers]]` entry, the keys other than name, type,
+// disabled and stop-on-failure are the options passed to the provider type's Factory.
+//
+//	[[auth.providers]]
+//	type = "legacy"
+//	users = ["admin:$2a$15$..."]
+//	groups = ["admin:admins,ops"]
+//	stop-on-failure = true
+//
+//	[[auth.providers]]
+//	type = "jwt"
+//	audience = "tls-web-client-auth"
+//	ca-file = "/run/secrets/ca.pem"
+type ProviderConfig struct {
+	Name          string                 `mapstructure:"name"`
+	Type          string                 `mapstructure:"type"`
+	Disabled      bool                   `mapstructure:"disabled"`
+	StopOnFailure bool                   `mapstructure:"stop-on-failure"`
+	Options       map[string]interface{} `mapstructure:"-"`
+}
+
+// nolint: gochecknoglobals // keys common to every provider entry
+var commonKeys = map[string]bool{
+	"name":            true,
+	"type":            true,
+	"disabled":        true,
+	"stop-on-failure": true,
+}
+
+// ParseConfig returns the provider entries from the raw `auth.providers` configuration value.
+func ParseConfig(raw interface{}) ([]ProviderConfig, error) {
+	entries, err := configtable.Tables(raw, "auth provider")
+	if err != nil {
+		return nil, err
+	}
+
+	cfgs := make([]ProviderConfig, 0, len(entries))
+
+	for i, entry := range entries {
+		cfg := ProviderConfig{Options: map[string]interface{}{}}
+		common := map[string]interface{}{}
+
+		for key, value := range entry {
+			if commonKeys[strings.ToLower(key)] {
+				common[strings.ToLower(key)] = value
+			} else {
+				cfg.Options[strings.ToLower(key)] = value
+			}
+		}
+
+		if err := configtable.Decode(common, &cfg); err != nil {
+			return nil, fmt.Errorf("auth provider %d: %w", i, err)
+		}
+
+		if cfg.Type == "" {
+			return nil, fmt.Errorf("auth provider %d: type is required", i)
+		}
+
+		cfgs = append(cfgs, cfg)
+	}
+
+	return cfgs, nil
+}
+
+// Build returns a Chain of the enabled providers in order, each is built by the Factory for its type.
+func Build(ctx context.Context, logger *zap.Logger, cfgs []ProviderConfig) (*Chain, error) {
+	links := []Link{}
+
+	for i, cfg := range cfgs {
+		if cfg.Disabled {
+			continue
+		}
+
+		factory, err := Lookup(cfg.Type)
+		if err != nil {
+			return nil, fmt.Errorf("auth provider %d: %w", i, err)
+		}
+
+		provider, err := factory(ctx, logger.With(zap.String("provider", providerName(cfg))), cfg.Options)
+		if err != nil {
+			return nil, fmt.Errorf("auth provider %d (%s): %w", i, providerName(cfg), err)
+		}
+
+		links = append(links, Link{
+			Name:          cfg.Name,
+			StopOnFailure: cfg.StopOnFailure,
+			Provider:      provider,
+		})
+	}
+
+	if len(links) == 0 {
+		return nil, fmt.Errorf("no auth providers are enabled")
+	}
+
+	return NewChain(links...), nil
+}
+
+// Validate returns an error for each provider entry that can't be built (and if none are enabled),
+// the providers are built with a cancelled context so no background work is left running.
+func Validate(logger *zap.Logger, cfgs []ProviderConfig) []error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	errs := []error{}
+	enabled := 0
+
+	for i, cfg := range cfgs {
+		if cfg.Disabled {
+			continue
+		}
+
+		enabled++
+
+		factory, err := Lookup(cfg.Type)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("auth provider %d: %w", i, err))
+
+			continue
+		}
+
+		if _, err := factory(ctx, logger, cfg.Options); err != nil {
+			errs = append(errs, fmt.Errorf("auth provider %d (%s): %w", i, providerName(cfg), err))
+		}
+	}
+
+	if enabled == 0 {
+		errs = append(errs, fmt.Errorf("no auth providers are enabled"))
+	}
+
+	return errs
+}
+
+// DecodeOptions decodes the provider options into out (a pointer to a struct with
+// `mapstructure:"key-name"` tags), unknown options are an error.
+func DecodeOptions(options map[string]interface{}, out interface{}) error {
+	return configtable.Decode(options, out)
+}
+
+func providerName(cfg ProviderConfig) string {
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+
+	return cfg.Type
+}
+
+// multiError is several errors reported together.
+type multiError []error
+
+func (m multiError) Error() string {
+	msgs := make([]string, len(m))
+	for i, err := range m {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+func joinErrors(errs []error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+
+	return multiError(errs)
+}
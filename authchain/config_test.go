@@ -0,0 +1,184 @@
+package authchain_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/koshatul/auth-proxy/authchain"
+	"github.com/koshatul/auth-proxy/httpauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+var _ = Describe("config", func() {
+
+	parse := func(toml string) ([]authchain.ProviderConfig, error) {
+		v := viper.New()
+		v.SetConfigType("toml")
+		Expect(v.ReadConfig(bytes.NewBufferString(toml))).To(Succeed())
+
+		return authchain.ParseConfig(v.Get("auth.providers"))
+	}
+
+	It("should parse the providers in order", func() {
+		cfgs, err := parse(strings.Join([]string{
+			`[[auth.providers]]`,
+			`type = "legacy"`,
+			`users = ["admin:secret"]`,
+			`stop-on-failure = true`,
+			``,
+			`[[auth.providers]]`,
+			`name = "partners"`,
+			`type = "jwt"`,
+			`audience = "partners"`,
+			`ca-file = "/run/secrets/partners.pem"`,
+			`verify-timeout = "2s"`,
+			`disabled = true`,
+		}, "\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfgs).To(HaveLen(2))
+
+		Expect(cfgs[0].Type).To(Equal("legacy"))
+		Expect(cfgs[0].StopOnFailure).To(BeTrue())
+		Expect(cfgs[0].Options).To(HaveKey("users"))
+		Expect(cfgs[0].Options).NotTo(HaveKey("stop-on-failure"))
+
+		Expect(cfgs[1].Name).To(Equal("partners"))
+		Expect(cfgs[1].Type).To(Equal("jwt"))
+		Expect(cfgs[1].Disabled).To(BeTrue())
+		Expect(cfgs[1].Options).To(HaveKeyWithValue("audience", "partners"))
+	})
+
+	It("should require a type", func() {
+		_, err := parse("[[auth.providers]]\nname = \"nameless\"\n")
+		Expect(err).To(MatchError(ContainSubstring("type is required")))
+	})
+
+	It("should return nothing when there are no providers", func() {
+		cfgs, err := authchain.ParseConfig(nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfgs).To(BeEmpty())
+	})
+
+	Describe("Build", func() {
+
+		build := func(cfgs ...authchain.ProviderConfig) (*authchain.Chain, error) {
+			return authchain.Build(context.Background(), zap.NewNop(), cfgs)
+		}
+
+		It("should build the enabled providers", func() {
+			chain, err := build(
+				authchain.ProviderConfig{Type: "legacy", Options: map[string]interface{}{"users": []interface{}{"admin:secret"}}},
+				authchain.ProviderConfig{Type: "jwt", Disabled: true},
+				authchain.ProviderConfig{Name: "other", Type: "LEGACY", StopOnFailure: true},
+			)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(chain.Links()).To(HaveLen(2))
+			Expect(chain.Links()[1].Name).To(Equal("other"))
+			Expect(chain.Links()[1].StopOnFailure).To(BeTrue())
+
+			id, err := chain.Authenticate(context.Background(), httpauth.Credentials{Username: "admin", Password: "secret"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id.Provider).To(Equal("legacy"))
+		})
+
+		It("should return the groups of legacy users", func() {
+			chain, err := build(authchain.ProviderConfig{Type: "legacy", Options: map[string]interface{}{
+				"users":  []interface{}{"admin:secret"},
+				"groups": []interface{}{"admin:admins"},
+			}})
+			Expect(err).NotTo(HaveOccurred())
+
+			id, err := chain.Authenticate(context.Background(), httpauth.Credentials{Username: "admin", Password: "secret"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id.Groups).To(Equal([]string{"admins"}))
+
+			_, err = build(authchain.ProviderConfig{Type: "legacy", Options: map[string]interface{}{
+				"groups": []interface{}{"admin:admins"},
+			}})
+			Expect(err).To(MatchError(ContainSubstring(`"admin" is not a legacy user`)))
+		})
+
+		It("should reject unknown types", func() {
+			_, err := build(authchain.ProviderConfig{Type: "ldap"})
+			Expect(err).To(MatchError(ContainSubstring(`unknown auth provider type "ldap"`)))
+		})
+
+		It("should reject unknown options", func() {
+			_, err := build(authchain.ProviderConfig{Type: "legacy", Options: map[string]interface{}{"user": "admin:secret"}})
+			Expect(err).To(MatchError(ContainSubstring("user")))
+		})
+
+		It("should report errors from the provider type", func() {
+			_, err := build(authchain.ProviderConfig{Type: "jwt", Options: map[string]interface{}{"audience": "test"}})
+			Expect(err).To(MatchError(ContainSubstring("ca-file is required")))
+
+			_, err = build(authchain.ProviderConfig{Type: "jwt", Options: map[string]interface{}{"ca-file": "/does/not/exist.pem"}})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should reject a CA file that isn't a PEM certificate", func() {
+			f, err := ioutil.TempFile("", "authchain")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(f.Name())
+
+			_, err = f.WriteString("not a certificate")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+
+			_, err = build(authchain.ProviderConfig{Type: "jwt", Options: map[string]interface{}{"ca-file": f.Name()}})
+			Expect(err).To(MatchError(ContainSubstring("no PEM certificate found")))
+		})
+
+		It("should require at least one enabled provider", func() {
+			_, err := build(authchain.ProviderConfig{Type: "legacy", Disabled: true})
+			Expect(err).To(MatchError("no auth providers are enabled"))
+		})
+
+		It("should build registered types", func() {
+			authchain.Register("static", func(ctx context.Context, logger *zap.Logger, options map[string]interface{}) (httpauth.Authenticator, error) {
+				return httpauth.AuthenticatorFunc(func(context.Context, httpauth.Credentials) (*httpauth.Identity, error) {
+					return &httpauth.Identity{Subject: "static", Provider: "static"}, nil
+				}), nil
+			})
+
+			Expect(authchain.Types()).To(ContainElement("static"))
+
+			chain, err := build(authchain.ProviderConfig{Type: "static"})
+			Expect(err).NotTo(HaveOccurred())
+
+			id, err := chain.Authenticate(context.Background(), httpauth.Credentials{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id.Subject).To(Equal("static"))
+		})
+
+	})
+
+	Describe("Validate", func() {
+
+		It("should report every invalid provider", func() {
+			errs := authchain.Validate(zap.NewNop(), []authchain.ProviderConfig{
+				{Type: "ldap"},
+				{Type: "legacy", Options: map[string]interface{}{"users": []interface{}{"admin:secret"}}},
+				{Type: "jwt", Options: map[string]interface{}{"audience": "test"}},
+				{Type: "legacy", Options: map[string]interface{}{"users": []interface{}{"admin", "other:$2a$nope"}}},
+			})
+			Expect(errs).To(HaveLen(3))
+			Expect(errs[0]).To(MatchError(ContainSubstring(`auth provider 0: unknown auth provider type "ldap"`)))
+			Expect(errs[1]).To(MatchError(ContainSubstring("auth provider 2 (jwt): ca-file is required")))
+			Expect(errs[2]).To(MatchError(ContainSubstring(`legacy user 0: expected "username:password"`)))
+			Expect(errs[2]).To(MatchError(ContainSubstring("legacy user 1 (other): invalid bcrypt hash")))
+		})
+
+		It("should require at least one enabled provider", func() {
+			Expect(authchain.Validate(zap.NewNop(), nil)).To(ConsistOf(MatchError("no auth providers are enabled")))
+		})
+
+	})
+
+})
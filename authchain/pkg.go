@@ -0,0 +1,5 @@
+// Package authchain builds an ordered chain of authentication providers from configuration.
+//
+// Provider types are looked up by name from a registry (jwt and legacy), each entry in the
+// chain is tried in turn until one accepts the credentials.
+package authchain
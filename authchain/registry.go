@@ -0,0 +1,64 @@
+package authchain
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/koshatul/auth-proxy/httpauth"
+	"go.uber.org/zap"
+)
+
+// Factory builds a provider from the options in its `[[auth.providers]]` entry, the provider
+// should stop any background work once ctx is done.
+type Factory func(ctx context.Context, logger *zap.Logger, options map[string]interface{}) (httpauth.Authenticator, error)
+
+// nolint: gochecknoglobals // registry of available provider types
+var (
+	factoriesLock sync.RWMutex
+	factories     = map[string]Factory{
+		"jwt":    newJWTProvider,
+		"legacy": newLegacyProvider,
+	}
+)
+
+// Register adds a named provider type to the registry, replacing any existing type with the same name.
+func Register(name string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+
+	factories[strings.ToLower(name)] = factory
+}
+
+// Lookup returns the named provider type from the registry.
+func Lookup(name string) (Factory, error) {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+
+	if f, ok := factories[strings.ToLower(name)]; ok {
+		return f, nil
+	}
+
+	return nil, fmt.Errorf("unknown auth provider type %q (available: %s)", name, strings.Join(typeNames(), ", "))
+}
+
+// Types returns the sorted names of all the registered provider types.
+func Types() []string {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+
+	return typeNames()
+}
+
+func typeNames() []string {
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
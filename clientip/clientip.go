@@ -0,0 +1,207 @@
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type contextKey struct{}
+
+// nolint: gochecknoglobals // read only
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Real-IP", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"}
+
+// Handler stores the client IP of each request in the request context.
+//
+// For a request from a trusted proxy, X-Forwarded-For is read from right to left and the client
+// is the first address that isn't a trusted proxy (so addresses a client prepends itself are
+// ignored), the header is trimmed to start at the client. If a malformed address is found
+// before one that isn't trusted the client is the connecting address and X-Forwarded-For is
+// removed. Without X-Forwarded-For the client is taken from X-Real-IP. X-Forwarded-Proto and
+// X-Forwarded-Host set the scheme and host like `handlers.ProxyHeaders`.
+//
+// For any other request the client is the connecting address and the forwarded headers are
+// removed, so they can't be spoofed to the backend. Forwarded (RFC 7239) is one of the headers
+// removed, it is never read.
+//
+// X-Real-IP is set to the client IP for the backend, and the proxy appends the connecting address
+// to X-Forwarded-For.
+type Handler struct {
+	Handler http.Handler
+
+	// TrustedProxies are the networks whose forwarded headers are honoured.
+	TrustedProxies []*net.IPNet
+}
+
+// ServeHTTP satisfies the http.Handler interface for Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	client := remoteIP(r.RemoteAddr)
+
+	if ip := net.ParseIP(client); ip != nil && h.trusted(ip) {
+		client = h.resolve(r, client)
+
+		if proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			r.URL.Scheme = proto
+		}
+
+		if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+			r.Host = host
+		}
+	} else {
+		for _, header := range forwardedHeaders {
+			r.Header.Del(header)
+		}
+	}
+
+	r.Header.Set("X-Real-IP", client)
+
+	h.Handler.ServeHTTP(w, r.WithContext(NewContext(r.Context(), client)))
+}
+
+// resolve returns the client IP for a request from a trusted proxy and trims X-Forwarded-For.
+func (h *Handler) resolve(r *http.Request, peer string) string {
+	hops := headerValues(r.Header, "X-Forwarded-For")
+	if len(hops) == 0 {
+		if ip := net.ParseIP(remoteIP(r.Header.Get("X-Real-IP"))); ip != nil {
+			return ip.String()
+		}
+
+		return peer
+	}
+
+	client, first := peer, len(hops)
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(remoteIP(hops[i]))
+		if ip == nil {
+			// a malformed hop before an untrusted one means the chain can't be followed to the
+			// client, so the trusted proxy is the client.
+			r.Header.Del("X-Forwarded-For")
+
+			return peer
+		}
+
+		client, first = ip.String(), i
+
+		if !h.trusted(ip) {
+			break
+		}
+	}
+
+	if first < len(hops) {
+		r.Header.Set("X-Forwarded-For", strings.Join(hops[first:], ", "))
+	} else {
+		r.Header.Del("X-Forwarded-For")
+	}
+
+	return client
+}
+
+func (h *Handler) trusted(ip net.IP) bool {
+	for _, n := range h.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseTrustedProxies parses CIDRs (or single addresses) of trusted proxies, a value may hold
+// several separated by commas.
+func ParseTrustedProxies(values []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v == "" {
+				continue
+			}
+
+			n, err := parseNetwork(v)
+			if err != nil {
+				return nil, err
+			}
+
+			networks = append(networks, n)
+		}
+	}
+
+	return networks, nil
+}
+
+func parseNetwork(v string) (*net.IPNet, error) {
+	if strings.Contains(v, "/") {
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", v, err)
+		}
+
+		return n, nil
+	}
+
+	ip := net.ParseIP(v)
+	if ip == nil {
+		return nil, fmt.Errorf("trusted proxy %q is not an IP address or CIDR", v)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(8*net.IPv4len, 8*net.IPv4len)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len)}, nil
+}
+
+// NewContext returns a copy of ctx carrying the client IP.
+func NewContext(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, contextKey{}, ip)
+}
+
+// FromContext returns the client IP carried by ctx, or an empty string if there is none.
+func FromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(contextKey{}).(string)
+
+	return ip
+}
+
+// FromRequest returns the client IP carried by the request context, or the host of the
+// connecting address if there is none.
+func FromRequest(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+
+	if ip := FromContext(r.Context()); ip != "" {
+		return ip
+	}
+
+	return remoteIP(r.RemoteAddr)
+}
+
+// remoteIP returns the address without a port (or the brackets around an IPv6 address).
+func remoteIP(addr string) string {
+	addr = strings.TrimSpace(addr)
+
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// headerValues returns the comma separated values of all headers matching key.
+func headerValues(h http.Header, key string) []string {
+	values := []string{}
+
+	for _, line := range h.Values(key) {
+		for _, v := range strings.Split(line, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+
+	return values
+}
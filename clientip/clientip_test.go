@@ -0,0 +1,118 @@
+package clientip_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/koshatul/auth-proxy/clientip"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Handler", func() {
+	var (
+		handler  *clientip.Handler
+		received *http.Request
+	)
+
+	serve := func(remoteAddr string, header map[string]string) string {
+		r := httptest.NewRequest(http.MethodGet, "http://proxy.internal/v2/", nil)
+		r.RemoteAddr = remoteAddr
+
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		return clientip.FromRequest(received)
+	}
+
+	BeforeEach(func() {
+		trusted, err := clientip.ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1,fd00::/8"})
+		Expect(err).NotTo(HaveOccurred())
+
+		received = nil
+		handler = &clientip.Handler{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r
+			}),
+			TrustedProxies: trusted,
+		}
+	})
+
+	DescribeTable("resolves the client IP",
+		func(remoteAddr string, header map[string]string, client, forwardedFor string) {
+			Expect(serve(remoteAddr, header)).To(Equal(client))
+			Expect(received.Header.Get("X-Forwarded-For")).To(Equal(forwardedFor))
+			Expect(received.Header.Get("X-Real-IP")).To(Equal(client))
+		},
+		Entry("direct", "203.0.113.5:1234", nil, "203.0.113.5", ""),
+		Entry("untrusted forwarded for",
+			"203.0.113.5:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			"203.0.113.5", ""),
+		Entry("untrusted real ip",
+			"203.0.113.5:1234", map[string]string{"X-Real-IP": "198.51.100.1"},
+			"203.0.113.5", ""),
+		Entry("trusted forwarded for",
+			"10.1.2.3:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			"198.51.100.1", "198.51.100.1"),
+		Entry("trusted chain",
+			"10.1.2.3:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, 192.168.1.1, 10.9.9.9"},
+			"198.51.100.1", "198.51.100.1, 192.168.1.1, 10.9.9.9"),
+		Entry("spoofed entries before the client are dropped",
+			"10.1.2.3:1234", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.1, 10.9.9.9"},
+			"198.51.100.1", "198.51.100.1, 10.9.9.9"),
+		Entry("all trusted",
+			"10.1.2.3:1234", map[string]string{"X-Forwarded-For": "10.9.9.9"},
+			"10.9.9.9", "10.9.9.9"),
+		Entry("malformed entry falls back to the peer",
+			"10.1.2.3:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, unknown, 10.9.9.9"},
+			"10.1.2.3", ""),
+		Entry("malformed entry before an untrusted hop is ignored",
+			"10.1.2.3:1234", map[string]string{"X-Forwarded-For": "unknown, 198.51.100.1, 10.9.9.9"},
+			"198.51.100.1", "198.51.100.1, 10.9.9.9"),
+		Entry("trusted real ip",
+			"10.1.2.3:1234", map[string]string{"X-Real-IP": "198.51.100.1"},
+			"198.51.100.1", ""),
+		Entry("trusted single address",
+			"192.168.1.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			"198.51.100.1", "198.51.100.1"),
+		Entry("neighbouring address isn't trusted",
+			"192.168.1.2:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			"192.168.1.2", ""),
+		Entry("ipv6",
+			"[fd00::1]:1234", map[string]string{"X-Forwarded-For": "[2001:db8::1]:5678"},
+			"2001:db8::1", "[2001:db8::1]:5678"),
+	)
+
+	It("honours the scheme and host only from trusted proxies", func() {
+		header := map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "registry.example.com"}
+
+		serve("10.1.2.3:1234", header)
+		Expect(received.URL.Scheme).To(Equal("https"))
+		Expect(received.Host).To(Equal("registry.example.com"))
+
+		serve("203.0.113.5:1234", header)
+		Expect(received.URL.Scheme).To(Equal("http"))
+		Expect(received.Host).To(Equal("proxy.internal"))
+		Expect(received.Header.Get("X-Forwarded-Proto")).To(BeEmpty())
+		Expect(received.Header.Get("X-Forwarded-Host")).To(BeEmpty())
+	})
+
+	It("falls back to the connecting address without the handler", func() {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "[2001:db8::1]:1234"
+		Expect(clientip.FromRequest(r)).To(Equal("2001:db8::1"))
+	})
+
+	DescribeTable("rejects invalid trusted proxies",
+		func(value, message string) {
+			_, err := clientip.ParseTrustedProxies([]string{value})
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		},
+		Entry("address", "10.0.0", "is not an IP address or CIDR"),
+		Entry("cidr", "10.0.0.0/33", "invalid CIDR address"),
+	)
+})
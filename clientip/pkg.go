@@ -0,0 +1,4 @@
+// Package clientip determines the real client IP of each request, the forwarded headers are only
+// honoured when the request comes from a trusted proxy. The IP is stored in the request context
+// for logging, auditing and load balancing.
+package clientip
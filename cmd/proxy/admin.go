@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/koshatul/auth-proxy/proxy"
+	"github.com/na4ma4/config"
+	"go.uber.org/zap"
+)
+
+// adminHandler serves the admin endpoint, the health of the backends and the expvar metrics.
+// The load balancer is replaced each time the handler is rebuilt.
+type adminHandler struct {
+	lock     sync.RWMutex
+	balancer *proxy.LoadBalancer
+	mux      *http.ServeMux
+}
+
+// backendsStatus is the response of the /backends admin endpoint.
+type backendsStatus struct {
+	Strategy string                `json:"strategy"`
+	Healthy  int                   `json:"healthy"`
+	Backends []proxy.BackendStatus `json:"backends"`
+}
+
+func newAdminHandler() *adminHandler {
+	a := &adminHandler{mux: http.NewServeMux()}
+
+	a.mux.HandleFunc("/healthz", a.healthz)
+	a.mux.HandleFunc("/backends", a.backends)
+	a.mux.Handle("/debug/vars", expvar.Handler())
+
+	return a
+}
+
+// SetBalancer replaces the load balancer reported on.
+func (a *adminHandler) SetBalancer(lb *proxy.LoadBalancer) {
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.balancer = lb
+}
+
+// Balancer returns the load balancer reported on, or nil.
+func (a *adminHandler) Balancer() *proxy.LoadBalancer {
+	if a == nil {
+		return nil
+	}
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.balancer
+}
+
+// ServeHTTP satisfies the http.Handler interface for adminHandler.
+func (a *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *adminHandler) status() (backendsStatus, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if a.balancer == nil {
+		return backendsStatus{}, false
+	}
+
+	s := backendsStatus{
+		Strategy: a.balancer.Strategy,
+		Backends: a.balancer.Status(),
+	}
+
+	for _, b := range s.Backends {
+		if b.Healthy {
+			s.Healthy++
+		}
+	}
+
+	return s, true
+}
+
+// healthz responds 200 while at least one backend is healthy, otherwise 503.
+func (a *adminHandler) healthz(w http.ResponseWriter, r *http.Request) {
+	if s, ok := a.status(); ok && s.Healthy > 0 {
+		fmt.Fprintf(w, "ok, %d of %d backends healthy\n", s.Healthy, len(s.Backends))
+
+		return
+	}
+
+	http.Error(w, "no healthy backends", http.StatusServiceUnavailable)
+}
+
+func (a *adminHandler) backends(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.status()
+	if !ok {
+		http.Error(w, "server is starting", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(s)
+}
+
+// startAdmin starts the admin listener when admin.port is set, the proxy keeps running if the
+// admin listener fails.
+func startAdmin(cfg config.Conf, logger *zap.Logger, admin *adminHandler) {
+	port := cfg.GetInt("admin.port")
+	if port == 0 {
+		return
+	}
+
+	bindAddr := fmt.Sprintf("%s:%d", cfg.GetString("admin.address"), port)
+
+	logger.Info("starting admin server", zap.String("bind-addr", bindAddr))
+
+	go func() {
+		if err := http.ListenAndServe(bindAddr, admin); err != nil {
+			logger.Error("Admin Server Error", zap.String("bind-addr", bindAddr), zap.Error(err))
+		}
+	}()
+}
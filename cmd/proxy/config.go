@@ -1,40 +1,214 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/koshatul/auth-proxy/httpauth"
+	"github.com/koshatul/auth-proxy/proxy"
+	"github.com/koshatul/auth-proxy/requestid"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
-func configDefaults() {
-	viper.SetDefault("server.address", "0.0.0.0")
-	viper.SetDefault("server.port", 80)
-	viper.SetDefault("server.realm", "Authentication Required")
-	viper.SetDefault("server.cache.default-expire", "60s")
-	viper.SetDefault("server.auth-ca", "/run/secrets/ca.pem")
-	_ = viper.BindEnv("server.auth-ca", "AUTH_CA_FILE")
+// binding is the flag and environment variable bound to a config key.
+type binding struct {
+	flag *pflag.Flag
+	env  string
+}
+
+// nolint: gochecknoglobals // flag and environment bindings are registered by the command init functions
+var bindings = map[string]*binding{}
+
+func bindingFor(key string) *binding {
+	if _, ok := bindings[key]; !ok {
+		bindings[key] = &binding{}
+	}
+
+	return bindings[key]
+}
+
+// bindFlag binds a config key to a flag, recording it so the source of the value can be reported.
+func bindFlag(key string, flag *pflag.Flag) {
+	bindingFor(key).flag = flag
+	_ = viper.BindPFlag(key, flag)
+}
+
+// bindEnv binds a config key to an environment variable, recording it so the source of the value
+// can be reported.
+func bindEnv(key, env string) {
+	bindingFor(key).env = env
+	_ = viper.BindEnv(key, env)
+}
+
+// configSource returns where the value of a config key comes from, in the order viper
+// resolves them: "flag", "env", "file" or "default".
+func configSource(key string, fileKeys map[string]bool) string {
+	if b, ok := bindings[key]; ok {
+		if b.flag != nil && b.flag.Changed {
+			return "flag"
+		}
 
-	viper.SetDefault("server.skip-tls-verify", false)
-	_ = viper.BindEnv("server.skip-tls-verify", "SKIP_TLS_VERIFY")
+		if b.env != "" && os.Getenv(b.env) != "" {
+			return "env"
+		}
+	}
 
-	viper.SetDefault("server.ca-bundle", "/etc/ca-bundle.pem")
-	_ = viper.BindEnv("server.ca-bundle", "CA_BUNDLE_FILE")
+	if fileKeys[key] {
+		return "file"
+	}
 
-	viper.SetDefault("auth.mincost", 15)
+	return "default"
+}
+
+func configDefaults(v *viper.Viper) {
+	v.SetDefault("server.address", "0.0.0.0")
+	v.SetDefault("server.port", 80)
+	v.SetDefault("server.realm", "Authentication Required")
+	v.SetDefault("server.trusted-proxies", []string{})
+	v.SetDefault("server.responses.login-url", "")
+	v.SetDefault("server.responses.routes", []string{})
+
+	for _, format := range httpauth.ResponseFormats() {
+		v.SetDefault("server.responses."+format+".unauthorized", "")
+		v.SetDefault("server.responses."+format+".forbidden", "")
+	}
+	v.SetDefault("server.cache.default-expire", "60s")
+	v.SetDefault("server.auth-ca", "/run/secrets/ca.pem")
+	bindEnv("server.auth-ca", "AUTH_CA_FILE")
+
+	v.SetDefault("server.skip-tls-verify", false)
+	bindEnv("server.skip-tls-verify", "SKIP_TLS_VERIFY")
+
+	v.SetDefault("server.ca-bundle", "/etc/ca-bundle.pem")
+	bindEnv("server.ca-bundle", "CA_BUNDLE_FILE")
+
+	v.SetDefault("server.access-log.format", "combined")
+	v.SetDefault("server.access-log.template", "")
+	sinkDefaults(v, "server.access-log", "stdout", "/var/log/auth-proxy/access.log", "auth-proxy", "local0")
+
+	v.SetDefault("server.request-id.header", requestid.DefaultHeader)
+	v.SetDefault("server.request-id.trust-incoming", true)
+	v.SetDefault("server.request-id.pattern", requestid.DefaultPattern)
+
+	v.SetDefault("server.token-query-param", "")
+	v.SetDefault("server.token-protocol-prefix", "")
+	v.SetDefault("server.upgrade-idle-timeout", "0s")
+	v.SetDefault("server.reload.watch", false)
+
+	v.SetDefault("backend.strategy", proxy.RoundRobin)
+	v.SetDefault("backend.tls-cert", "")
+	v.SetDefault("backend.tls-key", "")
+	v.SetDefault("backend.tls-server-name", "")
+	v.SetDefault("backend.tls-pins", []string{})
+	v.SetDefault("backend.health.path", "/")
+	v.SetDefault("backend.health.interval", "0s")
+	v.SetDefault("backend.health.timeout", "5s")
+	v.SetDefault("backend.health.expected-status", 0)
+	v.SetDefault("backend.health.max-failures", 0)
+	v.SetDefault("backend.health.backoff", "10s")
+	v.SetDefault("backend.health.max-backoff", "5m")
+
+	v.SetDefault("backend.transport.dial-timeout", "30s")
+	v.SetDefault("backend.transport.keep-alive", "30s")
+	v.SetDefault("backend.transport.tls-handshake-timeout", "10s")
+	v.SetDefault("backend.transport.response-header-timeout", "0s")
+	v.SetDefault("backend.transport.expect-continue-timeout", "1s")
+	v.SetDefault("backend.transport.idle-conn-timeout", "90s")
+	v.SetDefault("backend.transport.max-idle-conns", 100)
+	v.SetDefault("backend.transport.max-idle-conns-per-host", 16)
+	v.SetDefault("backend.transport.max-conns-per-host", 0)
+	v.SetDefault("backend.transport.flush-interval", "100ms")
+	v.SetDefault("backend.breaker.error-rate", 0.0)
+	v.SetDefault("backend.breaker.min-requests", 20)
+	v.SetDefault("backend.breaker.window", "10s")
+	v.SetDefault("backend.breaker.latency", "0s")
+	v.SetDefault("backend.breaker.open-duration", "30s")
+	v.SetDefault("backend.breaker.half-open-requests", 1)
+	v.SetDefault("backend.retry.attempts", 0)
+	v.SetDefault("backend.retry.budget-ratio", 0.2)
+	v.SetDefault("backend.retry.budget-burst", 10)
+	v.SetDefault("backend.error-pages.html", "")
+	v.SetDefault("backend.error-pages.json", "")
+
+	v.SetDefault("admin.address", "127.0.0.1")
+	v.SetDefault("admin.port", 0)
+
+	v.SetDefault("auth.mincost", 15)
+	v.SetDefault("auth.workers", 0)
+	v.SetDefault("auth.verify-timeout", "5s")
+
+	v.SetDefault("tracing.exporter", "none")
+	v.SetDefault("tracing.endpoint", "")
+	v.SetDefault("tracing.insecure", false)
+	v.SetDefault("tracing.service-name", "auth-proxy")
+	v.SetDefault("tracing.sample-ratio", 1.0)
+
+	sinkDefaults(v, "audit", "none", "/var/log/auth-proxy/audit.log", "auth-proxy-audit", "auth")
+}
+
+// sinkDefaults sets the defaults for a log sink under the supplied key prefix.
+func sinkDefaults(v *viper.Viper, prefix, output, path, tag, facility string) {
+	v.SetDefault(prefix+".output", output)
+	v.SetDefault(prefix+".buffer-size", 1024)
+	v.SetDefault(prefix+".file.path", path)
+	v.SetDefault(prefix+".file.max-size", 100)
+	v.SetDefault(prefix+".file.rotate-every", "0s")
+	v.SetDefault(prefix+".file.max-backups", 7)
+	v.SetDefault(prefix+".file.compress", true)
+	v.SetDefault(prefix+".syslog.network", "")
+	v.SetDefault(prefix+".syslog.address", "")
+	v.SetDefault(prefix+".syslog.tag", tag)
+	v.SetDefault(prefix+".syslog.facility", facility)
+}
+
+// configPaths sets the name of the config file and the directories it is searched for in.
+func configPaths(v *viper.Viper) {
+	v.SetConfigName("auth-proxy")
+	v.SetConfigType("toml")
+	v.AddConfigPath("./artifacts")
+	v.AddConfigPath("./test")
+	v.AddConfigPath("$HOME/.config")
+	v.AddConfigPath("$HOME/.auth-proxy")
+	v.AddConfigPath("/etc")
+	v.AddConfigPath("/etc/auth-proxy")
+	v.AddConfigPath("/usr/local/auth-proxy/etc")
+	v.AddConfigPath("/run/secrets")
+	v.AddConfigPath(".")
 }
 
 func configInit() {
-	viper.SetConfigName("auth-proxy")
-	viper.SetConfigType("toml")
-	viper.AddConfigPath("./artifacts")
-	viper.AddConfigPath("./test")
-	viper.AddConfigPath("$HOME/.config")
-	viper.AddConfigPath("$HOME/.auth-proxy")
-	viper.AddConfigPath("/etc")
-	viper.AddConfigPath("/etc/auth-proxy")
-	viper.AddConfigPath("/usr/local/auth-proxy/etc")
-	viper.AddConfigPath("/run/secrets")
-	viper.AddConfigPath(".")
-
-	configDefaults()
+	configPaths(viper.GetViper())
+	configDefaults(viper.GetViper())
 
 	_ = viper.ReadInConfig()
 }
+
+// readConfig reads the configuration into a new viper instance with the same defaults, flags and
+// environment variables as the global one, so a configuration that fails to load never replaces
+// the running one. It's not an error for there to be no config file.
+func readConfig() (*viper.Viper, error) {
+	v := viper.New()
+	configPaths(v)
+	configDefaults(v)
+
+	for key, b := range bindings {
+		if b.flag != nil {
+			_ = v.BindPFlag(key, b.flag)
+		}
+
+		if b.env != "" {
+			_ = v.BindEnv(key, b.env)
+		}
+	}
+
+	if err := v.ReadInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if !errors.As(err, &notFound) {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+	}
+
+	return v, nil
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/koshatul/auth-proxy/authchain"
+	"github.com/koshatul/auth-proxy/clientip"
+	"github.com/koshatul/auth-proxy/cors"
+	"github.com/koshatul/auth-proxy/httpauth"
+	"github.com/koshatul/auth-proxy/logsink"
+	"github.com/koshatul/auth-proxy/proxy"
+	"github.com/koshatul/auth-proxy/tracing"
+	"github.com/na4ma4/config"
+	"github.com/spf13/cast"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// nolint: gochecknoglobals // cobra uses globals in main
+var (
+	cmdConfig = &cobra.Command{
+		Use:   "config",
+		Short: "Check or show the server configuration",
+	}
+
+	cmdConfigValidate = &cobra.Command{
+		Use:   "validate",
+		Short: "Check the server configuration and report every error",
+		Run:   configValidateCommand,
+		Args:  cobra.NoArgs,
+	}
+
+	cmdConfigDump = &cobra.Command{
+		Use:   "dump",
+		Short: "Print the effective server configuration and where each value comes from",
+		Run:   configDumpCommand,
+		Args:  cobra.NoArgs,
+	}
+)
+
+// nolint:gochecknoinits // init is used in main for cobra
+func init() {
+	cmdConfigDump.Flags().Bool("json", false, "Print the configuration as JSON")
+
+	cmdConfig.AddCommand(cmdConfigValidate, cmdConfigDump)
+	rootCmd.AddCommand(cmdConfig)
+}
+
+// redacted replaces secret values in the config dump.
+const redacted = "REDACTED"
+
+// nolint: gochecknoglobals // config keys that hold durations
+var durationKeys = []string{
+	"server.cache.default-expire",
+	"server.upgrade-idle-timeout",
+	"server.access-log.file.rotate-every",
+	"audit.file.rotate-every",
+	"auth.verify-timeout",
+	"backend.health.interval",
+	"backend.health.timeout",
+	"backend.health.backoff",
+	"backend.health.max-backoff",
+	"backend.transport.dial-timeout",
+	"backend.transport.keep-alive",
+	"backend.transport.tls-handshake-timeout",
+	"backend.transport.response-header-timeout",
+	"backend.transport.expect-continue-timeout",
+	"backend.transport.idle-conn-timeout",
+	"backend.breaker.window",
+	"backend.breaker.latency",
+	"backend.breaker.open-duration",
+}
+
+// nolint: gochecknoglobals // config keys that hold counts
+var countKeys = []string{
+	"backend.health.max-failures",
+	"backend.transport.max-idle-conns",
+	"backend.transport.max-idle-conns-per-host",
+	"backend.transport.max-conns-per-host",
+	"backend.retry.attempts",
+	"backend.retry.budget-burst",
+	"backend.breaker.min-requests",
+	"backend.breaker.half-open-requests",
+}
+
+// nolint: gochecknoglobals // config keys that have no default or flag
+var extraKeys = []string{
+	"auth.providers",
+	"backend.targets",
+	"server.public",
+	"server.cors",
+}
+
+func configValidateCommand(cmd *cobra.Command, args []string) {
+	cfg := config.NewViperConfigFromViper(viper.GetViper(), "auth-proxy")
+
+	logger, _ := cfg.ZapConfig().Build()
+	defer logger.Sync() //nolint:errcheck
+
+	out := cmd.OutOrStdout()
+
+	errs := []error{}
+	if err := rereadConfig(); err != nil {
+		errs = append(errs, err)
+	} else {
+		for _, key := range unknownKeys() {
+			fmt.Fprintf(out, "warning: unknown setting %q in %s\n", key, viper.ConfigFileUsed())
+		}
+
+		errs = validateConfig(cfg, logger)
+	}
+
+	for _, err := range errs {
+		fmt.Fprintf(out, "error: %s\n", err)
+	}
+
+	if len(errs) > 0 {
+		fmt.Fprintf(out, "configuration is invalid (%d errors)\n", len(errs))
+		os.Exit(1)
+	}
+
+	fmt.Fprintln(out, "configuration is valid")
+}
+
+// validateConfig checks every setting the server uses without starting anything, it returns all
+// of the errors found rather than stopping at the first.
+func validateConfig(cfg config.Conf, logger *zap.Logger) []error {
+	errs := []error{}
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	backends, err := backendPool(cfg)
+	check(err)
+
+	if _, err := proxy.NewBalancer(cfg.GetString("backend.strategy"), backends); err != nil {
+		check(fmt.Errorf("backend.strategy: %w", err))
+	}
+
+	_, err = logFormatter(cfg)
+	check(err)
+
+	_, err = requestIDPattern(cfg)
+	check(err)
+
+	for _, key := range durationKeys {
+		check(durationSetting(cfg, key))
+	}
+
+	for _, key := range []string{"server.port", "admin.port"} {
+		if port := cfg.GetInt(key); port < 0 || port > 65535 {
+			check(fmt.Errorf("%s %d is not a valid port", key, port))
+		}
+	}
+
+	for _, key := range countKeys {
+		if n := cfg.GetInt(key); n < 0 {
+			check(fmt.Errorf("%s %d is negative", key, n))
+		}
+	}
+
+	if _, err := cast.ToDurationE(cfg.Get("backend.transport.flush-interval")); err != nil {
+		check(fmt.Errorf("backend.transport.flush-interval: %w", err))
+	}
+
+	for _, key := range []string{"backend.retry.budget-ratio", "backend.breaker.error-rate"} {
+		if r := cfg.GetFloat64(key); r < 0 || r > 1 {
+			check(fmt.Errorf("%s %g must be between 0 and 1", key, r))
+		}
+	}
+
+	if err := logsink.Validate(sinkConfig(cfg, "server.access-log")); err != nil {
+		check(fmt.Errorf("server.access-log: %w", err))
+	}
+
+	if !strings.EqualFold(cfg.GetString("audit.output"), "none") {
+		if err := logsink.Validate(sinkConfig(cfg, "audit")); err != nil {
+			check(fmt.Errorf("audit: %w", err))
+		}
+	}
+
+	if err := tracing.Validate(tracingConfig(cfg)); err != nil {
+		check(fmt.Errorf("tracing: %w", err))
+	}
+
+	_, err = loadCABundle(cfg)
+	check(err)
+
+	_, err = backendTLSConfig(cfg, logger)
+	check(err)
+
+	_, err = errorTemplates(cfg)
+	check(err)
+
+	_, err = authResponses(cfg)
+	check(err)
+
+	_, err = httpauth.ParsePublicRules(cfg.Get("server.public"))
+	check(err)
+
+	_, err = cors.ParsePolicies(cfg.Get("server.cors"))
+	check(err)
+
+	if _, err := clientip.ParseTrustedProxies(cfg.GetStringSlice("server.trusted-proxies")); err != nil {
+		check(fmt.Errorf("server.trusted-proxies: %w", err))
+	}
+
+	cfgs, err := providerConfigs(cfg)
+	if err != nil {
+		return append(errs, err)
+	}
+
+	return append(errs, authchain.Validate(logger, cfgs)...)
+}
+
+// durationSetting checks that a config key holds a valid, non-negative duration.
+func durationSetting(cfg config.Conf, key string) error {
+	d, err := cast.ToDurationE(cfg.Get(key))
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+
+	if d < 0 {
+		return fmt.Errorf("%s: duration %s is negative", key, d)
+	}
+
+	return nil
+}
+
+// fileKeys returns the keys set in the config file.
+func fileKeys() map[string]bool {
+	keys := map[string]bool{}
+
+	if viper.ConfigFileUsed() == "" {
+		return keys
+	}
+
+	v := viper.New()
+	v.SetConfigFile(viper.ConfigFileUsed())
+
+	if err := v.ReadInConfig(); err != nil {
+		return keys
+	}
+
+	for _, key := range v.AllKeys() {
+		keys[key] = true
+	}
+
+	return keys
+}
+
+// unknownKeys returns the sorted keys in the config file that the server doesn't use.
+func unknownKeys() []string {
+	v := viper.New()
+	configDefaults(v)
+
+	known := map[string]bool{}
+	for _, key := range append(v.AllKeys(), extraKeys...) {
+		known[key] = true
+	}
+
+	for key := range bindings {
+		known[key] = true
+	}
+
+	unknown := []string{}
+
+	for key := range fileKeys() {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+
+	sort.Strings(unknown)
+
+	return unknown
+}
+
+// dumpEntry is the value of a config key and where it comes from.
+type dumpEntry struct {
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+func configDumpCommand(cmd *cobra.Command, args []string) {
+	cfg := config.NewViperConfigFromViper(viper.GetViper(), "auth-proxy")
+
+	logger, _ := cfg.ZapConfig().Build()
+	defer logger.Sync() //nolint:errcheck
+
+	if err := rereadConfig(); err != nil {
+		logger.Error("reading configuration", zap.Error(err))
+		os.Exit(1)
+	}
+
+	fromFile := fileKeys()
+	entries := map[string]dumpEntry{}
+
+	for _, key := range viper.AllKeys() {
+		entries[key] = dumpEntry{
+			Value:  redact(key, displayValue(viper.Get(key))),
+			Source: configSource(key, fromFile),
+		}
+	}
+
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		enc := json.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent("", "  ")
+
+		if err := enc.Encode(entries); err != nil {
+			logger.Error("writing configuration", zap.Error(err))
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	writeDump(cmd.OutOrStdout(), entries)
+}
+
+// writeDump writes the entries as sorted "key = value # source" lines.
+func writeDump(w io.Writer, entries map[string]dumpEntry) {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	if file := viper.ConfigFileUsed(); file != "" {
+		fmt.Fprintf(w, "# config file: %s\n", file)
+	} else {
+		fmt.Fprintln(w, "# no config file")
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+
+	for _, key := range keys {
+		value, err := json.Marshal(entries[key].Value)
+		if err != nil {
+			value = []byte(fmt.Sprintf("%q", fmt.Sprint(entries[key].Value)))
+		}
+
+		fmt.Fprintf(tw, "%s\t= %s\t# %s\n", key, value, entries[key].Source)
+	}
+
+	_ = tw.Flush()
+}
+
+// displayValue converts values that don't marshal readably (eg. durations from flags).
+func displayValue(value interface{}) interface{} {
+	if d, ok := value.(time.Duration); ok {
+		return d.String()
+	}
+
+	return value
+}
+
+// redact replaces the secrets in a config value, legacy users keep their username so the
+// entries can still be told apart and URLs (eg. backend targets) keep everything but the password.
+func redact(key string, value interface{}) interface{} {
+	name := key
+	if i := strings.LastIndex(key, "."); i >= 0 {
+		name = key[i+1:]
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			out[k] = redact(key+"."+strings.ToLower(k), item)
+		}
+
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = redact(key, item)
+		}
+
+		return out
+	case []string:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = redact(key, item)
+		}
+
+		return out
+	case string:
+		switch {
+		case v == "":
+			return v
+		case name == "users" || name == "legacy-users":
+			if i := strings.Index(v, ":"); i >= 0 {
+				return v[:i+1] + redacted
+			}
+
+			return redacted
+		case strings.Contains(name, "password") || strings.Contains(name, "secret"):
+			return redacted
+		default:
+			return redactURL(v)
+		}
+	}
+
+	return value
+}
+
+// redactURL replaces the password in a URL, values that aren't URLs with a password are returned
+// unchanged.
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+
+	if _, ok := u.User.Password(); !ok {
+		return value
+	}
+
+	u.User = url.UserPassword(u.User.Username(), redacted)
+
+	return u.String()
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/koshatul/auth-proxy/authchain"
+	"github.com/koshatul/auth-proxy/proxy"
+	"github.com/na4ma4/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// nolint: gochecknoglobals // cobra uses globals in main
+var cmdDoctor = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the configuration, certificates, backend and listen address end to end",
+	Run:   doctorCommand,
+	Args:  cobra.NoArgs,
+}
+
+// nolint:gochecknoinits // init is used in main for cobra
+func init() {
+	cmdDoctor.Flags().Duration("timeout", 10*time.Second, "Timeout for each network check")
+
+	rootCmd.AddCommand(cmdDoctor)
+}
+
+// Status of a doctor check, only failures cause a non-zero exit code.
+const (
+	doctorPass = "PASS"
+	doctorWarn = "WARN"
+	doctorFail = "FAIL"
+)
+
+// bcryptSlow is how long a bcrypt comparison can take before it is reported, every uncached
+// legacy login waits this long.
+const bcryptSlow = time.Second
+
+// doctorResult is the outcome of a single doctor check.
+type doctorResult struct {
+	Name   string
+	Status string
+	Detail string
+}
+
+func pass(name, format string, args ...interface{}) doctorResult {
+	return doctorResult{Name: name, Status: doctorPass, Detail: fmt.Sprintf(format, args...)}
+}
+
+func warn(name, format string, args ...interface{}) doctorResult {
+	return doctorResult{Name: name, Status: doctorWarn, Detail: fmt.Sprintf(format, args...)}
+}
+
+func fail(name string, err error) doctorResult {
+	return doctorResult{Name: name, Status: doctorFail, Detail: err.Error()}
+}
+
+func doctorCommand(cmd *cobra.Command, args []string) {
+	cfg := config.NewViperConfigFromViper(viper.GetViper(), "auth-proxy")
+
+	logger, _ := cfg.ZapConfig().Build()
+	defer logger.Sync() //nolint:errcheck
+
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	ctx := context.Background()
+
+	results := []doctorResult{}
+	results = append(results, doctorConfig(cfg, logger)...)
+	results = append(results, doctorAuthCA(cfg)...)
+	results = append(results, doctorCABundle(cfg)...)
+	results = append(results, doctorBackend(ctx, cfg, logger, timeout)...)
+	results = append(results, doctorListen(cfg))
+	results = append(results, doctorBcrypt(cfg)...)
+
+	if writeDoctorReport(cmd.OutOrStdout(), results) > 0 {
+		os.Exit(1)
+	}
+}
+
+// writeDoctorReport writes the results and returns the number of failed checks.
+func writeDoctorReport(w io.Writer, results []doctorResult) int {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	failed, warnings := 0, 0
+
+	for _, r := range results {
+		switch r.Status {
+		case doctorFail:
+			failed++
+		case doctorWarn:
+			warnings++
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Status, r.Name, r.Detail)
+	}
+
+	_ = tw.Flush()
+
+	fmt.Fprintf(w, "\n%d checks, %d failed, %d warnings\n", len(results), failed, warnings)
+
+	return failed
+}
+
+// doctorConfig reports each configuration error found by validateConfig.
+func doctorConfig(cfg config.Conf, logger *zap.Logger) []doctorResult {
+	if err := rereadConfig(); err != nil {
+		return []doctorResult{fail("config", err)}
+	}
+
+	errs := validateConfig(cfg, logger)
+	if len(errs) == 0 {
+		if file := viper.ConfigFileUsed(); file != "" {
+			return []doctorResult{pass("config", "%s is valid", file)}
+		}
+
+		return []doctorResult{pass("config", "valid (no config file)")}
+	}
+
+	results := make([]doctorResult, 0, len(errs))
+	for _, err := range errs {
+		results = append(results, fail("config", err))
+	}
+
+	return results
+}
+
+// doctorAuthCA reports when the CA certificate of every enabled jwt provider expires, a CA file
+// that can't be loaded is already reported by doctorConfig.
+func doctorAuthCA(cfg config.Conf) []doctorResult {
+	cfgs, err := providerConfigs(cfg)
+	if err != nil {
+		return nil
+	}
+
+	results := []doctorResult{}
+
+	for _, p := range cfgs {
+		if p.Disabled || !strings.EqualFold(p.Type, "jwt") {
+			continue
+		}
+
+		opts := authchain.JWTOptions{}
+		if err := authchain.DecodeOptions(p.Options, &opts); err != nil {
+			continue
+		}
+
+		cert, err := authchain.LoadCertificate(opts.CAFile)
+		if err != nil {
+			continue
+		}
+
+		results = append(results, doctorCertificate("auth CA", opts.CAFile, opts.Audience, cert))
+	}
+
+	return results
+}
+
+// doctorCertificate reports when the CA certificate expires.
+func doctorCertificate(name, caFile, audience string, cert *x509.Certificate) doctorResult {
+	switch {
+	case time.Now().After(cert.NotAfter):
+		return fail(name, fmt.Errorf("%s: certificate %q expired %s", caFile, cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339)))
+	case time.Now().Before(cert.NotBefore):
+		return warn(name, "%s: certificate %q is not valid until %s", caFile, cert.Subject.CommonName, cert.NotBefore.Format(time.RFC3339))
+	}
+
+	return pass(name, "%s: %q, audience %q, expires %s", caFile, cert.Subject.CommonName, audience, cert.NotAfter.Format(time.RFC3339))
+}
+
+// doctorCABundle checks the certificates used to verify the backend, a bundle that can't be
+// loaded is already reported by doctorConfig.
+func doctorCABundle(cfg config.Conf) []doctorResult {
+	path := cfg.GetString("server.ca-bundle")
+
+	certs, err := loadCABundle(cfg)
+	if err != nil {
+		return nil
+	}
+
+	if len(certs) == 0 {
+		return []doctorResult{pass("CA bundle", "%s not found, using the system roots only", path)}
+	}
+
+	expired := 0
+
+	for _, cert := range certs {
+		if time.Now().After(cert.NotAfter) {
+			expired++
+		}
+	}
+
+	if expired > 0 {
+		return []doctorResult{warn("CA bundle", "%s: %d certificates, %d expired", path, len(certs), expired)}
+	}
+
+	return []doctorResult{pass("CA bundle", "%s: %d certificates", path, len(certs))}
+}
+
+// doctorBackend checks each backend in the pool.
+func doctorBackend(ctx context.Context, cfg config.Conf, logger *zap.Logger, timeout time.Duration) []doctorResult {
+	backends, err := backendPool(cfg)
+	if err != nil {
+		return []doctorResult{fail("backend", err)}
+	}
+
+	results := []doctorResult{}
+	for _, backend := range backends {
+		results = append(results, doctorBackendURL(ctx, cfg, logger, backend.URL, timeout)...)
+	}
+
+	return results
+}
+
+// doctorBackendURL checks that the backend host resolves, its certificate verifies (for https) and
+// that it responds to a request made with the same TLS settings as the proxy.
+func doctorBackendURL(ctx context.Context, cfg config.Conf, logger *zap.Logger, u *url.URL, timeout time.Duration) []doctorResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	results := []doctorResult{}
+
+	if net.ParseIP(u.Hostname()) == nil {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, u.Hostname())
+		if err != nil {
+			return append(results, fail("backend DNS", err))
+		}
+
+		results = append(results, pass("backend DNS", "%s resolves to %s", u.Hostname(), strings.Join(addrs, ", ")))
+	}
+
+	tlsConfig, err := backendTLSConfig(cfg, logger)
+	if err != nil {
+		return append(results, fail("backend TLS", err))
+	}
+
+	if u.Scheme == "https" {
+		results = append(results, doctorBackendTLS(ctx, cfg, u, tlsConfig))
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return append(results, fail("backend", err))
+	}
+
+	start := time.Now()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return append(results, fail("backend", err))
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return append(results, warn("backend", "%s responded %s in %s", u, resp.Status, time.Since(start).Round(time.Millisecond)))
+	}
+
+	return append(results, pass("backend", "%s responded %s in %s", u, resp.Status, time.Since(start).Round(time.Millisecond)))
+}
+
+// doctorBackendTLS checks the backend certificate against the CA bundle and system roots, even
+// when server.skip-tls-verify is set (a failure is then only a warning), along with any pinned
+// keys and the client certificate.
+func doctorBackendTLS(ctx context.Context, cfg config.Conf, u *url.URL, tlsConfig *tls.Config) doctorResult {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "443")
+	}
+
+	dialer := &net.Dialer{}
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
+
+	verify := tlsConfig.Clone()
+	verify.InsecureSkipVerify = false
+
+	if verify.ServerName == "" {
+		verify.ServerName = u.Hostname()
+	}
+
+	conn, err := tls.DialWithDialer(dialer, "tcp", host, verify)
+	if err != nil {
+		if cfg.GetBool("server.skip-tls-verify") && !errors.Is(err, proxy.ErrPinMismatch) {
+			return warn("backend TLS", "%s (ignored, server.skip-tls-verify is set)", err)
+		}
+
+		return fail("backend TLS", err)
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	leaf := state.PeerCertificates[0]
+
+	return pass("backend TLS", "certificate %q verified, expires %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+}
+
+// doctorListen checks that the server can bind its listen address.
+func doctorListen(cfg config.Conf) doctorResult {
+	bindAddr := fmt.Sprintf("%s:%d", cfg.GetString("server.address"), cfg.GetInt("server.port"))
+
+	l, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		return fail("listen", err)
+	}
+
+	_ = l.Close()
+
+	return pass("listen", "%s is available", bindAddr)
+}
+
+// doctorBcrypt reports how long a legacy password check takes at auth.mincost, and any legacy
+// users whose hashes are weaker.
+func doctorBcrypt(cfg config.Conf) []doctorResult {
+	cost := cfg.GetInt("auth.mincost")
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("doctor"), cost)
+	if err != nil {
+		return []doctorResult{fail("bcrypt", fmt.Errorf("auth.mincost %d: %w", cost, err))}
+	}
+
+	start := time.Now()
+	_ = bcrypt.CompareHashAndPassword(hash, []byte("doctor"))
+	took := time.Since(start).Round(time.Millisecond)
+
+	results := []doctorResult{}
+
+	if took > bcryptSlow {
+		results = append(results, warn("bcrypt", "cost %d takes %s per uncached legacy login", cost, took))
+	} else {
+		results = append(results, pass("bcrypt", "cost %d takes %s", cost, took))
+	}
+
+	for _, user := range legacyUsers(cfg) {
+		kv := strings.SplitN(user, ":", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[1], "$") {
+			continue
+		}
+
+		if c, err := bcrypt.Cost([]byte(kv[1])); err == nil && c < cost {
+			results = append(results, warn("bcrypt", "legacy user %q is hashed at cost %d, below auth.mincost %d", kv[0], c, cost))
+		}
+	}
+
+	return results
+}
+
+// legacyUsers returns the users of every enabled legacy provider, configuration errors are
+// reported by doctorConfig.
+func legacyUsers(cfg config.Conf) []string {
+	cfgs, err := providerConfigs(cfg)
+	if err != nil {
+		return nil
+	}
+
+	users := []string{}
+
+	for _, p := range cfgs {
+		if p.Disabled || !strings.EqualFold(p.Type, "legacy") {
+			continue
+		}
+
+		opts := authchain.LegacyOptions{}
+		if err := authchain.DecodeOptions(p.Options, &opts); err == nil {
+			users = append(users, opts.Users...)
+		}
+	}
+
+	return users
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/koshatul/auth-proxy/jwttest"
+	"github.com/na4ma4/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var _ = Describe("Doctor", func() {
+	newConfig := func(values map[string]interface{}) config.Conf {
+		v := viper.New()
+		configDefaults(v)
+
+		for key, value := range values {
+			v.Set(key, value)
+		}
+
+		return config.NewViperConfigFromViper(v, "auth-proxy")
+	}
+
+	It("writes every result and counts the failures", func() {
+		buf := &bytes.Buffer{}
+
+		failed := writeDoctorReport(buf, []doctorResult{
+			pass("config", "valid (no config file)"),
+			warn("bcrypt", "cost %d is slow", 15),
+			fail("listen", os.ErrPermission),
+		})
+		Expect(failed).To(Equal(1))
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		Expect(lines).To(Equal([]string{
+			"PASS  config  valid (no config file)",
+			"WARN  bcrypt  cost 15 is slow",
+			"FAIL  listen  permission denied",
+			"",
+			"3 checks, 1 failed, 1 warnings",
+		}))
+	})
+
+	DescribeTable("reports when the auth CA expires",
+		func(notBefore, notAfter time.Duration, status, detail string) {
+			cert := &x509.Certificate{
+				Subject:   pkix.Name{CommonName: "test CA"},
+				NotBefore: time.Now().Add(notBefore),
+				NotAfter:  time.Now().Add(notAfter),
+			}
+
+			r := doctorCertificate("auth CA", "ca.pem", "test", cert)
+			Expect(r.Status).To(Equal(status))
+			Expect(r.Detail).To(ContainSubstring(detail))
+		},
+		Entry("valid", -time.Hour, time.Hour, doctorPass, `ca.pem: "test CA", audience "test", expires`),
+		Entry("not yet valid", time.Hour, 2*time.Hour, doctorWarn, `certificate "test CA" is not valid until`),
+		Entry("expired", -2*time.Hour, -time.Hour, doctorFail, `certificate "test CA" expired`),
+	)
+
+	Describe("checking the auth CA", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+
+			dir, err = ioutil.TempDir("", "doctor")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		jwtProvider := func(caFile string) map[string]interface{} {
+			return map[string]interface{}{
+				"auth.providers": []interface{}{
+					map[string]interface{}{"type": "jwt", "audience": "test", "ca-file": caFile},
+				},
+			}
+		}
+
+		It("reports the certificate of each jwt provider", func() {
+			issuer, err := jwttest.NewIssuer()
+			Expect(err).NotTo(HaveOccurred())
+
+			caFile := filepath.Join(dir, "ca.pem")
+			Expect(ioutil.WriteFile(caFile, issuer.Certificate, 0o600)).To(Succeed())
+
+			results := doctorAuthCA(newConfig(jwtProvider(caFile)))
+			Expect(results).To(HaveLen(1))
+			Expect(results[0].Status).To(Equal(doctorPass))
+		})
+
+		It("leaves a CA that can't be loaded to the config check", func() {
+			Expect(doctorAuthCA(newConfig(jwtProvider(filepath.Join(dir, "missing.pem"))))).To(BeEmpty())
+		})
+	})
+
+	It("warns about legacy provider users hashed below auth.mincost", func() {
+		hash := func(cost int) string {
+			h, err := bcrypt.GenerateFromPassword([]byte("secret"), cost)
+			Expect(err).NotTo(HaveOccurred())
+
+			return string(h)
+		}
+
+		results := doctorBcrypt(newConfig(map[string]interface{}{
+			"auth.mincost": 5,
+			"auth.providers": []interface{}{
+				map[string]interface{}{"type": "legacy", "users": []interface{}{
+					"weak:" + hash(4),
+					"strong:" + hash(5),
+					"plain:secret",
+				}},
+				map[string]interface{}{"type": "legacy", "disabled": true, "users": []interface{}{"disabled:" + hash(4)}},
+			},
+		}))
+
+		Expect(results).To(HaveLen(2))
+		Expect(results[0].Status).To(Equal(doctorPass))
+		Expect(results[1].Status).To(Equal(doctorWarn))
+		Expect(results[1].Detail).To(Equal(`legacy user "weak" is hashed at cost 4, below auth.mincost 5`))
+	})
+})
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gorilla/handlers"
+	"github.com/koshatul/auth-proxy/audit"
+	"github.com/koshatul/auth-proxy/authchain"
+	"github.com/koshatul/auth-proxy/clientip"
+	"github.com/koshatul/auth-proxy/cors"
+	"github.com/koshatul/auth-proxy/httpauth"
+	"github.com/koshatul/auth-proxy/logformat"
+	"github.com/koshatul/auth-proxy/proxy"
+	"github.com/koshatul/auth-proxy/reload"
+	"github.com/koshatul/auth-proxy/requestid"
+	"github.com/koshatul/auth-proxy/tracing"
+	"github.com/na4ma4/config"
+	cache "github.com/patrickmn/go-cache"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// buildHandler builds the request handler (authentication, access logging and the backend proxy)
+// from the configuration, it is called at startup and on each reload. Background work for the
+// handler stops once ctx is done.
+func buildHandler(
+	ctx context.Context,
+	cfg config.Conf,
+	logger *zap.Logger,
+	accessLog io.Writer,
+	auditLog *audit.Logger,
+	admin *adminHandler,
+) (http.Handler, error) {
+	backends, err := backendPool(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	logFormatter, err := logFormatter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	requestIDPattern, err := requestIDPattern(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	provider, err := providerChain(ctx, cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := backendTLSConfig(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	balancer, err := proxy.NewLoadBalancer(
+		backends,
+		cfg.GetString("backend.strategy"),
+		cfg.GetBool("server.pass-host-header"),
+		tlsConfig,
+		transportConfig(cfg),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("building backend pool: %w", err)
+	}
+
+	balancer.HealthCheck = healthCheck(cfg)
+	balancer.Logger = logger
+	balancer.ErrorTemplates, err = errorTemplates(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	balancer.SetRetryPolicy(proxy.RetryPolicy{
+		Attempts:    cfg.GetInt("backend.retry.attempts"),
+		BudgetRatio: cfg.GetFloat64("backend.retry.budget-ratio"),
+		BudgetBurst: cfg.GetInt("backend.retry.budget-burst"),
+	})
+	balancer.SetBreaker(proxy.BreakerConfig{
+		ErrorRate:        cfg.GetFloat64("backend.breaker.error-rate"),
+		MinRequests:      cfg.GetInt("backend.breaker.min-requests"),
+		Window:           cfg.GetDuration("backend.breaker.window"),
+		Latency:          cfg.GetDuration("backend.breaker.latency"),
+		OpenDuration:     cfg.GetDuration("backend.breaker.open-duration"),
+		HalfOpenRequests: cfg.GetInt("backend.breaker.half-open-requests"),
+	})
+	// the running generation's backends keep their health and circuit breakers, keyed by URL
+	balancer.InheritHealth(admin.Balancer())
+	balancer.InheritBreakers(admin.Balancer())
+	balancer.StartHealthChecks(ctx)
+
+	go func() {
+		// the generation's requests have finished, its pooled connections would otherwise stay open
+		<-ctx.Done()
+		balancer.CloseIdleConnections()
+	}()
+
+	responses, err := authResponses(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	public, err := httpauth.ParsePublicRules(cfg.Get("server.public"))
+	if err != nil {
+		return nil, err
+	}
+
+	corsPolicies, err := cors.ParsePolicies(cfg.Get("server.cors"))
+	if err != nil {
+		return nil, err
+	}
+
+	trustedProxies, err := clientip.ParseTrustedProxies(cfg.GetStringSlice("server.trusted-proxies"))
+	if err != nil {
+		return nil, fmt.Errorf("server.trusted-proxies: %w", err)
+	}
+
+	authenticator := &httpauth.BasicAuthHandler{
+		Handler: &proxy.UpgradeHandler{
+			Handler:     balancer,
+			IdleTimeout: cfg.GetDuration("server.upgrade-idle-timeout"),
+			Deadline:    httpauth.SessionExpiry,
+		},
+		RemoveAuth: cfg.GetBool("server.remove-authorization-header"),
+		Public:     public,
+		BasicAuthWrapper: &httpauth.BasicAuthWrapper{
+			Cache:         cache.New(cfg.GetDuration("server.cache.default-expire"), time.Minute),
+			Realm:         cfg.GetString("server.realm"),
+			Provider:      provider,
+			Logger:        logger,
+			CacheDuration: cfg.GetDuration("server.cache.default-expire"),
+
+			UnauthorizedHandler: http.HandlerFunc(responses.Unauthorized),
+
+			TokenQueryParam:     cfg.GetString("server.token-query-param"),
+			TokenProtocolPrefix: cfg.GetString("server.token-protocol-prefix"),
+			Audit:               auditLog,
+		},
+	}
+
+	admin.SetBalancer(balancer)
+
+	// the client IP is resolved first so every handler (and log line) sees the same address
+	return &clientip.Handler{
+		Handler: &requestid.Handler{
+			Handler: &tracing.Handler{
+				Handler: logformat.WithFields(handlers.CustomLoggingHandler(
+					accessLog,
+					&cors.Handler{Handler: authenticator, Policies: corsPolicies, Forbidden: responses.Forbidden},
+					logFormatter,
+				)),
+			},
+			Header:        cfg.GetString("server.request-id.header"),
+			TrustIncoming: cfg.GetBool("server.request-id.trust-incoming"),
+			Pattern:       requestIDPattern,
+		},
+		TrustedProxies: trustedProxies,
+	}, nil
+}
+
+// backendPool returns the `[[backend.targets]]` entries, or if there are none the single
+// backend set by server.backend-uri.
+func backendPool(cfg config.Conf) ([]*proxy.Backend, error) {
+	if raw := cfg.Get("backend.targets"); raw != nil {
+		backends, err := proxy.ParseTargets(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(backends) > 0 {
+			return backends, nil
+		}
+	}
+
+	backend, err := proxy.NewBackend(cfg.GetString("server.backend-uri"), 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*proxy.Backend{backend}, nil
+}
+
+func healthCheck(cfg config.Conf) proxy.HealthCheck {
+	return proxy.HealthCheck{
+		Path:           cfg.GetString("backend.health.path"),
+		Interval:       cfg.GetDuration("backend.health.interval"),
+		Timeout:        cfg.GetDuration("backend.health.timeout"),
+		ExpectedStatus: cfg.GetInt("backend.health.expected-status"),
+		MaxFailures:    cfg.GetInt("backend.health.max-failures"),
+		Backoff:        cfg.GetDuration("backend.health.backoff"),
+		MaxBackoff:     cfg.GetDuration("backend.health.max-backoff"),
+	}
+}
+
+// authResponses returns the 401 and 403 responses, templates are loaded from the files set by
+// `server.responses.<format>.unauthorized` and `.forbidden`, and routes are "<prefix>=<format>".
+func authResponses(cfg config.Conf) (*httpauth.Responses, error) {
+	responses := httpauth.NewResponses()
+	responses.Realm = cfg.GetString("server.realm")
+	responses.LoginURL = cfg.GetString("server.responses.login-url")
+
+	for _, format := range httpauth.ResponseFormats() {
+		for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+			key := "server.responses." + format + "." + strings.ToLower(http.StatusText(status))
+			if filename := cfg.GetString(key); filename != "" {
+				if err := responses.Load(format, status, filename); err != nil {
+					return nil, fmt.Errorf("%s: %w", key, err)
+				}
+			}
+		}
+	}
+
+	for _, route := range cfg.GetStringSlice("server.responses.routes") {
+		parts := strings.SplitN(route, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("server.responses.routes: %q must be <prefix>=<format>", route)
+		}
+
+		if err := responses.AddRoute(parts[0], parts[1]); err != nil {
+			return nil, fmt.Errorf("server.responses.routes: %w", err)
+		}
+	}
+
+	return responses, nil
+}
+
+// errorTemplates loads the pages served when a request to the backend fails, an empty filename
+// uses the built in template.
+func errorTemplates(cfg config.Conf) (*proxy.ErrorTemplates, error) {
+	t, err := proxy.LoadErrorTemplates(
+		cfg.GetString("backend.error-pages.html"),
+		cfg.GetString("backend.error-pages.json"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("backend.error-pages: %w", err)
+	}
+
+	return t, nil
+}
+
+func transportConfig(cfg config.Conf) proxy.TransportConfig {
+	return proxy.TransportConfig{
+		DialTimeout:           cfg.GetDuration("backend.transport.dial-timeout"),
+		KeepAlive:             cfg.GetDuration("backend.transport.keep-alive"),
+		TLSHandshakeTimeout:   cfg.GetDuration("backend.transport.tls-handshake-timeout"),
+		ResponseHeaderTimeout: cfg.GetDuration("backend.transport.response-header-timeout"),
+		ExpectContinueTimeout: cfg.GetDuration("backend.transport.expect-continue-timeout"),
+		IdleConnTimeout:       cfg.GetDuration("backend.transport.idle-conn-timeout"),
+		MaxIdleConns:          cfg.GetInt("backend.transport.max-idle-conns"),
+		MaxIdleConnsPerHost:   cfg.GetInt("backend.transport.max-idle-conns-per-host"),
+		MaxConnsPerHost:       cfg.GetInt("backend.transport.max-conns-per-host"),
+		FlushInterval:         cfg.GetDuration("backend.transport.flush-interval"),
+	}
+}
+
+func logFormatter(cfg config.Conf) (handlers.LogFormatter, error) {
+	if tmpl := cfg.GetString("server.access-log.template"); tmpl != "" {
+		formatter, err := logformat.Compile(tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("compiling access log template: %w", err)
+		}
+
+		return formatter, nil
+	}
+
+	formatter, err := logformat.Formatter(cfg.GetString("server.access-log.format"))
+	if err != nil {
+		return nil, fmt.Errorf("selecting access log format: %w", err)
+	}
+
+	return formatter, nil
+}
+
+func requestIDPattern(cfg config.Conf) (*regexp.Regexp, error) {
+	pattern, err := regexp.Compile(cfg.GetString("server.request-id.pattern"))
+	if err != nil {
+		return nil, fmt.Errorf("compiling request ID pattern: %w", err)
+	}
+
+	return pattern, nil
+}
+
+func providerChain(ctx context.Context, cfg config.Conf, logger *zap.Logger) (*authchain.Chain, error) {
+	cfgs, err := providerConfigs(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("building auth providers: %w", err)
+	}
+
+	chain, err := authchain.Build(ctx, logger, cfgs)
+	if err != nil {
+		return nil, fmt.Errorf("building auth providers: %w", err)
+	}
+
+	return chain, nil
+}
+
+const authChanSize int = 10
+
+// providerConfigs returns the `[[auth.providers]]` entries, or if there are none the chain
+// configured by the legacy users and JWT flags (legacy users are checked first).
+func providerConfigs(cfg config.Conf) ([]authchain.ProviderConfig, error) {
+	if raw := cfg.Get("auth.providers"); raw != nil {
+		return authchain.ParseConfig(raw)
+	}
+
+	cfgs := []authchain.ProviderConfig{}
+
+	if users := cfg.GetStringSlice("server.legacy-users"); len(users) > 0 {
+		cfgs = append(cfgs, authchain.ProviderConfig{
+			Type:          "legacy",
+			StopOnFailure: true,
+			Options: map[string]interface{}{
+				"users": users,
+			},
+		})
+	}
+
+	return append(cfgs, authchain.ProviderConfig{
+		Type: "jwt",
+		Options: map[string]interface{}{
+			"audience":       cfg.GetString("server.audience"),
+			"ca-file":        cfg.GetString("server.auth-ca"),
+			"workers":        cfg.GetInt("auth.workers"),
+			"queue-size":     authChanSize,
+			"verify-timeout": cfg.GetDuration("auth.verify-timeout"),
+		},
+	}), nil
+}
+
+// backendTLSConfig returns the TLS settings for connections to the backends: the CA bundle, the
+// client certificate (reloaded when its files change), the server name and pinned keys.
+func backendTLSConfig(cfg config.Conf, logger *zap.Logger) (*tls.Config, error) {
+	//nolint:gosec // defaults to false, but it's up to the user
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.GetBool("server.skip-tls-verify"),
+		RootCAs:            buildCertPool(cfg, logger),
+		ServerName:         cfg.GetString("backend.tls-server-name"),
+	}
+
+	certFile, keyFile := cfg.GetString("backend.tls-cert"), cfg.GetString("backend.tls-key")
+
+	switch {
+	case certFile != "" && keyFile != "":
+		cert, err := proxy.LoadClientCertificate(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("backend.tls-cert: %w", err)
+		}
+
+		tlsConfig.GetClientCertificate = cert.GetClientCertificate
+	case certFile != "" || keyFile != "":
+		return nil, fmt.Errorf("backend.tls-cert and backend.tls-key must be set together")
+	}
+
+	if pins := cfg.GetStringSlice("backend.tls-pins"); len(pins) > 0 {
+		verify, err := proxy.PinVerifier(pins)
+		if err != nil {
+			return nil, fmt.Errorf("backend.tls-pins: %w", err)
+		}
+
+		tlsConfig.VerifyPeerCertificate = verify
+	}
+
+	return tlsConfig, nil
+}
+
+func buildCertPool(cfg config.Conf, logger *zap.Logger) *x509.CertPool {
+	rootCAs, _ := x509.SystemCertPool()
+	if rootCAs == nil {
+		rootCAs = x509.NewCertPool()
+	}
+
+	certs, err := loadCABundle(cfg)
+	if err != nil {
+		logger.Warn("failed to load custom certs", zap.String("ca-bundle", cfg.GetString("server.ca-bundle")), zap.Error(err))
+	}
+
+	if len(certs) > 0 {
+		logger.Debug("appending custom certs", zap.String("ca-bundle", cfg.GetString("server.ca-bundle")), zap.Int("count", len(certs)))
+	}
+
+	for _, cert := range certs {
+		rootCAs.AddCert(cert)
+	}
+
+	return rootCAs
+}
+
+// loadCABundle returns the certificates in the CA bundle, the bundle is optional so a missing
+// file returns no certificates and no error.
+func loadCABundle(cfg config.Conf) ([]*x509.Certificate, error) {
+	path := cfg.GetString("server.ca-bundle")
+
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading CA bundle: %w", err)
+	}
+
+	certs := []*x509.Certificate{}
+
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return certs, fmt.Errorf("CA bundle %q: %w", path, err)
+		}
+
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("CA bundle %q contains no certificates", path)
+	}
+
+	return certs, nil
+}
+
+// rereadConfig reads the config file into the global configuration again so the config and
+// doctor commands can report an error reading it, it's not an error for there to be no config file.
+func rereadConfig() error {
+	if err := viper.ReadInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	return nil
+}
+
+// watchConfig reloads the configuration each time the config file changes. The directory is
+// watched rather than the file so a file replaced by an editor or a Kubernetes ConfigMap update
+// (a symlink swap) is still seen, the reload itself reads the file.
+func watchConfig(ctx context.Context, logger *zap.Logger, reloader *reload.Reloader) {
+	file := viper.ConfigFileUsed()
+	if file == "" {
+		logger.Warn("not watching the configuration, no config file was found")
+
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Error("watching the config file", zap.Error(err))
+
+		return
+	}
+
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		logger.Error("watching the config file", zap.String("file", file), zap.Error(err))
+		_ = watcher.Close()
+
+		return
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		realFile, _ := filepath.EvalSymlinks(file)
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				current, _ := filepath.EvalSymlinks(file)
+				written := filepath.Clean(event.Name) == filepath.Clean(file) && event.Op&(fsnotify.Write|fsnotify.Create) != 0
+
+				if written || (current != "" && current != realFile) {
+					realFile = current
+
+					reloader.Reload(ctx, "file")
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+
+				logger.Warn("watching the config file", zap.Error(err))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 // nolint: gochecknoglobals // cobra uses globals in main
@@ -15,14 +14,18 @@ func init() {
 	cobra.OnInitialize(configInit)
 
 	rootCmd.PersistentFlags().BoolP("debug", "d", false, "Debug output")
-	_ = viper.BindPFlag("debug", rootCmd.PersistentFlags().Lookup("debug"))
-	_ = viper.BindEnv("debug", "DEBUG")
+	bindFlag("debug", rootCmd.PersistentFlags().Lookup("debug"))
+	bindEnv("debug", "DEBUG")
 
 	rootCmd.PersistentFlags().BoolP("info", "i", false, "Info output (includes non-apache format output)")
-	_ = viper.BindPFlag("extra-logs", rootCmd.PersistentFlags().Lookup("info"))
-	_ = viper.BindEnv("extra-logs", "EXTRA_LOGS")
+	bindFlag("extra-logs", rootCmd.PersistentFlags().Lookup("info"))
+	bindEnv("extra-logs", "EXTRA_LOGS")
 }
 
 func main() {
+	// The config and doctor commands check the configuration the server would run with, so they accept its flags.
+	cmdConfig.PersistentFlags().AddFlagSet(cmdServer.PersistentFlags())
+	cmdDoctor.PersistentFlags().AddFlagSet(cmdServer.PersistentFlags())
+
 	_ = rootCmd.Execute()
 }
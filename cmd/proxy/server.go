@@ -2,25 +2,21 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"strings"
-	"time"
+	"syscall"
 
-	"github.com/gorilla/handlers"
-	"github.com/koshatul/auth-proxy/httpauth"
+	"github.com/koshatul/auth-proxy/audit"
 	"github.com/koshatul/auth-proxy/jwtauth"
-	"github.com/koshatul/auth-proxy/legacy"
 	"github.com/koshatul/auth-proxy/logformat"
+	"github.com/koshatul/auth-proxy/logsink"
 	"github.com/koshatul/auth-proxy/proxy"
-	"github.com/koshatul/jwt/v2"
+	"github.com/koshatul/auth-proxy/reload"
+	"github.com/koshatul/auth-proxy/tracing"
 	"github.com/na4ma4/config"
-	cache "github.com/patrickmn/go-cache"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
@@ -36,83 +32,171 @@ var cmdServer = &cobra.Command{
 // nolint:gochecknoinits // init is used in main for cobra
 func init() {
 	cmdServer.PersistentFlags().StringP("audience", "a", "tls-web-client-auth", "Server Audience")
-	_ = viper.BindPFlag("server.audience", cmdServer.PersistentFlags().Lookup("audience"))
-	_ = viper.BindEnv("server.audience", "AUDIENCE")
+	bindFlag("server.audience", cmdServer.PersistentFlags().Lookup("audience"))
+	bindEnv("server.audience", "AUDIENCE")
 
 	cmdServer.PersistentFlags().StringP("backend", "u", "", "Backend URL (eg. 'http://docker-registry:5000/')")
-	_ = viper.BindPFlag("server.backend-uri", cmdServer.PersistentFlags().Lookup("backend"))
-	_ = viper.BindEnv("server.backend-uri", "BACKEND_URL")
+	bindFlag("server.backend-uri", cmdServer.PersistentFlags().Lookup("backend"))
+	bindEnv("server.backend-uri", "BACKEND_URL")
+
+	cmdServer.PersistentFlags().String(
+		"backend-strategy",
+		proxy.RoundRobin,
+		fmt.Sprintf("Load balancing strategy for backend.targets (%s)", strings.Join(proxy.Strategies(), ", ")),
+	)
+	bindFlag("backend.strategy", cmdServer.PersistentFlags().Lookup("backend-strategy"))
+	bindEnv("backend.strategy", "BACKEND_STRATEGY")
+
+	cmdServer.PersistentFlags().String("backend-tls-cert", "", "Client certificate presented to the backend (PEM)")
+	bindFlag("backend.tls-cert", cmdServer.PersistentFlags().Lookup("backend-tls-cert"))
+	bindEnv("backend.tls-cert", "BACKEND_TLS_CERT")
+
+	cmdServer.PersistentFlags().String("backend-tls-key", "", "Private key of the backend client certificate (PEM)")
+	bindFlag("backend.tls-key", cmdServer.PersistentFlags().Lookup("backend-tls-key"))
+	bindEnv("backend.tls-key", "BACKEND_TLS_KEY")
 
 	cmdServer.PersistentFlags().IntP("port", "p", 80, "HTTP Port")
-	_ = viper.BindPFlag("server.port", cmdServer.PersistentFlags().Lookup("port"))
-	_ = viper.BindEnv("server.port", "HTTP_PORT")
+	bindFlag("server.port", cmdServer.PersistentFlags().Lookup("port"))
+	bindEnv("server.port", "HTTP_PORT")
 
 	cmdServer.PersistentFlags().Bool("pass-host-header", false, "Pass Host: header to backend server (default: false)")
-	_ = viper.BindPFlag("server.pass-host-header", cmdServer.PersistentFlags().Lookup("pass-host-header"))
-	_ = viper.BindEnv("server.pass-host-header", "PASS_HOST_HEADER")
+	bindFlag("server.pass-host-header", cmdServer.PersistentFlags().Lookup("pass-host-header"))
+	bindEnv("server.pass-host-header", "PASS_HOST_HEADER")
 
 	cmdServer.PersistentFlags().Bool("remove-auth", false, "Remove Authorization headers from HTTP proxy (default: false)")
-	_ = viper.BindPFlag("server.remove-authorization-header", cmdServer.PersistentFlags().Lookup("remove-auth"))
-	_ = viper.BindEnv("server.remove-authorization-header", "REMOVE_AUTH_HEADER")
+	bindFlag("server.remove-authorization-header", cmdServer.PersistentFlags().Lookup("remove-auth"))
+	bindEnv("server.remove-authorization-header", "REMOVE_AUTH_HEADER")
 
-	cmdServer.PersistentFlags().StringSliceP(
-		"legacy-user",
-		"l",
-		[]string{},
-		"List of legacy users (username:password) that can authenticate, designed "+
-			"for allowing migration from a system with an old common login (allows it to work *temporarily*)",
+	cmdServer.PersistentFlags().String(
+		"log-format",
+		"combined",
+		fmt.Sprintf("Access log format (%s)", strings.Join(logformat.Formats(), ", ")),
 	)
+	bindFlag("server.access-log.format", cmdServer.PersistentFlags().Lookup("log-format"))
+	bindEnv("server.access-log.format", "LOG_FORMAT")
 
-	_ = viper.BindPFlag("server.legacy-users", cmdServer.PersistentFlags().Lookup("legacy-user"))
-	_ = viper.BindEnv("server.legacy-users", "LEGACY_USERS")
+	cmdServer.PersistentFlags().String(
+		"log-template",
+		"",
+		"Custom access log template, overrides --log-format (eg. '%h %u %t \"%r\" %s %b %{ms}T')",
+	)
+	bindFlag("server.access-log.template", cmdServer.PersistentFlags().Lookup("log-template"))
+	bindEnv("server.access-log.template", "LOG_TEMPLATE")
 
-	rootCmd.AddCommand(cmdServer)
-}
+	cmdServer.PersistentFlags().String("log-output", "stdout", "Access log output (stdout, stderr, file, syslog)")
+	bindFlag("server.access-log.output", cmdServer.PersistentFlags().Lookup("log-output"))
+	bindEnv("server.access-log.output", "LOG_OUTPUT")
 
-const userPassSepCount int = 2
-const authChanSize int = 10
+	cmdServer.PersistentFlags().String("log-file", "/var/log/auth-proxy/access.log", "Access log file (when --log-output=file)")
+	bindFlag("server.access-log.file.path", cmdServer.PersistentFlags().Lookup("log-file"))
+	bindEnv("server.access-log.file.path", "LOG_FILE")
 
-func addLegacyAuthFunc(
-	logger *zap.Logger,
-	cliLegacyUsers []string,
-	authFunc httpauth.AuthProvider,
-) httpauth.AuthProvider {
-	if len(cliLegacyUsers) > 0 {
-		logger.Debug("loading legacy users")
+	cmdServer.PersistentFlags().String("audit-output", "none", "Audit log output (none, stdout, stderr, file, syslog)")
+	bindFlag("audit.output", cmdServer.PersistentFlags().Lookup("audit-output"))
+	bindEnv("audit.output", "AUDIT_OUTPUT")
 
-		legacyUsers := make(map[string]legacy.AuthItem)
+	cmdServer.PersistentFlags().String("audit-file", "/var/log/auth-proxy/audit.log", "Audit log file (when --audit-output=file)")
+	bindFlag("audit.file.path", cmdServer.PersistentFlags().Lookup("audit-file"))
+	bindEnv("audit.file.path", "AUDIT_FILE")
 
-		for _, user := range cliLegacyUsers {
-			s := strings.SplitN(user, ":", userPassSepCount)
+	cmdServer.PersistentFlags().String("token-query-param", "", "Query parameter to accept a token from on upgrade (WebSocket) requests (eg. 'access_token')")
+	bindFlag("server.token-query-param", cmdServer.PersistentFlags().Lookup("token-query-param"))
+	bindEnv("server.token-query-param", "TOKEN_QUERY_PARAM")
 
-			if len(s) == userPassSepCount {
-				logger.Debug("Appending user to legacyUsers", zap.String("username", s[0]))
+	cmdServer.PersistentFlags().String(
+		"token-protocol-prefix",
+		"",
+		"Sec-WebSocket-Protocol prefix to accept a token from on upgrade requests (eg. 'bearer.')",
+	)
+	bindFlag("server.token-protocol-prefix", cmdServer.PersistentFlags().Lookup("token-protocol-prefix"))
+	bindEnv("server.token-protocol-prefix", "TOKEN_PROTOCOL_PREFIX")
 
-				legacyUsers[s[0]] = legacy.AuthItem{
-					Username: s[0],
-					Password: s[1],
-				}
-			}
-		}
+	cmdServer.PersistentFlags().Duration("upgrade-idle-timeout", 0, "Close upgraded (WebSocket) connections idle for this long (default: never)")
+	bindFlag("server.upgrade-idle-timeout", cmdServer.PersistentFlags().Lookup("upgrade-idle-timeout"))
+	bindEnv("server.upgrade-idle-timeout", "UPGRADE_IDLE_TIMEOUT")
 
-		authFunc = legacy.AuthCheckFunc(logger, legacyUsers, authFunc)
-	}
+	cmdServer.PersistentFlags().String("trace-exporter", "none", "Trace exporter (none, stdout, otlp)")
+	bindFlag("tracing.exporter", cmdServer.PersistentFlags().Lookup("trace-exporter"))
+	bindEnv("tracing.exporter", "TRACE_EXPORTER")
+
+	cmdServer.PersistentFlags().String("trace-endpoint", "", "OTLP/HTTP trace collector endpoint (eg. 'otel-collector:4318')")
+	bindFlag("tracing.endpoint", cmdServer.PersistentFlags().Lookup("trace-endpoint"))
+	bindEnv("tracing.endpoint", "OTEL_EXPORTER_OTLP_ENDPOINT")
+
+	cmdServer.PersistentFlags().Float64("trace-sample-ratio", 1.0, "Fraction of new traces to sample (0.0 - 1.0)")
+	bindFlag("tracing.sample-ratio", cmdServer.PersistentFlags().Lookup("trace-sample-ratio"))
+	bindEnv("tracing.sample-ratio", "TRACE_SAMPLE_RATIO")
 
-	return authFunc
+	cmdServer.PersistentFlags().Int("auth-workers", 0, "Number of tokens verified concurrently (default: number of CPUs)")
+	bindFlag("auth.workers", cmdServer.PersistentFlags().Lookup("auth-workers"))
+	bindEnv("auth.workers", "AUTH_WORKERS")
+
+	cmdServer.PersistentFlags().Duration("auth-verify-timeout", jwtauth.DefaultVerifyTimeout, "Maximum time to wait for a token to be verified")
+	bindFlag("auth.verify-timeout", cmdServer.PersistentFlags().Lookup("auth-verify-timeout"))
+	bindEnv("auth.verify-timeout", "AUTH_VERIFY_TIMEOUT")
+
+	cmdServer.PersistentFlags().Int("admin-port", 0, "Admin HTTP port for backend health and metrics (default: disabled)")
+	bindFlag("admin.port", cmdServer.PersistentFlags().Lookup("admin-port"))
+	bindEnv("admin.port", "ADMIN_PORT")
+
+	cmdServer.PersistentFlags().Bool("watch-config", false, "Reload the configuration when the config file changes (default: false)")
+	bindFlag("server.reload.watch", cmdServer.PersistentFlags().Lookup("watch-config"))
+	bindEnv("server.reload.watch", "WATCH_CONFIG")
+
+	cmdServer.PersistentFlags().StringSliceP(
+		"legacy-user",
+		"l",
+		[]string{},
+		"List of legacy users (username:password) that can authenticate, designed "+
+			"for allowing migration from a system with an old common login (allows it to work *temporarily*)",
+	)
+
+	bindFlag("server.legacy-users", cmdServer.PersistentFlags().Lookup("legacy-user"))
+	bindEnv("server.legacy-users", "LEGACY_USERS")
+
+	cmdServer.PersistentFlags().StringSlice(
+		"trusted-proxy",
+		[]string{},
+		"CIDR or address of a proxy whose X-Forwarded-For and X-Real-IP headers are trusted, may be repeated (default: none)",
+	)
+	bindFlag("server.trusted-proxies", cmdServer.PersistentFlags().Lookup("trusted-proxy"))
+	bindEnv("server.trusted-proxies", "TRUSTED_PROXIES")
+
+	rootCmd.AddCommand(cmdServer)
 }
 
 func showHelp(cmd *cobra.Command) {
 	_ = cmd.Help()
 }
 
-func verifierOrBust(cmd *cobra.Command, cfg config.Conf, logger *zap.Logger) (verifier jwt.Verifier) {
+// sinkConfig returns the log sink configuration under the supplied key prefix.
+func sinkConfig(cfg config.Conf, prefix string) logsink.Config {
+	const megabyte = 1024 * 1024
+
+	return logsink.Config{
+		Output:     cfg.GetString(prefix + ".output"),
+		BufferSize: cfg.GetInt(prefix + ".buffer-size"),
+		File: logsink.FileConfig{
+			Path:        cfg.GetString(prefix + ".file.path"),
+			MaxSize:     int64(cfg.GetInt(prefix+".file.max-size")) * megabyte,
+			RotateEvery: cfg.GetDuration(prefix + ".file.rotate-every"),
+			MaxBackups:  cfg.GetInt(prefix + ".file.max-backups"),
+			Compress:    cfg.GetBool(prefix + ".file.compress"),
+		},
+		Syslog: logsink.SyslogConfig{
+			Network:  cfg.GetString(prefix + ".syslog.network"),
+			Address:  cfg.GetString(prefix + ".syslog.address"),
+			Tag:      cfg.GetString(prefix + ".syslog.tag"),
+			Facility: cfg.GetString(prefix + ".syslog.facility"),
+		},
+	}
+}
+
+func logSinkOrBust(cmd *cobra.Command, cfg config.Conf, logger *zap.Logger, prefix string) (sink logsink.Sink) {
 	var err error
 
-	if verifier, err = jwt.NewRSAVerifierFromFile(
-		cfg.GetString("server.audience"),
-		cfg.GetString("server.auth-ca"),
-	); err != nil {
-		logger.Error("starting jwt verifier", zap.Error(err))
+	if sink, err = logsink.Open(sinkConfig(cfg, prefix)); err != nil {
+		logger.Error("opening log output", zap.String("config", prefix), zap.Error(err))
 		showHelp(cmd)
 		os.Exit(1)
 	}
@@ -120,39 +204,88 @@ func verifierOrBust(cmd *cobra.Command, cfg config.Conf, logger *zap.Logger) (ve
 	return
 }
 
-func backendURIOrBust(cmd *cobra.Command, cfg config.Conf, logger *zap.Logger) (u *url.URL) {
-	var err error
+// auditLoggerOrBust returns the audit logger and its sink, both are nil if auditing is disabled.
+func auditLoggerOrBust(cmd *cobra.Command, cfg config.Conf, logger *zap.Logger) (*audit.Logger, logsink.Sink) {
+	if strings.EqualFold(cfg.GetString("audit.output"), "none") {
+		return nil, nil
+	}
 
-	if u, err = url.Parse(cfg.GetString("server.backend-uri")); err != nil {
-		logger.Error("parsing backend URI", zap.String("URI", cfg.GetString("server.backend-uri")), zap.Error(err))
-		showHelp(cmd)
-		os.Exit(1)
+	sink := logSinkOrBust(cmd, cfg, logger, "audit")
+
+	return audit.NewLogger(sink), sink
+}
+
+// onHangup reopens the log sinks (eg. after logrotate) and reloads the configuration each time
+// the process receives SIGHUP.
+func onHangup(ctx context.Context, logger *zap.Logger, reloader *reload.Reloader, sinks ...logsink.Sink) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hup)
+
+		for {
+			select {
+			case <-hup:
+				for _, sink := range sinks {
+					if sink == nil {
+						continue
+					}
+
+					if err := sink.Reopen(); err != nil {
+						logger.Error("reopening log output", zap.Error(err))
+					}
+				}
+
+				logger.Info("reopened log outputs")
+
+				reloader.Reload(ctx, "signal")
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// backendURLs returns the URLs of the backends for logging, or none if the pool is invalid.
+func backendURLs(cfg config.Conf) []string {
+	backends, _ := backendPool(cfg)
+
+	urls := make([]string, len(backends))
+	for i, b := range backends {
+		urls[i] = b.String()
 	}
 
-	return
+	return urls
 }
 
-func buildCertPool(cfg config.Conf, logger *zap.Logger) *x509.CertPool {
-	rootCAs, _ := x509.SystemCertPool()
-	if rootCAs == nil {
-		rootCAs = x509.NewCertPool()
+// tracingConfig returns the tracing configuration, spans from the stdout exporter are written to stderr.
+func tracingConfig(cfg config.Conf) tracing.Config {
+	return tracing.Config{
+		Exporter:    cfg.GetString("tracing.exporter"),
+		Endpoint:    cfg.GetString("tracing.endpoint"),
+		Insecure:    cfg.GetBool("tracing.insecure"),
+		ServiceName: cfg.GetString("tracing.service-name"),
+		SampleRatio: cfg.GetFloat64("tracing.sample-ratio"),
+		Writer:      os.Stderr,
 	}
+}
 
-	certs, err := ioutil.ReadFile(cfg.GetString("server.ca-bundle"))
-	if err == nil {
-		logger.Debug("appending custom certs", zap.String("ca-bundle", cfg.GetString("server.ca-bundle")))
+// tracingOrBust sets up the trace exporter, the returned function flushes any pending spans.
+func tracingOrBust(ctx context.Context, cmd *cobra.Command, cfg config.Conf, logger *zap.Logger) (shutdown tracing.ShutdownFunc) {
+	var err error
 
-		if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
-			logger.Debug("failed to load custom certs", zap.String("ca-bundle", cfg.GetString("server.ca-bundle")))
-		}
+	if shutdown, err = tracing.Setup(ctx, tracingConfig(cfg)); err != nil {
+		logger.Error("starting tracing", zap.Error(err))
+		showHelp(cmd)
+		os.Exit(1)
 	}
 
-	return rootCAs
+	return
 }
 
 func serverCommand(cmd *cobra.Command, args []string) {
 	cfg := config.NewViperConfigFromViper(viper.GetViper(), "auth-proxy")
-	authChan := make(chan *jwtauth.AuthRequest, authChanSize)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -160,49 +293,60 @@ func serverCommand(cmd *cobra.Command, args []string) {
 	logger, _ := cfg.ZapConfig().Build()
 	defer logger.Sync() //nolint:errcheck
 
-	u := backendURIOrBust(cmd, cfg, logger)
-	verifier := verifierOrBust(cmd, cfg, logger)
-
-	go jwtauth.AuthRunner(ctx, logger, verifier, authChan)
+	shutdownTracing := tracingOrBust(ctx, cmd, cfg, logger)
+	defer shutdownTracing(context.Background()) //nolint:errcheck
 
-	rootCAs := buildCertPool(cfg, logger)
+	accessLog := logSinkOrBust(cmd, cfg, logger, "server.access-log")
+	defer accessLog.Close()
 
-	//nolint:gosec // defaults to false, but it's up to the user
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: cfg.GetBool("server.skip-tls-verify"),
-		RootCAs:            rootCAs,
+	auditLog, auditSink := auditLoggerOrBust(cmd, cfg, logger)
+	if auditSink != nil {
+		defer auditSink.Close()
 	}
 
-	authFunc := jwtauth.AuthCheckFunc(logger, authChan)
-	cliLegacyUsers := cfg.GetStringSlice("server.legacy-users")
-	authFunc = addLegacyAuthFunc(logger, cliLegacyUsers, authFunc)
-	s := http.NewServeMux()
-	authenticator := &httpauth.BasicAuthHandler{
-		Handler: handlers.ProxyHeaders(
-			proxy.NewSingleHostReverseProxy(u, cfg.GetBool("server.pass-host-header"), tlsConfig),
-		),
-		RemoveAuth: cfg.GetBool("server.remove-authorization-header"),
-		BasicAuthWrapper: &httpauth.BasicAuthWrapper{
-			Cache:         cache.New(cfg.GetDuration("server.cache.default-expire"), time.Minute),
-			Realm:         cfg.GetString("server.realm"),
-			AuthFunc:      authFunc,
-			Logger:        logger,
-			CacheDuration: cfg.GetDuration("server.cache.default-expire"),
+	handler := &reload.Handler{}
+	defer handler.Close()
+
+	admin := newAdminHandler()
+
+	// each load reads the configuration afresh, the global configuration keeps the settings that
+	// aren't reloaded (the listeners and log outputs) and is never left holding a failed reload
+	reloader := &reload.Reloader{
+		Handler: handler,
+		Logger:  logger,
+		Build: func(ctx context.Context) (http.Handler, error) {
+			v, err := readConfig()
+			if err != nil {
+				return nil, err
+			}
+
+			return buildHandler(ctx, config.NewViperConfigFromViper(v, "auth-proxy"), logger, accessLog, auditLog, admin)
 		},
 	}
 
-	s.Handle("/", handlers.CustomLoggingHandler(
-		os.Stdout,
-		authenticator,
-		logformat.WriteCombinedLog,
-	))
+	if err := reloader.Load(ctx); err != nil {
+		logger.Error("loading configuration", zap.Error(err))
+		showHelp(cmd)
+		os.Exit(1)
+	}
+
+	onHangup(ctx, logger, reloader, accessLog, auditSink)
+
+	if cfg.GetBool("server.reload.watch") {
+		watchConfig(ctx, logger, reloader)
+	}
+
+	startAdmin(cfg, logger, admin)
+
+	s := http.NewServeMux()
+	s.Handle("/", handler)
 
 	bindAddr := fmt.Sprintf("%s:%d", cfg.GetString("server.address"), cfg.GetInt("server.port"))
 
 	logger.Info("starting server",
 		zap.String("audience", cfg.GetString("server.audience")),
 		zap.String("bind-addr", bindAddr),
-		zap.String("proxy-uri", cfg.GetString("server.backend-uri")),
+		zap.Strings("proxy-uri", backendURLs(cfg)),
 	)
 
 	if err := http.ListenAndServe(bindAddr, s); err != nil {
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/koshatul/auth-proxy/authchain"
+	"github.com/koshatul/auth-proxy/jwtauth"
+	"github.com/koshatul/auth-proxy/jwttest"
+	"github.com/na4ma4/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// nolint: gochecknoglobals // cobra uses globals in main
+var (
+	cmdToken = &cobra.Command{
+		Use:   "token",
+		Short: "Work with authentication tokens",
+	}
+
+	cmdTokenInspect = &cobra.Command{
+		Use:   "inspect [token|-]",
+		Short: "Verify a token offline and show its claims and which check failed",
+		Long: "Verify a token against the configured audience and CA (server.audience and server.auth-ca) " +
+			"the same way the server does. The token is read from the argument, --file, or stdin " +
+			"(when there is no argument or it is '-'). Exits non-zero if the token is not valid.",
+		Run:  tokenInspectCommand,
+		Args: cobra.MaximumNArgs(1),
+	}
+
+	cmdTokenIssue = &cobra.Command{
+		Use:   "issue",
+		Short: "Issue a development token signed with a local CA key",
+		Long: "Issue a token signed with a local CA private key (eg. one generated by cfssl from the " +
+			"configs in test/), for development and integration tests. The server accepts the token when " +
+			"server.auth-ca is the matching certificate.",
+		Run:  tokenIssueCommand,
+		Args: cobra.NoArgs,
+	}
+)
+
+// nolint:gochecknoinits // init is used in main for cobra
+func init() {
+	cmdTokenInspect.Flags().StringP("file", "f", "", "Read the token from a file")
+	cmdTokenInspect.Flags().String("audience", "", "Audience to verify the token for (default: server.audience)")
+	cmdTokenInspect.Flags().String("auth-ca", "", "CA certificate file to verify the token with (default: server.auth-ca)")
+	cmdTokenInspect.Flags().Bool("json", false, "Print the result as JSON")
+
+	cmdTokenIssue.Flags().String("key", "", "CA private key file to sign the token with (PEM)")
+	cmdTokenIssue.Flags().String("sub", "", "Subject (username) of the token")
+	cmdTokenIssue.Flags().StringSlice("aud", []string{}, "Audience of the token, may be repeated (default: server.audience)")
+	cmdTokenIssue.Flags().Duration("ttl", time.Hour, "How long the token is valid for")
+	cmdTokenIssue.Flags().String("id", "", "Token ID (jti)")
+	cmdTokenIssue.Flags().String("issuer", "", "Issuer (iss)")
+	cmdTokenIssue.Flags().StringArray("claim", []string{}, "Additional claim as key=value, JSON values are decoded (eg. 'groups=[\"admin\"]')")
+	_ = cmdTokenIssue.MarkFlagRequired("key")
+	_ = cmdTokenIssue.MarkFlagRequired("sub")
+
+	cmdToken.AddCommand(cmdTokenInspect, cmdTokenIssue)
+	rootCmd.AddCommand(cmdToken)
+}
+
+// flagOrConfig returns the value of a string flag if it was set, otherwise the config key.
+func flagOrConfig(cmd *cobra.Command, cfg config.Conf, name, key string) string {
+	if f := cmd.Flags().Lookup(name); f != nil && f.Changed {
+		return f.Value.String()
+	}
+
+	return cfg.GetString(key)
+}
+
+// readToken returns the token from the argument, the --file flag or stdin, without surrounding
+// whitespace or an "Authorization: Bearer" style prefix.
+func readToken(cmd *cobra.Command, args []string) ([]byte, error) {
+	var (
+		token []byte
+		err   error
+	)
+
+	file, _ := cmd.Flags().GetString("file")
+
+	switch {
+	case len(args) > 0 && args[0] != "-":
+		token = []byte(args[0])
+	case file != "":
+		token, err = ioutil.ReadFile(file)
+	default:
+		token, err = ioutil.ReadAll(cmd.InOrStdin())
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	token = bytes.TrimSpace(token)
+	if i := bytes.IndexByte(token, ' '); i >= 0 && strings.EqualFold(string(token[:i]), "bearer") {
+		token = bytes.TrimSpace(token[i+1:])
+	}
+
+	if len(token) == 0 {
+		return nil, fmt.Errorf("no token supplied")
+	}
+
+	return token, nil
+}
+
+func tokenInspectCommand(cmd *cobra.Command, args []string) {
+	cfg := config.NewViperConfigFromViper(viper.GetViper(), "auth-proxy")
+
+	logger, _ := cfg.ZapConfig().Build()
+	defer logger.Sync() //nolint:errcheck
+
+	token, err := readToken(cmd, args)
+	if err != nil {
+		logger.Error("reading token", zap.Error(err))
+		showHelp(cmd)
+		os.Exit(1)
+	}
+
+	audience := flagOrConfig(cmd, cfg, "audience", "server.audience")
+	caFile := flagOrConfig(cmd, cfg, "auth-ca", "server.auth-ca")
+
+	verifier, err := authchain.NewVerifier(audience, caFile)
+	if err != nil {
+		logger.Error("unable to load verifier", zap.String("ca-file", caFile), zap.Error(err))
+		os.Exit(1)
+	}
+
+	inspection := jwtauth.Inspect(verifier, token)
+
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		enc := json.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent("", "  ")
+
+		if err := enc.Encode(inspection); err != nil {
+			logger.Error("writing result", zap.Error(err))
+			os.Exit(1)
+		}
+	} else {
+		writeInspection(cmd.OutOrStdout(), audience, inspection)
+	}
+
+	if !inspection.Valid {
+		os.Exit(1)
+	}
+}
+
+// writeInspection writes the inspection as a human readable report.
+func writeInspection(w io.Writer, audience string, i *jwtauth.Inspection) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	defer tw.Flush() //nolint:errcheck
+
+	if i.Valid {
+		fmt.Fprintf(tw, "valid:\tyes (audience %q)\n", audience)
+	} else {
+		fmt.Fprintf(tw, "valid:\tno, %s (audience %q)\n", i.Reason, audience)
+	}
+
+	fmt.Fprintln(tw, "checks:\t")
+
+	for _, c := range i.Checks {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", c.Name, c.Status, c.Error)
+	}
+
+	fmt.Fprintf(tw, "subject:\t%s\n", i.Subject)
+	fmt.Fprintf(tw, "token id:\t%s\n", i.TokenID)
+	fmt.Fprintf(tw, "issuer:\t%s\n", i.Issuer)
+	fmt.Fprintf(tw, "audiences:\t%s\n", strings.Join(i.Audiences, ", "))
+	fmt.Fprintf(tw, "online:\t%t\n", i.Online)
+	fmt.Fprintf(tw, "issued at:\t%s\n", relativeTime(i.IssuedAt))
+	fmt.Fprintf(tw, "not before:\t%s\n", relativeTime(i.NotBefore))
+	fmt.Fprintf(tw, "expires:\t%s\n", relativeTime(i.Expires))
+
+	if len(i.Claims) == 0 {
+		return
+	}
+
+	fmt.Fprintln(tw, "claims:\t")
+
+	keys := make([]string, 0, len(i.Claims))
+	for key := range i.Claims {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, _ := json.Marshal(i.Claims[key])
+		fmt.Fprintf(tw, "  %s\t%s\n", key, value)
+	}
+}
+
+// relativeTime formats a claim time with how long ago (or until) it is.
+func relativeTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+
+	d := time.Until(*t).Round(time.Second)
+	if d < 0 {
+		return fmt.Sprintf("%s (%s ago)", t.Format(time.RFC3339), -d)
+	}
+
+	return fmt.Sprintf("%s (in %s)", t.Format(time.RFC3339), d)
+}
+
+// nolint: gochecknoglobals // registered claims that have their own flags
+var registeredClaims = map[string]string{
+	"sub": "--sub",
+	"aud": "--aud",
+	"exp": "--ttl",
+	"nbf": "--ttl",
+	"iat": "--ttl",
+	"jti": "--id",
+	"iss": "--issuer",
+}
+
+// parseClaims returns the claims from "key=value" strings, values that are valid JSON (numbers,
+// booleans, arrays, objects or quoted strings) are decoded and anything else is a string.
+func parseClaims(list []string) (map[string]interface{}, error) {
+	claims := map[string]interface{}{}
+
+	for _, item := range list {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("claim %q must be key=value", item)
+		}
+
+		if flag, ok := registeredClaims[kv[0]]; ok {
+			return nil, fmt.Errorf("claim %q must be set with %s", kv[0], flag)
+		}
+
+		var value interface{}
+		if err := json.Unmarshal([]byte(kv[1]), &value); err != nil {
+			value = kv[1]
+		}
+
+		claims[kv[0]] = value
+	}
+
+	return claims, nil
+}
+
+func tokenIssueCommand(cmd *cobra.Command, args []string) {
+	cfg := config.NewViperConfigFromViper(viper.GetViper(), "auth-proxy")
+
+	logger, _ := cfg.ZapConfig().Build()
+	defer logger.Sync() //nolint:errcheck
+
+	keyFile, _ := cmd.Flags().GetString("key")
+	subject, _ := cmd.Flags().GetString("sub")
+	audiences, _ := cmd.Flags().GetStringSlice("aud")
+	ttl, _ := cmd.Flags().GetDuration("ttl")
+	id, _ := cmd.Flags().GetString("id")
+	issuerName, _ := cmd.Flags().GetString("issuer")
+	claimList, _ := cmd.Flags().GetStringArray("claim")
+
+	if len(audiences) == 0 {
+		audiences = []string{cfg.GetString("server.audience")}
+	}
+
+	claims, err := parseClaims(claimList)
+	if err != nil {
+		logger.Error("parsing claims", zap.Error(err))
+		showHelp(cmd)
+		os.Exit(1)
+	}
+
+	issuer, err := jwttest.LoadIssuer(keyFile)
+	if err != nil {
+		logger.Error("loading signing key", zap.String("key", keyFile), zap.Error(err))
+		os.Exit(1)
+	}
+
+	token, err := issuer.Issue(jwttest.Token{
+		Subject:   subject,
+		Audiences: audiences,
+		ID:        id,
+		Issuer:    issuerName,
+		TTL:       ttl,
+		Claims:    claims,
+	})
+	if err != nil {
+		logger.Error("signing token", zap.Error(err))
+		os.Exit(1)
+	}
+
+	fmt.Fprintln(cmd.OutOrStdout(), string(token))
+}
@@ -0,0 +1,75 @@
+package configtable
+
+import (
+	"fmt"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// Entries returns the entries of an array configuration value, which may be tables or plain
+// values, a missing value has no entries. Name is the name of an entry used in errors
+// (eg. "backend target").
+func Entries(raw interface{}, name string) ([]interface{}, error) {
+	var entries []interface{}
+
+	switch v := raw.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		entries = v
+	case []string:
+		for _, item := range v {
+			entries = append(entries, item)
+		}
+	case []map[string]interface{}:
+		for _, item := range v {
+			entries = append(entries, item)
+		}
+	default:
+		return nil, fmt.Errorf("%s: expected an array, got %T", name, raw)
+	}
+
+	return entries, nil
+}
+
+// Tables returns the tables of an array of tables configuration value, a missing value has no
+// tables. Name is the name of a table used in errors (eg. "cors policy").
+func Tables(raw interface{}, name string) ([]map[string]interface{}, error) {
+	entries, err := Entries(raw, name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: expected an array of tables, got %T", name, raw)
+	}
+
+	if entries == nil {
+		return nil, nil
+	}
+
+	tables := make([]map[string]interface{}, 0, len(entries))
+
+	for i, entry := range entries {
+		m, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s %d: expected a table, got %T", name, i, entry)
+		}
+
+		tables = append(tables, m)
+	}
+
+	return tables, nil
+}
+
+// Decode decodes a table into out (a pointer to a struct with `mapstructure:"key-name"` tags),
+// durations may be strings (eg. "10s") and unknown keys are an error.
+func Decode(input map[string]interface{}, out interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+		ErrorUnused:      true,
+		WeaklyTypedInput: true,
+		Result:           out,
+	})
+	if err != nil {
+		return err
+	}
+
+	return decoder.Decode(input)
+}
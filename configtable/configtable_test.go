@@ -0,0 +1,60 @@
+package configtable_test
+
+import (
+	"time"
+
+	"github.com/koshatul/auth-proxy/configtable"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("configtable", func() {
+	table := map[string]interface{}{"uri": "http://a:5000/"}
+
+	DescribeTable("returns the entries of an array",
+		func(raw interface{}, expected []interface{}) {
+			entries, err := configtable.Entries(raw, "target")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(Equal(expected))
+		},
+		Entry("missing", nil, nil),
+		Entry("array", []interface{}{"a", table}, []interface{}{"a", table}),
+		Entry("strings", []string{"a", "b"}, []interface{}{"a", "b"}),
+		Entry("tables", []map[string]interface{}{table}, []interface{}{table}),
+	)
+
+	DescribeTable("returns the tables of an array of tables",
+		func(raw interface{}, expected []map[string]interface{}, message string) {
+			tables, err := configtable.Tables(raw, "policy")
+			if message != "" {
+				Expect(err).To(MatchError(message))
+
+				return
+			}
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tables).To(Equal(expected))
+		},
+		Entry("missing", nil, nil, ""),
+		Entry("array", []interface{}{table}, []map[string]interface{}{table}, ""),
+		Entry("tables", []map[string]interface{}{table}, []map[string]interface{}{table}, ""),
+		Entry("not an array", "/", nil, "policy: expected an array of tables, got string"),
+		Entry("not a table", []interface{}{table, "/"}, nil, "policy 1: expected a table, got string"),
+	)
+
+	It("decodes a table", func() {
+		var out struct {
+			Name    string        `mapstructure:"name"`
+			Weight  int           `mapstructure:"weight"`
+			Timeout time.Duration `mapstructure:"timeout"`
+		}
+
+		Expect(configtable.Decode(map[string]interface{}{"name": "a", "weight": "2", "timeout": "10s"}, &out)).To(Succeed())
+		Expect(out.Name).To(Equal("a"))
+		Expect(out.Weight).To(Equal(2))
+		Expect(out.Timeout).To(Equal(10 * time.Second))
+
+		Expect(configtable.Decode(map[string]interface{}{"nme": "a"}, &out)).To(MatchError(ContainSubstring("invalid keys: nme")))
+	})
+})
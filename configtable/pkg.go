@@ -0,0 +1,3 @@
+// Package configtable decodes the arrays of tables in the configuration (eg. `[[server.cors]]`)
+// into structs.
+package configtable
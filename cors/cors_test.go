@@ -0,0 +1,215 @@
+package cors_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/koshatul/auth-proxy/cors"
+	"github.com/koshatul/auth-proxy/httpauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CORS", func() {
+	var (
+		handler *cors.Handler
+		reached bool
+	)
+
+	serve := func(method, target string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+
+		return rec
+	}
+
+	preflight := func(target, origin, method, headers string) *httptest.ResponseRecorder {
+		return serve(http.MethodOptions, target, map[string]string{
+			"Origin":                         origin,
+			"Access-Control-Request-Method":  method,
+			"Access-Control-Request-Headers": headers,
+		})
+	}
+
+	BeforeEach(func() {
+		reached = false
+
+		policies, err := cors.ParsePolicies([]interface{}{
+			map[string]interface{}{
+				"prefix":            "/api/",
+				"allowed-origins":   []interface{}{"https://app.example.com", "https://*.example.org"},
+				"allowed-methods":   []interface{}{"GET", "POST", "DELETE"},
+				"allowed-headers":   []interface{}{"Authorization", "Content-Type"},
+				"exposed-headers":   []interface{}{"X-Request-ID"},
+				"allow-credentials": true,
+				"max-age":           "10m",
+			},
+			map[string]interface{}{
+				"prefix":          "/public/",
+				"allowed-origins": []interface{}{"*"},
+				"allowed-headers": []interface{}{"*"},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		handler = &cors.Handler{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+
+				w.Header().Set("Access-Control-Allow-Origin", "https://backend.example.com")
+				if r.Header.Get("Authorization") == "" {
+					w.WriteHeader(http.StatusUnauthorized)
+				}
+			}),
+			Policies: policies,
+		}
+	})
+
+	Context("preflight", func() {
+		It("answers an allowed preflight without calling the handler", func() {
+			rec := preflight("/api/items", "https://app.example.com", "DELETE", "authorization, content-type")
+			Expect(reached).To(BeFalse())
+			Expect(rec.Code).To(Equal(http.StatusNoContent))
+			Expect(rec.Header().Get("Access-Control-Allow-Origin")).To(Equal("https://app.example.com"))
+			Expect(rec.Header().Get("Access-Control-Allow-Methods")).To(Equal("GET, POST, DELETE"))
+			Expect(rec.Header().Get("Access-Control-Allow-Headers")).To(Equal("authorization, content-type"))
+			Expect(rec.Header().Get("Access-Control-Allow-Credentials")).To(Equal("true"))
+			Expect(rec.Header().Get("Access-Control-Max-Age")).To(Equal("600"))
+			Expect(rec.Header().Values("Vary")).To(ContainElement("Origin"))
+		})
+
+		It("allows wildcard subdomains", func() {
+			Expect(preflight("/api/", "https://app.example.org", "GET", "").Code).To(Equal(http.StatusNoContent))
+			Expect(preflight("/api/", "https://a.b.example.org", "GET", "").Code).To(Equal(http.StatusNoContent))
+		})
+
+		DescribeTable("refuses a preflight that isn't allowed",
+			func(origin, method, headers string) {
+				rec := preflight("/api/", origin, method, headers)
+				Expect(reached).To(BeFalse())
+				Expect(rec.Code).To(Equal(http.StatusForbidden))
+				Expect(rec.Header().Get("Access-Control-Allow-Origin")).To(BeEmpty())
+			},
+			Entry("origin", "https://evil.com", "GET", ""),
+			Entry("scheme", "http://app.example.com", "GET", ""),
+			Entry("subdomain parent", "https://example.org", "GET", ""),
+			Entry("subdomain suffix", "https://evilexample.org", "GET", ""),
+			Entry("subdomain with port", "https://app.example.org:8443", "GET", ""),
+			Entry("method", "https://app.example.com", "PUT", ""),
+			Entry("header", "https://app.example.com", "GET", "X-Custom"),
+		)
+
+		DescribeTable("gives the reason a preflight isn't allowed",
+			func(origin, method, headers string, expected error) {
+				var reason error
+				handler.Forbidden = func(w http.ResponseWriter, r *http.Request, err error) {
+					reason = err
+					w.WriteHeader(http.StatusForbidden)
+				}
+
+				Expect(preflight("/api/", origin, method, headers).Code).To(Equal(http.StatusForbidden))
+				Expect(reason).To(Equal(expected))
+			},
+			Entry("origin", "https://evil.com", "GET", "", cors.ErrOriginNotAllowed),
+			Entry("method", "https://app.example.com", "PUT", "", cors.ErrMethodNotAllowed),
+			Entry("header", "https://app.example.com", "GET", "X-Custom", cors.ErrHeadersNotAllowed),
+		)
+
+		It("renders a refused preflight from the forbidden response templates", func() {
+			handler.Forbidden = httpauth.NewResponses().Forbidden
+
+			rec := serve(http.MethodOptions, "/api/", map[string]string{
+				"Origin":                        "https://evil.com",
+				"Access-Control-Request-Method": "GET",
+				"Accept":                        "application/json",
+			})
+			Expect(reached).To(BeFalse())
+			Expect(rec.Code).To(Equal(http.StatusForbidden))
+			Expect(rec.Header().Get("Access-Control-Allow-Origin")).To(BeEmpty())
+			Expect(rec.Body.String()).To(ContainSubstring(`"reason":"origin_not_allowed"`))
+		})
+
+		It("allows any origin and header", func() {
+			rec := preflight("/public/", "https://anywhere.test", "POST", "X-Custom")
+			Expect(rec.Code).To(Equal(http.StatusNoContent))
+			Expect(rec.Header().Get("Access-Control-Allow-Origin")).To(Equal("*"))
+			Expect(rec.Header().Get("Access-Control-Allow-Methods")).To(Equal("GET, HEAD, POST"))
+			Expect(rec.Header().Get("Access-Control-Allow-Headers")).To(Equal("X-Custom"))
+			Expect(rec.Header().Get("Access-Control-Allow-Credentials")).To(BeEmpty())
+		})
+
+		It("passes an OPTIONS request that isn't a preflight to the handler", func() {
+			serve(http.MethodOptions, "/api/", map[string]string{"Origin": "https://app.example.com"})
+			Expect(reached).To(BeTrue())
+		})
+	})
+
+	Context("responses", func() {
+		It("replaces the backend's headers for an allowed origin", func() {
+			rec := serve(http.MethodGet, "/api/", map[string]string{
+				"Origin":        "https://app.example.com",
+				"Authorization": "Bearer token",
+			})
+			Expect(reached).To(BeTrue())
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Header().Values("Access-Control-Allow-Origin")).To(Equal([]string{"https://app.example.com"}))
+			Expect(rec.Header().Get("Access-Control-Allow-Credentials")).To(Equal("true"))
+			Expect(rec.Header().Get("Access-Control-Expose-Headers")).To(Equal("X-Request-ID"))
+			Expect(rec.Header().Get("Vary")).To(Equal("Origin"))
+		})
+
+		It("decorates error responses so the client can read them", func() {
+			rec := serve(http.MethodGet, "/api/", map[string]string{"Origin": "https://app.example.com"})
+			Expect(rec.Code).To(Equal(http.StatusUnauthorized))
+			Expect(rec.Header().Get("Access-Control-Allow-Origin")).To(Equal("https://app.example.com"))
+		})
+
+		It("does not decorate responses for other origins", func() {
+			rec := serve(http.MethodGet, "/api/", map[string]string{"Origin": "https://evil.com"})
+			Expect(reached).To(BeTrue())
+			Expect(rec.Header().Get("Access-Control-Allow-Origin")).To(Equal("https://backend.example.com"))
+			Expect(rec.Header().Get("Access-Control-Allow-Credentials")).To(BeEmpty())
+		})
+
+		It("passes through paths without a policy", func() {
+			rec := preflight("/other/", "https://app.example.com", "GET", "")
+			Expect(reached).To(BeTrue())
+			Expect(rec.Header().Get("Vary")).To(BeEmpty())
+		})
+
+		It("matches the cleaned path", func() {
+			preflight("/api/../other/", "https://app.example.com", "GET", "")
+			Expect(reached).To(BeTrue())
+		})
+	})
+
+	DescribeTable("rejects invalid policies",
+		func(policy map[string]interface{}, message string) {
+			_, err := cors.ParsePolicies([]interface{}{policy})
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		},
+		Entry("no origins", map[string]interface{}{"prefix": "/"}, "no allowed origins"),
+		Entry("origin with a path", map[string]interface{}{"allowed-origins": []interface{}{"https://a.com/app"}}, "must be"),
+		Entry("origin without a scheme", map[string]interface{}{"allowed-origins": []interface{}{"a.com"}}, "must be"),
+		Entry("wildcard in the middle", map[string]interface{}{"allowed-origins": []interface{}{"https://a.*.com"}}, "first label"),
+		Entry("bad max age", map[string]interface{}{"allowed-origins": []interface{}{"*"}, "max-age": "soon"}, "invalid duration"),
+		Entry("credentials with any origin", map[string]interface{}{"allowed-origins": []interface{}{"https://a.com", "*"}, "allow-credentials": true}, "allow-credentials"),
+		Entry("unknown key", map[string]interface{}{"allowed-origins": []interface{}{"*"}, "origins": "*"}, "invalid keys: origins"),
+	)
+
+	It("exposes the policy checks", func() {
+		p := &cors.Policy{AllowedOrigins: []string{"https://*.example.com"}, MaxAge: time.Minute}
+		Expect(p.Validate()).To(Succeed())
+		Expect(p.AllowsOrigin("https://a.example.com")).To(BeTrue())
+		Expect(p.AllowsMethod("HEAD")).To(BeTrue())
+		Expect(p.AllowsMethod("DELETE")).To(BeFalse())
+		Expect(p.AllowsHeaders(nil)).To(BeTrue())
+	})
+})
@@ -0,0 +1,223 @@
+package cors
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/koshatul/auth-proxy/httpmatch"
+)
+
+// Handler answers preflight requests for the routes with a policy and adds the CORS headers to
+// every other response for an allowed origin, including the responses from the wrapped handler
+// (any CORS headers the backend sets are replaced). Requests for paths without a policy are passed
+// through untouched.
+type Handler struct {
+	Handler http.Handler
+
+	// Policies are checked in order, the first whose prefix matches the request path applies.
+	Policies []*Policy
+
+	// Forbidden writes the response to a preflight that isn't allowed (err is a *DeniedError),
+	// defaults to an empty 403 Forbidden.
+	Forbidden func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// DeniedError is the reason a preflight request isn't allowed.
+type DeniedError struct {
+	reason string
+}
+
+// Reasons a preflight request isn't allowed.
+// nolint: gochecknoglobals // sentinel errors
+var (
+	ErrOriginNotAllowed  = &DeniedError{reason: "origin_not_allowed"}
+	ErrMethodNotAllowed  = &DeniedError{reason: "method_not_allowed"}
+	ErrHeadersNotAllowed = &DeniedError{reason: "headers_not_allowed"}
+)
+
+func (e *DeniedError) Error() string {
+	return "cross-origin request refused: " + strings.ReplaceAll(e.reason, "_", " ")
+}
+
+// FailureReason returns the machine readable reason (eg. "origin_not_allowed").
+func (e *DeniedError) FailureReason() string {
+	return e.reason
+}
+
+// ServeHTTP satisfies the http.Handler interface for Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := h.policy(r)
+	if p == nil {
+		h.Handler.ServeHTTP(w, r)
+
+		return
+	}
+
+	origin := r.Header.Get("Origin")
+
+	if r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+		h.preflight(w, r, p)
+
+		return
+	}
+
+	w.Header().Add("Vary", "Origin")
+
+	if origin == "" || !p.AllowsOrigin(origin) {
+		h.Handler.ServeHTTP(w, r)
+
+		return
+	}
+
+	headers := http.Header{}
+	allowOrigin(headers, p, origin)
+
+	if len(p.ExposedHeaders) > 0 {
+		headers.Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+	}
+
+	rw := &responseWriter{ResponseWriter: w, headers: headers}
+	h.Handler.ServeHTTP(rw, r)
+
+	// a handler that writes nothing responds 200 OK once it returns
+	rw.apply()
+}
+
+// preflight answers a preflight request, one that isn't allowed gets 403 Forbidden without any
+// CORS headers so the browser refuses the actual request.
+func (h *Handler) preflight(w http.ResponseWriter, r *http.Request, p *Policy) {
+	w.Header().Add("Vary", "Origin")
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	origin := r.Header.Get("Origin")
+	method := r.Header.Get("Access-Control-Request-Method")
+	headers := requestHeaders(r)
+
+	if err := p.allows(origin, method, headers); err != nil {
+		if h.Forbidden != nil {
+			h.Forbidden(w, r, err)
+		} else {
+			w.WriteHeader(http.StatusForbidden)
+		}
+
+		return
+	}
+
+	allowOrigin(w.Header(), p, origin)
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(p.methods(), ", "))
+
+	if len(headers) > 0 {
+		// the request headers have been checked, echoing them also covers an allowed "*"
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	}
+
+	if p.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// policy returns the first policy matching the request path, or nil.
+func (h *Handler) policy(r *http.Request) *Policy {
+	urlPath := httpmatch.CleanPath(r.URL.Path)
+
+	for _, p := range h.Policies {
+		if strings.HasPrefix(urlPath, p.Prefix) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// allowOrigin sets the allowed origin, "*" is sent when any origin is allowed (a policy allowing
+// credentials can't), otherwise the request's origin is echoed.
+func allowOrigin(h http.Header, p *Policy, origin string) {
+	if p.allowsAnyOrigin() {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if p.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// requestHeaders returns the headers named in the preflight's Access-Control-Request-Headers.
+func requestHeaders(r *http.Request) []string {
+	headers := []string{}
+
+	for _, line := range r.Header.Values("Access-Control-Request-Headers") {
+		for _, v := range strings.Split(line, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				headers = append(headers, v)
+			}
+		}
+	}
+
+	return headers
+}
+
+// responseWriter replaces the CORS headers of the response with the policy's when the header is
+// written, it passes through Hijack and Flush so upgraded and streaming responses keep working.
+type responseWriter struct {
+	http.ResponseWriter
+	headers     http.Header
+	wroteHeader bool
+}
+
+// apply replaces the CORS headers, unless the header has already been written.
+func (w *responseWriter) apply() {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+
+	for key := range w.ResponseWriter.Header() {
+		if strings.HasPrefix(key, "Access-Control-") {
+			w.ResponseWriter.Header().Del(key)
+		}
+	}
+
+	for key, values := range w.headers {
+		w.ResponseWriter.Header()[key] = values
+	}
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	w.apply()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.apply()
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseWriter) Flush() {
+	w.apply()
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+
+	w.wroteHeader = true
+
+	return hj.Hijack()
+}
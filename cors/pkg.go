@@ -0,0 +1,3 @@
+// Package cors answers CORS preflight requests and adds the CORS headers to responses for the
+// routes with a policy, it runs in front of authentication because preflights carry no credentials.
+package cors
@@ -0,0 +1,171 @@
+package cors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/koshatul/auth-proxy/configtable"
+	"github.com/koshatul/auth-proxy/httpmatch"
+)
+
+// ErrNoOrigins is returned for a policy without any allowed origins.
+var ErrNoOrigins = errors.New("no allowed origins")
+
+// ErrCredentialsAnyOrigin is returned for a policy that allows credentials from any origin.
+var ErrCredentialsAnyOrigin = errors.New("allow-credentials can't be used with an allowed origin of \"*\"")
+
+// nolint: gochecknoglobals // read only
+var defaultMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// Policy is the CORS policy for requests whose path has the prefix, a single `[[server.cors]]` entry.
+//
+//	[[server.cors]]
+//	prefix = "/api/"
+//	allowed-origins = ["https://app.example.com", "https://*.example.com"]
+//	allowed-methods = ["GET", "POST", "DELETE"]
+//	allowed-headers = ["Authorization", "Content-Type"]
+//	exposed-headers = ["X-Request-ID"]
+//	allow-credentials = true
+//	max-age = "10m"
+//
+// An origin of "*" allows any origin, "https://*.example.com" allows any subdomain (but not
+// example.com itself). Methods default to GET, HEAD and POST, and an allowed header of "*"
+// allows any header. Credentials can only be allowed for listed origins.
+type Policy struct {
+	Prefix           string        `mapstructure:"prefix"`
+	AllowedOrigins   []string      `mapstructure:"allowed-origins"`
+	AllowedMethods   []string      `mapstructure:"allowed-methods"`
+	AllowedHeaders   []string      `mapstructure:"allowed-headers"`
+	ExposedHeaders   []string      `mapstructure:"exposed-headers"`
+	AllowCredentials bool          `mapstructure:"allow-credentials"`
+	MaxAge           time.Duration `mapstructure:"max-age"`
+}
+
+// Validate checks the policy's origins.
+func (p *Policy) Validate() error {
+	if len(p.AllowedOrigins) == 0 {
+		return ErrNoOrigins
+	}
+
+	if p.AllowCredentials && p.allowsAnyOrigin() {
+		return ErrCredentialsAnyOrigin
+	}
+
+	for _, origin := range p.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return fmt.Errorf("allowed origin %q must be \"*\" or a scheme and host", origin)
+		}
+
+		if strings.Contains(strings.TrimPrefix(u.Host, "*."), "*") {
+			return fmt.Errorf("allowed origin %q can only have a wildcard as the first label", origin)
+		}
+	}
+
+	return nil
+}
+
+// AllowsOrigin returns true if the origin is allowed.
+func (p *Policy) AllowsOrigin(origin string) bool {
+	origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+
+	for _, allowed := range p.AllowedOrigins {
+		allowed = strings.ToLower(strings.TrimSuffix(allowed, "/"))
+
+		switch {
+		case allowed == "*", allowed == origin:
+			return true
+		case strings.Contains(allowed, "://*."):
+			i := strings.Index(allowed, "*")
+			prefix, suffix := allowed[:i], allowed[i+1:]
+
+			if len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) &&
+				!strings.ContainsAny(origin[len(prefix):len(origin)-len(suffix)], "/:@") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// allowsAnyOrigin returns true if the policy allows any origin.
+func (p *Policy) allowsAnyOrigin() bool {
+	return httpmatch.ContainsFold(p.AllowedOrigins, "*")
+}
+
+// AllowsMethod returns true if the method is allowed.
+func (p *Policy) AllowsMethod(method string) bool {
+	return httpmatch.ContainsFold(p.methods(), method)
+}
+
+// AllowsHeaders returns true if every header is allowed.
+func (p *Policy) AllowsHeaders(headers []string) bool {
+	if httpmatch.ContainsFold(p.AllowedHeaders, "*") {
+		return true
+	}
+
+	for _, h := range headers {
+		if !httpmatch.ContainsFold(p.AllowedHeaders, h) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// allows returns the reason a preflight request isn't allowed, or nil.
+func (p *Policy) allows(origin, method string, headers []string) error {
+	switch {
+	case !p.AllowsOrigin(origin):
+		return ErrOriginNotAllowed
+	case !p.AllowsMethod(method):
+		return ErrMethodNotAllowed
+	case !p.AllowsHeaders(headers):
+		return ErrHeadersNotAllowed
+	}
+
+	return nil
+}
+
+func (p *Policy) methods() []string {
+	if len(p.AllowedMethods) == 0 {
+		return defaultMethods
+	}
+
+	return p.AllowedMethods
+}
+
+// ParsePolicies returns the checked policies from the raw `server.cors` configuration value.
+func ParsePolicies(raw interface{}) ([]*Policy, error) {
+	tables, err := configtable.Tables(raw, "cors policy")
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make([]*Policy, 0, len(tables))
+
+	for i, table := range tables {
+		p := &Policy{}
+
+		if err := configtable.Decode(table, p); err != nil {
+			return nil, fmt.Errorf("cors policy %d: %w", i, err)
+		}
+
+		if err := p.Validate(); err != nil {
+			return nil, fmt.Errorf("cors policy %d: %w", i, err)
+		}
+
+		policies = append(policies, p)
+	}
+
+	return policies, nil
+}
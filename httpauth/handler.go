@@ -9,32 +9,57 @@ type BasicAuthHandler struct {
 	Handler    http.Handler
 	RemoveAuth bool
 
+	// Public are the rules for requests let through without authentication, they are checked
+	// in order before the credentials.
+	Public []*PublicRule
+
 	*BasicAuthWrapper
 }
 
 // ServeHTTP Satisfies the http.Handler interface for basicAuth.
 func (b *BasicAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var (
-		username string
-		ok       bool
-	)
-
 	// Check if we have a user-provided error handler, else set a default
 	if b.UnauthorizedHandler == nil {
 		b.UnauthorizedHandler = http.HandlerFunc(defaultUnauthorizedHandler)
 	}
 
+	if rule := b.publicRule(r); rule != nil && !(rule.Optional && b.hasCredentials(r)) {
+		b.serveAnonymous(w, r)
+		return
+	}
+
 	// Check that the provided details match
-	if username, ok = b.authenticate(r); !ok {
-		b.requestAuth(w, r)
+	id, err := b.authenticate(r)
+
+	// a token outside the Authorization header is only for the proxy, it's removed whatever the
+	// outcome so it isn't written to the access log or forwarded to the backend
+	b.removeUpgradeToken(r)
+
+	if err != nil {
+		b.requestAuth(w, r, err)
 		return
 	}
 
+	// the identity header always comes from the authentication, never from the client
+	r.Header.Set("X-Username", id.Subject)
+
 	if b.RemoveAuth {
-		r.Header.Set("X-Username", username)
 		r.Header.Del("Authorization")
 	}
 
 	// Call the next handler on success.
+	b.Handler.ServeHTTP(w, withExpiry(r, id.Expires))
+}
+
+// serveAnonymous passes a request matching a public rule to the next handler without
+// authenticating it, a client supplied identity header is never forwarded.
+func (b *BasicAuthHandler) serveAnonymous(w http.ResponseWriter, r *http.Request) {
+	r.Header.Del("X-Username")
+	b.removeUpgradeToken(r)
+
+	if b.RemoveAuth {
+		r.Header.Del("Authorization")
+	}
+
 	b.Handler.ServeHTTP(w, r)
 }
@@ -1,12 +1,14 @@
 package httpauth_test
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"time"
 
+	"github.com/koshatul/auth-proxy/audit"
 	"github.com/koshatul/auth-proxy/httpauth"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -34,15 +36,17 @@ var _ = Describe("httpauth", func() {
 	}
 
 	var (
-		logcore zapcore.Core
-		logger  *zap.Logger
-		ts      *httptest.Server
+		logcore  zapcore.Core
+		logger   *zap.Logger
+		ts       *httptest.Server
+		auditBuf *bytes.Buffer
 	)
 
 	BeforeEach(func() {
 		// logcore, logobs = observer.New(zap.DebugLevel)
 		logcore, _ = observer.New(zap.DebugLevel)
 		logger = zap.New(logcore)
+		auditBuf = &bytes.Buffer{}
 
 		authenticator := &httpauth.BasicAuthHandler{
 			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -55,6 +59,7 @@ var _ = Describe("httpauth", func() {
 				AuthFunc:      authFunc,
 				Logger:        logger,
 				CacheDuration: time.Minute,
+				Audit:         audit.NewLogger(auditBuf),
 			},
 		}
 
@@ -120,9 +125,43 @@ var _ = Describe("httpauth", func() {
 			expectNotSuccessBody(res)
 		})
 
+		It("with cached authentication", func() {
+			c := ts.Client()
+
+			for i := 0; i < 2; i++ {
+				r, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+				Expect(err).NotTo(HaveOccurred())
+				r.SetBasicAuth("test", "valid-pass")
+				res, err := c.Do(r)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+				expectSuccessBody(res)
+			}
+
+			Expect(auditBuf.String()).To(ContainSubstring(`"outcome":"success","subject":"test"`))
+			Expect(auditBuf.String()).To(ContainSubstring(`"cached":true`))
+		})
+
 	})
 
 	Context("should fail", func() {
+
+		It("with malformed authentication", func() {
+			c := ts.Client()
+			r, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			Expect(err).NotTo(HaveOccurred())
+			r.Header.Set("Authorization", "Basic not-base64!")
+			res, err := c.Do(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+
+			expectNotSuccessBody(res)
+
+			Expect(auditBuf.String()).To(ContainSubstring(`"outcome":"failure","reason":"malformed"`))
+			Expect(auditBuf.String()).NotTo(ContainSubstring("not-base64"))
+		})
+
 	})
 
 })
@@ -0,0 +1,213 @@
+package httpauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/koshatul/auth-proxy/audit"
+)
+
+var (
+	// ErrNoCredentials is returned when the provider doesn't recognise the credentials (eg. an unknown
+	// user, or a password that isn't a token), the next provider may still accept them.
+	ErrNoCredentials = errors.New("no credentials for provider")
+
+	// ErrInvalid is returned when the provider recognises the credentials but they are not valid.
+	ErrInvalid = errors.New("invalid credentials")
+
+	// ErrExpired is returned when the credentials were valid but have expired (or are not yet valid).
+	ErrExpired = errors.New("credentials expired")
+
+	// ErrMissingCredentials is the reason a request without any credentials is refused.
+	ErrMissingCredentials = errors.New("no credentials supplied")
+)
+
+// Credentials are the username and password supplied with a request, tokens supplied outside
+// of the Authorization header on upgrade requests are passed as the username.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Identity is the result of a successful authentication.
+type Identity struct {
+	// Subject is the authenticated username.
+	Subject string
+
+	// Provider is the name of the provider that authenticated the credentials.
+	Provider string
+
+	// Expires is when the credentials stop being valid, zero if they don't expire.
+	Expires time.Time
+
+	// TokenID is the ID of the token used to authenticate, if there was one.
+	TokenID string
+
+	// Claims are the verified claims of the token used to authenticate, if there was one.
+	Claims map[string]interface{}
+
+	// Groups the subject is a member of.
+	Groups []string
+}
+
+// Authenticator authenticates the credentials supplied with a request, on failure it returns an
+// error that wraps ErrNoCredentials, ErrInvalid or ErrExpired (or the context error).
+//
+// The context carries the request ID and trace span of the request being authenticated.
+type Authenticator interface {
+	Authenticate(ctx context.Context, creds Credentials) (*Identity, error)
+}
+
+// AuthenticatorFunc is an adapter to allow the use of ordinary functions as an Authenticator.
+type AuthenticatorFunc func(ctx context.Context, creds Credentials) (*Identity, error)
+
+// Authenticate satisfies the Authenticator interface for AuthenticatorFunc.
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, creds Credentials) (*Identity, error) {
+	return f(ctx, creds)
+}
+
+// AuthError describes a failed authentication, it wraps one of the Err* errors (or the context error).
+type AuthError struct {
+	// Provider is the name of the provider that rejected the credentials.
+	Provider string
+
+	// Reason is one of the audit reasons (eg. audit.ReasonBadSignature).
+	Reason string
+
+	// Subject is the user the credentials claimed to be, if known.
+	Subject string
+
+	// TokenID is the ID of the rejected token, if there was one.
+	TokenID string
+
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	if e.Reason == "" {
+		return e.Provider + ": " + e.Err.Error()
+	}
+
+	return e.Provider + ": " + e.Err.Error() + " (" + e.Reason + ")"
+}
+
+// Unwrap returns the underlying error.
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// FailureReason returns the audit reason for an error returned by an Authenticator, an error
+// with a FailureReason method (eg. a refused CORS preflight) gives its own reason.
+func FailureReason(err error) string {
+	var authErr *AuthError
+	if errors.As(err, &authErr) && authErr.Reason != "" {
+		return authErr.Reason
+	}
+
+	var reasoned interface{ FailureReason() string }
+	if errors.As(err, &reasoned) {
+		return reasoned.FailureReason()
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return audit.ReasonTimeout
+	case errors.Is(err, context.Canceled):
+		return audit.ReasonCanceled
+	case errors.Is(err, ErrExpired):
+		return audit.ReasonExpired
+	case errors.Is(err, ErrNoCredentials):
+		return audit.ReasonUnknownUser
+	case errors.Is(err, ErrMissingCredentials):
+		return audit.ReasonMissingCredentials
+	}
+
+	return audit.ReasonInvalid
+}
+
+// Attempt is the result of a single provider tried by an Authenticator that tries several (eg. a
+// chain), Identity is set when the provider accepted the credentials and Err otherwise.
+type Attempt struct {
+	Identity *Identity
+	Err      error
+}
+
+type attemptsContextKey struct{}
+
+// attempts collects the results reported with RecordAttempt while authenticating a request.
+type attempts struct {
+	lock    sync.Mutex
+	results []Attempt
+}
+
+// withAttempts returns a copy of ctx that collects the attempts reported with RecordAttempt.
+func withAttempts(ctx context.Context, a *attempts) context.Context {
+	return context.WithValue(ctx, attemptsContextKey{}, a)
+}
+
+// RecordAttempt reports the result of a single provider, so the audit log has an event for each
+// provider tried rather than only the final result. It does nothing if ctx isn't from a request
+// being authenticated by BasicAuthWrapper.
+func RecordAttempt(ctx context.Context, id *Identity, err error) {
+	a, ok := ctx.Value(attemptsContextKey{}).(*attempts)
+	if !ok {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.results = append(a.results, Attempt{Identity: id, Err: err})
+}
+
+type requestContextKey struct{}
+
+// withRequest returns a copy of ctx carrying the request, for adapting an AuthProvider.
+func withRequest(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, requestContextKey{}, r)
+}
+
+// requestFromContext returns the request carried by ctx as a shallow copy with ctx as its context,
+// or an empty request if there isn't one.
+func requestFromContext(ctx context.Context) *http.Request {
+	if r, ok := ctx.Value(requestContextKey{}).(*http.Request); ok {
+		return r.WithContext(ctx)
+	}
+
+	return (&http.Request{Header: http.Header{}, URL: &url.URL{}}).WithContext(ctx)
+}
+
+// Authenticator returns an Authenticator for the AuthProvider function, failures are reported
+// as ErrInvalid and the session expiry set with SetSessionExpiry is returned in the Identity.
+func (f AuthProvider) Authenticator(name string) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, creds Credentials) (*Identity, error) {
+		s := &session{}
+		r := requestFromContext(context.WithValue(ctx, sessionContextKey{}, s))
+
+		username, ok := f(creds.Username, creds.Password, r)
+		if !ok {
+			return nil, &AuthError{Provider: name, Err: ErrInvalid}
+		}
+
+		return &Identity{Subject: username, Provider: name, Expires: s.Expires}, nil
+	})
+}
+
+// ProviderFunc returns an AuthProvider function for the Authenticator, for use where the
+// function type is still expected.
+func ProviderFunc(a Authenticator) AuthProvider {
+	return func(username, password string, r *http.Request) (string, bool) {
+		id, err := a.Authenticate(withRequest(r.Context(), r), Credentials{Username: username, Password: password})
+		if err != nil {
+			return "", false
+		}
+
+		SetSessionExpiry(r, id.Expires)
+
+		return id.Subject, true
+	}
+}
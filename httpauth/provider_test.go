@@ -0,0 +1,180 @@
+package httpauth_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/koshatul/auth-proxy/audit"
+	"github.com/koshatul/auth-proxy/cors"
+	"github.com/koshatul/auth-proxy/httpauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	cache "github.com/patrickmn/go-cache"
+	"go.uber.org/zap"
+)
+
+var _ = Describe("Authenticator", func() {
+
+	var (
+		auditBuf *bytes.Buffer
+		calls    int32
+		provider httpauth.AuthenticatorFunc
+		expires  time.Time
+		c        *cache.Cache
+	)
+
+	serve := func(username, password string) (int, string) {
+		var seen string
+
+		h := &httpauth.BasicAuthHandler{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = r.URL.User.Username()
+			}),
+			BasicAuthWrapper: &httpauth.BasicAuthWrapper{
+				Cache:               c,
+				Provider:            provider,
+				Logger:              zap.NewNop(),
+				CacheDuration:       time.Minute,
+				UnauthorizedHandler: http.NotFoundHandler(),
+				Audit:               audit.NewLogger(auditBuf),
+			},
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.SetBasicAuth(username, password)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		return w.Code, seen
+	}
+
+	lastEvent := func() audit.Event {
+		lines := bytes.Split(bytes.TrimSpace(auditBuf.Bytes()), []byte("\n"))
+		e := audit.Event{}
+		Expect(json.Unmarshal(lines[len(lines)-1], &e)).To(Succeed())
+
+		return e
+	}
+
+	BeforeEach(func() {
+		auditBuf = &bytes.Buffer{}
+		c = cache.New(time.Minute, time.Minute)
+		atomic.StoreInt32(&calls, 0)
+		expires = time.Now().Add(time.Hour)
+		provider = func(ctx context.Context, creds httpauth.Credentials) (*httpauth.Identity, error) {
+			atomic.AddInt32(&calls, 1)
+
+			switch creds.Password {
+			case "valid":
+				return &httpauth.Identity{Subject: creds.Username, Provider: "test", TokenID: "1234", Expires: expires}, nil
+			case "slow":
+				return nil, &httpauth.AuthError{Provider: "test", Err: context.DeadlineExceeded}
+			}
+
+			return nil, &httpauth.AuthError{Provider: "test", Reason: audit.ReasonBadSignature, TokenID: "5678", Err: httpauth.ErrInvalid}
+		}
+	})
+
+	It("should record the identity in the audit log", func() {
+		code, user := serve("test", "valid")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(user).To(Equal("test"))
+
+		e := lastEvent()
+		Expect(e.Provider).To(Equal("test"))
+		Expect(e.Outcome).To(Equal(audit.OutcomeSuccess))
+		Expect(e.Subject).To(Equal("test"))
+		Expect(e.TokenID).To(Equal("1234"))
+	})
+
+	It("should record the reason from the error in the audit log", func() {
+		code, _ := serve("test", "invalid")
+		Expect(code).To(Equal(http.StatusNotFound))
+
+		e := lastEvent()
+		Expect(e.Provider).To(Equal("test"))
+		Expect(e.Outcome).To(Equal(audit.OutcomeFailure))
+		Expect(e.Reason).To(Equal(audit.ReasonBadSignature))
+		Expect(e.TokenID).To(Equal("5678"))
+	})
+
+	It("should reject cached identities once they expire", func() {
+		expires = time.Now().Add(50 * time.Millisecond)
+
+		code, _ := serve("test", "valid")
+		Expect(code).To(Equal(http.StatusOK))
+
+		time.Sleep(100 * time.Millisecond)
+
+		code, _ = serve("test", "valid")
+		Expect(code).To(Equal(http.StatusNotFound))
+		Expect(lastEvent().Reason).To(Equal(audit.ReasonExpired))
+	})
+
+	It("should cache failures but not timeouts", func() {
+		serve("test", "invalid")
+		serve("test", "invalid")
+		Expect(atomic.LoadInt32(&calls)).To(Equal(int32(1)))
+		Expect(lastEvent().Cached).To(BeTrue())
+
+		serve("test", "slow")
+		serve("test", "slow")
+		Expect(atomic.LoadInt32(&calls)).To(Equal(int32(3)))
+		Expect(lastEvent().Reason).To(Equal(audit.ReasonTimeout))
+	})
+
+	Describe("FailureReason", func() {
+
+		It("should fall back to the reason for the wrapped error", func() {
+			Expect(httpauth.FailureReason(httpauth.ErrExpired)).To(Equal(audit.ReasonExpired))
+			Expect(httpauth.FailureReason(httpauth.ErrNoCredentials)).To(Equal(audit.ReasonUnknownUser))
+			Expect(httpauth.FailureReason(httpauth.ErrInvalid)).To(Equal(audit.ReasonInvalid))
+			Expect(httpauth.FailureReason(&httpauth.AuthError{Err: context.DeadlineExceeded})).To(Equal(audit.ReasonTimeout))
+		})
+
+		It("should use the reason an error gives itself", func() {
+			Expect(httpauth.FailureReason(fmt.Errorf("preflight: %w", cors.ErrOriginNotAllowed))).To(Equal("origin_not_allowed"))
+		})
+
+	})
+
+	Describe("AuthProvider adapter", func() {
+
+		It("should pass the request and report the session expiry", func() {
+			var seenPath string
+
+			f := httpauth.AuthProvider(func(username string, password string, r *http.Request) (string, bool) {
+				seenPath = r.URL.Path
+				httpauth.SetSessionExpiry(r, expires)
+
+				return username, password == "valid"
+			})
+			provider = f.Authenticator("func").Authenticate
+
+			code, _ := serve("test", "valid")
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(seenPath).To(Equal("/"))
+
+			e := lastEvent()
+			Expect(e.Provider).To(Equal("func"))
+			Expect(e.Outcome).To(Equal(audit.OutcomeSuccess))
+		})
+
+		It("should report failures as ErrInvalid", func() {
+			f := httpauth.AuthProvider(func(username string, password string, r *http.Request) (string, bool) {
+				return "", false
+			})
+
+			_, err := f.Authenticator("func").Authenticate(context.Background(), httpauth.Credentials{Username: "test"})
+			Expect(err).To(MatchError(httpauth.ErrInvalid))
+		})
+
+	})
+
+})
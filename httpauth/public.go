@@ -0,0 +1,157 @@
+package httpauth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/koshatul/auth-proxy/configtable"
+	"github.com/koshatul/auth-proxy/httpmatch"
+)
+
+// ErrPublicRule is returned for a public rule that doesn't set exactly one of prefix, glob or regex.
+var ErrPublicRule = errors.New("public rule must set exactly one of prefix, glob or regex")
+
+// PublicRule matches requests that are let through without authentication, a single
+// `[[server.public]]` entry.
+//
+//	[[server.public]]
+//	glob = "/favicon.ico"
+//	methods = ["GET", "HEAD"]
+//
+//	[[server.public]]
+//	prefix = "/.well-known/"
+//
+//	[[server.public]]
+//	regex = "^/v2/[^/]+/status$"
+//	optional = true
+//
+// Paths are matched after cleaning (so "/.well-known/../admin" is "/admin"), a glob's "*" does
+// not match "/". An empty Methods matches every method. No rule matches a path containing ";" or
+// "\" or an escaped "/", backends may resolve those differently (eg. "/public/..;/admin" is
+// "/admin" to Tomcat) so they are always authenticated.
+type PublicRule struct {
+	Prefix  string   `mapstructure:"prefix"`
+	Glob    string   `mapstructure:"glob"`
+	Regex   string   `mapstructure:"regex"`
+	Methods []string `mapstructure:"methods"`
+
+	// Optional authenticates requests that carry credentials (refusing invalid ones) so their
+	// identity is forwarded, only requests without credentials are let through anonymously.
+	Optional bool `mapstructure:"optional"`
+
+	regex *regexp.Regexp
+}
+
+// Compile checks the rule and compiles its regex, it must be called before Match.
+func (p *PublicRule) Compile() error {
+	set := 0
+
+	for _, s := range []string{p.Prefix, p.Glob, p.Regex} {
+		if s != "" {
+			set++
+		}
+	}
+
+	if set != 1 {
+		return ErrPublicRule
+	}
+
+	if p.Glob != "" {
+		if _, err := path.Match(p.Glob, "/"); err != nil {
+			return fmt.Errorf("glob %q: %w", p.Glob, err)
+		}
+	}
+
+	if p.Regex != "" {
+		re, err := regexp.Compile(p.Regex)
+		if err != nil {
+			return err
+		}
+
+		p.regex = re
+	}
+
+	return nil
+}
+
+// Match returns true if the rule matches the request.
+func (p *PublicRule) Match(r *http.Request) bool {
+	if len(p.Methods) > 0 && !httpmatch.ContainsFold(p.Methods, r.Method) {
+		return false
+	}
+
+	if ambiguousPath(r) {
+		return false
+	}
+
+	urlPath := httpmatch.CleanPath(r.URL.Path)
+
+	switch {
+	case p.Prefix != "":
+		return strings.HasPrefix(urlPath, p.Prefix)
+	case p.Glob != "":
+		ok, _ := path.Match(p.Glob, urlPath)
+
+		return ok
+	case p.regex != nil:
+		return p.regex.MatchString(urlPath)
+	}
+
+	return false
+}
+
+// ParsePublicRules returns the compiled rules from the raw `server.public` configuration value.
+func ParsePublicRules(raw interface{}) ([]*PublicRule, error) {
+	tables, err := configtable.Tables(raw, "public rule")
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]*PublicRule, 0, len(tables))
+
+	for i, table := range tables {
+		rule := &PublicRule{}
+
+		if err := configtable.Decode(table, rule); err != nil {
+			return nil, fmt.Errorf("public rule %d: %w", i, err)
+		}
+
+		if err := rule.Compile(); err != nil {
+			return nil, fmt.Errorf("public rule %d: %w", i, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// publicRule returns the first rule matching the request, or nil.
+func (b *BasicAuthHandler) publicRule(r *http.Request) *PublicRule {
+	for _, rule := range b.Public {
+		if rule.Match(r) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// hasCredentials returns true if the request carries credentials, even invalid ones.
+func (b *BasicAuthWrapper) hasCredentials(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" {
+		return true
+	}
+
+	return IsUpgradeRequest(r) && b.getUpgradeToken(r) != ""
+}
+
+// ambiguousPath returns true if the request path contains path parameters, backslashes or an
+// escaped slash, which backends may treat as separators.
+func ambiguousPath(r *http.Request) bool {
+	return strings.ContainsAny(r.URL.Path, ";\\") || strings.Contains(strings.ToLower(r.URL.RawPath), "%2f")
+}
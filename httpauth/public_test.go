@@ -0,0 +1,136 @@
+package httpauth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/koshatul/auth-proxy/httpauth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	cache "github.com/patrickmn/go-cache"
+	"go.uber.org/zap"
+)
+
+var _ = Describe("Public rules", func() {
+	DescribeTable("matching requests",
+		func(rule map[string]interface{}, method, target string, expected bool) {
+			rules, err := httpauth.ParsePublicRules([]interface{}{rule})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(rules[0].Match(httptest.NewRequest(method, target, nil))).To(Equal(expected))
+		},
+		Entry("prefix", map[string]interface{}{"prefix": "/.well-known/"}, "GET", "/.well-known/acme", true),
+		Entry("prefix mismatch", map[string]interface{}{"prefix": "/.well-known/"}, "GET", "/v2/", false),
+		Entry("prefix traversal", map[string]interface{}{"prefix": "/.well-known/"}, "GET", "/.well-known/../v2/", false),
+		Entry("prefix encoded traversal", map[string]interface{}{"prefix": "/public/"}, "GET", "/public/%2e%2e/v2/", false),
+		Entry("prefix path parameter traversal", map[string]interface{}{"prefix": "/public/"}, "GET", "/public/..;/admin", false),
+		Entry("prefix encoded path parameter", map[string]interface{}{"prefix": "/public/"}, "GET", "/public/%3b/admin", false),
+		Entry("prefix backslash traversal", map[string]interface{}{"prefix": "/public/"}, "GET", "/public/..\\admin", false),
+		Entry("prefix encoded backslash traversal", map[string]interface{}{"prefix": "/public/"}, "GET", "/public/..%5cadmin", false),
+		Entry("prefix encoded slash", map[string]interface{}{"prefix": "/public/"}, "GET", "/public/a%2F..%2F..%2Fadmin", false),
+		Entry("prefix path parameter", map[string]interface{}{"prefix": "/public/"}, "GET", "/public/file;jsessionid=1", false),
+		Entry("glob", map[string]interface{}{"glob": "/*.ico"}, "GET", "/favicon.ico", true),
+		Entry("glob does not cross segments", map[string]interface{}{"glob": "/*.ico"}, "GET", "/a/favicon.ico", false),
+		Entry("regex", map[string]interface{}{"regex": "^/status/?$"}, "GET", "/status", true),
+		Entry("regex mismatch", map[string]interface{}{"regex": "^/status/?$"}, "GET", "/status/detail", false),
+		Entry("method", map[string]interface{}{"prefix": "/", "methods": []interface{}{"options"}}, "OPTIONS", "/v2/", true),
+		Entry("other method", map[string]interface{}{"prefix": "/", "methods": []interface{}{"OPTIONS"}}, "GET", "/v2/", false),
+	)
+
+	DescribeTable("rejects invalid rules",
+		func(raw interface{}, message string) {
+			_, err := httpauth.ParsePublicRules(raw)
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		},
+		Entry("no matcher", []interface{}{map[string]interface{}{"methods": []interface{}{"GET"}}}, "exactly one of prefix, glob or regex"),
+		Entry("two matchers", []interface{}{map[string]interface{}{"prefix": "/", "glob": "/*"}}, "exactly one of prefix, glob or regex"),
+		Entry("bad glob", []interface{}{map[string]interface{}{"glob": "/["}}, "syntax error in pattern"),
+		Entry("bad regex", []interface{}{map[string]interface{}{"regex": "("}}, "missing closing )"),
+		Entry("unknown key", []interface{}{map[string]interface{}{"prefix": "/", "path": "/"}}, "invalid keys: path"),
+		Entry("not a table", []interface{}{"/favicon.ico"}, "public rule 0: expected a table"),
+		Entry("not an array", "/favicon.ico", "expected an array of tables"),
+	)
+
+	Context("handler", func() {
+		var (
+			handler  *httpauth.BasicAuthHandler
+			username string
+		)
+
+		get := func(target string, auth ...string) int {
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+			r.Header.Set("X-Username", "spoofed")
+
+			if len(auth) == 2 {
+				r.SetBasicAuth(auth[0], auth[1])
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+
+			return rec.Code
+		}
+
+		BeforeEach(func() {
+			username = ""
+
+			rules, err := httpauth.ParsePublicRules([]interface{}{
+				map[string]interface{}{"glob": "/favicon.ico"},
+				map[string]interface{}{"prefix": "/status/", "optional": true},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			handler = &httpauth.BasicAuthHandler{
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					username = r.Header.Get("X-Username")
+				}),
+				RemoveAuth: true,
+				Public:     rules,
+				BasicAuthWrapper: &httpauth.BasicAuthWrapper{
+					Cache:  cache.New(time.Minute, time.Minute),
+					Logger: zap.NewNop(),
+					AuthFunc: func(username, password string, r *http.Request) (string, bool) {
+						return username, username == "test" && password == "valid-pass"
+					},
+				},
+			}
+		})
+
+		It("lets public requests through without authentication", func() {
+			Expect(get("/favicon.ico")).To(Equal(http.StatusOK))
+			Expect(username).To(BeEmpty())
+
+			Expect(get("/v2/")).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("does not authenticate credentials sent to a public path", func() {
+			Expect(get("/favicon.ico", "test", "invalid-pass")).To(Equal(http.StatusOK))
+			Expect(username).To(BeEmpty())
+		})
+
+		It("replaces a spoofed identity on an optional path when the authorization isn't removed", func() {
+			handler.RemoveAuth = false
+
+			Expect(get("/status/", "test", "valid-pass")).To(Equal(http.StatusOK))
+			Expect(username).To(Equal("test"))
+
+			Expect(get("/status/")).To(Equal(http.StatusOK))
+			Expect(username).To(BeEmpty())
+
+			Expect(get("/v2/", "test", "valid-pass")).To(Equal(http.StatusOK))
+			Expect(username).To(Equal("test"))
+		})
+
+		It("forwards the identity on an optional path when credentials are supplied", func() {
+			Expect(get("/status/", "test", "valid-pass")).To(Equal(http.StatusOK))
+			Expect(username).To(Equal("test"))
+
+			Expect(get("/status/", "test", "invalid-pass")).To(Equal(http.StatusUnauthorized))
+
+			Expect(get("/status/")).To(Equal(http.StatusOK))
+			Expect(username).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,271 @@
+package httpauth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/koshatul/auth-proxy/audit"
+	"github.com/koshatul/auth-proxy/negotiate"
+	"github.com/koshatul/auth-proxy/requestid"
+)
+
+// Formats of the unauthorized and forbidden responses.
+const (
+	FormatText     = "text"
+	FormatHTML     = "html"
+	FormatJSON     = "json"
+	FormatRegistry = "registry"
+)
+
+// formatContentTypes are the content types of each format.
+// nolint: gochecknoglobals // read only
+var formatContentTypes = map[string]string{
+	FormatText:     negotiate.Text,
+	FormatHTML:     negotiate.HTML,
+	FormatJSON:     negotiate.JSON,
+	FormatRegistry: negotiate.JSON,
+}
+
+// defaultResponseTemplates are the built in templates for each format and status.
+// nolint: gochecknoglobals // read only
+var defaultResponseTemplates = map[string]map[int]string{
+	FormatText: {
+		http.StatusUnauthorized: "{{.StatusText}}\n",
+		http.StatusForbidden:    "{{.StatusText}}\n",
+	},
+	FormatHTML: {
+		http.StatusUnauthorized: defaultHTML,
+		http.StatusForbidden:    defaultHTML,
+	},
+	FormatJSON: {
+		http.StatusUnauthorized: defaultJSON,
+		http.StatusForbidden:    defaultJSON,
+	},
+	FormatRegistry: {
+		http.StatusUnauthorized: `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required",` +
+			`"detail":{"reason":{{json .Reason}}}}]}` + "\n",
+		http.StatusForbidden: `{"errors":[{"code":"DENIED","message":"requested access to the resource is denied",` +
+			`"detail":{"reason":{{json .Reason}}}}]}` + "\n",
+	},
+}
+
+// defaultHTML adds a link to the login page to the default page.
+const defaultHTML = negotiate.DefaultHTML + `{{define "detail"}}{{if .LoginURL}}
+<p><a href="{{.LoginURL}}">Log in</a></p>
+{{- end}}{{end}}`
+
+const defaultJSON = `{"status":{{.Status}},"error":{{json .Error}},"reason":{{json .Reason}},"message":{{json .Message}}` +
+	`{{if .RequestID}},"request_id":{{json .RequestID}}{{end}}}` + "\n"
+
+// ResponseData is the data available to the response templates.
+type ResponseData struct {
+	Status     int
+	StatusText string
+
+	// Error is "unauthorized" or "forbidden".
+	Error string
+
+	// Reason is the machine readable reason the request was refused (eg. audit.ReasonExpired).
+	Reason string
+
+	// Message is a description of the reason for people.
+	Message string
+
+	Realm     string
+	RequestID string
+
+	// URL is the URL that was requested, and LoginURL the configured login page.
+	URL      string
+	LoginURL string
+}
+
+// ResponseRoute selects the format of the responses for requests whose path has the prefix.
+type ResponseRoute struct {
+	Prefix string
+	Format string
+}
+
+// Responses writes the unauthorized (401) and forbidden (403) responses from templates, the
+// format is chosen by the first route matching the request path or negotiated from the Accept
+// header. Requests that accept neither HTML nor JSON get plain text.
+//
+// Unauthorized can be used as the BasicAuthWrapper's UnauthorizedHandler, and Forbidden as the
+// cors.Handler's Forbidden.
+type Responses struct {
+	Realm    string
+	LoginURL string
+	Routes   []ResponseRoute
+
+	templates map[string]map[int]negotiate.Template
+}
+
+// NewResponses returns Responses using the built in templates.
+func NewResponses() *Responses {
+	rs := &Responses{templates: map[string]map[int]negotiate.Template{}}
+
+	for format, statuses := range defaultResponseTemplates {
+		for status, text := range statuses {
+			if err := rs.Parse(format, status, text); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	return rs
+}
+
+// Parse replaces the template for the format and status (http.StatusUnauthorized or
+// http.StatusForbidden), the json function encodes a value.
+func (rs *Responses) Parse(format string, status int, text string) error {
+	if _, ok := formatContentTypes[format]; !ok {
+		return fmt.Errorf("unknown response format %q (available: %s)", format, strings.Join(ResponseFormats(), ", "))
+	}
+
+	if status != http.StatusUnauthorized && status != http.StatusForbidden {
+		return fmt.Errorf("no response template for status %d", status)
+	}
+
+	name := fmt.Sprintf("%s-%d", format, status)
+
+	var t negotiate.Template
+
+	if format == FormatHTML {
+		h, err := negotiate.ParseHTML(name, text)
+		if err != nil {
+			return err
+		}
+
+		t = h
+	} else {
+		j, err := negotiate.ParseText(name, text)
+		if err != nil {
+			return err
+		}
+
+		t = j
+	}
+
+	if rs.templates[format] == nil {
+		rs.templates[format] = map[int]negotiate.Template{}
+	}
+
+	rs.templates[format][status] = t
+
+	return nil
+}
+
+// AddRoute selects the format for requests whose path has the prefix, routes are matched in the
+// order they are added.
+func (rs *Responses) AddRoute(prefix, format string) error {
+	if _, ok := formatContentTypes[format]; !ok {
+		return fmt.Errorf("unknown response format %q (available: %s)", format, strings.Join(ResponseFormats(), ", "))
+	}
+
+	rs.Routes = append(rs.Routes, ResponseRoute{Prefix: prefix, Format: format})
+
+	return nil
+}
+
+// Load replaces the template for the format and status with the contents of a file.
+func (rs *Responses) Load(format string, status int, filename string) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	return rs.Parse(format, status, string(b))
+}
+
+// ResponseFormats returns the names of the response formats.
+func ResponseFormats() []string {
+	names := make([]string, 0, len(formatContentTypes))
+	for name := range formatContentTypes {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Unauthorized writes a 401 Unauthorized response, for the reason from FailureFromRequest.
+func (rs *Responses) Unauthorized(w http.ResponseWriter, r *http.Request) {
+	rs.Write(w, r, http.StatusUnauthorized, FailureFromRequest(r))
+}
+
+// Forbidden writes a 403 Forbidden response for the reason err.
+func (rs *Responses) Forbidden(w http.ResponseWriter, r *http.Request, err error) {
+	rs.Write(w, r, http.StatusForbidden, err)
+}
+
+// Write writes the response for the status, a template that fails to render falls back to
+// plain text.
+func (rs *Responses) Write(w http.ResponseWriter, r *http.Request, status int, err error) {
+	data := ResponseData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Error:      strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_")),
+		Message:    http.StatusText(status),
+		Realm:      rs.Realm,
+		RequestID:  requestid.FromRequest(r),
+		URL:        r.URL.RequestURI(),
+		LoginURL:   rs.LoginURL,
+	}
+
+	if err != nil {
+		data.Reason = FailureReason(err)
+		data.Message = responseMessage(data.Reason, data.Message)
+	}
+
+	format := rs.format(r)
+
+	if format == FormatRegistry {
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	}
+
+	negotiate.Write(w, status, formatContentTypes[format], rs.templates[format][status], data, data.StatusText)
+}
+
+// format returns the format of the response to the request.
+func (rs *Responses) format(r *http.Request) string {
+	for _, route := range rs.Routes {
+		if strings.HasPrefix(r.URL.Path, route.Prefix) {
+			return route.Format
+		}
+	}
+
+	switch negotiate.ContentType(r, negotiate.Text, negotiate.HTML, negotiate.JSON) {
+	case negotiate.HTML:
+		return FormatHTML
+	case negotiate.JSON:
+		return FormatJSON
+	}
+
+	return FormatText
+}
+
+// responseMessage returns a description of a failure reason.
+func responseMessage(reason, fallback string) string {
+	switch reason {
+	case audit.ReasonMissingCredentials:
+		return "Authentication is required"
+	case audit.ReasonExpired:
+		return "The credentials have expired"
+	case audit.ReasonNotYetValid:
+		return "The credentials are not valid yet"
+	case audit.ReasonMalformed:
+		return "The credentials could not be read"
+	case audit.ReasonTimeout, audit.ReasonCanceled:
+		return "The credentials could not be checked, try again"
+	case audit.ReasonRevoked:
+		return "The credentials have been revoked"
+	case audit.ReasonUnknownUser, audit.ReasonInvalidPassword, audit.ReasonInvalid, audit.ReasonBadSignature,
+		audit.ReasonInvalidAudience, audit.ReasonMissingSubject, audit.ReasonOnlineToken:
+		return "The credentials are not valid"
+	}
+
+	return fallback
+}
@@ -0,0 +1,165 @@
+package httpauth_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/koshatul/auth-proxy/audit"
+	"github.com/koshatul/auth-proxy/httpauth"
+	"github.com/koshatul/auth-proxy/requestid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	cache "github.com/patrickmn/go-cache"
+	"go.uber.org/zap"
+)
+
+var _ = Describe("Responses", func() {
+	var (
+		responses *httpauth.Responses
+		handler   http.Handler
+	)
+
+	get := func(path, accept string, auth ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r = r.WithContext(requestid.NewContext(r.Context(), "abc123"))
+
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+
+		if len(auth) == 2 {
+			r.SetBasicAuth(auth[0], auth[1])
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+
+		return rec
+	}
+
+	decode := func(rec *httptest.ResponseRecorder) map[string]interface{} {
+		body := map[string]interface{}{}
+		Expect(json.Unmarshal(rec.Body.Bytes(), &body)).To(Succeed())
+
+		return body
+	}
+
+	BeforeEach(func() {
+		responses = httpauth.NewResponses()
+		responses.LoginURL = "/login"
+
+		handler = &httpauth.BasicAuthHandler{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				responses.Forbidden(w, r, &httpauth.AuthError{Reason: audit.ReasonRevoked, Err: errors.New("revoked")})
+			}),
+			BasicAuthWrapper: &httpauth.BasicAuthWrapper{
+				Cache:               cache.New(time.Minute, time.Minute),
+				Realm:               "test",
+				Logger:              zap.NewNop(),
+				UnauthorizedHandler: http.HandlerFunc(responses.Unauthorized),
+				AuthFunc: func(username, password string, r *http.Request) (string, bool) {
+					return username, username == "test" && password == "valid-pass"
+				},
+			},
+		}
+	})
+
+	It("responds with plain text by default", func() {
+		rec := get("/", "")
+		Expect(rec.Code).To(Equal(http.StatusUnauthorized))
+		Expect(rec.Header().Get("WWW-Authenticate")).To(Equal(`Basic realm="test"`))
+		Expect(rec.Header().Get("Content-Type")).To(HavePrefix("text/plain"))
+		Expect(rec.Body.String()).To(Equal("Unauthorized\n"))
+	})
+
+	It("responds with the reason as JSON when preferred", func() {
+		rec := get("/", "application/json")
+		Expect(rec.Header().Get("Content-Type")).To(Equal("application/json; charset=utf-8"))
+		Expect(decode(rec)).To(Equal(map[string]interface{}{
+			"status":     float64(http.StatusUnauthorized),
+			"error":      "unauthorized",
+			"reason":     audit.ReasonMissingCredentials,
+			"message":    "Authentication is required",
+			"request_id": "abc123",
+		}))
+
+		rec = get("/", "application/json", "test", "invalid-pass")
+		Expect(decode(rec)).To(HaveKeyWithValue("reason", audit.ReasonInvalid))
+	})
+
+	It("responds with a login link when HTML is preferred", func() {
+		rec := get("/", "text/html,application/xhtml+xml,*/*;q=0.8")
+		Expect(rec.Header().Get("Content-Type")).To(Equal("text/html; charset=utf-8"))
+		Expect(rec.Body.String()).To(ContainSubstring(`<a href="/login">Log in</a>`))
+	})
+
+	It("responds with registry errors on a registry route", func() {
+		Expect(responses.AddRoute("/v2/", httpauth.FormatRegistry)).To(Succeed())
+
+		rec := get("/v2/", "")
+		Expect(rec.Code).To(Equal(http.StatusUnauthorized))
+		Expect(rec.Header().Get("Docker-Distribution-API-Version")).To(Equal("registry/2.0"))
+		Expect(decode(rec)).To(Equal(map[string]interface{}{
+			"errors": []interface{}{map[string]interface{}{
+				"code":    "UNAUTHORIZED",
+				"message": "authentication required",
+				"detail":  map[string]interface{}{"reason": audit.ReasonMissingCredentials},
+			}},
+		}))
+
+		rec = get("/v2/", "", "test", "valid-pass")
+		Expect(rec.Code).To(Equal(http.StatusForbidden))
+		Expect(rec.Body.String()).To(ContainSubstring(`"code":"DENIED"`))
+	})
+
+	It("responds forbidden with the reason", func() {
+		rec := get("/", "application/json", "test", "valid-pass")
+		Expect(rec.Code).To(Equal(http.StatusForbidden))
+		Expect(decode(rec)).To(HaveKeyWithValue("error", "forbidden"))
+		Expect(decode(rec)).To(HaveKeyWithValue("reason", audit.ReasonRevoked))
+	})
+
+	DescribeTable("describes the failure reason",
+		func(reason, message string) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept", "application/json")
+			rec := httptest.NewRecorder()
+			responses.Forbidden(rec, r, &httpauth.AuthError{Reason: reason, Err: httpauth.ErrInvalid})
+
+			Expect(decode(rec)).To(HaveKeyWithValue("message", message))
+		},
+		Entry("expired", audit.ReasonExpired, "The credentials have expired"),
+		Entry("not yet valid", audit.ReasonNotYetValid, "The credentials are not valid yet"),
+		Entry("malformed", audit.ReasonMalformed, "The credentials could not be read"),
+		Entry("timeout", audit.ReasonTimeout, "The credentials could not be checked, try again"),
+		Entry("revoked", audit.ReasonRevoked, "The credentials have been revoked"),
+		Entry("bad signature", audit.ReasonBadSignature, "The credentials are not valid"),
+	)
+
+	It("uses templates loaded from files", func() {
+		dir, err := ioutil.TempDir("", "httpauth-responses")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		filename := filepath.Join(dir, "401.html")
+		Expect(ioutil.WriteFile(filename, []byte(`<a href="{{.LoginURL}}?rd={{.URL}}">{{.Reason}}</a>`), 0600)).To(Succeed())
+		Expect(responses.Load(httpauth.FormatHTML, http.StatusUnauthorized, filename)).To(Succeed())
+
+		rec := get("/app?page=1", "text/html")
+		Expect(rec.Body.String()).To(Equal(`<a href="/login?rd=%2fapp%3fpage%3d1">missing_credentials</a>`))
+	})
+
+	It("rejects unknown formats and statuses", func() {
+		Expect(responses.Parse("xml", http.StatusUnauthorized, "")).To(MatchError(ContainSubstring(`unknown response format "xml"`)))
+		Expect(responses.Parse(httpauth.FormatJSON, http.StatusNotFound, "")).To(MatchError("no response template for status 404"))
+		Expect(responses.AddRoute("/", "xml")).To(HaveOccurred())
+		Expect(responses.Parse(httpauth.FormatJSON, http.StatusUnauthorized, "{{.Status")).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,42 @@
+package httpauth
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type sessionContextKey struct{}
+
+type expiryContextKey struct{}
+
+// session is passed to an AuthProvider function in the request context so that it can report
+// the session expiry back to the Authenticator adapter.
+type session struct {
+	Expires time.Time
+}
+
+// SetSessionExpiry records the time the credentials in the request stop being valid,
+// it should be called by an AuthProvider on successful authentication.
+func SetSessionExpiry(r *http.Request, expires time.Time) {
+	if s, ok := r.Context().Value(sessionContextKey{}).(*session); ok {
+		s.Expires = expires
+	}
+}
+
+// SessionExpiry returns the time the credentials used to authenticate the request
+// expire, if the AuthProvider reported one.
+func SessionExpiry(r *http.Request) (time.Time, bool) {
+	t, ok := r.Context().Value(expiryContextKey{}).(time.Time)
+
+	return t, ok && !t.IsZero()
+}
+
+// withExpiry returns a shallow copy of the request carrying the session expiry for downstream handlers.
+func withExpiry(r *http.Request, expires time.Time) *http.Request {
+	if expires.IsZero() {
+		return r
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), expiryContextKey{}, expires))
+}
@@ -2,18 +2,27 @@ package httpauth
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
+	"github.com/koshatul/auth-proxy/audit"
+	"github.com/koshatul/auth-proxy/logformat"
+	"github.com/koshatul/auth-proxy/tracing"
 	cache "github.com/patrickmn/go-cache"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
+	"golang.org/x/net/http/httpguts"
 )
 
 // AuthProvider is a function that given a username, password and request, authenticates the user.
+//
+// Deprecated: implement Authenticator instead, use `AuthProvider.Authenticator()` to adapt existing functions.
 type AuthProvider func(username string, password string, r *http.Request) (string, bool)
 
 // BasicAuthWrapper needs a comment
@@ -21,64 +30,282 @@ type BasicAuthWrapper struct {
 	Cache               *cache.Cache
 	Realm               string
 	Logger              *zap.Logger
-	AuthFunc            AuthProvider
 	UnauthorizedHandler http.Handler
 	CacheDuration       time.Duration
+
+	// Provider authenticates the credentials supplied with each request.
+	Provider Authenticator
+
+	// AuthFunc is used when Provider is nil.
+	//
+	// Deprecated: use Provider.
+	AuthFunc AuthProvider
+
+	// TokenQueryParam is the query parameter checked for a token on upgrade (eg. WebSocket)
+	// requests that have no Authorization header, an empty value disables the check.
+	TokenQueryParam string
+
+	// TokenProtocolPrefix is the prefix of a Sec-WebSocket-Protocol value that carries
+	// a token (eg. "bearer." for "bearer.<token>"), an empty value disables the check.
+	TokenProtocolPrefix string
+
+	// Audit receives an event for every authentication attempt, including cached results.
+	Audit *audit.Logger
 }
 
-// Require authentication, and serve our error handler otherwise.
-func (b *BasicAuthWrapper) requestAuth(w http.ResponseWriter, r *http.Request) {
+// Require authentication, and serve our error handler otherwise. The reason authentication
+// failed is available to the handler from FailureFromRequest.
+func (b *BasicAuthWrapper) requestAuth(w http.ResponseWriter, r *http.Request, err error) {
 	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q`, b.Realm))
-	b.UnauthorizedHandler.ServeHTTP(w, r)
+	b.UnauthorizedHandler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), failureContextKey{}, err)))
+}
+
+type failureContextKey struct{}
+
+// FailureFromRequest returns the error that caused the request to be refused, for use by an
+// UnauthorizedHandler, or nil.
+func FailureFromRequest(r *http.Request) error {
+	err, _ := r.Context().Value(failureContextKey{}).(error)
+
+	return err
+}
+
+// provider returns the Authenticator to use, or nil if none is configured.
+func (b *BasicAuthWrapper) provider() Authenticator {
+	if b.Provider != nil {
+		return b.Provider
+	}
+
+	if b.AuthFunc != nil {
+		return b.AuthFunc.Authenticator("")
+	}
+
+	return nil
 }
 
 type cachedResponse struct {
-	Username string
-	Result   bool
+	Identity *Identity
+	Err      error
+
+	// Attempts are the results of each provider tried, reported with RecordAttempt.
+	Attempts []Attempt
 }
 
 // authenticate retrieves and then validates the user:password combination provided in
-// the request header. Returns 'false' if the user has not successfully authenticated.
-func (b *BasicAuthWrapper) authenticate(r *http.Request) (string, bool) {
+// the request header. Returns the reason the user has not successfully authenticated as an error.
+func (b *BasicAuthWrapper) authenticate(r *http.Request) (*Identity, error) {
 	if r == nil {
-		return "", false
+		return nil, ErrMissingCredentials
 	}
 
-	// If AuthFunc is missing, fail logins
-	if b.AuthFunc == nil {
-		return "", false
+	// If Provider is missing, fail logins
+	provider := b.provider()
+	if provider == nil {
+		return nil, &AuthError{Err: ErrInvalid}
+	}
+
+	cacheKey, givenUser, givenPass, err := b.getCredentials(r)
+	if err != nil {
+		if r.Header.Get("Authorization") == "" {
+			return nil, ErrMissingCredentials
+		}
+
+		b.Audit.Record(r, audit.Event{
+			Provider: "basic",
+			Outcome:  audit.OutcomeFailure,
+			Reason:   audit.ReasonMalformed,
+		})
+
+		return nil, &AuthError{Provider: "basic", Reason: audit.ReasonMalformed, Err: err}
 	}
 
-	if v, ok := b.Cache.Get(r.Header.Get("Authorization")); ok {
+	fields := logformat.FieldsFromRequest(r)
+
+	ctx, span := tracing.Tracer().Start(r.Context(), "httpauth.authenticate")
+	defer span.End()
+
+	_, cacheSpan := tracing.Tracer().Start(ctx, "httpauth.cache")
+	v, cached := b.Cache.Get(cacheKey)
+	cacheSpan.SetAttributes(attribute.Bool("cache.hit", cached))
+	cacheSpan.End()
+
+	var resp cachedResponse
+
+	if cached {
 		// ACL Record cached
-		resp := v.(cachedResponse)
-		if resp.Result {
-			r.URL.User = url.User(resp.Username)
+		resp = v.(cachedResponse)
+		fields.SetCacheHit(true)
+
+		if resp.Identity != nil && !resp.Identity.Expires.IsZero() && time.Now().After(resp.Identity.Expires) {
+			resp = cachedResponse{Err: &AuthError{
+				Provider: resp.Identity.Provider,
+				Reason:   audit.ReasonExpired,
+				TokenID:  resp.Identity.TokenID,
+				Err:      ErrExpired,
+			}}
+		}
+	} else {
+		tried := &attempts{}
+		id, err := provider.Authenticate(
+			withAttempts(withRequest(ctx, r), tried),
+			Credentials{Username: givenUser, Password: givenPass},
+		)
+		resp = cachedResponse{Identity: id, Err: err, Attempts: tried.results}
+
+		if err == nil && id == nil {
+			resp.Err = &AuthError{Err: ErrInvalid}
 		}
 
-		return resp.Username, resp.Result
+		// Don't remember failures caused by the verifier being too busy or the client going away.
+		if !errors.Is(resp.Err, context.DeadlineExceeded) && !errors.Is(resp.Err, context.Canceled) {
+			b.Cache.Set(cacheKey, resp, b.CacheDuration)
+		}
+	}
+
+	b.record(r, resp, cached)
+
+	span.SetAttributes(
+		attribute.Bool("auth.cached", cached),
+		attribute.Bool("auth.result", resp.Err == nil),
+	)
+
+	if resp.Err != nil {
+		var authErr *AuthError
+		if errors.As(resp.Err, &authErr) {
+			fields.SetAuthProvider(authErr.Provider)
+			span.SetAttributes(attribute.String("auth.provider", authErr.Provider))
+		}
+
+		span.SetAttributes(attribute.String("auth.reason", FailureReason(resp.Err)))
+
+		return nil, resp.Err
+	}
+
+	fields.SetAuthProvider(resp.Identity.Provider)
+	fields.SetClaims(resp.Identity.Claims)
+	span.SetAttributes(attribute.String("auth.provider", resp.Identity.Provider))
+
+	r.URL.User = url.User(resp.Identity.Subject)
+
+	return resp.Identity, nil
+}
+
+// record writes an audit event for each provider that recognised the credentials, or for the
+// authentication result if none did (or the provider doesn't report its attempts).
+func (b *BasicAuthWrapper) record(r *http.Request, resp cachedResponse, cached bool) {
+	recorded := false
+
+	for _, a := range resp.Attempts {
+		if errors.Is(a.Err, ErrNoCredentials) {
+			continue
+		}
+
+		b.recordAttempt(r, a, cached)
+		recorded = true
+	}
+
+	if !recorded {
+		b.recordAttempt(r, Attempt{Identity: resp.Identity, Err: resp.Err}, cached)
+	}
+}
+
+// recordAttempt writes the audit event for the result of a single provider.
+func (b *BasicAuthWrapper) recordAttempt(r *http.Request, a Attempt, cached bool) {
+	if a.Err == nil {
+		b.Audit.Record(r, audit.Event{
+			Provider: a.Identity.Provider,
+			Outcome:  audit.OutcomeSuccess,
+			Subject:  a.Identity.Subject,
+			TokenID:  a.Identity.TokenID,
+			Cached:   cached,
+		})
+
+		return
+	}
+
+	e := audit.Event{
+		Outcome: audit.OutcomeFailure,
+		Reason:  FailureReason(a.Err),
+		Cached:  cached,
+	}
+
+	var authErr *AuthError
+	if errors.As(a.Err, &authErr) {
+		e.Provider = authErr.Provider
+		e.Subject = authErr.Subject
+		e.TokenID = authErr.TokenID
+	}
+
+	b.Audit.Record(r, e)
+}
+
+// getCredentials returns the cache key, username and password from the request, tokens supplied
+// outside of the Authorization header on upgrade requests are returned as the username.
+func (b *BasicAuthWrapper) getCredentials(r *http.Request) (string, string, string, error) {
+	if r.Header.Get("Authorization") == "" && IsUpgradeRequest(r) {
+		if token := b.getUpgradeToken(r); token != "" {
+			return "Token " + token, token, "", nil
+		}
 	}
 
 	givenUser, givenPass, err := GetBasicAuthFromRequest(r)
-	if err != nil {
-		return "", false
+
+	return r.Header.Get("Authorization"), givenUser, givenPass, err
+}
+
+// getUpgradeToken returns the token from the query parameter or Sec-WebSocket-Protocol
+// header, whichever is enabled and present.
+func (b *BasicAuthWrapper) getUpgradeToken(r *http.Request) string {
+	if b.TokenQueryParam != "" {
+		if token := r.URL.Query().Get(b.TokenQueryParam); token != "" {
+			return token
+		}
 	}
 
-	authUser, authResult := b.AuthFunc(givenUser, givenPass, r)
-	b.Cache.Set(
-		r.Header.Get("Authorization"),
-		cachedResponse{
-			Username: authUser,
-			Result:   authResult,
-		},
-		b.CacheDuration,
-	)
+	if b.TokenProtocolPrefix != "" {
+		for _, protocol := range headerValues(r.Header, "Sec-WebSocket-Protocol") {
+			if strings.HasPrefix(protocol, b.TokenProtocolPrefix) {
+				return strings.TrimPrefix(protocol, b.TokenProtocolPrefix)
+			}
+		}
+	}
+
+	return ""
+}
 
-	if authResult {
-		r.URL.User = url.User(authUser)
+// removeUpgradeToken strips any token supplied outside of the Authorization header from the request.
+func (b *BasicAuthWrapper) removeUpgradeToken(r *http.Request) {
+	if b.TokenQueryParam != "" {
+		if query, ok := removeQueryParam(r.URL.RawQuery, b.TokenQueryParam); ok {
+			r.URL.RawQuery = query
+
+			if i := strings.IndexByte(r.RequestURI, '?'); i >= 0 {
+				r.RequestURI = r.RequestURI[:i]
+			}
+
+			if query != "" {
+				r.RequestURI += "?" + query
+			}
+		}
 	}
 
-	return authUser, authResult
+	if b.TokenProtocolPrefix != "" {
+		if protocols := headerValues(r.Header, "Sec-WebSocket-Protocol"); len(protocols) > 0 {
+			kept := make([]string, 0, len(protocols))
+
+			for _, protocol := range protocols {
+				if !strings.HasPrefix(protocol, b.TokenProtocolPrefix) {
+					kept = append(kept, protocol)
+				}
+			}
+
+			r.Header.Del("Sec-WebSocket-Protocol")
+
+			if len(kept) > 0 {
+				r.Header.Set("Sec-WebSocket-Protocol", strings.Join(kept, ", "))
+			}
+		}
+	}
 }
 
 // defaultUnauthorizedHandler provides a default HTTP 401 Unauthorized response.
@@ -86,6 +313,26 @@ func defaultUnauthorizedHandler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 }
 
+// IsUpgradeRequest returns true if the request is asking to switch protocols (eg. WebSocket).
+func IsUpgradeRequest(r *http.Request) bool {
+	return httpguts.HeaderValuesContainsToken(r.Header["Connection"], "Upgrade") && r.Header.Get("Upgrade") != ""
+}
+
+// headerValues returns the comma separated values of all headers matching key.
+func headerValues(h http.Header, key string) []string {
+	values := []string{}
+
+	for _, line := range h[http.CanonicalHeaderKey(key)] {
+		for _, v := range strings.Split(line, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+
+	return values
+}
+
 // GetBasicAuthFromRequest returns basic auth username and password given a `*http.Request`
 func GetBasicAuthFromRequest(r *http.Request) (string, string, error) {
 	const basicScheme string = "Basic "
@@ -118,3 +365,30 @@ func GetBasicAuthFromRequest(r *http.Request) (string, string, error) {
 
 	return string(creds[0]), string(creds[1]), nil
 }
+
+// removeQueryParam removes the pairs for key from a raw query string, the rest of the query is
+// left as it was sent (in order and with its original encoding) so signed URLs still match. It
+// returns false if there was nothing to remove.
+func removeQueryParam(rawQuery, key string) (string, bool) {
+	pairs := strings.Split(rawQuery, "&")
+	kept := make([]string, 0, len(pairs))
+
+	for _, pair := range pairs {
+		name := pair
+		if i := strings.IndexByte(pair, '='); i >= 0 {
+			name = pair[:i]
+		}
+
+		if unescaped, err := url.QueryUnescape(name); err == nil && unescaped == key {
+			continue
+		}
+
+		kept = append(kept, pair)
+	}
+
+	if len(kept) == len(pairs) {
+		return rawQuery, false
+	}
+
+	return strings.Join(kept, "&"), true
+}
@@ -0,0 +1,35 @@
+package httpmatch
+
+import (
+	"path"
+	"strings"
+)
+
+// CleanPath returns the path with "." and ".." elements resolved, keeping a trailing slash.
+func CleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+
+	if p[0] != '/' {
+		p = "/" + p
+	}
+
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+
+	return cleaned
+}
+
+// ContainsFold returns true if values contains s, ignoring case.
+func ContainsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+
+	return false
+}
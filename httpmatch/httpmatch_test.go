@@ -0,0 +1,28 @@
+package httpmatch_test
+
+import (
+	"github.com/koshatul/auth-proxy/httpmatch"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("httpmatch", func() {
+	DescribeTable("cleans paths",
+		func(p, expected string) {
+			Expect(httpmatch.CleanPath(p)).To(Equal(expected))
+		},
+		Entry("empty", "", "/"),
+		Entry("relative", "a/b", "/a/b"),
+		Entry("trailing slash", "/a/b/", "/a/b/"),
+		Entry("traversal", "/public/../admin", "/admin"),
+		Entry("traversal past the root", "/../../admin/", "/admin/"),
+		Entry("dot and double slash", "/a/./b//c", "/a/b/c"),
+	)
+
+	It("finds values ignoring case", func() {
+		Expect(httpmatch.ContainsFold([]string{"GET", "post"}, "POST")).To(BeTrue())
+		Expect(httpmatch.ContainsFold([]string{"GET"}, "PUT")).To(BeFalse())
+		Expect(httpmatch.ContainsFold(nil, "GET")).To(BeFalse())
+	})
+})
@@ -0,0 +1,3 @@
+// Package httpmatch has the helpers shared by the configured rules matched against requests
+// (public paths and CORS policies).
+package httpmatch
@@ -0,0 +1,118 @@
+package jwtauth
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/koshatul/auth-proxy/audit"
+	"github.com/koshatul/jwt/v2"
+	pjwt "github.com/pascaldekloe/jwt"
+)
+
+// Status of a check made when inspecting a token.
+const (
+	CheckPassed  = "pass"
+	CheckFailed  = "fail"
+	CheckSkipped = "skipped"
+)
+
+// Check is the outcome of one of the checks a token must pass.
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Inspection describes a token and the checks it passed or failed, the token details are taken
+// from the token without verification so they are available even when a check fails.
+type Inspection struct {
+	Valid     bool                   `json:"valid"`
+	Reason    string                 `json:"reason,omitempty"`
+	Checks    []Check                `json:"checks"`
+	Subject   string                 `json:"subject,omitempty"`
+	TokenID   string                 `json:"token_id,omitempty"`
+	Issuer    string                 `json:"issuer,omitempty"`
+	Audiences []string               `json:"audiences,omitempty"`
+	Online    bool                   `json:"online"`
+	IssuedAt  *time.Time             `json:"issued_at,omitempty"`
+	NotBefore *time.Time             `json:"not_before,omitempty"`
+	Expires   *time.Time             `json:"expires,omitempty"`
+	Claims    map[string]interface{} `json:"claims,omitempty"`
+}
+
+// inspectChecks are the checks in the order they are made, with the failure reason that stops at each.
+// nolint: gochecknoglobals // fixed list of checks
+var inspectChecks = []struct {
+	name    string
+	reasons []string
+}{
+	{"format", []string{audit.ReasonMalformed}},
+	{"signature", []string{audit.ReasonBadSignature}},
+	{"audience", []string{audit.ReasonInvalidAudience}},
+	{"validity", []string{audit.ReasonExpired, audit.ReasonNotYetValid}},
+	{"subject", []string{audit.ReasonMissingSubject}},
+	{"online", []string{audit.ReasonOnlineToken}},
+}
+
+// Inspect verifies the token the same way the proxy does and reports which check failed.
+func Inspect(verifier jwt.Verifier, token []byte) *Inspection {
+	_, err := verify(verifier, token)
+	reason := FailureReason(token, err)
+
+	i := &Inspection{
+		Valid:  err == nil,
+		Reason: reason,
+		Checks: make([]Check, 0, len(inspectChecks)),
+	}
+
+	status := CheckPassed
+
+	for _, check := range inspectChecks {
+		c := Check{Name: check.name, Status: status}
+
+		if status == CheckPassed && containsString(check.reasons, reason) {
+			c.Status = CheckFailed
+			c.Error = err.Error()
+			status = CheckSkipped
+		}
+
+		i.Checks = append(i.Checks, c)
+	}
+
+	if claims, perr := pjwt.ParseWithoutCheck(token); perr == nil {
+		i.Subject = claims.Subject
+		i.TokenID = claims.ID
+		i.Issuer = claims.Issuer
+		i.Audiences = claims.Audiences
+		i.Online, _ = claims.Set["onl"].(bool)
+		i.IssuedAt = numericTime(claims.Issued)
+		i.NotBefore = numericTime(claims.NotBefore)
+		i.Expires = numericTime(claims.Expires)
+
+		if json.Unmarshal(claims.Raw, &i.Claims) != nil {
+			i.Claims = claims.Set
+		}
+	}
+
+	return i
+}
+
+func numericTime(n *pjwt.NumericTime) *time.Time {
+	if n == nil {
+		return nil
+	}
+
+	t := n.Time()
+
+	return &t
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,126 @@
+package jwtauth_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"time"
+
+	"github.com/koshatul/auth-proxy/audit"
+	"github.com/koshatul/auth-proxy/jwtauth"
+	"github.com/koshatul/jwt/v2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Inspect", func() {
+
+	var (
+		signingKey *rsa.PrivateKey
+		otherKey   *rsa.PrivateKey
+		verifier   jwt.Verifier
+	)
+
+	sign := func(key *rsa.PrivateKey, claims ...jwt.Claim) []byte {
+		signer := &jwt.RSASigner{PrivateKey: key, Algorithm: jwt.RS256}
+		token, err := signer.SignClaims(claims...)
+		Expect(err).NotTo(HaveOccurred())
+
+		return token
+	}
+
+	claims := func(audience, subject string, nbf, exp time.Duration, extra ...jwt.Claim) []jwt.Claim {
+		return append([]jwt.Claim{
+			jwt.String(jwt.Subject, subject),
+			jwt.String(jwt.Audience, audience),
+			jwt.String(jwt.ID, "token-1234"),
+			jwt.Time(jwt.NotBefore, time.Now().Add(nbf)),
+			jwt.Time(jwt.Expires, time.Now().Add(exp)),
+		}, extra...)
+	}
+
+	statuses := func(i *jwtauth.Inspection) []string {
+		s := []string{}
+		for _, c := range i.Checks {
+			s = append(s, c.Name+"="+c.Status)
+		}
+
+		return s
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		if signingKey == nil {
+			signingKey, err = rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).NotTo(HaveOccurred())
+			otherKey, err = rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		verifier = &jwt.RSAVerifier{PublicKey: &signingKey.PublicKey, Audience: testAudience}
+	})
+
+	It("should pass every check for a valid token", func() {
+		i := jwtauth.Inspect(verifier, sign(signingKey, claims(testAudience, "test-user", -time.Minute, time.Hour)...))
+		Expect(i.Valid).To(BeTrue())
+		Expect(i.Reason).To(BeEmpty())
+		Expect(statuses(i)).To(Equal([]string{
+			"format=pass", "signature=pass", "audience=pass", "validity=pass", "subject=pass", "online=pass",
+		}))
+		Expect(i.Subject).To(Equal("test-user"))
+		Expect(i.TokenID).To(Equal("token-1234"))
+		Expect(i.Audiences).To(ConsistOf(testAudience))
+		Expect(*i.Expires).To(BeTemporally("~", time.Now().Add(time.Hour), time.Second))
+		Expect(i.Claims).To(HaveKeyWithValue("sub", "test-user"))
+	})
+
+	DescribeTable("should report the failed check",
+		func(buildToken func() []byte, reason string, failed string) {
+			i := jwtauth.Inspect(verifier, buildToken())
+			Expect(i.Valid).To(BeFalse())
+			Expect(i.Reason).To(Equal(reason))
+
+			passed := true
+			for _, c := range i.Checks {
+				switch {
+				case c.Name == failed:
+					Expect(c.Status).To(Equal(jwtauth.CheckFailed))
+					Expect(c.Error).NotTo(BeEmpty())
+					passed = false
+				case passed:
+					Expect(c.Status).To(Equal(jwtauth.CheckPassed), c.Name)
+				default:
+					Expect(c.Status).To(Equal(jwtauth.CheckSkipped), c.Name)
+				}
+			}
+		},
+		Entry("malformed", func() []byte { return []byte("not-a-token") }, audit.ReasonMalformed, "format"),
+		Entry("signed by another key", func() []byte {
+			return sign(otherKey, claims(testAudience, "test-user", -time.Minute, time.Hour)...)
+		}, audit.ReasonBadSignature, "signature"),
+		Entry("wrong audience", func() []byte {
+			return sign(signingKey, claims("other", "test-user", -time.Minute, time.Hour)...)
+		}, audit.ReasonInvalidAudience, "audience"),
+		Entry("expired", func() []byte {
+			return sign(signingKey, claims(testAudience, "test-user", -time.Hour, -time.Minute)...)
+		}, audit.ReasonExpired, "validity"),
+		Entry("not yet valid", func() []byte {
+			return sign(signingKey, claims(testAudience, "test-user", time.Hour, 2*time.Hour)...)
+		}, audit.ReasonNotYetValid, "validity"),
+		Entry("no subject", func() []byte {
+			return sign(signingKey, claims(testAudience, "", -time.Minute, time.Hour)...)
+		}, audit.ReasonMissingSubject, "subject"),
+		Entry("online", func() []byte {
+			return sign(signingKey, claims(testAudience, "test-user", -time.Minute, time.Hour, jwt.Bool("onl", true))...)
+		}, audit.ReasonOnlineToken, "online"),
+	)
+
+	It("should show the unverified details of a rejected token", func() {
+		i := jwtauth.Inspect(verifier, sign(otherKey, claims(testAudience, "test-user", -time.Hour, -time.Minute)...))
+		Expect(i.Subject).To(Equal("test-user"))
+		Expect(i.TokenID).To(Equal("token-1234"))
+		Expect(*i.Expires).To(BeTemporally("<", time.Now()))
+	})
+
+})
@@ -0,0 +1,208 @@
+package jwtauth_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/koshatul/auth-proxy/audit"
+	"github.com/koshatul/auth-proxy/httpauth"
+	"github.com/koshatul/auth-proxy/jwtauth"
+	"github.com/koshatul/jwt/v2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	cache "github.com/patrickmn/go-cache"
+	"go.uber.org/goleak"
+	"go.uber.org/zap"
+)
+
+// verifierFunc adapts a function to the jwt.Verifier interface.
+type verifierFunc func(token []byte) (jwt.VerifyResult, error)
+
+func (f verifierFunc) Verify(token []byte) (jwt.VerifyResult, error) {
+	return f(token)
+}
+
+var _ = Describe("worker pool", func() {
+
+	var (
+		ignore    goleak.Option
+		authChan  chan *jwtauth.AuthRequest
+		cancel    context.CancelFunc
+		done      chan struct{}
+		verifyFn  func(token []byte) (jwt.VerifyResult, error)
+		callCount int32
+	)
+
+	startRunner := func(workers int) {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		done = make(chan struct{})
+
+		go func() {
+			defer close(done)
+
+			jwtauth.AuthRunner(ctx, zap.NewNop(), verifierFunc(func(token []byte) (jwt.VerifyResult, error) {
+				atomic.AddInt32(&callCount, 1)
+
+				return verifyFn(token)
+			}), authChan, workers)
+		}()
+	}
+
+	stopRunner := func() {
+		cancel()
+		Eventually(done).Should(BeClosed())
+	}
+
+	credentials := func(username, password string) httpauth.Credentials {
+		return httpauth.Credentials{Username: username, Password: password}
+	}
+
+	BeforeEach(func() {
+		ignore = goleak.IgnoreCurrent()
+		authChan = make(chan *jwtauth.AuthRequest, 10)
+		atomic.StoreInt32(&callCount, 0)
+		verifyFn = func(token []byte) (jwt.VerifyResult, error) {
+			if string(token) == "good" {
+				return jwt.VerifyResult{Subject: "test-user"}, nil
+			}
+
+			return jwt.VerifyResult{}, jwt.ErrTokenInvalidAudience
+		}
+	})
+
+	It("should not verify more tokens at once than there are workers", func() {
+		var inFlight, maxInFlight int32
+
+		gate := make(chan struct{})
+		verifyFn = func(token []byte) (jwt.VerifyResult, error) {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+
+			for {
+				m := atomic.LoadInt32(&maxInFlight)
+				if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+					break
+				}
+			}
+
+			<-gate
+
+			return jwt.VerifyResult{Subject: "test-user"}, nil
+		}
+
+		startRunner(2)
+
+		provider := jwtauth.NewProvider(zap.NewNop(), authChan, time.Minute)
+
+		var wg sync.WaitGroup
+
+		for i := 0; i < 6; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				_, err := provider.Authenticate(context.Background(), credentials("good", "good"))
+				Expect(err).NotTo(HaveOccurred())
+			}()
+		}
+
+		Eventually(func() int32 { return atomic.LoadInt32(&inFlight) }).Should(Equal(int32(2)))
+		Consistently(func() int32 { return atomic.LoadInt32(&maxInFlight) }, 100*time.Millisecond).Should(Equal(int32(2)))
+
+		close(gate)
+		wg.Wait()
+
+		stopRunner()
+		Expect(goleak.Find(ignore)).To(Succeed())
+	})
+
+	It("should not leak the password verification when the username is a valid token", func() {
+		startRunner(1)
+
+		provider := jwtauth.NewProvider(zap.NewNop(), authChan, time.Minute)
+
+		for i := 0; i < 5; i++ {
+			id, err := provider.Authenticate(context.Background(), credentials("good", "not-a-token"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id.Subject).To(Equal("test-user"))
+		}
+
+		stopRunner()
+		Expect(goleak.Find(ignore)).To(Succeed())
+	})
+
+	It("should fail with a timeout instead of blocking when the runner has stopped", func() {
+		startRunner(1)
+		stopRunner()
+
+		provider := jwtauth.NewProvider(zap.NewNop(), authChan, 50*time.Millisecond)
+
+		start := time.Now()
+		_, err := provider.Authenticate(context.Background(), credentials("good", "good"))
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+		Expect(httpauth.FailureReason(err)).To(Equal(audit.ReasonTimeout))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+
+		Expect(goleak.Find(ignore)).To(Succeed())
+	})
+
+	It("should not verify tokens for a request that has been canceled", func() {
+		startRunner(1)
+
+		ctx, cancelRequest := context.WithCancel(context.Background())
+		cancelRequest()
+
+		provider := jwtauth.NewProvider(zap.NewNop(), authChan, time.Minute)
+
+		_, err := provider.Authenticate(ctx, credentials("good", "good"))
+		Expect(err).To(MatchError(context.Canceled))
+		Expect(httpauth.FailureReason(err)).To(Equal(audit.ReasonCanceled))
+		Expect(atomic.LoadInt32(&callCount)).To(BeZero())
+
+		stopRunner()
+		Expect(goleak.Find(ignore)).To(Succeed())
+	})
+
+	It("should not cache failures caused by a timeout", func() {
+		startRunner(1)
+		stopRunner()
+
+		ts := httptest.NewServer(&httpauth.BasicAuthHandler{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+			BasicAuthWrapper: &httpauth.BasicAuthWrapper{
+				Cache:         cache.New(time.Minute, time.Minute),
+				Provider:      jwtauth.NewProvider(zap.NewNop(), authChan, 50*time.Millisecond),
+				Logger:        zap.NewNop(),
+				CacheDuration: time.Minute,
+			},
+		})
+		defer ts.Close()
+
+		get := func() int {
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.SetBasicAuth("good", "")
+
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+
+			return res.StatusCode
+		}
+
+		Expect(get()).To(Equal(http.StatusUnauthorized))
+
+		startRunner(1)
+		defer stopRunner()
+
+		Expect(get()).To(Equal(http.StatusOK))
+	})
+
+})
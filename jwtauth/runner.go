@@ -3,16 +3,39 @@ package jwtauth
 import (
 	"context"
 	"errors"
-	"net/http"
+	"fmt"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/koshatul/auth-proxy/audit"
 	"github.com/koshatul/auth-proxy/httpauth"
+	"github.com/koshatul/auth-proxy/requestid"
+	"github.com/koshatul/auth-proxy/tracing"
 	"github.com/koshatul/jwt/v2"
+	pjwt "github.com/pascaldekloe/jwt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+// ErrMissingSubject is returned when a valid token has no subject (username).
+var ErrMissingSubject = errors.New("username is empty")
+
+// ErrOnlineToken is returned for online tokens, which can't be validated by the proxy.
+var ErrOnlineToken = errors.New("online tokens can not be validated")
+
+// DefaultVerifyTimeout is how long AuthCheckFunc waits for a token to be verified when no timeout is supplied.
+const DefaultVerifyTimeout = 5 * time.Second
+
 // AuthRequest is the authentication request and a return channel for the response.
+//
+// Context carries the request ID and trace span of the HTTP request being authenticated, the token is not
+// verified if it is done before a worker picks up the request. ReturnChannel should be buffered (with room
+// for one response) so the worker never blocks on a caller that has given up waiting.
 type AuthRequest struct {
+	Context       context.Context
 	Token         []byte
 	ReturnChannel chan *AuthResponse
 }
@@ -23,12 +46,34 @@ type AuthResponse struct {
 	Error  error
 }
 
-// AuthRunner is the routine that runs the authentication checking channels
-func AuthRunner(ctx context.Context, logger *zap.Logger, verifier jwt.Verifier, authChan chan *AuthRequest) {
+// AuthRunner verifies the tokens sent on authChan using a fixed number of worker goroutines, it returns
+// once ctx is done and all the workers have exited.
+func AuthRunner(ctx context.Context, logger *zap.Logger, verifier jwt.Verifier, authChan chan *AuthRequest, workers int) {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	var wg sync.WaitGroup
+
+	wg.Add(workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+
+			authWorker(ctx, logger, verifier, authChan)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// authWorker verifies tokens from authChan one at a time until ctx is done.
+func authWorker(ctx context.Context, logger *zap.Logger, verifier jwt.Verifier, authChan chan *AuthRequest) {
 	for {
 		select {
 		case request := <-authChan:
-			go doAuthRunner(logger, verifier, request)
+			doAuthRunner(logger, verifier, request)
 		case <-ctx.Done():
 			return
 		}
@@ -37,87 +82,314 @@ func AuthRunner(ctx context.Context, logger *zap.Logger, verifier jwt.Verifier,
 
 // doAuthRunner is the actual authentication check process (separated so it can be tested and defers will work)
 func doAuthRunner(logger *zap.Logger, verifier jwt.Verifier, request *AuthRequest) {
-	result, err := verifier.Verify(request.Token)
+	ctx := request.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	logger = logger.With(requestid.Field(ctx))
+
+	if err := ctx.Err(); err != nil {
+		logger.Debug("Skipping Token Verification", zap.Error(err))
+		reply(ctx, request, &AuthResponse{Error: err})
+
+		return
+	}
+
+	_, span := tracing.Tracer().Start(ctx, "jwtauth.verify")
+	result, err := verify(verifier, request.Token)
+
 	if err != nil {
+		span.RecordError(err)
 		logger.Debug("Error Verifying Token", zap.Error(err))
-		request.ReturnChannel <- &AuthResponse{
-			Error: err,
-		}
+	}
 
-		return
+	span.End()
+
+	reply(ctx, request, &AuthResponse{Result: result, Error: err})
+}
+
+// verify checks the token with the verifier and then applies the proxy's own subject and online
+// checks, the result is returned with ErrOnlineToken so the caller can still see the subject.
+func verify(verifier jwt.Verifier, token []byte) (jwt.VerifyResult, error) {
+	result, err := verifier.Verify(token)
+
+	switch {
+	case err != nil:
+		return jwt.VerifyResult{}, err
+	case strings.EqualFold(result.Subject, ""):
+		return jwt.VerifyResult{}, ErrMissingSubject
+	case result.IsOnline:
+		return result, ErrOnlineToken
 	}
 
-	if strings.EqualFold(result.Subject, "") {
-		logger.Debug("Verifying Token", zap.Error(errors.New("username is empty")))
-		request.ReturnChannel <- &AuthResponse{
-			Error: err,
-		}
+	return result, nil
+}
 
-		return
+// reply sends the response to the caller, giving up if the caller's context is done so an
+// abandoned unbuffered ReturnChannel can't block the worker.
+func reply(ctx context.Context, request *AuthRequest, response *AuthResponse) {
+	select {
+	case request.ReturnChannel <- response:
+	case <-ctx.Done():
 	}
+}
 
-	if result.IsOnline {
-		request.ReturnChannel <- &AuthResponse{
-			Result: result,
-			Error:  errors.New("online tokens can not be validated"),
-		}
+// Provider is a httpauth.Authenticator that verifies the username and password as tokens using
+// the AuthRunner worker pool, the token with a subject is accepted.
+type Provider struct {
+	logger   *zap.Logger
+	authChan chan *AuthRequest
+	timeout  time.Duration
+}
 
-		return
+// NewProvider returns a Provider that sends tokens to authChan and waits at most timeout
+// (DefaultVerifyTimeout if zero) for them to be verified, if the AuthRunner has stopped or is too
+// busy the authentication fails rather than blocking the request forever.
+func NewProvider(logger *zap.Logger, authChan chan *AuthRequest, timeout time.Duration) *Provider {
+	if timeout <= 0 {
+		timeout = DefaultVerifyTimeout
+	}
+
+	return &Provider{
+		logger:   logger,
+		authChan: authChan,
+		timeout:  timeout,
+	}
+}
+
+// Authenticate satisfies the httpauth.Authenticator interface for Provider.
+func (p *Provider) Authenticate(ctx context.Context, creds httpauth.Credentials) (*httpauth.Identity, error) {
+	logger := p.logger.With(requestid.Field(ctx))
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	ctx, span := tracing.Tracer().Start(ctx, "jwtauth.authenticate")
+	defer span.End()
+
+	// Each channel round-trip gets a span covering the time queued and verifying.
+	userCtx, userSpan := tracing.Tracer().Start(ctx, "jwtauth.runner", trace.WithAttributes(attribute.String("token", "username")))
+	defer userSpan.End()
+
+	passCtx, passSpan := tracing.Tracer().Start(ctx, "jwtauth.runner", trace.WithAttributes(attribute.String("token", "password")))
+	defer passSpan.End()
+
+	recUserCh := submit(userCtx, p.authChan, []byte(creds.Username))
+	recPassCh := submit(passCtx, p.authChan, []byte(creds.Password))
+
+	// Test username for token
+	userResponse := receive(ctx, recUserCh)
+	userSpan.End()
+
+	if userResponse.Error == nil && !strings.EqualFold(userResponse.Result.Subject, "") {
+		span.SetAttributes(attribute.Bool("auth.result", true))
+
+		return authSuccess(logger, userResponse), nil
 	}
 
-	request.ReturnChannel <- &AuthResponse{
-		Result: result,
-		Error:  nil,
+	// Test password for token
+	passResponse := receive(ctx, recPassCh)
+	passSpan.End()
+
+	if passResponse.Error == nil && !strings.EqualFold(passResponse.Result.Subject, "") {
+		span.SetAttributes(attribute.Bool("auth.result", true))
+
+		return authSuccess(logger, passResponse), nil
 	}
+
+	err := authFailure(logger, []byte(creds.Username), userResponse, []byte(creds.Password), passResponse)
+	span.SetAttributes(attribute.Bool("auth.result", false), attribute.String("auth.reason", err.Reason))
+
+	return nil, err
 }
 
 // AuthCheckFunc returns a authentication check function for use with `httpauth.BasicAuth()``
-func AuthCheckFunc(logger *zap.Logger, authChan chan *AuthRequest) httpauth.AuthProvider {
-	return func(username, password string, r *http.Request) (string, bool) {
-		recUserCh := make(chan *AuthResponse)
-		recPassCh := make(chan *AuthResponse)
-		authChan <- &AuthRequest{
-			Token:         []byte(username),
-			ReturnChannel: recUserCh,
+//
+// Deprecated: use NewProvider.
+func AuthCheckFunc(logger *zap.Logger, authChan chan *AuthRequest, timeout time.Duration) httpauth.AuthProvider {
+	return httpauth.ProviderFunc(NewProvider(logger, authChan, timeout))
+}
+
+// submit queues the token for verification and returns the channel the response will be sent on, if ctx
+// is done before the request is queued the error is sent on the returned channel instead.
+func submit(ctx context.Context, authChan chan *AuthRequest, token []byte) chan *AuthResponse {
+	ch := make(chan *AuthResponse, 1)
+
+	select {
+	case authChan <- &AuthRequest{Context: ctx, Token: token, ReturnChannel: ch}:
+	case <-ctx.Done():
+		ch <- &AuthResponse{Error: ctx.Err()}
+	}
+
+	return ch
+}
+
+// receive waits for the response to a submitted token, or returns the context error once ctx is done.
+func receive(ctx context.Context, ch chan *AuthResponse) *AuthResponse {
+	select {
+	case response := <-ch:
+		return response
+	case <-ctx.Done():
+		return &AuthResponse{Error: ctx.Err()}
+	}
+}
+
+// authSuccess logs the successful authentication and returns the identity.
+func authSuccess(logger *zap.Logger, response *AuthResponse) *httpauth.Identity {
+	logger.Debug("Auth Success",
+		zap.String("username", response.Result.Subject),
+		zap.Bool("online", response.Result.IsOnline),
+		zap.String("uuid", response.Result.ID),
+	)
+
+	return &httpauth.Identity{
+		Subject:  response.Result.Subject,
+		Provider: "jwt",
+		Expires:  response.Result.Expires,
+		TokenID:  response.Result.ID,
+		Claims:   claimValues(response.Result.Claims),
+		Groups:   claimStrings(response.Result.Claims["groups"]),
+	}
+}
+
+// authFailure logs the failed authentication and returns the error, the reason is taken from whichever
+// of the username or password looked like a token (the password if both or neither did).
+func authFailure(
+	logger *zap.Logger,
+	userToken []byte, userResponse *AuthResponse,
+	passToken []byte, passResponse *AuthResponse,
+) *httpauth.AuthError {
+	userReason := FailureReason(userToken, userResponse.Error)
+	reason := FailureReason(passToken, passResponse.Error)
+	token := passToken
+	err := passResponse.Error
+
+	switch {
+	case reason == audit.ReasonMalformed && userReason == audit.ReasonMalformed:
+		reason = audit.ReasonUnknownUser
+		err = httpauth.ErrNoCredentials
+	case reason == audit.ReasonMalformed:
+		reason = userReason
+		token = userToken
+		err = userResponse.Error
+	}
+
+	logger.Info("Auth Failure",
+		zap.String("reason", reason),
+		zap.NamedError("username-error", userResponse.Error),
+		zap.NamedError("password-error", passResponse.Error),
+	)
+
+	switch reason {
+	case audit.ReasonExpired, audit.ReasonNotYetValid:
+		err = httpauth.ErrExpired
+	case audit.ReasonTimeout, audit.ReasonCanceled, audit.ReasonUnknownUser:
+	default:
+		err = fmt.Errorf("%w: %s", httpauth.ErrInvalid, err)
+	}
+
+	return &httpauth.AuthError{
+		Provider: "jwt",
+		Reason:   reason,
+		TokenID:  unverifiedTokenID(token),
+		Err:      err,
+	}
+}
+
+// FailureReason classifies the error returned when verifying the token as one of the audit reasons.
+func FailureReason(token []byte, err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.DeadlineExceeded):
+		return audit.ReasonTimeout
+	case errors.Is(err, context.Canceled):
+		return audit.ReasonCanceled
+	case errors.Is(err, ErrOnlineToken):
+		return audit.ReasonOnlineToken
+	case errors.Is(err, ErrMissingSubject):
+		return audit.ReasonMissingSubject
+	case errors.Is(err, jwt.ErrTokenInvalidAudience):
+		return audit.ReasonInvalidAudience
+	case errors.Is(err, pjwt.ErrSigMiss):
+		return audit.ReasonBadSignature
+	case errors.Is(err, jwt.ErrTokenTimeNotValid):
+		if claims, perr := pjwt.ParseWithoutCheck(token); perr == nil && claims.NotBefore != nil &&
+			time.Now().Before(claims.NotBefore.Time()) {
+			return audit.ReasonNotYetValid
 		}
-		authChan <- &AuthRequest{
-			Token:         []byte(password),
-			ReturnChannel: recPassCh,
+
+		return audit.ReasonExpired
+	}
+
+	return audit.ReasonMalformed
+}
+
+// unverifiedTokenID returns the ID of the token without checking the signature, it must only be
+// used to identify tokens in the logs.
+func unverifiedTokenID(token []byte) string {
+	claims, err := pjwt.ParseWithoutCheck(token)
+	if err != nil {
+		return ""
+	}
+
+	return claims.ID
+}
+
+// claimValues flattens the verified claims into plain values for logging.
+func claimValues(claims map[string][]jwt.Claim) map[string]interface{} {
+	values := make(map[string]interface{}, len(claims))
+
+	for key, list := range claims {
+		items := make([]interface{}, 0, len(list))
+		for _, c := range list {
+			items = append(items, claimValue(c))
 		}
 
-		// Test username for token
-		response := <-recUserCh
-		if response.Error == nil && !strings.EqualFold(response.Result.Subject, "") {
-			logger.Debug("Auth Success",
-				zap.String("username", response.Result.Subject),
-				zap.Bool("online", response.Result.IsOnline),
-				zap.String("uuid", response.Result.ID),
-				zap.Error(response.Error),
-			)
-
-			return response.Result.Subject, true
+		if len(items) == 1 {
+			values[key] = items[0]
+		} else {
+			values[key] = items
 		}
+	}
 
-		// Test password for token
-		response = <-recPassCh
-		if response.Error == nil && !strings.EqualFold(response.Result.Subject, "") {
-			logger.Debug("Auth Success",
-				zap.String("username", response.Result.Subject),
-				zap.Bool("online", response.Result.IsOnline),
-				zap.String("uuid", response.Result.ID),
-				zap.Error(response.Error),
-			)
-
-			return response.Result.Subject, true
+	return values
+}
+
+// claimStrings returns the string values of a claim, which may be a single string or an array.
+func claimStrings(list []jwt.Claim) []string {
+	values := []string{}
+
+	for _, c := range list {
+		switch v := claimValue(c).(type) {
+		case string:
+			values = append(values, v)
+		case []interface{}:
+			for _, item := range v {
+				if str, ok := item.(string); ok {
+					values = append(values, str)
+				}
+			}
+		case []string:
+			values = append(values, v...)
 		}
+	}
 
-		logger.Info("Auth Failure",
-			zap.String("username", response.Result.Subject),
-			zap.Bool("online", response.Result.IsOnline),
-			zap.String("uuid", response.Result.ID),
-			zap.Error(response.Error),
-		)
+	return values
+}
 
-		return "", false
+// claimValue returns the plain value of a claim.
+func claimValue(c jwt.Claim) interface{} {
+	switch c.Type {
+	case jwt.StringType:
+		return c.String
+	case jwt.Float64Type:
+		return c.Float
+	case jwt.TimeType:
+		t, _ := c.Time()
+		return t
 	}
+
+	return c.Interface
 }
@@ -0,0 +1,236 @@
+package jwtauth_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/koshatul/auth-proxy/audit"
+	"github.com/koshatul/auth-proxy/httpauth"
+	"github.com/koshatul/auth-proxy/jwtauth"
+	"github.com/koshatul/auth-proxy/tracing"
+	"github.com/koshatul/jwt/v2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	pjwt "github.com/pascaldekloe/jwt"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const testAudience string = "test-audience"
+
+var _ = Describe("jwtauth", func() {
+
+	var (
+		signingKey *rsa.PrivateKey
+		otherKey   *rsa.PrivateKey
+		authChan   chan *jwtauth.AuthRequest
+		provider   *jwtauth.Provider
+		cancel     context.CancelFunc
+	)
+
+	sign := func(key *rsa.PrivateKey, claims ...jwt.Claim) string {
+		signer := &jwt.RSASigner{PrivateKey: key, Algorithm: jwt.RS256}
+		token, err := signer.SignClaims(claims...)
+		Expect(err).NotTo(HaveOccurred())
+
+		return string(token)
+	}
+
+	validClaims := func(extra ...jwt.Claim) []jwt.Claim {
+		return append([]jwt.Claim{
+			jwt.String(jwt.Subject, "test-user"),
+			jwt.String(jwt.Audience, testAudience),
+			jwt.String(jwt.ID, "token-1234"),
+			jwt.Time(jwt.NotBefore, time.Now().Add(-time.Minute)),
+			jwt.Time(jwt.Expires, time.Now().Add(time.Hour)),
+		}, extra...)
+	}
+
+	authenticate := func(username, password string) (*httpauth.Identity, error) {
+		return provider.Authenticate(context.Background(), httpauth.Credentials{Username: username, Password: password})
+	}
+
+	authError := func(err error) *httpauth.AuthError {
+		authErr := &httpauth.AuthError{}
+		Expect(errors.As(err, &authErr)).To(BeTrue())
+
+		return authErr
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		if signingKey == nil {
+			signingKey, err = rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).NotTo(HaveOccurred())
+			otherKey, err = rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+
+		authChan = make(chan *jwtauth.AuthRequest, 10)
+		verifier := &jwt.RSAVerifier{PublicKey: &signingKey.PublicKey, Audience: testAudience}
+
+		go jwtauth.AuthRunner(ctx, zap.NewNop(), verifier, authChan, 2)
+
+		provider = jwtauth.NewProvider(zap.NewNop(), authChan, time.Second)
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	Context("should succeed", func() {
+
+		It("with a token as the password", func() {
+			id, err := authenticate("anything", sign(signingKey, validClaims()...))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id.Subject).To(Equal("test-user"))
+			Expect(id.Provider).To(Equal("jwt"))
+			Expect(id.TokenID).To(Equal("token-1234"))
+			Expect(id.Expires).To(BeTemporally("~", time.Now().Add(time.Hour), time.Minute))
+			Expect(id.Claims).To(HaveKeyWithValue("aud", testAudience))
+		})
+
+		It("with a token as the username", func() {
+			id, err := authenticate(sign(signingKey, validClaims()...), "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id.Subject).To(Equal("test-user"))
+		})
+
+		It("with the groups from the token", func() {
+			// The signer only supports scalar claims, so sign the array claim directly.
+			claims := &pjwt.Claims{
+				Registered: pjwt.Registered{
+					Subject:   "test-user",
+					Audiences: []string{testAudience},
+					NotBefore: pjwt.NewNumericTime(time.Now().Add(-time.Minute)),
+					Expires:   pjwt.NewNumericTime(time.Now().Add(time.Hour)),
+				},
+				Set: map[string]interface{}{"groups": []interface{}{"admin", "developers"}},
+			}
+			token, err := claims.RSASign(pjwt.RS256, signingKey)
+			Expect(err).NotTo(HaveOccurred())
+
+			id, err := authenticate("anything", string(token))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id.Groups).To(ConsistOf("admin", "developers"))
+		})
+
+		It("with the deprecated function adapter", func() {
+			authFunc := jwtauth.AuthCheckFunc(zap.NewNop(), authChan, time.Second)
+			username, ok := authFunc("anything", sign(signingKey, validClaims()...), httptest.NewRequest(http.MethodGet, "/", nil))
+			Expect(ok).To(BeTrue())
+			Expect(username).To(Equal("test-user"))
+		})
+
+	})
+
+	Context("should fail", func() {
+
+		DescribeTable("with reason",
+			func(buildToken func() string, reason string, sentinel error) {
+				token := buildToken()
+				id, err := authenticate("anything", token)
+				Expect(id).To(BeNil())
+				Expect(err).To(MatchError(sentinel))
+				Expect(err.Error()).NotTo(ContainSubstring(token))
+
+				authErr := authError(err)
+				Expect(authErr.Provider).To(Equal("jwt"))
+				Expect(authErr.Reason).To(Equal(reason))
+				Expect(authErr.Subject).To(BeEmpty())
+			},
+			Entry("expired", func() string {
+				return sign(signingKey, validClaims(jwt.Time(jwt.Expires, time.Now().Add(-time.Minute)))...)
+			}, audit.ReasonExpired, httpauth.ErrExpired),
+			Entry("not yet valid", func() string {
+				return sign(signingKey, validClaims(jwt.Time(jwt.NotBefore, time.Now().Add(time.Hour)))...)
+			}, audit.ReasonNotYetValid, httpauth.ErrExpired),
+			Entry("bad signature", func() string {
+				return sign(otherKey, validClaims()...)
+			}, audit.ReasonBadSignature, httpauth.ErrInvalid),
+			Entry("wrong audience", func() string {
+				return sign(signingKey,
+					jwt.String(jwt.Subject, "test-user"),
+					jwt.String(jwt.Audience, "someone-else"),
+					jwt.Time(jwt.NotBefore, time.Now().Add(-time.Minute)),
+					jwt.Time(jwt.Expires, time.Now().Add(time.Hour)),
+				)
+			}, audit.ReasonInvalidAudience, httpauth.ErrInvalid),
+			Entry("missing subject", func() string {
+				return sign(signingKey,
+					jwt.String(jwt.Audience, testAudience),
+					jwt.Time(jwt.NotBefore, time.Now().Add(-time.Minute)),
+					jwt.Time(jwt.Expires, time.Now().Add(time.Hour)),
+				)
+			}, audit.ReasonMissingSubject, httpauth.ErrInvalid),
+			Entry("online token", func() string {
+				return sign(signingKey, validClaims(jwt.Bool("onl", true))...)
+			}, audit.ReasonOnlineToken, httpauth.ErrInvalid),
+			Entry("not a token", func() string {
+				return "password"
+			}, audit.ReasonUnknownUser, httpauth.ErrNoCredentials),
+		)
+
+		It("and record the token ID of a rejected token", func() {
+			_, err := authenticate("anything", sign(otherKey, validClaims()...))
+			Expect(authError(err).TokenID).To(Equal("token-1234"))
+		})
+
+	})
+
+	Context("tracing", func() {
+
+		It("should record the verification spans under the authentication span", func() {
+			exporter := tracetest.NewInMemoryExporter()
+			provider := tracing.NewTracerProvider(tracing.Config{SampleRatio: 1}, sdktrace.WithSyncer(exporter))
+			otel.SetTracerProvider(provider)
+
+			defer func() {
+				_ = provider.Shutdown(context.Background())
+				otel.SetTracerProvider(trace.NewNoopTracerProvider())
+			}()
+
+			_, err := authenticate("anything", sign(signingKey, validClaims()...))
+			Expect(err).NotTo(HaveOccurred())
+
+			// The password runner span ends when the authentication span does, wait for its verify span.
+			Eventually(func() int { return len(exporter.GetSpans()) }).Should(Equal(5))
+
+			spans := map[trace.SpanID]tracetest.SpanStub{}
+			var auth tracetest.SpanStub
+
+			for _, s := range exporter.GetSpans() {
+				spans[s.SpanContext.SpanID()] = s
+				if s.Name == "jwtauth.authenticate" {
+					auth = s
+				}
+			}
+
+			Expect(auth.Name).To(Equal("jwtauth.authenticate"))
+
+			for _, s := range spans {
+				switch s.Name {
+				case "jwtauth.runner":
+					Expect(s.Parent.SpanID()).To(Equal(auth.SpanContext.SpanID()))
+				case "jwtauth.verify":
+					Expect(spans[s.Parent.SpanID()].Name).To(Equal("jwtauth.runner"))
+				}
+			}
+		})
+
+	})
+
+})
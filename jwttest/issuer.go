@@ -0,0 +1,167 @@
+package jwttest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	"github.com/koshatul/jwt/v2"
+	pjwt "github.com/pascaldekloe/jwt"
+)
+
+// testKeyBits is the size of the keys generated by NewIssuer.
+const testKeyBits = 2048
+
+// Issuer signs tokens with an RSA private key.
+type Issuer struct {
+	Key *rsa.PrivateKey
+
+	// Certificate is the PEM certificate for Key, it is set by NewIssuer and is what the proxy
+	// loads from server.auth-ca to verify the tokens.
+	Certificate []byte
+}
+
+// Token describes the token to issue.
+type Token struct {
+	Subject   string
+	Audiences []string
+	ID        string
+	Issuer    string
+
+	// NotBefore defaults to now.
+	NotBefore time.Time
+
+	// TTL is how long the token is valid from NotBefore, a negative TTL issues an expired token
+	// and zero issues a token that doesn't expire.
+	TTL time.Duration
+
+	// Online marks the token as an online token, which the proxy rejects.
+	Online bool
+
+	// Claims are additional claims, they may be any JSON value (eg. a list of groups).
+	Claims map[string]interface{}
+}
+
+// NewIssuer returns an Issuer with a new key and a self-signed certificate for it.
+func NewIssuer() (*Issuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, testKeyBits)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "jwttest"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Issuer{
+		Key:         key,
+		Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}, nil
+}
+
+// LoadIssuer returns an Issuer for the PEM private key file (PKCS#1, as written by cfssl, or PKCS#8).
+func LoadIssuer(keyFile string) (*Issuer, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", keyFile)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return &Issuer{Key: key}, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyFile, err)
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: %T is not an RSA key", keyFile, parsed)
+	}
+
+	return &Issuer{Key: key}, nil
+}
+
+// WriteCertificate writes the certificate to a file, for use as server.auth-ca.
+func (i *Issuer) WriteCertificate(filename string) error {
+	if len(i.Certificate) == 0 {
+		return errors.New("issuer has no certificate")
+	}
+
+	return ioutil.WriteFile(filename, i.Certificate, 0o600)
+}
+
+// Verifier returns a verifier that accepts the issuer's tokens for the audience.
+func (i *Issuer) Verifier(audience string) jwt.Verifier {
+	return &jwt.RSAVerifier{PublicKey: &i.Key.PublicKey, Audience: audience}
+}
+
+// Issue returns a token signed with RS256.
+func (i *Issuer) Issue(t Token) ([]byte, error) {
+	now := time.Now()
+
+	notBefore := t.NotBefore
+	if notBefore.IsZero() {
+		notBefore = now
+	}
+
+	claims := &pjwt.Claims{
+		Registered: pjwt.Registered{
+			Issuer:    t.Issuer,
+			Subject:   t.Subject,
+			Audiences: t.Audiences,
+			ID:        t.ID,
+			Issued:    pjwt.NewNumericTime(now),
+			NotBefore: pjwt.NewNumericTime(notBefore),
+		},
+		Set: map[string]interface{}{},
+	}
+
+	if t.TTL != 0 {
+		claims.Expires = pjwt.NewNumericTime(notBefore.Add(t.TTL))
+	}
+
+	for k, v := range t.Claims {
+		claims.Set[k] = v
+	}
+
+	if t.Online {
+		claims.Set["onl"] = true
+	}
+
+	return claims.RSASign(pjwt.RS256, i.Key)
+}
+
+// MustIssue is Issue for tests, it panics if the token can't be signed.
+func (i *Issuer) MustIssue(t Token) string {
+	token, err := i.Issue(t)
+	if err != nil {
+		panic(err)
+	}
+
+	return string(token)
+}
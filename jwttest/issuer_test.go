@@ -0,0 +1,109 @@
+package jwttest_test
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/koshatul/auth-proxy/jwtauth"
+	"github.com/koshatul/auth-proxy/jwttest"
+	"github.com/koshatul/jwt/v2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Issuer", func() {
+
+	const audience = "tls-web-client-auth"
+
+	var (
+		issuer *jwttest.Issuer
+		dir    string
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		if issuer == nil {
+			issuer, err = jwttest.NewIssuer()
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		dir, err = ioutil.TempDir("", "jwttest")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	writeKey := func(blockType string, der []byte) string {
+		path := filepath.Join(dir, "ca-key.pem")
+		Expect(ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600)).To(Succeed())
+
+		return path
+	}
+
+	It("should issue tokens the proxy's verifier accepts from the certificate file", func() {
+		caFile := filepath.Join(dir, "ca.pem")
+		Expect(issuer.WriteCertificate(caFile)).To(Succeed())
+
+		verifier, err := jwt.NewRSAVerifierFromFile(audience, caFile)
+		Expect(err).NotTo(HaveOccurred())
+
+		token, err := issuer.Issue(jwttest.Token{
+			Subject:   "alice",
+			Audiences: []string{audience},
+			ID:        "token-1",
+			TTL:       time.Hour,
+			Claims:    map[string]interface{}{"groups": []string{"admin", "developers"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		result, err := verifier.Verify(token)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Subject).To(Equal("alice"))
+		Expect(result.ID).To(Equal("token-1"))
+		Expect(result.Expires).To(BeTemporally("~", time.Now().Add(time.Hour), time.Second))
+		Expect(result.Claims).To(HaveKey("groups"))
+	})
+
+	It("should issue expired and online tokens", func() {
+		verifier := issuer.Verifier(audience)
+
+		expired := issuer.MustIssue(jwttest.Token{Subject: "alice", Audiences: []string{audience}, TTL: -time.Minute})
+		Expect(jwtauth.Inspect(verifier, []byte(expired)).Reason).To(Equal("expired"))
+
+		online := issuer.MustIssue(jwttest.Token{Subject: "alice", Audiences: []string{audience}, TTL: time.Hour, Online: true})
+		Expect(jwtauth.Inspect(verifier, []byte(online)).Reason).To(Equal("online_token"))
+	})
+
+	It("should load PKCS#1 and PKCS#8 keys", func() {
+		loaded, err := jwttest.LoadIssuer(writeKey("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(issuer.Key)))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded.Key.Equal(issuer.Key)).To(BeTrue())
+
+		der, err := x509.MarshalPKCS8PrivateKey(issuer.Key)
+		Expect(err).NotTo(HaveOccurred())
+
+		loaded, err = jwttest.LoadIssuer(writeKey("PRIVATE KEY", der))
+		Expect(err).NotTo(HaveOccurred())
+
+		token := loaded.MustIssue(jwttest.Token{Subject: "alice", Audiences: []string{audience}, TTL: time.Hour})
+		Expect(jwtauth.Inspect(issuer.Verifier(audience), []byte(token)).Valid).To(BeTrue())
+	})
+
+	It("should fail to load a file that isn't a key", func() {
+		_, err := jwttest.LoadIssuer(writeKey("CERTIFICATE", []byte("nope")))
+		Expect(err).To(HaveOccurred())
+
+		path := filepath.Join(dir, "empty.pem")
+		Expect(ioutil.WriteFile(path, []byte("not pem"), 0o600)).To(Succeed())
+		_, err = jwttest.LoadIssuer(path)
+		Expect(err).To(MatchError(ContainSubstring("no PEM data found")))
+	})
+
+})
@@ -0,0 +1,3 @@
+// Package jwttest issues tokens signed by a local CA key, for development and for tests that
+// need tokens the proxy's verifier accepts without the production issuer.
+package jwttest
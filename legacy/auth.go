@@ -1,14 +1,17 @@
 package legacy
 
 import (
+	"context"
 	"crypto/subtle"
-	"net/http"
-	"net/url"
+	"fmt"
 	"strings"
 
 	"golang.org/x/crypto/bcrypt"
 
+	"github.com/koshatul/auth-proxy/audit"
 	"github.com/koshatul/auth-proxy/httpauth"
+	"github.com/koshatul/auth-proxy/requestid"
+	"github.com/koshatul/auth-proxy/tracing"
 	"go.uber.org/zap"
 )
 
@@ -16,46 +19,164 @@ import (
 type AuthItem struct {
 	Username string
 	Password string
+	Groups   []string
 }
 
-// AuthCheckFunc returns a authentication check function for use with `httpauth.BasicAuth()``
-func AuthCheckFunc(
-	logger *zap.Logger,
-	legacyAuthItems map[string]AuthItem,
-	authProvider httpauth.AuthProvider,
-) httpauth.AuthProvider {
-	return func(username, password string, r *http.Request) (string, bool) {
-		if len(legacyAuthItems) > 0 {
-			// Do Legacy Auth
-			if v, ok := legacyAuthItems[username]; ok {
-				if strings.HasPrefix(v.Password, `$`) {
-					logger.Debug("Testing auth with bcrypt", zap.String("username", username))
+// userPassSepCount is the number of parts in a "username:password" user.
+const userPassSepCount int = 2
+
+// ParseUsers returns the legacy users from a list of "username:password" strings, the password
+// may be a bcrypt hash. Entries without a separator are skipped.
+func ParseUsers(logger *zap.Logger, users []string) map[string]AuthItem {
+	legacyUsers := make(map[string]AuthItem)
+
+	for _, user := range users {
+		s := strings.SplitN(user, ":", userPassSepCount)
+
+		if len(s) == userPassSepCount {
+			logger.Debug("Appending user to legacyUsers", zap.String("username", s[0]))
+
+			legacyUsers[s[0]] = AuthItem{
+				Username: s[0],
+				Password: s[1],
+			}
+		}
+	}
+
+	return legacyUsers
+}
 
-					if err := bcrypt.CompareHashAndPassword([]byte(v.Password), []byte(password)); err == nil {
-						logger.Debug("Auth Success[legacy(bcrypt)]", zap.String("username", username))
+// SetGroups sets the groups of the legacy users from a list of "username:group,group" strings,
+// it returns an error for an entry that is malformed or for a user that isn't in users.
+func SetGroups(users map[string]AuthItem, groups []string) error {
+	for i, entry := range groups {
+		s := strings.SplitN(entry, ":", userPassSepCount)
+		if len(s) != userPassSepCount || s[0] == "" {
+			return fmt.Errorf("legacy group %d: expected \"username:group,group\"", i)
+		}
 
-						r.URL.User = url.User(v.Username)
+		item, ok := users[s[0]]
+		if !ok {
+			return fmt.Errorf("legacy group %d: %q is not a legacy user", i, s[0])
+		}
 
-						return v.Username, true
-					}
-				} else {
-					logger.Debug("Testing auth with plaintext", zap.String("username", username))
+		for _, group := range strings.Split(s[1], ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				item.Groups = append(item.Groups, group)
+			}
+		}
 
-					if subtle.ConstantTimeCompare([]byte(password), []byte(v.Password)) == 1 {
-						logger.Debug("Auth Success[legacy(plain)]", zap.String("username", username))
+		users[s[0]] = item
+	}
 
-						r.URL.User = url.User(v.Username)
+	return nil
+}
 
-						return v.Username, true
-					}
-				}
+// ValidateUsers returns an error for each entry in a list of "username:password" strings that
+// ParseUsers would skip or that could never authenticate.
+func ValidateUsers(users []string) []error {
+	errs := []error{}
+	seen := map[string]bool{}
 
-				logger.Debug("Auth Failure[legacy]", zap.String("username", username))
+	for i, user := range users {
+		s := strings.SplitN(user, ":", userPassSepCount)
 
-				return "", false
+		switch {
+		case len(s) != userPassSepCount:
+			errs = append(errs, fmt.Errorf("legacy user %d: expected \"username:password\"", i))
+		case s[0] == "":
+			errs = append(errs, fmt.Errorf("legacy user %d: username is empty", i))
+		case s[1] == "":
+			errs = append(errs, fmt.Errorf("legacy user %d (%s): password is empty", i, s[0]))
+		case seen[s[0]]:
+			errs = append(errs, fmt.Errorf("legacy user %d (%s): duplicate username", i, s[0]))
+		case strings.HasPrefix(s[1], `$`):
+			if _, err := bcrypt.Cost([]byte(s[1])); err != nil {
+				errs = append(errs, fmt.Errorf("legacy user %d (%s): invalid bcrypt hash: %w", i, s[0], err))
 			}
 		}
 
-		return authProvider(username, password, r)
+		if len(s) == userPassSepCount {
+			seen[s[0]] = true
+		}
+	}
+
+	return errs
+}
+
+// Provider is a httpauth.Authenticator that checks the username and password against a fixed list
+// of users, credentials for users not in the list are passed to the next Authenticator.
+type Provider struct {
+	logger *zap.Logger
+	items  map[string]AuthItem
+	next   httpauth.Authenticator
+}
+
+// NewProvider returns a Provider for the legacy users, next may be nil.
+func NewProvider(logger *zap.Logger, legacyAuthItems map[string]AuthItem, next httpauth.Authenticator) *Provider {
+	return &Provider{
+		logger: logger,
+		items:  legacyAuthItems,
+		next:   next,
+	}
+}
+
+// Authenticate satisfies the httpauth.Authenticator interface for Provider.
+func (p *Provider) Authenticate(ctx context.Context, creds httpauth.Credentials) (*httpauth.Identity, error) {
+	v, ok := p.items[creds.Username]
+	if !ok {
+		if p.next == nil {
+			return nil, &httpauth.AuthError{Provider: "legacy", Reason: audit.ReasonUnknownUser, Err: httpauth.ErrNoCredentials}
+		}
+
+		return p.next.Authenticate(ctx, creds)
+	}
+
+	logger := p.logger.With(requestid.Field(ctx))
+
+	_, span := tracing.Tracer().Start(ctx, "legacy.authenticate")
+	defer span.End()
+
+	if strings.HasPrefix(v.Password, `$`) {
+		logger.Debug("Testing auth with bcrypt", zap.String("username", creds.Username))
+
+		if err := bcrypt.CompareHashAndPassword([]byte(v.Password), []byte(creds.Password)); err == nil {
+			logger.Debug("Auth Success[legacy(bcrypt)]", zap.String("username", creds.Username))
+
+			return &httpauth.Identity{Subject: v.Username, Provider: "legacy", Groups: v.Groups}, nil
+		}
+	} else {
+		logger.Debug("Testing auth with plaintext", zap.String("username", creds.Username))
+
+		if subtle.ConstantTimeCompare([]byte(creds.Password), []byte(v.Password)) == 1 {
+			logger.Debug("Auth Success[legacy(plain)]", zap.String("username", creds.Username))
+
+			return &httpauth.Identity{Subject: v.Username, Provider: "legacy", Groups: v.Groups}, nil
+		}
+	}
+
+	logger.Debug("Auth Failure[legacy]", zap.String("username", creds.Username))
+
+	return nil, &httpauth.AuthError{
+		Provider: "legacy",
+		Reason:   audit.ReasonInvalidPassword,
+		Subject:  v.Username,
+		Err:      httpauth.ErrInvalid,
+	}
+}
+
+// AuthCheckFunc returns a authentication check function for use with `httpauth.BasicAuth()``
+//
+// Deprecated: use NewProvider.
+func AuthCheckFunc(
+	logger *zap.Logger,
+	legacyAuthItems map[string]AuthItem,
+	authProvider httpauth.AuthProvider,
+) httpauth.AuthProvider {
+	var next httpauth.Authenticator
+	if authProvider != nil {
+		next = authProvider.Authenticator("")
 	}
+
+	return httpauth.ProviderFunc(NewProvider(logger, legacyAuthItems, next))
 }
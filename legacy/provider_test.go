@@ -0,0 +1,132 @@
+package legacy_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/koshatul/auth-proxy/audit"
+	"github.com/koshatul/auth-proxy/httpauth"
+	"github.com/koshatul/auth-proxy/legacy"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+)
+
+var _ = Describe("Provider", func() {
+
+	users := map[string]legacy.AuthItem{
+		"joey-bloggs": {Username: "joey-bloggs", Password: "totally-secure-password"},
+	}
+
+	credentials := func(username, password string) httpauth.Credentials {
+		return httpauth.Credentials{Username: username, Password: password}
+	}
+
+	It("should return the identity of a legacy user", func() {
+		id, err := legacy.NewProvider(zap.NewNop(), users, nil).
+			Authenticate(context.Background(), credentials("joey-bloggs", "totally-secure-password"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(id.Subject).To(Equal("joey-bloggs"))
+		Expect(id.Provider).To(Equal("legacy"))
+		Expect(id.Expires.IsZero()).To(BeTrue())
+	})
+
+	It("should return ErrInvalid for the wrong password", func() {
+		_, err := legacy.NewProvider(zap.NewNop(), users, nil).
+			Authenticate(context.Background(), credentials("joey-bloggs", "wrong"))
+		Expect(err).To(MatchError(httpauth.ErrInvalid))
+
+		authErr := &httpauth.AuthError{}
+		Expect(errors.As(err, &authErr)).To(BeTrue())
+		Expect(authErr.Provider).To(Equal("legacy"))
+		Expect(authErr.Reason).To(Equal(audit.ReasonInvalidPassword))
+		Expect(authErr.Subject).To(Equal("joey-bloggs"))
+	})
+
+	It("should return ErrNoCredentials for an unknown user without a next provider", func() {
+		_, err := legacy.NewProvider(zap.NewNop(), users, nil).
+			Authenticate(context.Background(), credentials("someone-else", "totally-secure-password"))
+		Expect(err).To(MatchError(httpauth.ErrNoCredentials))
+	})
+
+	It("should pass unknown users to the next provider", func() {
+		next := httpauth.AuthenticatorFunc(func(ctx context.Context, creds httpauth.Credentials) (*httpauth.Identity, error) {
+			return &httpauth.Identity{Subject: creds.Username, Provider: "next"}, nil
+		})
+
+		id, err := legacy.NewProvider(zap.NewNop(), users, next).
+			Authenticate(context.Background(), credentials("someone-else", "anything"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(id.Provider).To(Equal("next"))
+	})
+
+	It("should not modify the request when used as a function", func() {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		deny := func(username string, password string, r *http.Request) (string, bool) { return "", false }
+
+		user, ok := legacy.AuthCheckFunc(zap.NewNop(), users, deny)(
+			"joey-bloggs", "totally-secure-password", req,
+		)
+		Expect(ok).To(BeTrue())
+		Expect(user).To(Equal("joey-bloggs"))
+		Expect(req.URL.User).To(BeNil())
+	})
+
+	Describe("SetGroups", func() {
+
+		It("should return the groups of a user in the identity", func() {
+			grouped := legacy.ParseUsers(zap.NewNop(), []string{"joey-bloggs:totally-secure-password", "jane:pass"})
+			Expect(legacy.SetGroups(grouped, []string{"joey-bloggs:admins, ops,"})).To(Succeed())
+
+			provider := legacy.NewProvider(zap.NewNop(), grouped, nil)
+
+			id, err := provider.Authenticate(context.Background(), credentials("joey-bloggs", "totally-secure-password"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id.Groups).To(Equal([]string{"admins", "ops"}))
+
+			id, err = provider.Authenticate(context.Background(), credentials("jane", "pass"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id.Groups).To(BeEmpty())
+		})
+
+		It("should reject malformed entries and unknown users", func() {
+			Expect(legacy.SetGroups(map[string]legacy.AuthItem{}, []string{"admins"})).
+				To(MatchError(`legacy group 0: expected "username:group,group"`))
+			Expect(legacy.SetGroups(map[string]legacy.AuthItem{}, []string{"someone:admins"})).
+				To(MatchError(`legacy group 0: "someone" is not a legacy user`))
+		})
+
+	})
+
+	Describe("ValidateUsers", func() {
+
+		It("should accept well formed users", func() {
+			Expect(legacy.ValidateUsers([]string{
+				"joey-bloggs:totally-secure-password",
+				"jane:pass:with:colons",
+				"admin:$2a$04$IA1JuaL5pCYoc1R4L5qJ/eXVrqcs13bjSHmbXQz7PmMiD.InITn3S",
+			})).To(BeEmpty())
+		})
+
+		It("should report every malformed user", func() {
+			errs := legacy.ValidateUsers([]string{
+				"no-separator",
+				":password",
+				"nopass:",
+				"admin:$2a$broken",
+				"joey:one",
+				"joey:two",
+			})
+			Expect(errs).To(HaveLen(5))
+			Expect(errs[0]).To(MatchError(`legacy user 0: expected "username:password"`))
+			Expect(errs[1]).To(MatchError("legacy user 1: username is empty"))
+			Expect(errs[2]).To(MatchError("legacy user 2 (nopass): password is empty"))
+			Expect(errs[3]).To(MatchError(ContainSubstring("legacy user 3 (admin): invalid bcrypt hash")))
+			Expect(errs[4]).To(MatchError("legacy user 5 (joey): duplicate username"))
+		})
+
+	})
+
+})
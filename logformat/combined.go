@@ -2,39 +2,41 @@ package logformat
 
 import (
 	"io"
-	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"time"
 
 	"github.com/gorilla/handlers"
+	"github.com/koshatul/auth-proxy/clientip"
 )
 
 // Copied and modified from github.com/gorilla/handlers/logging.go
 
-// buildCommonLogLine builds a log entry for req in Apache Common Log Format.
-// ts is the timestamp with which the entry should be logged.
-// status and size are used to provide the response HTTP status and size.
-func buildCommonLogLine(req *http.Request, url url.URL, ts time.Time, status int, size int) []byte {
-	username := "-"
-
+// requestUsername returns the authenticated username for req, or "-" if there is none.
+func requestUsername(req *http.Request, url url.URL) string {
 	switch {
 	case req.URL.User != nil:
 		if name := req.URL.User.Username(); name != "" {
-			username = name
+			return name
 		}
 	case url.User != nil:
 		if name := url.User.Username(); name != "" {
-			username = name
+			return name
 		}
 	}
 
-	host, _, err := net.SplitHostPort(req.RemoteAddr)
-	if err != nil {
-		host = req.RemoteAddr
-	}
+	return "-"
+}
+
+// requestHost returns the client IP for req, see `clientip.Handler`.
+func requestHost(req *http.Request) string {
+	return clientip.FromRequest(req)
+}
 
+// requestURI returns the URI for req as it was received, less any token the authenticator
+// removed from it.
+func requestURI(req *http.Request, url url.URL) string {
 	uri := req.RequestURI
 
 	// Requests using the CONNECT method over HTTP/2.0 must use
@@ -48,6 +50,17 @@ func buildCommonLogLine(req *http.Request, url url.URL, ts time.Time, status int
 		uri = url.RequestURI()
 	}
 
+	return uri
+}
+
+// buildCommonLogLine builds a log entry for req in Apache Common Log Format.
+// ts is the timestamp with which the entry should be logged.
+// status and size are used to provide the response HTTP status and size.
+func buildCommonLogLine(req *http.Request, url url.URL, ts time.Time, status int, size int) []byte {
+	username := requestUsername(req, url)
+	host := requestHost(req)
+	uri := requestURI(req, url)
+
 	buf := make([]byte, 0, 3*(len(host)+len(username)+len(req.Method)+len(uri)+len(req.Proto)+50)/2)
 	buf = append(buf, host...)
 	buf = append(buf, " - "...)
@@ -68,6 +81,15 @@ func buildCommonLogLine(req *http.Request, url url.URL, ts time.Time, status int
 	return buf
 }
 
+// WriteCommonLog writes a log entry for req to w in Apache Common Log Format.
+// ts is the timestamp with which the entry should be logged.
+// status and size are used to provide the response HTTP status and size.
+func WriteCommonLog(writer io.Writer, params handlers.LogFormatterParams) {
+	buf := buildCommonLogLine(params.Request, params.URL, params.TimeStamp, params.StatusCode, params.Size)
+	buf = append(buf, '\n')
+	_, _ = writer.Write(buf)
+}
+
 // WriteCombinedLog writes a log entry for req to w in Apache Combined Log Format.
 // ts is the timestamp with which the entry should be logged.
 // status and size are used to provide the response HTTP status and size.
@@ -0,0 +1,214 @@
+package logformat
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/koshatul/auth-proxy/requestid"
+)
+
+type fieldsContextKey struct{}
+
+// Fields holds details about a request that are discovered by the inner handlers
+// (authentication, proxy) and can't be derived from the request itself.
+//
+// All methods are safe to call on a nil *Fields.
+type Fields struct {
+	lock            sync.Mutex
+	authProvider    string
+	cacheHit        bool
+	upstreamLatency time.Duration
+	requestID       string
+	route           string
+	claims          map[string]interface{}
+	responseHeader  http.Header
+}
+
+// WithFields returns a handler that attaches an empty *Fields to the request context
+// so it can be populated by the wrapped handler and read by a LogFormatter.
+//
+// It must wrap the logging handler so the request the formatter receives carries the context,
+// and be wrapped by the `requestid.Handler` for the request ID to be recorded.
+func WithFields(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := &Fields{
+			requestID:      requestid.FromRequest(r),
+			responseHeader: w.Header(),
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), fieldsContextKey{}, f)))
+	})
+}
+
+// FieldsFromRequest returns the *Fields attached to the request, or nil if there are none.
+func FieldsFromRequest(r *http.Request) *Fields {
+	if r == nil {
+		return nil
+	}
+
+	f, _ := r.Context().Value(fieldsContextKey{}).(*Fields)
+
+	return f
+}
+
+// SetAuthProvider records the name of the provider that authenticated the request.
+func (f *Fields) SetAuthProvider(name string) {
+	if f == nil {
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.authProvider = name
+}
+
+// AuthProvider returns the name of the provider that authenticated the request.
+func (f *Fields) AuthProvider() string {
+	if f == nil {
+		return ""
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.authProvider
+}
+
+// SetCacheHit records whether the authentication result came from the cache.
+func (f *Fields) SetCacheHit(hit bool) {
+	if f == nil {
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.cacheHit = hit
+}
+
+// CacheHit returns true if the authentication result came from the cache.
+func (f *Fields) CacheHit() bool {
+	if f == nil {
+		return false
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.cacheHit
+}
+
+// SetUpstreamLatency records how long the backend took to return response headers.
+func (f *Fields) SetUpstreamLatency(d time.Duration) {
+	if f == nil {
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.upstreamLatency = d
+}
+
+// UpstreamLatency returns how long the backend took to return response headers.
+func (f *Fields) UpstreamLatency() time.Duration {
+	if f == nil {
+		return 0
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.upstreamLatency
+}
+
+// SetRequestID records the ID of the request.
+func (f *Fields) SetRequestID(id string) {
+	if f == nil {
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.requestID = id
+}
+
+// RequestID returns the ID of the request.
+func (f *Fields) RequestID() string {
+	if f == nil {
+		return ""
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.requestID
+}
+
+// SetRoute records the backend the request was routed to.
+func (f *Fields) SetRoute(route string) {
+	if f == nil {
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.route = route
+}
+
+// Route returns the backend the request was routed to.
+func (f *Fields) Route() string {
+	if f == nil {
+		return ""
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.route
+}
+
+// SetClaims records the claims of the token used to authenticate the request.
+func (f *Fields) SetClaims(claims map[string]interface{}) {
+	if f == nil {
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.claims = claims
+}
+
+// Claims returns the claims of the token used to authenticate the request.
+func (f *Fields) Claims() map[string]interface{} {
+	if f == nil {
+		return nil
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.claims
+}
+
+// ResponseHeader returns the headers sent in the response.
+func (f *Fields) ResponseHeader() http.Header {
+	if f == nil {
+		return http.Header{}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.responseHeader == nil {
+		return http.Header{}
+	}
+
+	return f.responseHeader
+}
@@ -0,0 +1,60 @@
+package logformat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/handlers"
+)
+
+// nolint: gochecknoglobals // registry of available formats
+var (
+	formattersLock sync.RWMutex
+	formatters     = map[string]handlers.LogFormatter{
+		"combined": WriteCombinedLog,
+		"common":   WriteCommonLog,
+		"json":     WriteJSONLog,
+		"logfmt":   WriteLogfmtLog,
+	}
+)
+
+// Register adds a named LogFormatter to the registry, replacing any existing format with the same name.
+func Register(name string, formatter handlers.LogFormatter) {
+	formattersLock.Lock()
+	defer formattersLock.Unlock()
+
+	formatters[strings.ToLower(name)] = formatter
+}
+
+// Formatter returns the named LogFormatter from the registry.
+func Formatter(name string) (handlers.LogFormatter, error) {
+	formattersLock.RLock()
+	defer formattersLock.RUnlock()
+
+	if f, ok := formatters[strings.ToLower(name)]; ok {
+		return f, nil
+	}
+
+	return nil, fmt.Errorf("unknown log format %q (available: %s)", name, strings.Join(formatNames(), ", "))
+}
+
+// Formats returns the sorted names of all the registered formats.
+func Formats() []string {
+	formattersLock.RLock()
+	defer formattersLock.RUnlock()
+
+	return formatNames()
+}
+
+func formatNames() []string {
+	names := make([]string, 0, len(formatters))
+	for name := range formatters {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
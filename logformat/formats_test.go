@@ -0,0 +1,143 @@
+package logformat_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/handlers"
+	"github.com/koshatul/auth-proxy/clientip"
+	"github.com/koshatul/auth-proxy/logformat"
+	"github.com/koshatul/auth-proxy/requestid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("formats", func() {
+
+	serve := func(formatter handlers.LogFormatter, inner http.HandlerFunc) string {
+		buf := &bytes.Buffer{}
+		h := logformat.WithFields(handlers.CustomLoggingHandler(buf, inner, formatter))
+
+		h = &requestid.Handler{Handler: h, TrustIncoming: true}
+
+		req := httptest.NewRequest(http.MethodGet, "/v2/_catalog?n=10", nil)
+		req.RemoteAddr = "192.0.2.10:51234"
+		req.Header.Set("User-Agent", "test-agent")
+		req.Header.Set("X-Request-ID", "req-1234")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		return buf.String()
+	}
+
+	authenticated := func(w http.ResponseWriter, r *http.Request) {
+		r.URL.User = url.User("test-user")
+		f := logformat.FieldsFromRequest(r)
+		f.SetAuthProvider("jwt")
+		f.SetCacheHit(true)
+		f.SetUpstreamLatency(1500 * time.Microsecond)
+		f.SetRoute("registry:5000")
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte("Hello World!"))
+	}
+
+	Context("registry", func() {
+
+		It("should return the built in formats", func() {
+			Expect(logformat.Formats()).To(ContainElement("combined"))
+			Expect(logformat.Formats()).To(ContainElement("common"))
+			Expect(logformat.Formats()).To(ContainElement("json"))
+			Expect(logformat.Formats()).To(ContainElement("logfmt"))
+		})
+
+		It("should fail with an unknown format", func() {
+			_, err := logformat.Formatter("not-a-format")
+			Expect(err).To(MatchError(ContainSubstring(`unknown log format "not-a-format"`)))
+		})
+
+	})
+
+	Context("should format", func() {
+
+		It("as common", func() {
+			f, err := logformat.Formatter("common")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(serve(f, authenticated)).To(MatchRegexp(
+				`^192\.0\.2\.10 - test-user \[[^\]]+\] "GET /v2/_catalog\?n=10 HTTP/1\.1" 202 12\n$`,
+			))
+		})
+
+		It("as combined", func() {
+			f, err := logformat.Formatter("COMBINED")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(serve(f, authenticated)).To(HaveSuffix(`202 12 "" "test-agent"` + "\n"))
+		})
+
+		It("as json", func() {
+			f, err := logformat.Formatter("json")
+			Expect(err).NotTo(HaveOccurred())
+
+			line := map[string]interface{}{}
+			Expect(json.Unmarshal([]byte(serve(f, authenticated)), &line)).To(Succeed())
+			Expect(line).To(HaveKeyWithValue("remote_addr", "192.0.2.10"))
+			Expect(line).To(HaveKeyWithValue("user", "test-user"))
+			Expect(line).To(HaveKeyWithValue("uri", "/v2/_catalog?n=10"))
+			Expect(line).To(HaveKeyWithValue("status", BeNumerically("==", http.StatusAccepted)))
+			Expect(line).To(HaveKeyWithValue("auth_provider", "jwt"))
+			Expect(line).To(HaveKeyWithValue("cache_hit", true))
+			Expect(line).To(HaveKeyWithValue("upstream_latency_ms", BeNumerically("==", 1.5)))
+			Expect(line).To(HaveKeyWithValue("request_id", "req-1234"))
+			Expect(line).To(HaveKeyWithValue("route", "registry:5000"))
+		})
+
+		It("as json without an authenticated user", func() {
+			f, err := logformat.Formatter("json")
+			Expect(err).NotTo(HaveOccurred())
+
+			line := map[string]interface{}{}
+			Expect(json.Unmarshal([]byte(serve(f, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusUnauthorized)
+			})), &line)).To(Succeed())
+			Expect(line).NotTo(HaveKey("user"))
+			Expect(line).NotTo(HaveKey("auth_provider"))
+			Expect(line).To(HaveKeyWithValue("cache_hit", false))
+		})
+
+		It("with the client IP forwarded by a trusted proxy", func() {
+			f, err := logformat.Formatter("common")
+			Expect(err).NotTo(HaveOccurred())
+
+			trusted, err := clientip.ParseTrustedProxies([]string{"192.0.2.0/24"})
+			Expect(err).NotTo(HaveOccurred())
+
+			buf := &bytes.Buffer{}
+			h := &clientip.Handler{
+				Handler:        logformat.WithFields(handlers.CustomLoggingHandler(buf, http.HandlerFunc(authenticated), f)),
+				TrustedProxies: trusted,
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+			req.RemoteAddr = "192.0.2.10:51234"
+			req.Header.Set("X-Forwarded-For", "198.51.100.7")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			Expect(buf.String()).To(HavePrefix("198.51.100.7 - test-user "))
+		})
+
+		It("as logfmt", func() {
+			f, err := logformat.Formatter("logfmt")
+			Expect(err).NotTo(HaveOccurred())
+
+			line := serve(f, authenticated)
+			Expect(line).To(ContainSubstring(` remote_addr=192.0.2.10 user=test-user method=GET uri="/v2/_catalog?n=10" `))
+			Expect(line).To(ContainSubstring(` referer="" user_agent=test-agent `))
+			Expect(line).To(ContainSubstring(` auth_provider=jwt cache_hit=true upstream_latency_ms=1.5 `))
+			Expect(line).To(HaveSuffix(" request_id=req-1234 route=registry:5000\n"))
+		})
+
+	})
+
+})
@@ -0,0 +1,77 @@
+package logformat
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/gorilla/handlers"
+)
+
+// logEntry is the structured representation of a request used by the JSON and logfmt formats.
+type logEntry struct {
+	Time              string  `json:"time"`
+	RemoteAddr        string  `json:"remote_addr"`
+	User              string  `json:"user,omitempty"`
+	Method            string  `json:"method"`
+	URI               string  `json:"uri"`
+	Proto             string  `json:"proto"`
+	Status            int     `json:"status"`
+	Size              int     `json:"size"`
+	Referer           string  `json:"referer,omitempty"`
+	UserAgent         string  `json:"user_agent,omitempty"`
+	DurationMS        float64 `json:"duration_ms"`
+	AuthProvider      string  `json:"auth_provider,omitempty"`
+	CacheHit          bool    `json:"cache_hit"`
+	UpstreamLatencyMS float64 `json:"upstream_latency_ms,omitempty"`
+	RequestID         string  `json:"request_id,omitempty"`
+	Route             string  `json:"route,omitempty"`
+}
+
+// newLogEntry builds a logEntry from the formatter params and any *Fields attached to the request.
+func newLogEntry(params handlers.LogFormatterParams) logEntry {
+	req := params.Request
+	fields := FieldsFromRequest(req)
+
+	e := logEntry{
+		Time:              params.TimeStamp.Format(time.RFC3339Nano),
+		RemoteAddr:        requestHost(req),
+		User:              requestUsername(req, params.URL),
+		Method:            req.Method,
+		URI:               requestURI(req, params.URL),
+		Proto:             req.Proto,
+		Status:            params.StatusCode,
+		Size:              params.Size,
+		Referer:           req.Referer(),
+		UserAgent:         req.UserAgent(),
+		DurationMS:        durationMS(time.Since(params.TimeStamp)),
+		AuthProvider:      fields.AuthProvider(),
+		CacheHit:          fields.CacheHit(),
+		UpstreamLatencyMS: durationMS(fields.UpstreamLatency()),
+		RequestID:         fields.RequestID(),
+		Route:             fields.Route(),
+	}
+
+	if e.User == "-" {
+		e.User = ""
+	}
+
+	return e
+}
+
+// durationMS returns d in milliseconds with microsecond precision.
+func durationMS(d time.Duration) float64 {
+	return float64(d.Microseconds()) / float64(time.Millisecond/time.Microsecond)
+}
+
+// WriteJSONLog writes a log entry for req to w as a single line JSON object, including
+// the extra details recorded in the request *Fields.
+func WriteJSONLog(writer io.Writer, params handlers.LogFormatterParams) {
+	buf, err := json.Marshal(newLogEntry(params))
+	if err != nil {
+		return
+	}
+
+	buf = append(buf, '\n')
+	_, _ = writer.Write(buf)
+}
@@ -0,0 +1,65 @@
+package logformat
+
+import (
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/handlers"
+)
+
+// WriteLogfmtLog writes a log entry for req to w in logfmt (key=value) format, including
+// the extra details recorded in the request *Fields.
+func WriteLogfmtLog(writer io.Writer, params handlers.LogFormatterParams) {
+	e := newLogEntry(params)
+
+	buf := make([]byte, 0, 256)
+	buf = appendLogfmt(buf, "time", e.Time)
+	buf = appendLogfmt(buf, "remote_addr", e.RemoteAddr)
+	buf = appendLogfmt(buf, "user", e.User)
+	buf = appendLogfmt(buf, "method", e.Method)
+	buf = appendLogfmt(buf, "uri", e.URI)
+	buf = appendLogfmt(buf, "proto", e.Proto)
+	buf = appendLogfmt(buf, "status", strconv.Itoa(e.Status))
+	buf = appendLogfmt(buf, "size", strconv.Itoa(e.Size))
+	buf = appendLogfmt(buf, "referer", e.Referer)
+	buf = appendLogfmt(buf, "user_agent", e.UserAgent)
+	buf = appendLogfmt(buf, "duration_ms", strconv.FormatFloat(e.DurationMS, 'f', -1, 64))
+	buf = appendLogfmt(buf, "auth_provider", e.AuthProvider)
+	buf = appendLogfmt(buf, "cache_hit", strconv.FormatBool(e.CacheHit))
+	buf = appendLogfmt(buf, "upstream_latency_ms", strconv.FormatFloat(e.UpstreamLatencyMS, 'f', -1, 64))
+	buf = appendLogfmt(buf, "request_id", e.RequestID)
+	buf = appendLogfmt(buf, "route", e.Route)
+	buf = append(buf, '\n')
+	_, _ = writer.Write(buf)
+}
+
+// appendLogfmt appends key=value to buf, quoting the value if it is empty or contains
+// spaces, quotes, equals signs or non-printable characters.
+func appendLogfmt(buf []byte, key, value string) []byte {
+	if len(buf) > 0 {
+		buf = append(buf, ' ')
+	}
+
+	buf = append(buf, key...)
+	buf = append(buf, '=')
+
+	if value == "" || strings.ContainsAny(value, " =\"\\") || !isPrintable(value) {
+		buf = append(buf, '"')
+		buf = appendQuoted(buf, value)
+
+		return append(buf, '"')
+	}
+
+	return append(buf, value...)
+}
+
+func isPrintable(s string) bool {
+	for _, r := range s {
+		if !strconv.IsPrint(r) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -1,2 +1,5 @@
 // Package logformat is a http handler wrapper for providing Apache CLF output.
+//
+// Formats are looked up by name from a registry (combined, common, json and logfmt),
+// the structured formats include extra request details recorded in *Fields.
 package logformat
@@ -0,0 +1,346 @@
+package logformat
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/handlers"
+)
+
+// templateParams is the state available to each compiled template segment.
+type templateParams struct {
+	handlers.LogFormatterParams
+	fields   *Fields
+	duration time.Duration
+}
+
+// templateSegment appends a single literal or directive to buf.
+type templateSegment func(buf []byte, p *templateParams) []byte
+
+// templateDirective builds a segment for a directive given its (possibly empty) {argument}.
+type templateDirective func(arg string) (templateSegment, error)
+
+// Compile parses an access log template (in the style of Apache LogFormat) and returns a
+// LogFormatter, the template is only parsed once so formatting each line is cheap.
+//
+// Supported directives:
+//
+//   %%            literal percent sign
+//   %h, %a        remote host
+//   %u            authenticated user
+//   %t            time the request was received in CLF ([02/Jan/2006:15:04:05 -0700])
+//   %{layout}t    time the request was received formatted with a Go time layout
+//   %r            first line of the request ("GET /path HTTP/1.1")
+//   %m %U %q %H   method, path, query string (with leading "?") and protocol
+//   %s            response status
+//   %b, %B        response size ("-" instead of 0 for %b)
+//   %D            duration in microseconds
+//   %T            duration in seconds, %{ms}T, %{us}T and %{s}T select the unit
+//   %{Name}i      request header
+//   %{Name}o      response header
+//   %{claim}j     JWT claim of the authenticated token
+//   %{field}x     extra request field (provider, cache, upstream_ms, request_id, route)
+func Compile(tmpl string) (handlers.LogFormatter, error) {
+	segments, err := parseTemplate(tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(writer io.Writer, params handlers.LogFormatterParams) {
+		p := &templateParams{
+			LogFormatterParams: params,
+			fields:             FieldsFromRequest(params.Request),
+			duration:           time.Since(params.TimeStamp),
+		}
+
+		buf := make([]byte, 0, 256)
+		for _, segment := range segments {
+			buf = segment(buf, p)
+		}
+
+		buf = append(buf, '\n')
+		_, _ = writer.Write(buf)
+	}, nil
+}
+
+// nolint: gocyclo,funlen
+func parseTemplate(tmpl string) ([]templateSegment, error) {
+	directives := templateDirectives()
+	segments := []templateSegment{}
+	literal := []byte{}
+
+	flushLiteral := func() {
+		if len(literal) > 0 {
+			segments = append(segments, literalSegment(string(literal)))
+			literal = []byte{}
+		}
+	}
+
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '%' {
+			literal = append(literal, tmpl[i])
+			continue
+		}
+
+		start := i
+		i++
+
+		if i >= len(tmpl) {
+			return nil, fmt.Errorf("invalid log template at offset %d: trailing %%", start)
+		}
+
+		if tmpl[i] == '%' {
+			literal = append(literal, '%')
+			continue
+		}
+
+		arg := ""
+
+		if tmpl[i] == '{' {
+			end := strings.IndexByte(tmpl[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid log template at offset %d: unterminated %%{", start)
+			}
+
+			arg = tmpl[i+1 : i+end]
+			i += end + 1
+
+			if i >= len(tmpl) {
+				return nil, fmt.Errorf("invalid log template at offset %d: missing directive after %%{%s}", start, arg)
+			}
+		}
+
+		directive, ok := directives[tmpl[i]]
+		if !ok {
+			return nil, fmt.Errorf("invalid log template at offset %d: unknown directive %q", start, tmpl[start:i+1])
+		}
+
+		segment, err := directive(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log template at offset %d: %q: %w", start, tmpl[start:i+1], err)
+		}
+
+		flushLiteral()
+
+		segments = append(segments, segment)
+	}
+
+	flushLiteral()
+
+	return segments, nil
+}
+
+func literalSegment(s string) templateSegment {
+	return func(buf []byte, p *templateParams) []byte {
+		return append(buf, s...)
+	}
+}
+
+// noArg wraps a segment for a directive that doesn't accept an argument.
+func noArg(segment templateSegment) templateDirective {
+	return func(arg string) (templateSegment, error) {
+		if arg != "" {
+			return nil, fmt.Errorf("directive does not accept an argument")
+		}
+
+		return segment, nil
+	}
+}
+
+// requireArg wraps a segment builder for a directive that requires an argument.
+func requireArg(build func(arg string) templateSegment) templateDirective {
+	return func(arg string) (templateSegment, error) {
+		if arg == "" {
+			return nil, fmt.Errorf("directive requires an argument (eg. %%{Name})")
+		}
+
+		return build(arg), nil
+	}
+}
+
+// nolint: funlen
+func templateDirectives() map[byte]templateDirective {
+	remoteHost := noArg(func(buf []byte, p *templateParams) []byte {
+		return append(buf, requestHost(p.Request)...)
+	})
+
+	return map[byte]templateDirective{
+		'h': remoteHost,
+		'a': remoteHost,
+		'u': noArg(func(buf []byte, p *templateParams) []byte {
+			return appendQuoted(buf, requestUsername(p.Request, p.URL))
+		}),
+		't': templateTime,
+		'r': noArg(func(buf []byte, p *templateParams) []byte {
+			buf = append(buf, p.Request.Method...)
+			buf = append(buf, ' ')
+			buf = appendQuoted(buf, requestURI(p.Request, p.URL))
+			buf = append(buf, ' ')
+
+			return append(buf, p.Request.Proto...)
+		}),
+		'm': noArg(func(buf []byte, p *templateParams) []byte {
+			return append(buf, p.Request.Method...)
+		}),
+		'U': noArg(func(buf []byte, p *templateParams) []byte {
+			return appendQuoted(buf, p.URL.Path)
+		}),
+		'q': noArg(func(buf []byte, p *templateParams) []byte {
+			// from the request URI rather than the URL copied before the request was served,
+			// so a token the authenticator removed isn't logged
+			uri := requestURI(p.Request, p.URL)
+
+			i := strings.IndexByte(uri, '?')
+			if i < 0 || i == len(uri)-1 {
+				return buf
+			}
+
+			return appendQuoted(append(buf, '?'), uri[i+1:])
+		}),
+		'H': noArg(func(buf []byte, p *templateParams) []byte {
+			return append(buf, p.Request.Proto...)
+		}),
+		's': noArg(func(buf []byte, p *templateParams) []byte {
+			return strconv.AppendInt(buf, int64(p.StatusCode), 10)
+		}),
+		'b': noArg(func(buf []byte, p *templateParams) []byte {
+			if p.Size == 0 {
+				return append(buf, '-')
+			}
+
+			return strconv.AppendInt(buf, int64(p.Size), 10)
+		}),
+		'B': noArg(func(buf []byte, p *templateParams) []byte {
+			return strconv.AppendInt(buf, int64(p.Size), 10)
+		}),
+		'D': noArg(func(buf []byte, p *templateParams) []byte {
+			return strconv.AppendInt(buf, p.duration.Microseconds(), 10)
+		}),
+		'T': templateDuration,
+		'i': requireArg(func(name string) templateSegment {
+			return func(buf []byte, p *templateParams) []byte {
+				return appendHeader(buf, p.Request.Header, name)
+			}
+		}),
+		'o': requireArg(func(name string) templateSegment {
+			return func(buf []byte, p *templateParams) []byte {
+				return appendHeader(buf, p.fields.ResponseHeader(), name)
+			}
+		}),
+		'j': requireArg(func(name string) templateSegment {
+			return func(buf []byte, p *templateParams) []byte {
+				return appendClaim(buf, p.fields.Claims(), name)
+			}
+		}),
+		'x': templateField,
+	}
+}
+
+func templateTime(layout string) (templateSegment, error) {
+	if layout == "" {
+		layout = "[02/Jan/2006:15:04:05 -0700]"
+	}
+
+	return func(buf []byte, p *templateParams) []byte {
+		return p.TimeStamp.AppendFormat(buf, layout)
+	}, nil
+}
+
+func templateDuration(unit string) (templateSegment, error) {
+	var divisor time.Duration
+
+	switch unit {
+	case "", "s":
+		divisor = time.Second
+	case "ms":
+		divisor = time.Millisecond
+	case "us", "µs":
+		divisor = time.Microsecond
+	default:
+		return nil, fmt.Errorf("unknown duration unit %q (s, ms, us)", unit)
+	}
+
+	return func(buf []byte, p *templateParams) []byte {
+		return strconv.AppendInt(buf, int64(p.duration/divisor), 10)
+	}, nil
+}
+
+func templateField(name string) (templateSegment, error) {
+	switch name {
+	case "provider":
+		return func(buf []byte, p *templateParams) []byte {
+			return appendOrDash(buf, p.fields.AuthProvider())
+		}, nil
+	case "cache":
+		return func(buf []byte, p *templateParams) []byte {
+			return strconv.AppendBool(buf, p.fields.CacheHit())
+		}, nil
+	case "upstream_ms":
+		return func(buf []byte, p *templateParams) []byte {
+			return strconv.AppendFloat(buf, durationMS(p.fields.UpstreamLatency()), 'f', -1, 64)
+		}, nil
+	case "request_id":
+		return func(buf []byte, p *templateParams) []byte {
+			return appendOrDash(buf, p.fields.RequestID())
+		}, nil
+	case "route":
+		return func(buf []byte, p *templateParams) []byte {
+			return appendOrDash(buf, p.fields.Route())
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown field %q (provider, cache, upstream_ms, request_id, route)", name)
+}
+
+// appendOrDash appends the quoted value, or "-" if it is empty.
+func appendOrDash(buf []byte, value string) []byte {
+	if value == "" {
+		return append(buf, '-')
+	}
+
+	return appendQuoted(buf, value)
+}
+
+// appendHeader appends the comma separated values of the named header, or "-" if it is not present.
+func appendHeader(buf []byte, h http.Header, name string) []byte {
+	return appendOrDash(buf, strings.Join(h.Values(name), ", "))
+}
+
+// appendClaim appends the value of the named claim, or "-" if it is not present.
+func appendClaim(buf []byte, claims map[string]interface{}, name string) []byte {
+	v, ok := claims[name]
+	if !ok {
+		return append(buf, '-')
+	}
+
+	return appendOrDash(buf, claimString(v))
+}
+
+// claimString formats a claim value for the log.
+func claimString(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(val)
+	case time.Time:
+		return val.Format(time.RFC3339)
+	case []string:
+		return strings.Join(val, ",")
+	case []interface{}:
+		s := make([]string, 0, len(val))
+		for _, item := range val {
+			s = append(s, claimString(item))
+		}
+
+		return strings.Join(s, ",")
+	}
+
+	return fmt.Sprintf("%v", v)
+}
@@ -0,0 +1,92 @@
+package logformat_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/handlers"
+	"github.com/koshatul/auth-proxy/logformat"
+	"github.com/koshatul/auth-proxy/requestid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("template", func() {
+
+	serve := func(tmpl string) string {
+		f, err := logformat.Compile(tmpl)
+		Expect(err).NotTo(HaveOccurred())
+
+		buf := &bytes.Buffer{}
+		h := logformat.WithFields(handlers.CustomLoggingHandler(buf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.User = url.User("test-user")
+			fields := logformat.FieldsFromRequest(r)
+			fields.SetAuthProvider("jwt")
+			fields.SetClaims(map[string]interface{}{
+				"sub": "test-user",
+				"aud": []interface{}{"web", "api"},
+				"exp": time.Date(2030, time.January, 2, 3, 4, 5, 0, time.UTC),
+			})
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("Hello World!"))
+		}), f))
+
+		h = &requestid.Handler{Handler: h, TrustIncoming: true}
+
+		req := httptest.NewRequest(http.MethodGet, "/v2/_catalog?n=10", nil)
+		req.RemoteAddr = "192.0.2.10:51234"
+		req.Header.Set("User-Agent", `test "agent"`)
+		req.Header.Set("X-Request-ID", "req-1234")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		return buf.String()
+	}
+
+	DescribeTable("should format",
+		func(tmpl, expected string) {
+			Expect(serve(tmpl)).To(Equal(expected + "\n"))
+		},
+		Entry("literal", "hello 100%% world", "hello 100% world"),
+		Entry("remote host", "%h %a", "192.0.2.10 192.0.2.10"),
+		Entry("user", "%u", "test-user"),
+		Entry("request line", `"%r"`, `"GET /v2/_catalog?n=10 HTTP/1.1"`),
+		Entry("request parts", "%m %U%q %H", "GET /v2/_catalog?n=10 HTTP/1.1"),
+		Entry("status and size", "%s %b %B", "200 12 12"),
+		Entry("request header", `"%{User-Agent}i" %{X-Missing}i`, `"test \"agent\"" -`),
+		Entry("response header", "%{Content-Type}o", "text/plain"),
+		Entry("string claim", "%{sub}j", "test-user"),
+		Entry("list claim", "%{aud}j", "web,api"),
+		Entry("time claim", "%{exp}j %{missing}j", "2030-01-02T03:04:05Z -"),
+		Entry("extra fields", "%{provider}x %{cache}x %{request_id}x %{route}x", "jwt false req-1234 -"),
+	)
+
+	It("should format durations", func() {
+		Expect(serve("%D %T %{ms}T %{us}T %{s}T")).To(MatchRegexp(`^\d+ 0 0 \d+ 0\n$`))
+	})
+
+	It("should format time with a layout", func() {
+		Expect(serve("%{2006}t")).To(MatchRegexp(`^\d{4}\n$`))
+		Expect(serve("%t")).To(MatchRegexp(`^\[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\]\n$`))
+	})
+
+	DescribeTable("should fail to compile",
+		func(tmpl, expected string) {
+			_, err := logformat.Compile(tmpl)
+			Expect(err).To(MatchError(ContainSubstring(expected)))
+		},
+		Entry("trailing percent", "%h %", "offset 3: trailing %"),
+		Entry("unknown directive", "%h %Z", `offset 3: unknown directive "%Z"`),
+		Entry("unterminated argument", "%{User-Agent", "offset 0: unterminated %{"),
+		Entry("missing directive", "%{User-Agent}", "missing directive after %{User-Agent}"),
+		Entry("missing argument", "%i", `"%i": directive requires an argument`),
+		Entry("unexpected argument", "%{foo}h", `"%{foo}h": directive does not accept an argument`),
+		Entry("unknown duration unit", "%{ns}T", `unknown duration unit "ns"`),
+		Entry("unknown field", "%{nope}x", `unknown field "nope"`),
+	)
+
+})
@@ -0,0 +1,93 @@
+package logsink
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// AsyncWriter is a Sink that queues writes and performs them in the background so that
+// a slow destination doesn't block request handling, lines are dropped when the queue is full.
+type AsyncWriter struct {
+	sink    Sink
+	queue   chan []byte
+	done    chan struct{}
+	dropped uint64
+
+	lock     sync.RWMutex
+	closed   bool
+	closeErr error
+}
+
+// NewAsyncWriter returns an AsyncWriter that queues up to size lines for sink.
+func NewAsyncWriter(sink Sink, size int) *AsyncWriter {
+	w := &AsyncWriter{
+		sink:  sink,
+		queue: make(chan []byte, size),
+		done:  make(chan struct{}),
+	}
+
+	go w.run()
+
+	return w
+}
+
+func (w *AsyncWriter) run() {
+	defer close(w.done)
+
+	for p := range w.queue {
+		_, _ = w.sink.Write(p)
+	}
+}
+
+// Write satisfies the io.Writer interface for AsyncWriter, it never blocks.
+//
+// p is copied so the caller may reuse it.
+func (w *AsyncWriter) Write(p []byte) (int, error) {
+	line := make([]byte, len(p))
+	copy(line, p)
+
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	if w.closed {
+		atomic.AddUint64(&w.dropped, 1)
+
+		return len(p), nil
+	}
+
+	select {
+	case w.queue <- line:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+
+	return len(p), nil
+}
+
+// Dropped returns the number of lines that were discarded because the queue was full.
+func (w *AsyncWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// Reopen satisfies the Sink interface for AsyncWriter.
+func (w *AsyncWriter) Reopen() error {
+	return w.sink.Reopen()
+}
+
+// Close satisfies the Sink interface for AsyncWriter, queued lines are written before
+// the underlying Sink is closed.
+func (w *AsyncWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return w.closeErr
+	}
+
+	w.closed = true
+	close(w.queue)
+	<-w.done
+	w.closeErr = w.sink.Close()
+
+	return w.closeErr
+}
@@ -0,0 +1,100 @@
+package logsink_test
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/koshatul/auth-proxy/logsink"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// blockingSink is a Sink whose writes block until it is released.
+type blockingSink struct {
+	lock    sync.Mutex
+	buf     bytes.Buffer
+	release chan struct{}
+	closed  bool
+}
+
+func (s *blockingSink) Write(p []byte) (int, error) {
+	<-s.release
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.buf.Write(p)
+}
+
+func (s *blockingSink) Reopen() error {
+	return nil
+}
+
+func (s *blockingSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+
+	return nil
+}
+
+func (s *blockingSink) String() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.buf.String()
+}
+
+var _ = Describe("AsyncWriter", func() {
+
+	It("should not block when the sink is slow", func() {
+		sink := &blockingSink{release: make(chan struct{})}
+		w := logsink.NewAsyncWriter(sink, 2)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+
+			for i := 0; i < 10; i++ {
+				_, _ = w.Write([]byte("line\n"))
+			}
+		}()
+
+		Eventually(done, time.Second).Should(BeClosed())
+		Expect(w.Dropped()).To(BeNumerically(">=", 7))
+
+		close(sink.release)
+		Expect(w.Close()).To(Succeed())
+		Expect(sink.closed).To(BeTrue())
+	})
+
+	It("should write queued lines before closing", func() {
+		sink := &blockingSink{release: make(chan struct{})}
+		close(sink.release)
+		w := logsink.NewAsyncWriter(sink, 10)
+
+		buf := []byte("line one\n")
+		_, _ = w.Write(buf)
+		copy(buf, "LINE")
+		_, _ = w.Write([]byte("line two\n"))
+
+		Expect(w.Close()).To(Succeed())
+		Expect(sink.String()).To(Equal("line one\nline two\n"))
+		Expect(w.Dropped()).To(BeZero())
+	})
+
+	It("should drop lines written after close", func() {
+		sink := &blockingSink{release: make(chan struct{})}
+		close(sink.release)
+		w := logsink.NewAsyncWriter(sink, 10)
+		Expect(w.Close()).To(Succeed())
+
+		n, err := w.Write([]byte("line\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(5))
+		Expect(w.Dropped()).To(BeNumerically("==", 1))
+	})
+
+})
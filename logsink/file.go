@@ -0,0 +1,282 @@
+package logsink
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is used to name rotated files, it sorts in the order the files were rotated.
+const backupTimeFormat = "20060102T150405.000000000"
+
+// compressSuffix is appended to rotated files once they have been compressed.
+const compressSuffix = ".gz"
+
+// RotatingFile is a Sink that writes to a file, rotating it when it grows past MaxSize or
+// has been open longer than RotateEvery. Rotated files are renamed with a timestamp suffix,
+// optionally compressed and the oldest are removed once there are more than MaxBackups.
+type RotatingFile struct {
+	cfg FileConfig
+
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+
+	// background serialises compression and pruning of rotated files.
+	background sync.Mutex
+	pending    sync.WaitGroup
+}
+
+// NewRotatingFile opens (or creates) the file at cfg.Path for appending.
+func NewRotatingFile(cfg FileConfig) (*RotatingFile, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("log file path is empty")
+	}
+
+	f := &RotatingFile{cfg: cfg}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// open opens the file, the lock must be held by the caller (or f is not yet shared).
+func (f *RotatingFile) open() error {
+	file, size, err := openFile(f.cfg.Path)
+	if err != nil {
+		return err
+	}
+
+	f.file = file
+	f.size = size
+	f.openedAt = time.Now()
+
+	return nil
+}
+
+// openFile opens (or creates) the file at path for appending and returns its size.
+func openFile(path string) (*os.File, int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, 0, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, 0, err
+	}
+
+	return file, info.Size(), nil
+}
+
+// Write satisfies the io.Writer interface for RotatingFile, rotating the file first if required.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if f.shouldRotate(len(p)) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+func (f *RotatingFile) shouldRotate(n int) bool {
+	if f.cfg.MaxSize > 0 && f.size > 0 && f.size+int64(n) > f.cfg.MaxSize {
+		return true
+	}
+
+	return f.cfg.RotateEvery > 0 && time.Since(f.openedAt) >= f.cfg.RotateEvery
+}
+
+// Rotate closes the current file, renames it with a timestamp suffix and opens a new file.
+func (f *RotatingFile) Rotate() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file == nil {
+		return os.ErrClosed
+	}
+
+	return f.rotate()
+}
+
+// rotate does the work of Rotate, the lock must be held by the caller.
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	f.file = nil
+	backup := f.cfg.Path + "-" + time.Now().UTC().Format(backupTimeFormat)
+
+	if err := os.Rename(f.cfg.Path, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	f.pending.Add(1)
+
+	go f.afterRotate(backup)
+
+	return nil
+}
+
+// afterRotate compresses the rotated file (if enabled) and removes old backups.
+func (f *RotatingFile) afterRotate(backup string) {
+	defer f.pending.Done()
+
+	f.background.Lock()
+	defer f.background.Unlock()
+
+	if f.cfg.Compress {
+		_ = compressFile(backup)
+	}
+
+	_ = f.prune()
+}
+
+// Backups returns the rotated files for this log, oldest first.
+func (f *RotatingFile) Backups() ([]string, error) {
+	matches, err := filepath.Glob(f.cfg.Path + "-*")
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return strings.TrimSuffix(matches[i], compressSuffix) < strings.TrimSuffix(matches[j], compressSuffix)
+	})
+
+	return matches, nil
+}
+
+// prune removes the oldest backups beyond MaxBackups.
+func (f *RotatingFile) prune() error {
+	if f.cfg.MaxBackups <= 0 {
+		return nil
+	}
+
+	backups, err := f.Backups()
+	if err != nil {
+		return err
+	}
+
+	for len(backups) > f.cfg.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+// Reopen satisfies the Sink interface for RotatingFile, it is used after the file has
+// been moved by an external tool (eg. logrotate). If the new file can't be opened the current
+// one is kept, so the log continues in the moved file rather than being lost.
+func (f *RotatingFile) Reopen() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	file, size, err := openFile(f.cfg.Path)
+	if err != nil {
+		return err
+	}
+
+	prev := f.file
+
+	f.file = file
+	f.size = size
+	f.openedAt = time.Now()
+
+	if prev != nil {
+		return prev.Close()
+	}
+
+	return nil
+}
+
+// Close satisfies the Sink interface for RotatingFile, it waits for any pending compression.
+func (f *RotatingFile) Close() error {
+	f.lock.Lock()
+
+	var err error
+
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+
+	f.lock.Unlock()
+
+	f.pending.Wait()
+
+	return err
+}
+
+// compressFile gzips the file at path to path.gz and removes the original.
+func compressFile(path string) (err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+compressSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = os.Remove(path + compressSuffix)
+		}
+	}()
+
+	gz := gzip.NewWriter(dst)
+
+	if _, err = io.Copy(gz, src); err != nil {
+		_ = dst.Close()
+		return err
+	}
+
+	if err = gz.Close(); err != nil {
+		_ = dst.Close()
+		return err
+	}
+
+	if err = dst.Close(); err != nil {
+		return err
+	}
+
+	_ = src.Close()
+
+	return os.Remove(path)
+}
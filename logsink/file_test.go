@@ -0,0 +1,194 @@
+package logsink_test
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/koshatul/auth-proxy/logsink"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RotatingFile", func() {
+
+	var (
+		dir  string
+		path string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "logsink")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "logs", "access.log")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	readFile := func(name string) string {
+		b, err := ioutil.ReadFile(name)
+		Expect(err).NotTo(HaveOccurred())
+
+		return string(b)
+	}
+
+	readGzip := func(name string) string {
+		f, err := os.Open(name)
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+
+		gz, err := gzip.NewReader(f)
+		Expect(err).NotTo(HaveOccurred())
+
+		b, err := ioutil.ReadAll(gz)
+		Expect(err).NotTo(HaveOccurred())
+
+		return string(b)
+	}
+
+	It("should create the file and append lines", func() {
+		f, err := logsink.NewRotatingFile(logsink.FileConfig{Path: path})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = f.Write([]byte("line one\n"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = f.Write([]byte("line two\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		Expect(readFile(path)).To(Equal("line one\nline two\n"))
+	})
+
+	It("should rotate when the file reaches the maximum size", func() {
+		f, err := logsink.NewRotatingFile(logsink.FileConfig{Path: path, MaxSize: 20})
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, line := range []string{"0123456789\n", "abcdefghij\n", "klmnopqrst\n"} {
+			_, err = f.Write([]byte(line))
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		Expect(f.Close()).To(Succeed())
+
+		backups, err := f.Backups()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backups).To(HaveLen(2))
+		Expect(readFile(backups[0])).To(Equal("0123456789\n"))
+		Expect(readFile(backups[1])).To(Equal("abcdefghij\n"))
+		Expect(readFile(path)).To(Equal("klmnopqrst\n"))
+	})
+
+	It("should rotate when the file has been open too long", func() {
+		f, err := logsink.NewRotatingFile(logsink.FileConfig{Path: path, RotateEvery: 50 * time.Millisecond})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = f.Write([]byte("before\n"))
+		Expect(err).NotTo(HaveOccurred())
+		time.Sleep(60 * time.Millisecond)
+		_, err = f.Write([]byte("after\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		backups, err := f.Backups()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backups).To(HaveLen(1))
+		Expect(readFile(backups[0])).To(Equal("before\n"))
+		Expect(readFile(path)).To(Equal("after\n"))
+	})
+
+	It("should compress and prune rotated files", func() {
+		f, err := logsink.NewRotatingFile(logsink.FileConfig{Path: path, MaxBackups: 2, Compress: true})
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, line := range []string{"one\n", "two\n", "three\n", "four\n"} {
+			_, err = f.Write([]byte(line))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(f.Rotate()).To(Succeed())
+		}
+
+		Expect(f.Close()).To(Succeed())
+
+		backups, err := f.Backups()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backups).To(HaveLen(2))
+		Expect(backups[0]).To(HaveSuffix(".gz"))
+		Expect(readGzip(backups[0])).To(Equal("three\n"))
+		Expect(readGzip(backups[1])).To(Equal("four\n"))
+	})
+
+	It("should reopen the file after it has been moved", func() {
+		f, err := logsink.NewRotatingFile(logsink.FileConfig{Path: path})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = f.Write([]byte("before\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.Rename(path, path+".1")).To(Succeed())
+		Expect(f.Reopen()).To(Succeed())
+		_, err = f.Write([]byte("after\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		Expect(readFile(path + ".1")).To(Equal("before\n"))
+		Expect(readFile(path)).To(Equal("after\n"))
+	})
+
+	It("should keep writing to the moved file when the new file can't be opened", func() {
+		f, err := logsink.NewRotatingFile(logsink.FileConfig{Path: path})
+		Expect(err).NotTo(HaveOccurred())
+
+		// the log directory is moved and replaced with a file, so the log can't be created again
+		moved := filepath.Join(dir, "moved")
+		Expect(os.Rename(filepath.Dir(path), moved)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Dir(path), nil, 0o600)).To(Succeed())
+
+		Expect(f.Reopen()).NotTo(Succeed())
+		_, err = f.Write([]byte("after\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		Expect(readFile(filepath.Join(moved, "access.log"))).To(Equal("after\n"))
+	})
+
+	It("should fail to write after close", func() {
+		f, err := logsink.NewRotatingFile(logsink.FileConfig{Path: path})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		_, err = f.Write([]byte("line\n"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should open a file sink from config", func() {
+		sink, err := logsink.Open(logsink.Config{Output: "file", File: logsink.FileConfig{Path: path}, BufferSize: 10})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = sink.Write([]byte("line\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sink.Close()).To(Succeed())
+		Expect(readFile(path)).To(Equal("line\n"))
+	})
+
+	It("should fail with an unknown output", func() {
+		_, err := logsink.Open(logsink.Config{Output: "carrier-pigeon"})
+		Expect(err).To(MatchError(ContainSubstring(`unknown log output "carrier-pigeon"`)))
+		Expect(strings.Contains(err.Error(), "syslog")).To(BeTrue())
+	})
+
+	It("should validate a file sink without creating the file", func() {
+		Expect(logsink.Validate(logsink.Config{Output: "file", File: logsink.FileConfig{Path: filepath.Join(dir, "access.log")}})).To(Succeed())
+		Expect(filepath.Join(dir, "access.log")).NotTo(BeAnExistingFile())
+
+		Expect(logsink.Validate(logsink.Config{Output: "file", File: logsink.FileConfig{Path: path}})).
+			To(MatchError(ContainSubstring("does not exist")))
+		Expect(logsink.Validate(logsink.Config{Output: "file"})).To(MatchError("log file path is empty"))
+		Expect(logsink.Validate(logsink.Config{Output: "carrier-pigeon"})).
+			To(MatchError(ContainSubstring(`unknown log output "carrier-pigeon"`)))
+	})
+
+})
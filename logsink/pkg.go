@@ -0,0 +1,3 @@
+// Package logsink provides the writers the access and audit logs are written to,
+// files with size and time based rotation, syslog and buffered asynchronous writes.
+package logsink
@@ -0,0 +1,129 @@
+package logsink
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Sink is a log destination that can be reopened (eg. after an external logrotate) and closed.
+type Sink interface {
+	io.Writer
+
+	// Reopen closes and reopens any underlying files, it is called on SIGHUP.
+	Reopen() error
+
+	// Close flushes any buffered lines and releases the underlying resources.
+	Close() error
+}
+
+// Config is the configuration for a Sink.
+type Config struct {
+	// Output is the type of sink: stdout, stderr, file or syslog.
+	Output string
+
+	// BufferSize is the number of lines that are queued for writing in the background,
+	// lines are dropped when the queue is full. Zero writes synchronously.
+	BufferSize int
+
+	File   FileConfig
+	Syslog SyslogConfig
+}
+
+// FileConfig is the configuration for a file Sink.
+type FileConfig struct {
+	Path        string
+	MaxSize     int64
+	RotateEvery time.Duration
+	MaxBackups  int
+	Compress    bool
+}
+
+// SyslogConfig is the configuration for a syslog Sink.
+type SyslogConfig struct {
+	// Network is "udp", "tcp" or "unix", empty connects to the local syslog server.
+	Network  string
+	Address  string
+	Tag      string
+	Facility string
+}
+
+// Open returns the Sink described by cfg.
+func Open(cfg Config) (Sink, error) {
+	var (
+		sink Sink
+		err  error
+	)
+
+	switch strings.ToLower(cfg.Output) {
+	case "", "stdout", "-":
+		sink = &stdSink{Writer: os.Stdout}
+	case "stderr":
+		sink = &stdSink{Writer: os.Stderr}
+	case "file":
+		sink, err = NewRotatingFile(cfg.File)
+	case "syslog":
+		sink, err = NewSyslog(cfg.Syslog)
+	default:
+		return nil, fmt.Errorf("unknown log output %q (stdout, stderr, file, syslog)", cfg.Output)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.BufferSize > 0 {
+		sink = NewAsyncWriter(sink, cfg.BufferSize)
+	}
+
+	return sink, nil
+}
+
+// Validate checks cfg without opening the Sink, so it doesn't create files or connect to syslog.
+func Validate(cfg Config) error {
+	if cfg.BufferSize < 0 {
+		return fmt.Errorf("buffer size %d is negative", cfg.BufferSize)
+	}
+
+	switch strings.ToLower(cfg.Output) {
+	case "", "stdout", "-", "stderr":
+		return nil
+	case "file":
+		if cfg.File.Path == "" {
+			return errors.New("log file path is empty")
+		}
+
+		if dir := filepath.Dir(cfg.File.Path); !isDir(dir) {
+			return fmt.Errorf("log file directory %q does not exist", dir)
+		}
+
+		return nil
+	case "syslog":
+		return validateSyslog(cfg.Syslog)
+	}
+
+	return fmt.Errorf("unknown log output %q (stdout, stderr, file, syslog)", cfg.Output)
+}
+
+func isDir(path string) bool {
+	st, err := os.Stat(path)
+
+	return err == nil && st.IsDir()
+}
+
+// stdSink is a Sink for stdout or stderr, it can't be reopened or closed.
+type stdSink struct {
+	io.Writer
+}
+
+func (s *stdSink) Reopen() error {
+	return nil
+}
+
+func (s *stdSink) Close() error {
+	return nil
+}
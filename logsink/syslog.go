@@ -0,0 +1,64 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package logsink
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+)
+
+// syslogSink is a Sink that sends each line as a syslog message.
+type syslogSink struct {
+	*syslog.Writer
+}
+
+// NewSyslog returns a Sink that sends each line as an informational syslog message.
+func NewSyslog(cfg SyslogConfig) (Sink, error) {
+	facility, err := syslogFacility(cfg.Facility)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := syslog.Dial(cfg.Network, cfg.Address, facility|syslog.LOG_INFO, cfg.Tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslogSink{Writer: w}, nil
+}
+
+// Reopen satisfies the Sink interface for syslogSink, the connection is re-established as needed.
+func (s *syslogSink) Reopen() error {
+	return nil
+}
+
+func validateSyslog(cfg SyslogConfig) error {
+	_, err := syslogFacility(cfg.Facility)
+
+	return err
+}
+
+func syslogFacility(name string) (syslog.Priority, error) {
+	facilities := map[string]syslog.Priority{
+		"":       syslog.LOG_LOCAL0,
+		"user":   syslog.LOG_USER,
+		"daemon": syslog.LOG_DAEMON,
+		"auth":   syslog.LOG_AUTH,
+		"local0": syslog.LOG_LOCAL0,
+		"local1": syslog.LOG_LOCAL1,
+		"local2": syslog.LOG_LOCAL2,
+		"local3": syslog.LOG_LOCAL3,
+		"local4": syslog.LOG_LOCAL4,
+		"local5": syslog.LOG_LOCAL5,
+		"local6": syslog.LOG_LOCAL6,
+		"local7": syslog.LOG_LOCAL7,
+	}
+
+	if f, ok := facilities[strings.ToLower(name)]; ok {
+		return f, nil
+	}
+
+	return 0, fmt.Errorf("unknown syslog facility %q", name)
+}
@@ -0,0 +1,82 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package logsink_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/koshatul/auth-proxy/logsink"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("syslog", func() {
+
+	readPacket := func(conn net.PacketConn) string {
+		buf := make([]byte, 2048)
+		Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+		n, _, err := conn.ReadFrom(buf)
+		Expect(err).NotTo(HaveOccurred())
+
+		return string(buf[:n])
+	}
+
+	It("should send lines to a UDP listener", func() {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		sink, err := logsink.Open(logsink.Config{
+			Output: "syslog",
+			Syslog: logsink.SyslogConfig{
+				Network:  "udp",
+				Address:  conn.LocalAddr().String(),
+				Tag:      "auth-proxy-test",
+				Facility: "local3",
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		defer sink.Close()
+
+		_, err = sink.Write([]byte("127.0.0.1 - test [] \"GET / HTTP/1.1\" 200 12\n"))
+		Expect(err).NotTo(HaveOccurred())
+
+		// local3 (19) * 8 + info (6) = 158
+		msg := readPacket(conn)
+		Expect(msg).To(HavePrefix("<158>"))
+		Expect(msg).To(ContainSubstring("auth-proxy-test["))
+		Expect(msg).To(ContainSubstring(`"GET / HTTP/1.1" 200 12`))
+	})
+
+	It("should send lines to a unix datagram listener", func() {
+		dir, err := ioutil.TempDir("", "logsink")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		addr := filepath.Join(dir, "syslog.sock")
+		conn, err := net.ListenPacket("unixgram", addr)
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		sink, err := logsink.NewSyslog(logsink.SyslogConfig{Network: "unixgram", Address: addr, Tag: "auth-proxy-test"})
+		Expect(err).NotTo(HaveOccurred())
+		defer sink.Close()
+
+		_, err = sink.Write([]byte("hello unix\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(readPacket(conn)).To(ContainSubstring("hello unix"))
+	})
+
+	It("should fail with an unknown facility", func() {
+		_, err := logsink.NewSyslog(logsink.SyslogConfig{Network: "udp", Address: "127.0.0.1:514", Facility: "kernel-panic"})
+		Expect(err).To(MatchError(ContainSubstring(`unknown syslog facility "kernel-panic"`)))
+		Expect(logsink.Validate(logsink.Config{Output: "syslog", Syslog: logsink.SyslogConfig{Facility: "kernel-panic"}})).
+			To(MatchError(ContainSubstring(`unknown syslog facility "kernel-panic"`)))
+	})
+
+})
@@ -0,0 +1,17 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package logsink
+
+import (
+	"errors"
+)
+
+// NewSyslog returns an error as syslog is not supported on this platform.
+func NewSyslog(cfg SyslogConfig) (Sink, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+func validateSyslog(cfg SyslogConfig) error {
+	return errors.New("syslog is not supported on this platform")
+}
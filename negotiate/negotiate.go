@@ -0,0 +1,116 @@
+package negotiate
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Content types commonly offered.
+const (
+	JSON = "application/json"
+	HTML = "text/html"
+	Text = "text/plain"
+)
+
+// acceptRange is a single media range from an Accept header.
+type acceptRange struct {
+	typ     string
+	subtype string
+	q       float64
+}
+
+// ContentType returns the offer the request's Accept header prefers, or an empty string if it
+// accepts none of them. Offers are media types without parameters, ties go to the earliest offer
+// and a request without an Accept header gets the first offer. Structured syntax suffixes are
+// matched, so "application/problem+json" accepts an "application/json" offer.
+func ContentType(r *http.Request, offers ...string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+
+	header := strings.Join(r.Header.Values("Accept"), ",")
+	if strings.TrimSpace(header) == "" {
+		return offers[0]
+	}
+
+	ranges := parse(header)
+
+	best, bestQ, bestSpecificity := "", 0.0, -1
+
+	for _, offer := range offers {
+		typ, subtype := split(offer)
+
+		q, specificity := 0.0, -1
+
+		for _, ar := range ranges {
+			s := ar.match(typ, subtype)
+			if s > specificity {
+				q, specificity = ar.q, s
+			}
+		}
+
+		if specificity >= 0 && q > 0 && (q > bestQ || (q == bestQ && specificity > bestSpecificity)) {
+			best, bestQ, bestSpecificity = offer, q, specificity
+		}
+	}
+
+	return best
+}
+
+// match returns how specifically the range matches the type, or -1 if it doesn't.
+func (ar acceptRange) match(typ, subtype string) int {
+	switch {
+	case ar.typ == "*" && ar.subtype == "*":
+		return 0
+	case ar.typ != typ:
+		return -1
+	case ar.subtype == "*":
+		return 1
+	case ar.subtype == subtype:
+		return 3
+	case strings.HasSuffix(ar.subtype, "+"+subtype):
+		return 2
+	}
+
+	return -1
+}
+
+func parse(header string) []acceptRange {
+	ranges := []acceptRange{}
+
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+
+		typ, subtype := split(params[0])
+		if typ == "" || subtype == "" {
+			continue
+		}
+
+		ar := acceptRange{typ: typ, subtype: subtype, q: 1}
+
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "q") {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					ar.q = q
+				}
+			}
+		}
+
+		ranges = append(ranges, ar)
+	}
+
+	return ranges
+}
+
+func split(mediaType string) (string, string) {
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+	i := strings.IndexByte(mediaType, '/')
+	if i < 0 {
+		return "", ""
+	}
+
+	return strings.TrimSpace(mediaType[:i]), strings.TrimSpace(mediaType[i+1:])
+}
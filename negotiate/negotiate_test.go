@@ -0,0 +1,35 @@
+package negotiate_test
+
+import (
+	"net/http/httptest"
+
+	"github.com/koshatul/auth-proxy/negotiate"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ContentType", func() {
+	DescribeTable("picks the preferred offer",
+		func(accept string, expected string) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if accept != "" {
+				r.Header.Set("Accept", accept)
+			}
+
+			Expect(negotiate.ContentType(r, negotiate.HTML, negotiate.JSON, negotiate.Text)).To(Equal(expected))
+		},
+		Entry("no header", "", negotiate.HTML),
+		Entry("anything", "*/*", negotiate.HTML),
+		Entry("exact", "application/json", negotiate.JSON),
+		Entry("browser", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", negotiate.HTML),
+		Entry("quality", "text/html;q=0.5, application/json", negotiate.JSON),
+		Entry("specific beats wildcard", "*/*;q=0.9, application/json;q=0.9", negotiate.JSON),
+		Entry("subtype wildcard", "text/*", negotiate.HTML),
+		Entry("suffix", "application/vnd.docker.distribution.manifest.v2+json", negotiate.JSON),
+		Entry("excluded", "text/html;q=0, */*", negotiate.JSON),
+		Entry("case insensitive", "Application/JSON", negotiate.JSON),
+		Entry("nothing acceptable", "image/png", ""),
+		Entry("malformed", "garbage", ""),
+	)
+})
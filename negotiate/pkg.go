@@ -0,0 +1,2 @@
+// Package negotiate picks the response content type a client prefers from its Accept header.
+package negotiate
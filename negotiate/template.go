@@ -0,0 +1,63 @@
+package negotiate
+
+import (
+	"bytes"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	texttemplate "text/template"
+)
+
+// DefaultHTML is the layout of the built in HTML error pages, the data needs Status, StatusText,
+// Message and RequestID fields. A template using it can define "detail" to add to the page.
+const DefaultHTML = `<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+{{- block "detail" .}}{{end}}
+{{- if .RequestID}}
+<p><small>Request ID: {{.RequestID}}</small></p>
+{{- end}}
+</body>
+</html>
+`
+
+// Template is a parsed HTML or text template.
+type Template interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// ParseHTML parses an HTML template.
+func ParseHTML(name, text string) (*htmltemplate.Template, error) {
+	return htmltemplate.New(name).Parse(text)
+}
+
+// ParseText parses a text template (eg. for JSON), the json function encodes a value.
+func ParseText(name, text string) (*texttemplate.Template, error) {
+	return texttemplate.New(name).Funcs(texttemplate.FuncMap{"json": jsonValue}).Parse(text)
+}
+
+// Write responds with the template rendered as the content type, a missing template or one that
+// fails to render responds with the fallback message as plain text instead.
+func Write(w http.ResponseWriter, status int, contentType string, t Template, data interface{}, fallback string) {
+	var buf bytes.Buffer
+	if t == nil || t.Execute(&buf, data) != nil {
+		http.Error(w, fallback, status)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = buf.WriteTo(w)
+}
+
+func jsonValue(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+
+	return string(b), err
+}
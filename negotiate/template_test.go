@@ -0,0 +1,56 @@
+package negotiate_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/koshatul/auth-proxy/negotiate"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Write", func() {
+	type page struct {
+		Status     int
+		StatusText string
+		Message    string
+		RequestID  string
+	}
+
+	It("renders a template as the content type", func() {
+		t, err := negotiate.ParseText("json", `{"message":{{json .Message}}}`)
+		Expect(err).NotTo(HaveOccurred())
+
+		rec := httptest.NewRecorder()
+		negotiate.Write(rec, http.StatusBadGateway, negotiate.JSON, t, page{Message: `say "hi"`}, "fallback")
+		Expect(rec.Code).To(Equal(http.StatusBadGateway))
+		Expect(rec.Header().Get("Content-Type")).To(Equal("application/json; charset=utf-8"))
+		Expect(rec.Header().Get("X-Content-Type-Options")).To(Equal("nosniff"))
+		Expect(rec.Body.String()).To(Equal(`{"message":"say \"hi\""}`))
+	})
+
+	It("renders the default HTML with a detail", func() {
+		t, err := negotiate.ParseHTML("html", negotiate.DefaultHTML+`{{define "detail"}}
+<p>detail</p>{{end}}`)
+		Expect(err).NotTo(HaveOccurred())
+
+		rec := httptest.NewRecorder()
+		negotiate.Write(rec, http.StatusForbidden, negotiate.HTML, t, page{Status: 403, StatusText: "Forbidden", Message: "<no>"}, "fallback")
+		Expect(rec.Body.String()).To(ContainSubstring("<p>&lt;no&gt;</p>\n<p>detail</p>\n</body>"))
+	})
+
+	It("falls back to plain text when the template fails", func() {
+		t, err := negotiate.ParseText("json", `{{.Missing}}`)
+		Expect(err).NotTo(HaveOccurred())
+
+		rec := httptest.NewRecorder()
+		negotiate.Write(rec, http.StatusBadGateway, negotiate.JSON, t, page{}, "fallback")
+		Expect(rec.Code).To(Equal(http.StatusBadGateway))
+		Expect(rec.Header().Get("Content-Type")).To(HavePrefix("text/plain"))
+		Expect(rec.Body.String()).To(Equal("fallback\n"))
+
+		rec = httptest.NewRecorder()
+		negotiate.Write(rec, http.StatusBadGateway, negotiate.JSON, nil, page{}, "fallback")
+		Expect(rec.Body.String()).To(Equal("fallback\n"))
+	})
+})
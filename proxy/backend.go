@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"sync/atomic"
+)
+
+// Backend is a single upstream instance in a load balanced pool.
+type Backend struct {
+	URL    *url.URL
+	Weight int
+
+	active  int64
+	health  *health
+	breaker *Breaker
+}
+
+// NewBackend returns a backend for an absolute http or https URL, a weight of zero is treated as one.
+func NewBackend(rawurl string, weight int) (*Backend, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("parsing backend URI: %w", err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("backend URI %q must be an absolute http or https URL", rawurl)
+	}
+
+	if weight < 0 {
+		return nil, fmt.Errorf("backend %q: weight %d is negative", rawurl, weight)
+	}
+
+	if weight == 0 {
+		weight = 1
+	}
+
+	return &Backend{URL: u, Weight: weight, health: &health{}}, nil
+}
+
+// Active returns the number of requests currently being proxied to the backend.
+func (b *Backend) Active() int64 {
+	return atomic.LoadInt64(&b.active)
+}
+
+func (b *Backend) acquire() {
+	atomic.AddInt64(&b.active, 1)
+}
+
+func (b *Backend) release() {
+	atomic.AddInt64(&b.active, -1)
+}
+
+// String returns the backend URL.
+func (b *Backend) String() string {
+	return b.URL.String()
+}
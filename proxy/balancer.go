@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/koshatul/auth-proxy/clientip"
+)
+
+// Balancer picks the backend for a request from the candidates, candidates is never empty.
+type Balancer interface {
+	Next(r *http.Request, candidates []*Backend) *Backend
+}
+
+// BalancerFactory returns a Balancer for a pool of backends.
+type BalancerFactory func(backends []*Backend) Balancer
+
+// Load balancing strategies.
+const (
+	RoundRobin     = "round-robin"
+	LeastConn      = "least-conn"
+	ConsistentHash = "consistent-hash"
+)
+
+// nolint: gochecknoglobals // registry of available strategies
+var (
+	balancersLock sync.RWMutex
+	balancers     = map[string]BalancerFactory{
+		RoundRobin:     newRoundRobin,
+		LeastConn:      newLeastConn,
+		ConsistentHash: newConsistentHash,
+	}
+)
+
+// RegisterBalancer adds a named strategy to the registry, replacing any existing strategy with the same name.
+func RegisterBalancer(name string, factory BalancerFactory) {
+	balancersLock.Lock()
+	defer balancersLock.Unlock()
+
+	balancers[strings.ToLower(name)] = factory
+}
+
+// NewBalancer returns a Balancer for the backends using the named strategy.
+func NewBalancer(name string, backends []*Backend) (Balancer, error) {
+	balancersLock.RLock()
+	defer balancersLock.RUnlock()
+
+	if f, ok := balancers[strings.ToLower(name)]; ok {
+		return f(backends), nil
+	}
+
+	return nil, fmt.Errorf("unknown load balancing strategy %q (available: %s)", name, strings.Join(balancerNames(), ", "))
+}
+
+// Strategies returns the sorted names of all the registered strategies.
+func Strategies() []string {
+	balancersLock.RLock()
+	defer balancersLock.RUnlock()
+
+	return balancerNames()
+}
+
+func balancerNames() []string {
+	names := make([]string, 0, len(balancers))
+	for name := range balancers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// roundRobin is a smooth weighted round robin, each backend is picked in proportion to its
+// weight without picking the heavier backends in bursts.
+type roundRobin struct {
+	lock    sync.Mutex
+	current map[*Backend]int
+}
+
+func newRoundRobin([]*Backend) Balancer {
+	return &roundRobin{current: map[*Backend]int{}}
+}
+
+func (b *roundRobin) Next(r *http.Request, candidates []*Backend) *Backend {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var (
+		best  *Backend
+		total int
+	)
+
+	for _, be := range candidates {
+		b.current[be] += be.Weight
+		total += be.Weight
+
+		if best == nil || b.current[be] > b.current[best] {
+			best = be
+		}
+	}
+
+	b.current[best] -= total
+
+	return best
+}
+
+// leastConn picks the backend with the fewest active requests relative to its weight, ties are
+// broken by rotating through the candidates so an idle pool is still spread evenly.
+type leastConn struct {
+	next uint64
+}
+
+func newLeastConn([]*Backend) Balancer {
+	return &leastConn{}
+}
+
+func (b *leastConn) Next(r *http.Request, candidates []*Backend) *Backend {
+	offset := int(atomic.AddUint64(&b.next, 1) % uint64(len(candidates)))
+
+	var best *Backend
+
+	for i := range candidates {
+		be := candidates[(offset+i)%len(candidates)]
+
+		// compare active/weight without dividing
+		if best == nil || be.Active()*int64(best.Weight) < best.Active()*int64(be.Weight) {
+			best = be
+		}
+	}
+
+	return best
+}
+
+// hashReplicas is the number of points each unit of weight has on the hash ring.
+const hashReplicas = 100
+
+// consistentHash maps the authenticated username (or the client address for anonymous requests)
+// onto a hash ring so the same user is always sent to the same backend while it is available,
+// removing a backend only moves the users that were on it.
+type consistentHash struct {
+	ring   []uint32
+	owners map[uint32]*Backend
+}
+
+func newConsistentHash(backends []*Backend) Balancer {
+	b := &consistentHash{owners: map[uint32]*Backend{}}
+
+	for _, be := range backends {
+		for i := 0; i < be.Weight*hashReplicas; i++ {
+			point := crc32.ChecksumIEEE([]byte(be.String() + "#" + strconv.Itoa(i)))
+			if _, ok := b.owners[point]; ok {
+				continue
+			}
+
+			b.owners[point] = be
+			b.ring = append(b.ring, point)
+		}
+	}
+
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i] < b.ring[j] })
+
+	return b
+}
+
+func (b *consistentHash) Next(r *http.Request, candidates []*Backend) *Backend {
+	available := make(map[*Backend]bool, len(candidates))
+	for _, be := range candidates {
+		available[be] = true
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(HashKey(r)))
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i] >= hash })
+
+	for i := range b.ring {
+		if be := b.owners[b.ring[(start+i)%len(b.ring)]]; available[be] {
+			return be
+		}
+	}
+
+	return candidates[0]
+}
+
+// HashKey returns the key used to pick a backend with consistent hashing, the username set by
+// the authentication handler or the client IP for anonymous requests.
+func HashKey(r *http.Request) string {
+	if r.URL.User != nil && r.URL.User.Username() != "" {
+		return "user:" + r.URL.User.Username()
+	}
+
+	return "addr:" + clientip.FromRequest(r)
+}
@@ -0,0 +1,141 @@
+package proxy_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/koshatul/auth-proxy/proxy"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func mustBackend(rawurl string, weight int) *proxy.Backend {
+	b, err := proxy.NewBackend(rawurl, weight)
+	Expect(err).NotTo(HaveOccurred())
+
+	return b
+}
+
+func requestAs(username string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	if username != "" {
+		r.URL.User = url.User(username)
+	}
+
+	return r
+}
+
+func pick(b proxy.Balancer, r *http.Request, candidates []*proxy.Backend, n int) map[*proxy.Backend]int {
+	counts := map[*proxy.Backend]int{}
+
+	for i := 0; i < n; i++ {
+		counts[b.Next(r, candidates)]++
+	}
+
+	return counts
+}
+
+var _ = Describe("Balancer", func() {
+	var a, b, c *proxy.Backend
+
+	BeforeEach(func() {
+		a = mustBackend("http://a:5000", 1)
+		b = mustBackend("http://b:5000", 2)
+		c = mustBackend("http://c:5000", 1)
+	})
+
+	It("rejects an unknown strategy", func() {
+		_, err := proxy.NewBalancer("random", []*proxy.Backend{a})
+		Expect(err).To(MatchError(ContainSubstring(`unknown load balancing strategy "random"`)))
+		Expect(err).To(MatchError(ContainSubstring("consistent-hash, least-conn, round-robin")))
+	})
+
+	It("looks up strategies case insensitively", func() {
+		_, err := proxy.NewBalancer("Round-Robin", []*proxy.Backend{a})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	Context("round-robin", func() {
+		It("spreads requests in proportion to the weights", func() {
+			pool := []*proxy.Backend{a, b, c}
+			rr, _ := proxy.NewBalancer(proxy.RoundRobin, pool)
+
+			Expect(pick(rr, requestAs(""), pool, 400)).To(Equal(map[*proxy.Backend]int{a: 100, b: 200, c: 100}))
+		})
+
+		It("interleaves the heavier backends", func() {
+			pool := []*proxy.Backend{a, b}
+			rr, _ := proxy.NewBalancer(proxy.RoundRobin, pool)
+
+			order := []*proxy.Backend{}
+			for i := 0; i < 3; i++ {
+				order = append(order, rr.Next(requestAs(""), pool))
+			}
+
+			Expect(order).To(ConsistOf(b, a, b))
+			Expect(order[0]).NotTo(BeIdenticalTo(order[1]))
+		})
+	})
+
+	Context("least-conn", func() {
+		It("rotates between idle backends", func() {
+			pool := []*proxy.Backend{a, b, c}
+			lc, _ := proxy.NewBalancer(proxy.LeastConn, pool)
+
+			Expect(pick(lc, requestAs(""), pool, 30)).To(Equal(map[*proxy.Backend]int{a: 10, b: 10, c: 10}))
+		})
+	})
+
+	Context("consistent-hash", func() {
+		It("always sends a user to the same backend", func() {
+			pool := []*proxy.Backend{a, b, c}
+			ch, _ := proxy.NewBalancer(proxy.ConsistentHash, pool)
+
+			for i := 0; i < 20; i++ {
+				user := fmt.Sprintf("user-%d", i)
+				Expect(pick(ch, requestAs(user), pool, 5)).To(HaveLen(1), user)
+			}
+		})
+
+		It("spreads users over the backends", func() {
+			pool := []*proxy.Backend{a, b, c}
+			ch, _ := proxy.NewBalancer(proxy.ConsistentHash, pool)
+
+			counts := map[*proxy.Backend]int{}
+			for i := 0; i < 1000; i++ {
+				counts[ch.Next(requestAs(fmt.Sprintf("user-%d", i)), pool)]++
+			}
+
+			Expect(counts[a]).To(BeNumerically("~", 250, 100))
+			Expect(counts[b]).To(BeNumerically("~", 500, 100))
+			Expect(counts[c]).To(BeNumerically("~", 250, 100))
+		})
+
+		It("only moves the users of a backend that is not a candidate", func() {
+			pool := []*proxy.Backend{a, b, c}
+			ch, _ := proxy.NewBalancer(proxy.ConsistentHash, pool)
+
+			for i := 0; i < 100; i++ {
+				r := requestAs(fmt.Sprintf("user-%d", i))
+				before := ch.Next(r, pool)
+				after := ch.Next(r, []*proxy.Backend{a, c})
+
+				if before != b {
+					Expect(after).To(BeIdenticalTo(before))
+				} else {
+					Expect(after).NotTo(BeIdenticalTo(b))
+				}
+			}
+		})
+
+		It("hashes anonymous requests by client address", func() {
+			r := requestAs("")
+			r.RemoteAddr = "192.0.2.10:51234"
+			Expect(proxy.HashKey(r)).To(Equal("addr:192.0.2.10"))
+
+			Expect(proxy.HashKey(requestAs("bob"))).To(Equal("user:bob"))
+		})
+	})
+})
@@ -0,0 +1,379 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// nolint: gochecknoglobals // expvar metrics are process wide
+var (
+	breakerMetrics = expvar.NewMap("circuit_breaker")
+	metricOpened   = new(expvar.Int)
+	metricClosed   = new(expvar.Int)
+	metricRejected = new(expvar.Int)
+	metricBreakers = new(expvar.Map).Init()
+)
+
+// ErrCircuitOpen is wrapped by the errors for requests rejected by an open circuit breaker.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// nolint: gochecknoinits // expvar metrics are published once
+func init() {
+	breakerMetrics.Set("opened_total", metricOpened)
+	breakerMetrics.Set("closed_total", metricClosed)
+	breakerMetrics.Set("rejected_total", metricRejected)
+	breakerMetrics.Set("state", metricBreakers)
+}
+
+// Circuit breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// breakerBuckets is the number of buckets the error rate window is divided into.
+const breakerBuckets = 10
+
+// BreakerConfig configures the circuit breaker of each backend, a zero ErrorRate disables it.
+type BreakerConfig struct {
+	// ErrorRate is the fraction of failed requests in Window (once there have been at least
+	// MinRequests) that opens the breaker. Connection errors, 5xx responses and responses that
+	// take longer than Latency (when set) are failures.
+	ErrorRate   float64
+	MinRequests int
+	Window      time.Duration
+	Latency     time.Duration
+
+	// OpenDuration is how long the breaker stays open before HalfOpenRequests trial requests
+	// are let through, if they all succeed the breaker closes otherwise it opens again.
+	OpenDuration     time.Duration
+	HalfOpenRequests int
+}
+
+// CircuitOpenError is returned for requests to a backend whose circuit breaker is open.
+type CircuitOpenError struct {
+	Backend    string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Backend, ErrCircuitOpen)
+}
+
+// Unwrap returns the underlying error.
+func (e *CircuitOpenError) Unwrap() error {
+	return ErrCircuitOpen
+}
+
+// BreakerStatus is a snapshot of the state of a circuit breaker.
+type BreakerStatus struct {
+	State     string     `json:"state"`
+	Requests  int        `json:"requests"`
+	Failures  int        `json:"failures"`
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+}
+
+type breakerBucket struct {
+	epoch    int64
+	requests int
+	failures int
+}
+
+// breakerResult is the outcome of a request let through a circuit breaker.
+type breakerResult int
+
+const (
+	breakerSuccess breakerResult = iota
+	breakerFailure
+	breakerIgnored
+)
+
+// Breaker is a circuit breaker for a single backend.
+type Breaker struct {
+	name   string
+	config BreakerConfig
+
+	lock      sync.Mutex
+	state     string
+	buckets   [breakerBuckets]breakerBucket
+	openUntil time.Time
+	round     int
+	trials    int
+	successes int
+}
+
+func newBreaker(name string, config BreakerConfig) *Breaker {
+	if config.HalfOpenRequests <= 0 {
+		config.HalfOpenRequests = 1
+	}
+
+	if config.Window <= 0 {
+		config.Window = 10 * time.Second
+	}
+
+	b := &Breaker{name: name, config: config}
+	b.setState(BreakerClosed)
+
+	return b
+}
+
+// Status returns a snapshot of the breaker.
+func (b *Breaker) Status() BreakerStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	s := BreakerStatus{State: b.state}
+	s.Requests, s.Failures = b.counts(time.Now())
+
+	if b.state == BreakerOpen {
+		t := b.openUntil
+		s.OpenUntil = &t
+	}
+
+	return s
+}
+
+// ready returns true if a request would be let through, without taking a half-open trial.
+func (b *Breaker) ready(now time.Time) (bool, time.Duration) {
+	switch b.state {
+	case BreakerOpen:
+		if now.Before(b.openUntil) {
+			return false, b.openUntil.Sub(now)
+		}
+
+		return true, 0
+	case BreakerHalfOpen:
+		if b.trials >= b.config.HalfOpenRequests {
+			return false, b.config.OpenDuration
+		}
+	}
+
+	return true, 0
+}
+
+// Ready returns true if a request would be let through, otherwise how long until it might be.
+func (b *Breaker) Ready() (bool, time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.ready(time.Now())
+}
+
+// allow returns nil if the request can be made, each allowed request must be recorded with the
+// half-open round it is a trial request of (zero if it isn't one).
+func (b *Breaker) allow() (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+
+	if ok, retryAfter := b.ready(now); !ok {
+		metricRejected.Add(1)
+
+		return 0, &CircuitOpenError{Backend: b.name, RetryAfter: retryAfter}
+	}
+
+	if b.state == BreakerOpen {
+		b.setState(BreakerHalfOpen)
+		b.round++
+		b.trials, b.successes = 0, 0
+	}
+
+	if b.state != BreakerHalfOpen {
+		return 0, nil
+	}
+
+	b.trials++
+
+	return b.round, nil
+}
+
+// record counts the result of an allowed request, trial is the half-open round returned by allow.
+func (b *Breaker) record(result breakerResult, trial int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+
+	switch b.state {
+	case BreakerClosed:
+		if result == breakerIgnored {
+			return
+		}
+
+		bucket := b.bucket(now)
+		bucket.requests++
+
+		if result == breakerFailure {
+			bucket.failures++
+		}
+
+		requests, failures := b.counts(now)
+		if requests >= b.config.MinRequests && float64(failures) >= b.config.ErrorRate*float64(requests) {
+			b.trip(now)
+		}
+	case BreakerHalfOpen:
+		// requests let through before this round of trials don't decide it
+		if trial != b.round {
+			return
+		}
+
+		b.trials--
+
+		switch result {
+		case breakerFailure:
+			b.trip(now)
+		case breakerSuccess:
+			b.successes++
+			if b.successes >= b.config.HalfOpenRequests {
+				b.buckets = [breakerBuckets]breakerBucket{}
+				b.setState(BreakerClosed)
+				metricClosed.Add(1)
+			}
+		}
+	}
+}
+
+// InheritBreakers gives the backends the circuit breaker state of prev's backends (the load
+// balancer being replaced) with the same URL, so a backend whose breaker is open stays that way
+// when the configuration is reloaded. A breaker with an unchanged configuration is shared, the
+// requests still being made through prev then count towards it too.
+func (lb *LoadBalancer) InheritBreakers(prev *LoadBalancer) {
+	if prev == nil {
+		return
+	}
+
+	breakers := map[string]*Breaker{}
+	for _, b := range prev.Backends {
+		if b.breaker != nil {
+			breakers[b.String()] = b.breaker
+		}
+	}
+
+	for _, b := range lb.Backends {
+		p, ok := breakers[b.String()]
+
+		switch {
+		case !ok, b.breaker == nil:
+		case b.breaker.config == p.config:
+			b.breaker = p
+		default:
+			b.breaker.inherit(p)
+		}
+	}
+}
+
+// inherit copies the state of prev, a breaker with a different configuration. The window of
+// requests is only kept if it is the same length, and prev's trial requests aren't counted.
+func (b *Breaker) inherit(prev *Breaker) {
+	prev.lock.Lock()
+	defer prev.lock.Unlock()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.openUntil = prev.openUntil
+	b.setState(prev.state)
+
+	if b.config.Window == prev.config.Window {
+		b.buckets = prev.buckets
+	}
+
+	if prev.state == BreakerHalfOpen {
+		// prev's trials are recorded against prev, this breaker takes its own
+		b.round++
+		b.successes = prev.successes
+	}
+}
+
+func (b *Breaker) trip(now time.Time) {
+	b.buckets = [breakerBuckets]breakerBucket{}
+	b.openUntil = now.Add(b.config.OpenDuration)
+	b.setState(BreakerOpen)
+	metricOpened.Add(1)
+}
+
+func (b *Breaker) setState(state string) {
+	b.state = state
+
+	s := new(expvar.String)
+	s.Set(state)
+	metricBreakers.Set(b.name, s)
+}
+
+func (b *Breaker) width() int64 {
+	w := int64(b.config.Window) / breakerBuckets
+	if w <= 0 {
+		return 1
+	}
+
+	return w
+}
+
+// bucket returns the bucket for the current time, clearing it if it was last used in an
+// earlier window.
+func (b *Breaker) bucket(now time.Time) *breakerBucket {
+	epoch := now.UnixNano() / b.width()
+	bucket := &b.buckets[epoch%breakerBuckets]
+
+	if bucket.epoch != epoch {
+		*bucket = breakerBucket{epoch: epoch}
+	}
+
+	return bucket
+}
+
+// counts returns the requests and failures in the window.
+func (b *Breaker) counts(now time.Time) (requests, failures int) {
+	epoch := now.UnixNano() / b.width()
+
+	for _, bucket := range b.buckets {
+		if epoch-bucket.epoch < breakerBuckets {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+
+	return requests, failures
+}
+
+// breakerTransport rejects requests to backends whose circuit breaker is open and records the
+// result of the requests it lets through.
+type breakerTransport struct {
+	http.RoundTripper
+}
+
+// RoundTrip satisfies the http.RoundTripper interface for breakerTransport.
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backend := BackendFromRequest(req)
+	if backend == nil || backend.breaker == nil {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	trial, err := backend.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	res, err := t.RoundTripper.RoundTrip(req)
+
+	switch {
+	case err != nil && errors.Is(err, context.Canceled):
+		backend.breaker.record(breakerIgnored, trial)
+	case err != nil, res.StatusCode >= http.StatusInternalServerError:
+		backend.breaker.record(breakerFailure, trial)
+	case backend.breaker.config.Latency > 0 && time.Since(start) > backend.breaker.config.Latency:
+		backend.breaker.record(breakerFailure, trial)
+	default:
+		backend.breaker.record(breakerSuccess, trial)
+	}
+
+	return res, err
+}
@@ -0,0 +1,237 @@
+package proxy_test
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/koshatul/auth-proxy/proxy"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func breakerMetric(name string) int64 {
+	v, err := strconv.ParseInt(expvar.Get("circuit_breaker").(*expvar.Map).Get(name).String(), 10, 64)
+	Expect(err).NotTo(HaveOccurred())
+
+	return v
+}
+
+var _ = Describe("Breaker", func() {
+	var (
+		server   *httptest.Server
+		status   int32
+		delay    int64
+		requests int32
+		backend  *proxy.Backend
+		lb       *proxy.LoadBalancer
+	)
+
+	get := func(h http.Handler) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/", nil))
+
+		return rec
+	}
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&status, http.StatusInternalServerError)
+		atomic.StoreInt64(&delay, 0)
+		atomic.StoreInt32(&requests, 0)
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			time.Sleep(time.Duration(atomic.LoadInt64(&delay)))
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+		}))
+
+		backend = mustBackend(server.URL, 1)
+		lb, _ = proxy.NewLoadBalancer([]*proxy.Backend{backend}, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+		lb.SetBreaker(proxy.BreakerConfig{
+			ErrorRate:    0.5,
+			MinRequests:  4,
+			Window:       time.Minute,
+			Latency:      50 * time.Millisecond,
+			OpenDuration: 100 * time.Millisecond,
+		})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("opens when the error rate is exceeded and fails fast", func() {
+		opened := breakerMetric("opened_total")
+
+		atomic.StoreInt32(&status, http.StatusOK)
+		Expect(get(lb).Code).To(Equal(http.StatusOK))
+		Expect(get(lb).Code).To(Equal(http.StatusOK))
+
+		atomic.StoreInt32(&status, http.StatusInternalServerError)
+		Expect(get(lb).Code).To(Equal(http.StatusInternalServerError))
+		Expect(backend.Status().Breaker.State).To(Equal(proxy.BreakerClosed))
+		Expect(get(lb).Code).To(Equal(http.StatusInternalServerError))
+		Expect(backend.Status().Breaker.State).To(Equal(proxy.BreakerOpen))
+
+		rec := get(lb)
+		Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(rec.Header().Get("Retry-After")).To(Equal("1"))
+		Expect(rec.Body.String()).To(ContainSubstring("circuit breaker is open"))
+		Expect(atomic.LoadInt32(&requests)).To(BeEquivalentTo(4))
+
+		Expect(breakerMetric("opened_total")).To(Equal(opened + 1))
+		Expect(expvar.Get("circuit_breaker").String()).To(ContainSubstring(`"` + server.URL + `": "open"`))
+	})
+
+	It("counts slow responses as failures", func() {
+		atomic.StoreInt32(&status, http.StatusOK)
+		atomic.StoreInt64(&delay, int64(100*time.Millisecond))
+
+		for i := 0; i < 4; i++ {
+			Expect(get(lb).Code).To(Equal(http.StatusOK))
+		}
+
+		Expect(backend.Status().Breaker.State).To(Equal(proxy.BreakerOpen))
+	})
+
+	It("closes after a successful trial request", func() {
+		for i := 0; i < 4; i++ {
+			get(lb)
+		}
+
+		Expect(get(lb).Code).To(Equal(http.StatusServiceUnavailable))
+
+		atomic.StoreInt32(&status, http.StatusOK)
+
+		Eventually(func() int { return get(lb).Code }).Should(Equal(http.StatusOK))
+		Expect(backend.Status().Breaker.State).To(Equal(proxy.BreakerClosed))
+		Expect(get(lb).Code).To(Equal(http.StatusOK))
+	})
+
+	It("opens again after a failed trial request", func() {
+		for i := 0; i < 4; i++ {
+			get(lb)
+		}
+
+		Expect(get(lb).Code).To(Equal(http.StatusServiceUnavailable))
+
+		Eventually(func() int { return get(lb).Code }).Should(Equal(http.StatusInternalServerError))
+		Expect(backend.Status().Breaker.State).To(Equal(proxy.BreakerOpen))
+		Expect(get(lb).Code).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("sends requests to the other backends while open", func() {
+		good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("good"))
+		}))
+		defer good.Close()
+
+		pool := []*proxy.Backend{backend, mustBackend(good.URL, 1)}
+		lb, _ = proxy.NewLoadBalancer(pool, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+		lb.SetBreaker(proxy.BreakerConfig{ErrorRate: 1, MinRequests: 1, OpenDuration: time.Hour})
+
+		Expect(get(lb).Code).To(Equal(http.StatusInternalServerError))
+
+		for i := 0; i < 4; i++ {
+			Expect(get(lb).Body.String()).To(Equal("good"))
+		}
+
+		Expect(atomic.LoadInt32(&requests)).To(BeEquivalentTo(1))
+	})
+
+	It("only closes after the trial requests succeed", func() {
+		release := map[string]chan struct{}{"/first": make(chan struct{}), "/trial": make(chan struct{})}
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ch, ok := release[r.URL.Path]; ok {
+				<-ch
+			}
+
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+		}))
+		defer slow.Close()
+
+		backend = mustBackend(slow.URL, 1)
+		lb, _ = proxy.NewLoadBalancer([]*proxy.Backend{backend}, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+		lb.SetBreaker(proxy.BreakerConfig{ErrorRate: 1, MinRequests: 1, OpenDuration: 50 * time.Millisecond})
+
+		start := func(path string) chan int {
+			code := make(chan int, 1)
+			go func() {
+				defer GinkgoRecover()
+
+				rec := httptest.NewRecorder()
+				lb.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+				code <- rec.Code
+			}()
+
+			return code
+		}
+
+		// a request let through while closed is still running when the breaker opens
+		first := start("/first")
+		Eventually(func() int64 { return backend.Active() }).Should(BeEquivalentTo(1))
+		Expect(get(lb).Code).To(Equal(http.StatusInternalServerError))
+		Expect(backend.Status().Breaker.State).To(Equal(proxy.BreakerOpen))
+
+		time.Sleep(60 * time.Millisecond)
+		atomic.StoreInt32(&status, http.StatusOK)
+		trial := start("/trial")
+		Eventually(func() string { return backend.Status().Breaker.State }).Should(Equal(proxy.BreakerHalfOpen))
+
+		close(release["/first"])
+		Eventually(first).Should(Receive(Equal(http.StatusOK)))
+		Expect(backend.Status().Breaker.State).To(Equal(proxy.BreakerHalfOpen))
+		Expect(get(lb).Code).To(Equal(http.StatusServiceUnavailable))
+
+		close(release["/trial"])
+		Eventually(trial).Should(Receive(Equal(http.StatusOK)))
+		Expect(backend.Status().Breaker.State).To(Equal(proxy.BreakerClosed))
+	})
+
+	It("keeps its state for backends with the same URL across a reload", func() {
+		for i := 0; i < 4; i++ {
+			get(lb)
+		}
+
+		Expect(backend.Status().Breaker.State).To(Equal(proxy.BreakerOpen))
+		openUntil := *backend.Status().Breaker.OpenUntil
+
+		reload := func(config proxy.BreakerConfig) *proxy.LoadBalancer {
+			reloaded, _ := proxy.NewLoadBalancer([]*proxy.Backend{mustBackend(server.URL, 1)}, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+			reloaded.SetBreaker(config)
+			reloaded.InheritBreakers(lb)
+
+			return reloaded
+		}
+
+		same := reload(proxy.BreakerConfig{
+			ErrorRate:    0.5,
+			MinRequests:  4,
+			Window:       time.Minute,
+			Latency:      50 * time.Millisecond,
+			OpenDuration: 100 * time.Millisecond,
+		})
+		Expect(get(same).Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(same.Backends[0].Status().Breaker.OpenUntil).To(Equal(&openUntil))
+
+		changed := reload(proxy.BreakerConfig{ErrorRate: 1, MinRequests: 1, OpenDuration: time.Hour})
+		Expect(get(changed).Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(changed.Backends[0].Status().Breaker.OpenUntil).To(Equal(&openUntil))
+
+		Expect(reload(proxy.BreakerConfig{}).Backends[0].Status().Breaker).To(BeNil())
+		Expect(atomic.LoadInt32(&requests)).To(BeEquivalentTo(4))
+	})
+
+	It("is disabled without an error rate", func() {
+		lb.SetBreaker(proxy.BreakerConfig{})
+
+		for i := 0; i < 10; i++ {
+			Expect(get(lb).Code).To(Equal(http.StatusInternalServerError))
+		}
+
+		Expect(backend.Status().Breaker).To(BeNil())
+	})
+})
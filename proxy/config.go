@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/koshatul/auth-proxy/configtable"
+)
+
+// TargetConfig is a single `[[backend.targets]]` entry, a plain string is also accepted as the
+// URI of a target with the default weight.
+//
+//	[backend]
+//	strategy = "consistent-hash"
+//
+//	[[backend.targets]]
+//	uri = "http://registry-1:5000/"
+//	weight = 2
+//
+//	[[backend.targets]]
+//	uri = "http://registry-2:5000/"
+type TargetConfig struct {
+	URI    string `mapstructure:"uri"`
+	Weight int    `mapstructure:"weight"`
+}
+
+// ParseTargets returns the backends from the raw `backend.targets` configuration value.
+func ParseTargets(raw interface{}) ([]*Backend, error) {
+	entries, err := configtable.Entries(raw, "backend target")
+	if err != nil {
+		return nil, err
+	}
+
+	backends := make([]*Backend, 0, len(entries))
+
+	for i, entry := range entries {
+		cfg := TargetConfig{}
+
+		switch v := entry.(type) {
+		case string:
+			cfg.URI = v
+		case map[string]interface{}:
+			if err := configtable.Decode(v, &cfg); err != nil {
+				return nil, fmt.Errorf("backend target %d: %w", i, err)
+			}
+		default:
+			return nil, fmt.Errorf("backend target %d: expected a string or table, got %T", i, entry)
+		}
+
+		backend, err := NewBackend(cfg.URI, cfg.Weight)
+		if err != nil {
+			return nil, fmt.Errorf("backend target %d: %w", i, err)
+		}
+
+		backends = append(backends, backend)
+	}
+
+	return backends, nil
+}
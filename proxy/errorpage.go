@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/koshatul/auth-proxy/negotiate"
+	"github.com/koshatul/auth-proxy/requestid"
+)
+
+// Classes of backend errors.
+const (
+	ErrorTimeout           = "timeout"
+	ErrorConnectionRefused = "connection_refused"
+	ErrorTLS               = "tls"
+	ErrorCircuitOpen       = "circuit_open"
+	ErrorNoBackends        = "no_healthy_backends"
+	ErrorCanceled          = "canceled"
+	ErrorBadGateway        = "bad_gateway"
+)
+
+// ClassifyError returns the class of an error proxying a request to a backend and the status
+// to respond with, 504 Gateway Timeout for timeouts, 503 Service Unavailable for an open
+// circuit breaker and 502 Bad Gateway otherwise.
+func ClassifyError(err error) (string, int) {
+	var (
+		open      *CircuitOpenError
+		netErr    net.Error
+		authority x509.UnknownAuthorityError
+		hostname  x509.HostnameError
+		invalid   x509.CertificateInvalidError
+		record    tls.RecordHeaderError
+	)
+
+	switch {
+	case errors.As(err, &open):
+		return ErrorCircuitOpen, http.StatusServiceUnavailable
+	case errors.Is(err, context.Canceled):
+		return ErrorCanceled, http.StatusBadGateway
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTimeout, http.StatusGatewayTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorConnectionRefused, http.StatusBadGateway
+	case errors.Is(err, ErrPinMismatch),
+		errors.As(err, &authority), errors.As(err, &hostname), errors.As(err, &invalid), errors.As(err, &record),
+		// alerts from the backend are unexported, but always prefixed
+		strings.Contains(err.Error(), "tls: "):
+		return ErrorTLS, http.StatusBadGateway
+	}
+
+	return ErrorBadGateway, http.StatusBadGateway
+}
+
+// ErrorPage is the data available to the error templates.
+type ErrorPage struct {
+	Status     int
+	StatusText string
+	Class      string
+	Message    string
+	RequestID  string
+
+	// RetryAfter is the number of seconds to wait before retrying, or 0.
+	RetryAfter int
+}
+
+// DefaultErrorHTML is the default template for HTML error pages.
+const DefaultErrorHTML = negotiate.DefaultHTML + `{{define "detail"}}{{if .RetryAfter}}
+<p>Please try again in {{.RetryAfter}} seconds.</p>
+{{- end}}{{end}}`
+
+// DefaultErrorJSON is the default template for JSON error responses, the json function
+// encodes a value.
+const DefaultErrorJSON = `{"status":{{.Status}},"error":{{json .Class}},"message":{{json .Message}}` +
+	`{{if .RequestID}},"request_id":{{json .RequestID}}{{end}}` +
+	`{{if .RetryAfter}},"retry_after":{{.RetryAfter}}{{end}}}
+`
+
+// ErrorTemplates renders error responses as HTML or JSON depending on what the client accepts,
+// clients that accept neither get the message as plain text.
+type ErrorTemplates struct {
+	HTML *htmltemplate.Template
+	JSON *texttemplate.Template
+}
+
+// DefaultErrorTemplates returns the built in error templates.
+func DefaultErrorTemplates() *ErrorTemplates {
+	t, _ := ParseErrorTemplates(DefaultErrorHTML, DefaultErrorJSON)
+
+	return t
+}
+
+// ParseErrorTemplates parses the HTML and JSON error templates, an empty template uses the default.
+func ParseErrorTemplates(html, jsonTemplate string) (*ErrorTemplates, error) {
+	if html == "" {
+		html = DefaultErrorHTML
+	}
+
+	if jsonTemplate == "" {
+		jsonTemplate = DefaultErrorJSON
+	}
+
+	h, err := negotiate.ParseHTML("html", html)
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := negotiate.ParseText("json", jsonTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ErrorTemplates{HTML: h, JSON: j}, nil
+}
+
+// LoadErrorTemplates reads the HTML and JSON error templates from files, an empty filename
+// uses the default.
+func LoadErrorTemplates(htmlFile, jsonFile string) (*ErrorTemplates, error) {
+	var html, jsonTemplate []byte
+
+	if htmlFile != "" {
+		b, err := ioutil.ReadFile(htmlFile)
+		if err != nil {
+			return nil, err
+		}
+
+		html = b
+	}
+
+	if jsonFile != "" {
+		b, err := ioutil.ReadFile(jsonFile)
+		if err != nil {
+			return nil, err
+		}
+
+		jsonTemplate = b
+	}
+
+	return ParseErrorTemplates(string(html), string(jsonTemplate))
+}
+
+// Write responds with the error page, a template that fails to render falls back to plain text.
+func (t *ErrorTemplates) Write(w http.ResponseWriter, r *http.Request, page ErrorPage) {
+	if page.StatusText == "" {
+		page.StatusText = http.StatusText(page.Status)
+	}
+
+	if page.RequestID == "" {
+		page.RequestID = requestid.FromRequest(r)
+	}
+
+	if page.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(page.RetryAfter))
+	}
+
+	var tmpl negotiate.Template
+
+	contentType := negotiate.ContentType(r, negotiate.Text, negotiate.HTML, negotiate.JSON)
+
+	switch {
+	case contentType == negotiate.HTML && t.HTML != nil:
+		tmpl = t.HTML
+	case contentType == negotiate.JSON && t.JSON != nil:
+		tmpl = t.JSON
+	}
+
+	negotiate.Write(w, page.Status, contentType, tmpl, page, page.Message)
+}
+
+// retryAfterSeconds rounds a duration up to whole seconds.
+func retryAfterSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
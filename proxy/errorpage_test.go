@@ -0,0 +1,166 @@
+package proxy_test
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/koshatul/auth-proxy/proxy"
+	"github.com/koshatul/auth-proxy/requestid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+var _ = Describe("Error pages", func() {
+	DescribeTable("classifies backend errors",
+		func(err error, class string, status int) {
+			c, s := proxy.ClassifyError(err)
+			Expect(c).To(Equal(class))
+			Expect(s).To(Equal(status))
+		},
+		Entry("deadline", fmt.Errorf("dial: %w", context.DeadlineExceeded), proxy.ErrorTimeout, http.StatusGatewayTimeout),
+		Entry("net timeout", &net.OpError{Op: "read", Err: timeoutError{}}, proxy.ErrorTimeout, http.StatusGatewayTimeout),
+		Entry("refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+			proxy.ErrorConnectionRefused, http.StatusBadGateway),
+		Entry("unknown authority", x509.UnknownAuthorityError{}, proxy.ErrorTLS, http.StatusBadGateway),
+		Entry("pin mismatch", fmt.Errorf("handshake: %w", proxy.ErrPinMismatch), proxy.ErrorTLS, http.StatusBadGateway),
+		Entry("alert", errors.New("remote error: tls: bad certificate"), proxy.ErrorTLS, http.StatusBadGateway),
+		Entry("circuit open", &proxy.CircuitOpenError{}, proxy.ErrorCircuitOpen, http.StatusServiceUnavailable),
+		Entry("canceled", context.Canceled, proxy.ErrorCanceled, http.StatusBadGateway),
+		Entry("other", errors.New("unexpected EOF"), proxy.ErrorBadGateway, http.StatusBadGateway),
+	)
+
+	Context("load balancer", func() {
+		var (
+			dead   *proxy.Backend
+			lb     *proxy.LoadBalancer
+			logs   *observer.ObservedLogs
+			accept string
+		)
+
+		get := func() *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+			r = r.WithContext(requestid.NewContext(r.Context(), "abc123"))
+
+			if accept != "" {
+				r.Header.Set("Accept", accept)
+			}
+
+			rec := httptest.NewRecorder()
+			lb.ServeHTTP(rec, r)
+
+			return rec
+		}
+
+		BeforeEach(func() {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			dead = mustBackend("http://"+l.Addr().String(), 1)
+			l.Close()
+
+			lb, err = proxy.NewLoadBalancer([]*proxy.Backend{dead}, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+			Expect(err).NotTo(HaveOccurred())
+
+			var core zapcore.Core
+			core, logs = observer.New(zap.DebugLevel)
+			lb.Logger = zap.New(core)
+			accept = ""
+		})
+
+		It("logs the failure with the request ID", func() {
+			Expect(get().Code).To(Equal(http.StatusBadGateway))
+
+			entries := logs.FilterMessage("backend request failed").All()
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].ContextMap()).To(HaveKeyWithValue("request-id", "abc123"))
+			Expect(entries[0].ContextMap()).To(HaveKeyWithValue("class", proxy.ErrorConnectionRefused))
+			Expect(entries[0].ContextMap()).To(HaveKeyWithValue("backend", dead.String()))
+		})
+
+		It("responds with plain text by default", func() {
+			rec := get()
+			Expect(rec.Header().Get("Content-Type")).To(HavePrefix("text/plain"))
+			Expect(rec.Body.String()).To(Equal("backend refused the connection\n"))
+		})
+
+		It("responds with JSON when preferred", func() {
+			accept = "application/json"
+
+			rec := get()
+			Expect(rec.Header().Get("Content-Type")).To(Equal("application/json; charset=utf-8"))
+
+			var body map[string]interface{}
+			Expect(json.Unmarshal(rec.Body.Bytes(), &body)).To(Succeed())
+			Expect(body).To(Equal(map[string]interface{}{
+				"status":     float64(http.StatusBadGateway),
+				"error":      proxy.ErrorConnectionRefused,
+				"message":    "backend refused the connection",
+				"request_id": "abc123",
+			}))
+		})
+
+		It("responds with HTML when preferred", func() {
+			accept = "text/html,application/xhtml+xml,*/*;q=0.8"
+
+			rec := get()
+			Expect(rec.Header().Get("Content-Type")).To(Equal("text/html; charset=utf-8"))
+			Expect(rec.Body.String()).To(ContainSubstring("<h1>502 Bad Gateway</h1>"))
+			Expect(rec.Body.String()).To(ContainSubstring("Request ID: abc123"))
+		})
+
+		It("includes the retry delay when the circuit breaker is open", func() {
+			lb.SetBreaker(proxy.BreakerConfig{ErrorRate: 1, MinRequests: 1, OpenDuration: time.Minute})
+			get()
+
+			accept = "application/json"
+
+			rec := get()
+			Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(rec.Header().Get("Retry-After")).To(Equal("60"))
+			Expect(rec.Body.String()).To(ContainSubstring(`"retry_after":60`))
+		})
+
+		It("uses templates loaded from files", func() {
+			dir, err := ioutil.TempDir("", "proxy-errors")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			htmlFile := filepath.Join(dir, "error.html")
+			Expect(ioutil.WriteFile(htmlFile, []byte(`<p>{{.Status}} {{.Class}} {{.Message}}</p>`), 0600)).To(Succeed())
+
+			lb.ErrorTemplates, err = proxy.LoadErrorTemplates(htmlFile, "")
+			Expect(err).NotTo(HaveOccurred())
+
+			accept = "text/html"
+			Expect(get().Body.String()).To(Equal("<p>502 connection_refused backend refused the connection</p>"))
+
+			accept = "application/json"
+			Expect(get().Body.String()).To(ContainSubstring(`"error":"connection_refused"`))
+		})
+
+		It("rejects templates that fail to parse", func() {
+			_, err := proxy.ParseErrorTemplates("{{.Status", "")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,306 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthCheck configures the active probes and passive ejection of unhealthy backends, the zero
+// value disables both.
+type HealthCheck struct {
+	// Path is requested on each backend (joined to the backend's base path) every Interval, a
+	// zero Interval disables the active probes.
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// ExpectedStatus is the status a healthy backend responds to the probe with, zero accepts
+	// any 2xx or 3xx status.
+	ExpectedStatus int
+
+	// MaxFailures is the number of consecutive 5xx responses or connection errors after which a
+	// backend is ejected, zero disables passive ejection. The first ejection lasts Backoff and
+	// each further ejection without a success in between doubles it, up to MaxBackoff.
+	MaxFailures int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+// expected returns true if a probe response status means the backend is healthy.
+func (hc HealthCheck) expected(status int) bool {
+	if hc.ExpectedStatus == 0 {
+		return status >= http.StatusOK && status < http.StatusBadRequest
+	}
+
+	return status == hc.ExpectedStatus
+}
+
+// backoff returns how long the nth consecutive ejection lasts.
+func (hc HealthCheck) backoff(ejections int) time.Duration {
+	d := hc.Backoff
+
+	for i := 1; i < ejections; i++ {
+		if hc.MaxBackoff > 0 && d >= hc.MaxBackoff {
+			break
+		}
+
+		d *= 2
+	}
+
+	if hc.MaxBackoff > 0 && d > hc.MaxBackoff {
+		return hc.MaxBackoff
+	}
+
+	return d
+}
+
+// health is the health state of a backend.
+type health struct {
+	lock sync.Mutex
+
+	probeFailed  bool
+	lastProbe    time.Time
+	failures     int
+	ejections    int
+	ejectedUntil time.Time
+	lastError    string
+}
+
+// BackendStatus is a snapshot of the health of a backend.
+type BackendStatus struct {
+	URL          string     `json:"url"`
+	Weight       int        `json:"weight"`
+	Healthy      bool       `json:"healthy"`
+	Active       int64      `json:"active"`
+	Failures     int        `json:"consecutive_failures"`
+	Ejections    int        `json:"ejections"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+	ProbeFailed  bool       `json:"probe_failed"`
+	LastProbe    *time.Time `json:"last_probe,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+
+	Breaker *BreakerStatus `json:"breaker,omitempty"`
+}
+
+// Healthy returns true if the backend passed its last probe and is not ejected.
+func (b *Backend) Healthy() bool {
+	b.health.lock.Lock()
+	defer b.health.lock.Unlock()
+
+	return b.healthy(time.Now())
+}
+
+func (b *Backend) healthy(now time.Time) bool {
+	return !b.health.probeFailed && !now.Before(b.health.ejectedUntil)
+}
+
+// Status returns a snapshot of the health of the backend.
+func (b *Backend) Status() BackendStatus {
+	b.health.lock.Lock()
+	defer b.health.lock.Unlock()
+
+	now := time.Now()
+	s := BackendStatus{
+		URL:         b.String(),
+		Weight:      b.Weight,
+		Healthy:     b.healthy(now),
+		Active:      b.Active(),
+		Failures:    b.health.failures,
+		Ejections:   b.health.ejections,
+		ProbeFailed: b.health.probeFailed,
+		LastError:   b.health.lastError,
+	}
+
+	if now.Before(b.health.ejectedUntil) {
+		t := b.health.ejectedUntil
+		s.EjectedUntil = &t
+	}
+
+	if !b.health.lastProbe.IsZero() {
+		t := b.health.lastProbe
+		s.LastProbe = &t
+	}
+
+	if b.breaker != nil {
+		bs := b.breaker.Status()
+		s.Breaker = &bs
+	}
+
+	return s
+}
+
+// reportSuccess records a response that wasn't a server error, ending the run of failures.
+func (b *Backend) reportSuccess() {
+	b.health.lock.Lock()
+	defer b.health.lock.Unlock()
+
+	b.health.failures = 0
+	b.health.lastError = ""
+
+	if !b.health.ejectedUntil.IsZero() && !time.Now().Before(b.health.ejectedUntil) {
+		b.health.ejections = 0
+		b.health.ejectedUntil = time.Time{}
+	}
+}
+
+// reportFailure records a server error or connection error and ejects the backend once there
+// have been hc.MaxFailures in a row, it returns true if the backend was ejected.
+func (b *Backend) reportFailure(hc HealthCheck, err error) bool {
+	b.health.lock.Lock()
+	defer b.health.lock.Unlock()
+
+	b.health.failures++
+	b.health.lastError = err.Error()
+
+	if hc.MaxFailures <= 0 || b.health.failures < hc.MaxFailures {
+		return false
+	}
+
+	b.health.failures = 0
+	b.health.ejections++
+	b.health.ejectedUntil = time.Now().Add(hc.backoff(b.health.ejections))
+
+	return true
+}
+
+// reportProbe records the result of an active health probe.
+func (b *Backend) reportProbe(err error) {
+	b.health.lock.Lock()
+	defer b.health.lock.Unlock()
+
+	b.health.lastProbe = time.Now()
+	b.health.probeFailed = err != nil
+
+	if err != nil {
+		b.health.lastError = err.Error()
+	} else if b.health.failures == 0 {
+		b.health.lastError = ""
+	}
+}
+
+// InheritHealth shares the health state of prev's backends (the load balancer being replaced)
+// with the backends that have the same URL, so a backend that was ejected or failing its probes
+// stays that way when the configuration is reloaded. If the active probes have been disabled or
+// changed the probe results no longer apply, so only the passive ejection state is copied.
+func (lb *LoadBalancer) InheritHealth(prev *LoadBalancer) {
+	if prev == nil {
+		return
+	}
+
+	states := map[string]*health{}
+	for _, b := range prev.Backends {
+		states[b.String()] = b.health
+	}
+
+	sameProbes := lb.HealthCheck.Interval > 0 && prev.HealthCheck.Interval > 0 &&
+		lb.HealthCheck.Path == prev.HealthCheck.Path &&
+		lb.HealthCheck.Timeout == prev.HealthCheck.Timeout &&
+		lb.HealthCheck.ExpectedStatus == prev.HealthCheck.ExpectedStatus
+
+	for _, b := range lb.Backends {
+		h, ok := states[b.String()]
+
+		switch {
+		case !ok:
+		case sameProbes:
+			b.health = h
+		default:
+			b.health = h.passive()
+		}
+	}
+}
+
+// passive returns a copy of the passive ejection state, without the probe results.
+func (h *health) passive() *health {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return &health{
+		failures:     h.failures,
+		ejections:    h.ejections,
+		ejectedUntil: h.ejectedUntil,
+	}
+}
+
+// probe requests the health check path from the backend.
+func (lb *LoadBalancer) probe(ctx context.Context, client *http.Client, b *Backend) error {
+	if lb.HealthCheck.Timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, lb.HealthCheck.Timeout)
+		defer cancel()
+	}
+
+	u := *b.URL
+	u.Path = singleJoiningSlash(b.URL.Path, lb.HealthCheck.Path)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if !lb.HealthCheck.expected(resp.StatusCode) {
+		return fmt.Errorf("health check %s responded %s", u.String(), resp.Status)
+	}
+
+	return nil
+}
+
+// StartHealthChecks probes every backend each HealthCheck.Interval until ctx is done, the
+// first probes are made immediately.
+func (lb *LoadBalancer) StartHealthChecks(ctx context.Context) {
+	if lb.HealthCheck.Interval <= 0 {
+		return
+	}
+
+	client := &http.Client{
+		Transport: lb.transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	probeAll := func() {
+		var wg sync.WaitGroup
+
+		for _, b := range lb.Backends {
+			wg.Add(1)
+
+			go func(b *Backend) {
+				defer wg.Done()
+
+				err := lb.probe(ctx, client, b)
+				if ctx.Err() == nil {
+					b.reportProbe(err)
+				}
+			}(b)
+		}
+
+		wg.Wait()
+	}
+
+	go func() {
+		ticker := time.NewTicker(lb.HealthCheck.Interval)
+		defer ticker.Stop()
+
+		for {
+			probeAll()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,245 @@
+package proxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/koshatul/auth-proxy/proxy"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HealthCheck", func() {
+	var (
+		good, bad   *httptest.Server
+		badStatus   int32
+		probes      int32
+		goodBackend *proxy.Backend
+		badBackend  *proxy.Backend
+	)
+
+	get := func(h http.Handler) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/", nil))
+
+		return rec
+	}
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&badStatus, http.StatusInternalServerError)
+		atomic.StoreInt32(&probes, 0)
+
+		good = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("good"))
+		}))
+		bad = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" {
+				atomic.AddInt32(&probes, 1)
+			}
+
+			w.WriteHeader(int(atomic.LoadInt32(&badStatus)))
+			_, _ = w.Write([]byte("bad"))
+		}))
+
+		goodBackend = mustBackend(good.URL, 1)
+		badBackend = mustBackend(bad.URL, 1)
+	})
+
+	AfterEach(func() {
+		good.Close()
+		bad.Close()
+	})
+
+	Context("passive", func() {
+		It("ejects a backend after consecutive server errors", func() {
+			lb, _ := proxy.NewLoadBalancer([]*proxy.Backend{goodBackend, badBackend}, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+			lb.HealthCheck = proxy.HealthCheck{MaxFailures: 2, Backoff: time.Hour}
+
+			bodies := map[string]int{}
+			for i := 0; i < 10; i++ {
+				bodies[get(lb).Body.String()]++
+			}
+
+			Expect(bodies).To(Equal(map[string]int{"good": 8, "bad": 2}))
+			Expect(badBackend.Healthy()).To(BeFalse())
+			Expect(badBackend.Status().EjectedUntil).NotTo(BeNil())
+			Expect(badBackend.Status().LastError).To(Equal("500 Internal Server Error"))
+		})
+
+		It("ejects a backend after connection errors", func() {
+			bad.Close()
+
+			lb, _ := proxy.NewLoadBalancer([]*proxy.Backend{badBackend}, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+			lb.HealthCheck = proxy.HealthCheck{MaxFailures: 1, Backoff: time.Hour}
+
+			Expect(get(lb).Code).To(Equal(http.StatusBadGateway))
+
+			rec := get(lb)
+			Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(rec.Body.String()).To(ContainSubstring("no healthy backends available"))
+		})
+
+		It("brings an ejected backend back after the backoff", func() {
+			lb, _ := proxy.NewLoadBalancer([]*proxy.Backend{badBackend}, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+			lb.HealthCheck = proxy.HealthCheck{MaxFailures: 1, Backoff: 50 * time.Millisecond}
+
+			Expect(get(lb).Code).To(Equal(http.StatusInternalServerError))
+			Expect(get(lb).Code).To(Equal(http.StatusServiceUnavailable))
+
+			atomic.StoreInt32(&badStatus, http.StatusOK)
+
+			Eventually(func() int { return get(lb).Code }).Should(Equal(http.StatusOK))
+			Expect(badBackend.Status().Ejections).To(BeZero())
+		})
+
+		It("doubles the backoff of repeated ejections up to the maximum", func() {
+			lb, _ := proxy.NewLoadBalancer([]*proxy.Backend{badBackend}, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+			lb.HealthCheck = proxy.HealthCheck{MaxFailures: 1, Backoff: 20 * time.Millisecond, MaxBackoff: 60 * time.Millisecond}
+
+			ejectedFor := func() time.Duration {
+				Eventually(func() int { return get(lb).Code }).Should(Equal(http.StatusInternalServerError))
+
+				return time.Until(*badBackend.Status().EjectedUntil)
+			}
+
+			Expect(ejectedFor()).To(BeNumerically("~", 20*time.Millisecond, 15*time.Millisecond))
+			Expect(ejectedFor()).To(BeNumerically("~", 40*time.Millisecond, 15*time.Millisecond))
+			Expect(ejectedFor()).To(BeNumerically("~", 60*time.Millisecond, 15*time.Millisecond))
+			Expect(ejectedFor()).To(BeNumerically("~", 60*time.Millisecond, 15*time.Millisecond))
+			Expect(badBackend.Status().Ejections).To(Equal(4))
+		})
+
+		It("keeps the health of backends with the same URL across a reload", func() {
+			lb, _ := proxy.NewLoadBalancer([]*proxy.Backend{badBackend}, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+			lb.HealthCheck = proxy.HealthCheck{MaxFailures: 1, Backoff: time.Hour}
+
+			Expect(get(lb).Code).To(Equal(http.StatusInternalServerError))
+
+			reloaded, _ := proxy.NewLoadBalancer(
+				[]*proxy.Backend{mustBackend(bad.URL, 1), mustBackend(good.URL, 1)},
+				proxy.RoundRobin, false, nil, proxy.TransportConfig{},
+			)
+			reloaded.HealthCheck = lb.HealthCheck
+			reloaded.InheritHealth(lb)
+
+			Expect(reloaded.Backends[0].Healthy()).To(BeFalse())
+			Expect(reloaded.Backends[0].Status().Ejections).To(Equal(1))
+			Expect(reloaded.Backends[1].Healthy()).To(BeTrue())
+
+			for i := 0; i < 4; i++ {
+				Expect(get(reloaded).Body.String()).To(Equal("good"))
+			}
+		})
+
+		It("does nothing when disabled", func() {
+			lb, _ := proxy.NewLoadBalancer([]*proxy.Backend{badBackend}, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+
+			for i := 0; i < 10; i++ {
+				Expect(get(lb).Code).To(Equal(http.StatusInternalServerError))
+			}
+
+			Expect(badBackend.Status().Failures).To(Equal(10))
+		})
+	})
+
+	Context("active", func() {
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+		)
+
+		BeforeEach(func() {
+			ctx, cancel = context.WithCancel(context.Background())
+		})
+
+		AfterEach(func() {
+			cancel()
+		})
+
+		It("skips backends that fail the probe until they pass again", func() {
+			lb, _ := proxy.NewLoadBalancer([]*proxy.Backend{goodBackend, badBackend}, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+			lb.HealthCheck = proxy.HealthCheck{Path: "/healthz", Interval: 20 * time.Millisecond}
+			lb.StartHealthChecks(ctx)
+
+			Eventually(badBackend.Healthy).Should(BeFalse())
+			Expect(goodBackend.Healthy()).To(BeTrue())
+
+			for i := 0; i < 4; i++ {
+				Expect(get(lb).Body.String()).To(Equal("good"))
+			}
+
+			Expect(badBackend.Status().ProbeFailed).To(BeTrue())
+			Expect(badBackend.Status().LastError).To(ContainSubstring("/healthz responded 500 Internal Server Error"))
+
+			atomic.StoreInt32(&badStatus, http.StatusOK)
+			Eventually(badBackend.Healthy).Should(BeTrue())
+		})
+
+		It("accepts only the expected status when set", func() {
+			atomic.StoreInt32(&badStatus, http.StatusNoContent)
+
+			lb, _ := proxy.NewLoadBalancer([]*proxy.Backend{badBackend}, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+			lb.HealthCheck = proxy.HealthCheck{Path: "/healthz", Interval: 20 * time.Millisecond, ExpectedStatus: http.StatusOK}
+			lb.StartHealthChecks(ctx)
+
+			Eventually(badBackend.Healthy).Should(BeFalse())
+			Expect(get(lb).Code).To(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("keeps failed probes across a reload only while the probes are unchanged", func() {
+			lb, _ := proxy.NewLoadBalancer([]*proxy.Backend{badBackend}, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+			lb.HealthCheck = proxy.HealthCheck{MaxFailures: 1, Backoff: 300 * time.Millisecond}
+
+			Expect(get(lb).Code).To(Equal(http.StatusInternalServerError))
+
+			probing := lb.HealthCheck
+			probing.Path = "/healthz"
+			probing.Interval = time.Hour
+			lb.HealthCheck = probing
+			lb.StartHealthChecks(ctx)
+
+			Eventually(func() bool { return badBackend.Status().ProbeFailed }).Should(BeTrue())
+
+			reload := func(hc proxy.HealthCheck) *proxy.Backend {
+				reloaded, _ := proxy.NewLoadBalancer([]*proxy.Backend{mustBackend(bad.URL, 1)}, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+				reloaded.HealthCheck = hc
+				reloaded.InheritHealth(lb)
+
+				return reloaded.Backends[0]
+			}
+
+			Expect(reload(probing).Status().ProbeFailed).To(BeTrue())
+
+			moved := probing
+			moved.Path = "/ready"
+			Expect(reload(moved).Status().ProbeFailed).To(BeFalse())
+
+			disabled := probing
+			disabled.Interval = 0
+			b := reload(disabled)
+			Expect(b.Status().ProbeFailed).To(BeFalse())
+			Expect(b.Status().LastError).To(BeEmpty())
+
+			// the passive ejection is kept, then ends with its backoff
+			Expect(b.Status().Ejections).To(Equal(1))
+			Expect(b.Healthy()).To(BeFalse())
+			Eventually(b.Healthy).Should(BeTrue())
+		})
+
+		It("stops probing when the context is done", func() {
+			lb, _ := proxy.NewLoadBalancer([]*proxy.Backend{badBackend}, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+			lb.HealthCheck = proxy.HealthCheck{Path: "/healthz", Interval: 10 * time.Millisecond}
+			lb.StartHealthChecks(ctx)
+
+			Eventually(func() int32 { return atomic.LoadInt32(&probes) }).Should(BeNumerically(">=", 2))
+			cancel()
+
+			time.Sleep(20 * time.Millisecond)
+			n := atomic.LoadInt32(&probes)
+			Consistently(func() int32 { return atomic.LoadInt32(&probes) }, 50*time.Millisecond).Should(Equal(n))
+		})
+	})
+})
@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	"github.com/koshatul/auth-proxy/requestid"
+	"go.uber.org/zap"
+)
+
+// ErrNoBackends is returned when a load balancer is created without any backends.
+var ErrNoBackends = errors.New("no backends configured")
+
+type attemptContextKey struct{}
+
+// attempt is the state of a single attempt to proxy a request to a backend.
+type attempt struct {
+	backend  *Backend
+	canRetry bool
+	retry    bool
+}
+
+// LoadBalancer is a reverse proxy that spreads requests over a pool of backends, each request is
+// routed to the scheme, host and base path of the backend picked by the Balancer the same way as
+// NewSingleHostReverseProxy. Unhealthy backends are skipped, if none are healthy the request fails
+// with 503 Service Unavailable.
+type LoadBalancer struct {
+	Backends    []*Backend
+	Balancer    Balancer
+	Strategy    string
+	HealthCheck HealthCheck
+
+	// Logger receives backend errors, defaults to a no-op logger.
+	Logger *zap.Logger
+
+	// ErrorTemplates renders the responses to failed requests, defaults to DefaultErrorTemplates.
+	ErrorTemplates *ErrorTemplates
+
+	proxy     *httputil.ReverseProxy
+	transport *http.Transport
+	retry     RetryPolicy
+	budget    *retryBudget
+}
+
+// NewLoadBalancer returns a LoadBalancer for the backends using the named strategy.
+func NewLoadBalancer(
+	backends []*Backend,
+	strategy string,
+	passHostHeader bool,
+	tlsConfig *tls.Config,
+	transport TransportConfig,
+) (*LoadBalancer, error) {
+	if len(backends) == 0 {
+		return nil, ErrNoBackends
+	}
+
+	balancer, err := NewBalancer(strategy, backends)
+	if err != nil {
+		return nil, err
+	}
+
+	lb := &LoadBalancer{
+		Backends:       backends,
+		Balancer:       balancer,
+		Strategy:       strategy,
+		Logger:         zap.NewNop(),
+		ErrorTemplates: DefaultErrorTemplates(),
+		transport:      newTransport(tlsConfig, transport),
+		budget:         newRetryBudget(RetryPolicy{}),
+	}
+
+	lb.proxy = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			rewriteRequest(req, BackendFromRequest(req).URL, passHostHeader)
+		},
+		Transport:      &timedTransport{RoundTripper: &breakerTransport{RoundTripper: lb.transport}},
+		FlushInterval:  transport.FlushInterval,
+		ModifyResponse: lb.modifyResponse,
+		ErrorHandler:   lb.errorHandler,
+	}
+
+	return lb, nil
+}
+
+// SetRetryPolicy sets how requests that fail to reach a backend are retried, the retry budget
+// starts full.
+func (lb *LoadBalancer) SetRetryPolicy(p RetryPolicy) {
+	lb.retry = p
+	lb.budget = newRetryBudget(p)
+}
+
+// SetBreaker gives each backend a circuit breaker, a zero ErrorRate removes them.
+func (lb *LoadBalancer) SetBreaker(config BreakerConfig) {
+	for _, b := range lb.Backends {
+		b.breaker = nil
+
+		if config.ErrorRate > 0 {
+			b.breaker = newBreaker(b.String(), config)
+		}
+	}
+}
+
+// CloseIdleConnections closes the idle connections to the backends (and those used by the health
+// checks).
+func (lb *LoadBalancer) CloseIdleConnections() {
+	lb.transport.CloseIdleConnections()
+}
+
+// ServeHTTP satisfies the http.Handler interface for LoadBalancer.
+func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if lb.retry.Attempts > 0 {
+		lb.budget.deposit()
+	}
+
+	tried := map[*Backend]bool{}
+
+	for n := 0; ; n++ {
+		candidates, retryAfter := lb.available(tried)
+		if len(candidates) == 0 {
+			if retryAfter > 0 {
+				lb.writeError(w, r, &CircuitOpenError{RetryAfter: retryAfter})
+
+				return
+			}
+
+			lb.logger().Warn("no healthy backends available", requestid.Field(r.Context()))
+			lb.ErrorTemplates.Write(w, r, ErrorPage{
+				Status:  http.StatusServiceUnavailable,
+				Class:   ErrorNoBackends,
+				Message: "no healthy backends available",
+			})
+
+			return
+		}
+
+		a := &attempt{
+			backend:  lb.Balancer.Next(r, candidates),
+			canRetry: n < lb.retry.Attempts && replayable(r),
+		}
+		tried[a.backend] = true
+
+		lb.serve(w, r, a)
+
+		if !a.retry {
+			return
+		}
+	}
+}
+
+func (lb *LoadBalancer) serve(w http.ResponseWriter, r *http.Request, a *attempt) {
+	// counted until the response (or upgraded connection) is finished, for least-conn
+	a.backend.acquire()
+	defer a.backend.release()
+
+	lb.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), attemptContextKey{}, a)))
+}
+
+// Status returns a snapshot of the health of each backend.
+func (lb *LoadBalancer) Status() []BackendStatus {
+	status := make([]BackendStatus, len(lb.Backends))
+	for i, b := range lb.Backends {
+		status[i] = b.Status()
+	}
+
+	return status
+}
+
+// available returns the healthy backends whose circuit breakers are closed that haven't been
+// tried, or if they have all been tried every available backend. When there are none and a
+// healthy backend's breaker is open, it returns how long until the first breaker lets a request
+// through.
+func (lb *LoadBalancer) available(tried map[*Backend]bool) ([]*Backend, time.Duration) {
+	candidates := make([]*Backend, 0, len(lb.Backends))
+	untried := make([]*Backend, 0, len(lb.Backends))
+
+	var retryAfter time.Duration
+
+	for _, b := range lb.Backends {
+		if !b.Healthy() {
+			continue
+		}
+
+		if b.breaker != nil {
+			if ok, wait := b.breaker.Ready(); !ok {
+				if retryAfter == 0 || wait < retryAfter {
+					retryAfter = wait
+				}
+
+				continue
+			}
+		}
+
+		candidates = append(candidates, b)
+
+		if !tried[b] {
+			untried = append(untried, b)
+		}
+	}
+
+	if len(untried) > 0 {
+		return untried, 0
+	}
+
+	return candidates, retryAfter
+}
+
+// modifyResponse counts server errors towards ejecting the backend.
+func (lb *LoadBalancer) modifyResponse(resp *http.Response) error {
+	backend := BackendFromRequest(resp.Request)
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		backend.reportFailure(lb.HealthCheck, errors.New(resp.Status))
+	} else {
+		backend.reportSuccess()
+	}
+
+	return nil
+}
+
+// errorHandler counts connection errors towards ejecting the backend (unless the client went
+// away), if the request can be retried it is left to ServeHTTP otherwise the error is logged and
+// written with the status for its class.
+func (lb *LoadBalancer) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	backend := BackendFromRequest(r)
+
+	var open *CircuitOpenError
+	if !errors.As(err, &open) && !errors.Is(err, context.Canceled) {
+		backend.reportFailure(lb.HealthCheck, err)
+	}
+
+	class, _ := ClassifyError(err)
+	fields := []zap.Field{
+		requestid.Field(r.Context()),
+		zap.String("backend", backend.String()),
+		zap.String("class", class),
+		zap.Error(err),
+	}
+
+	if a := attemptFromRequest(r); a != nil && a.canRetry && connectionFailure(err) && lb.budget.withdraw() {
+		lb.logger().Debug("retrying backend request", fields...)
+
+		a.retry = true
+
+		return
+	}
+
+	if class == ErrorCanceled {
+		lb.logger().Debug("client canceled backend request", fields...)
+	} else {
+		lb.logger().Warn("backend request failed", fields...)
+	}
+
+	lb.writeError(w, r, err)
+}
+
+// writeError responds with the error page for a backend error, an open circuit breaker includes
+// the seconds until it lets requests through again.
+func (lb *LoadBalancer) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	class, status := ClassifyError(err)
+	page := ErrorPage{Status: status, Class: class, Message: errorMessage(class)}
+
+	var open *CircuitOpenError
+	if errors.As(err, &open) {
+		page.RetryAfter = retryAfterSeconds(open.RetryAfter)
+	}
+
+	lb.ErrorTemplates.Write(w, r, page)
+}
+
+func (lb *LoadBalancer) logger() *zap.Logger {
+	if lb.Logger == nil {
+		return zap.NewNop()
+	}
+
+	return lb.Logger
+}
+
+// errorMessage returns the message shown to clients for an error class, the details are only logged.
+func errorMessage(class string) string {
+	switch class {
+	case ErrorTimeout:
+		return "backend did not respond in time"
+	case ErrorConnectionRefused:
+		return "backend refused the connection"
+	case ErrorTLS:
+		return "secure connection to the backend failed"
+	case ErrorCircuitOpen:
+		return "backend unavailable, circuit breaker is open"
+	}
+
+	return "backend request failed"
+}
+
+// BackendFromRequest returns the backend picked for a request by a LoadBalancer, or nil.
+func BackendFromRequest(r *http.Request) *Backend {
+	if a := attemptFromRequest(r); a != nil {
+		return a.backend
+	}
+
+	return nil
+}
+
+func attemptFromRequest(r *http.Request) *attempt {
+	a, _ := r.Context().Value(attemptContextKey{}).(*attempt)
+
+	return a
+}
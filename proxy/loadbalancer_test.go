@@ -0,0 +1,156 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/koshatul/auth-proxy/proxy"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LoadBalancer", func() {
+	var (
+		servers []*httptest.Server
+		release chan struct{}
+	)
+
+	// newServer starts a backend that replies with its name and the request URI, requests to
+	// /slow are held until release is closed.
+	newServer := func(name string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/base/slow" {
+				<-release
+			}
+
+			_, _ = w.Write([]byte(name + " " + r.URL.RequestURI()))
+		}))
+		servers = append(servers, s)
+
+		return s
+	}
+
+	get := func(h http.Handler, target string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		body, _ := ioutil.ReadAll(rec.Body)
+
+		return string(body)
+	}
+
+	BeforeEach(func() {
+		servers = nil
+		release = make(chan struct{})
+	})
+
+	AfterEach(func() {
+		for _, s := range servers {
+			s.Close()
+		}
+	})
+
+	It("requires at least one backend", func() {
+		_, err := proxy.NewLoadBalancer(nil, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+		Expect(err).To(MatchError(proxy.ErrNoBackends))
+	})
+
+	It("joins the path and query of the picked backend", func() {
+		one := mustBackend(newServer("one").URL+"/base?from=one", 1)
+		two := mustBackend(newServer("two").URL+"/base/", 1)
+
+		lb, err := proxy.NewLoadBalancer([]*proxy.Backend{one, two}, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(get(lb, "/v2/?n=1")).To(Equal("one /base/v2/?from=one&n=1"))
+		Expect(get(lb, "/v2/?n=2")).To(Equal("two /base/v2/?n=2"))
+		Expect(get(lb, "/v2/")).To(Equal("one /base/v2/?from=one"))
+	})
+
+	It("sends new requests to the backend with the fewest in flight", func() {
+		one := mustBackend(newServer("one").URL+"/base", 1)
+		two := mustBackend(newServer("two").URL+"/base", 1)
+
+		lb, err := proxy.NewLoadBalancer([]*proxy.Backend{one, two}, proxy.LeastConn, false, nil, proxy.TransportConfig{})
+		Expect(err).NotTo(HaveOccurred())
+
+		done := make(chan string)
+
+		go func() {
+			defer GinkgoRecover()
+			done <- get(lb, "/slow")
+		}()
+
+		Eventually(func() int64 { return one.Active() + two.Active() }).Should(BeEquivalentTo(1))
+
+		busy, idle := "one", "two"
+		if two.Active() == 1 {
+			busy, idle = "two", "one"
+		}
+
+		for i := 0; i < 3; i++ {
+			Expect(get(lb, "/fast")).To(Equal(idle + " /base/fast"))
+		}
+
+		close(release)
+		Expect(<-done).To(Equal(busy + " /base/slow"))
+		Expect(one.Active() + two.Active()).To(BeZero())
+	})
+
+	It("keeps a user on the same backend", func() {
+		pool := []*proxy.Backend{
+			mustBackend(newServer("one").URL, 1),
+			mustBackend(newServer("two").URL, 1),
+			mustBackend(newServer("three").URL, 1),
+		}
+
+		lb, err := proxy.NewLoadBalancer(pool, proxy.ConsistentHash, false, nil, proxy.TransportConfig{})
+		Expect(err).NotTo(HaveOccurred())
+
+		seen := map[string]bool{}
+
+		for i := 0; i < 5; i++ {
+			rec := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+			r.URL.User = url.User("alice")
+			lb.ServeHTTP(rec, r)
+
+			seen[rec.Body.String()] = true
+		}
+
+		Expect(seen).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("ParseTargets", func() {
+	It("accepts strings and tables", func() {
+		backends, err := proxy.ParseTargets([]interface{}{
+			"http://a:5000/",
+			map[string]interface{}{"uri": "https://b:5000/v2", "weight": "3"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backends).To(HaveLen(2))
+		Expect(backends[0].String()).To(Equal("http://a:5000/"))
+		Expect(backends[0].Weight).To(Equal(1))
+		Expect(backends[1].String()).To(Equal("https://b:5000/v2"))
+		Expect(backends[1].Weight).To(Equal(3))
+	})
+
+	It("returns nothing when unset", func() {
+		Expect(proxy.ParseTargets(nil)).To(BeEmpty())
+	})
+
+	DescribeTable("rejects invalid targets",
+		func(raw interface{}, message string) {
+			_, err := proxy.ParseTargets(raw)
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		},
+		Entry("not an array", "http://a:5000", "expected an array"),
+		Entry("not a string or table", []interface{}{42}, "backend target 0: expected a string or table"),
+		Entry("relative URI", []interface{}{"a:5000"}, `backend URI "a:5000" must be an absolute http or https URL`),
+		Entry("negative weight", []interface{}{map[string]interface{}{"uri": "http://a", "weight": -1}}, "weight -1 is negative"),
+		Entry("unknown key", []interface{}{map[string]interface{}{"url": "http://a"}}, "invalid keys: url"),
+	)
+})
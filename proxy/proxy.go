@@ -6,6 +6,15 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"time"
+
+	"github.com/koshatul/auth-proxy/logformat"
+	"github.com/koshatul/auth-proxy/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func singleJoiningSlash(a, b string) string {
@@ -28,36 +37,75 @@ func singleJoiningSlash(a, b string) string {
 // the target request will be for /base/dir.
 // NewSingleHostReverseProxy rewrites the Host header, and uses a custom tlsConfig.
 func NewSingleHostReverseProxy(target *url.URL, passHostHeader bool, tlsConfig *tls.Config) *httputil.ReverseProxy {
-	targetQuery := target.RawQuery
 	director := func(req *http.Request) {
-		req.URL.Scheme = target.Scheme
-		req.URL.Host = target.Host
-		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
-
-		if !passHostHeader {
-			req.Host = target.Host
-		}
-
-		if targetQuery == "" || req.URL.RawQuery == "" {
-			req.URL.RawQuery = targetQuery + req.URL.RawQuery
-		} else {
-			req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
-		}
-
-		if _, ok := req.Header["User-Agent"]; !ok {
-			// explicitly disable User-Agent so it's not set to default value
-			req.Header.Set("User-Agent", "")
-		}
+		rewriteRequest(req, target, passHostHeader)
 	}
 
-	if tlsConfig == nil {
-		tlsConfig = &tls.Config{}
+	return &httputil.ReverseProxy{
+		Director:  director,
+		Transport: &timedTransport{RoundTripper: newTransport(tlsConfig, TransportConfig{})},
 	}
+}
 
-	tr := &http.Transport{TLSClientConfig: tlsConfig}
+// rewriteRequest points the request at the target, joining the target's base path and query
+// with the request's.
+func rewriteRequest(req *http.Request, target *url.URL, passHostHeader bool) {
+	targetQuery := target.RawQuery
 
-	return &httputil.ReverseProxy{
-		Director:  director,
-		Transport: tr,
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
+
+	if !passHostHeader {
+		req.Host = target.Host
+	}
+
+	if targetQuery == "" || req.URL.RawQuery == "" {
+		req.URL.RawQuery = targetQuery + req.URL.RawQuery
+	} else {
+		req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
+	}
+
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// explicitly disable User-Agent so it's not set to default value
+		req.Header.Set("User-Agent", "")
 	}
+
+	logformat.FieldsFromRequest(req).SetRoute(target.Host)
+}
+
+// timedTransport records the time taken for the backend to return response headers
+// in the request log fields, it also starts a client span for the backend request and
+// forwards the trace context in the traceparent header.
+type timedTransport struct {
+	http.RoundTripper
+}
+
+// RoundTrip satisfies the http.RoundTripper interface for timedTransport.
+func (t *timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracing.Tracer().Start(req.Context(), "proxy.upstream",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPClientAttributesFromHTTPRequest(req)...),
+	)
+	defer span.End()
+
+	out := req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(out.Header))
+
+	start := time.Now()
+	res, err := t.RoundTripper.RoundTrip(out)
+
+	logformat.FieldsFromRequest(req).SetUpstreamLatency(time.Since(start))
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		return res, err
+	}
+
+	span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(res.StatusCode)...)
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(res.StatusCode))
+
+	return res, err
 }
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// RetryPolicy configures retrying requests that failed to reach a backend, the zero value
+// disables retries.
+//
+// Only idempotent requests without a body are retried, and only when the connection to the
+// backend failed (the backend can't have acted on the request). Each retry goes to another
+// healthy backend when there is one.
+type RetryPolicy struct {
+	// Attempts is the number of retries after the first attempt.
+	Attempts int
+
+	// BudgetRatio limits retries to this fraction of requests (eg. 0.2 allows one retry for
+	// every five requests) so a failing pool isn't sent a multiple of its normal load, up to
+	// BudgetBurst retries can be made before the budget has been earned.
+	BudgetRatio float64
+	BudgetBurst int
+}
+
+// retryBudget is a token bucket filled by requests and emptied by retries.
+type retryBudget struct {
+	lock    sync.Mutex
+	ratio   float64
+	max     float64
+	balance float64
+}
+
+func newRetryBudget(p RetryPolicy) *retryBudget {
+	return &retryBudget{
+		ratio:   p.BudgetRatio,
+		max:     float64(p.BudgetBurst),
+		balance: float64(p.BudgetBurst),
+	}
+}
+
+// deposit adds the share of a retry earned by a request.
+func (b *retryBudget) deposit() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.balance += b.ratio
+	if b.balance > b.max {
+		b.balance = b.max
+	}
+}
+
+// withdraw takes a retry from the budget, it returns false if the budget is spent.
+func (b *retryBudget) withdraw() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.balance < 1 {
+		return false
+	}
+
+	b.balance--
+
+	return true
+}
+
+// nolint: gochecknoglobals // methods that are safe to retry
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// replayable returns true if the request can be sent again, it must be idempotent and have
+// no body to replay.
+func replayable(r *http.Request) bool {
+	return idempotentMethods[r.Method] && r.ContentLength == 0 &&
+		(r.Body == nil || r.Body == http.NoBody)
+}
+
+// connectionFailure returns true if err means the connection to the backend couldn't be made,
+// so the request never reached it. Errors once the connection is made (eg. the backend closing
+// it before responding) aren't connection failures, the backend may have acted on the request.
+func connectionFailure(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var opErr *net.OpError
+
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
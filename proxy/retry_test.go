@@ -0,0 +1,197 @@
+package proxy_test
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/koshatul/auth-proxy/proxy"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transport", func() {
+	var (
+		good *httptest.Server
+		dead *proxy.Backend
+	)
+
+	serve := func(h http.Handler, method string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+
+		var r *http.Request
+		if method == http.MethodPost {
+			r = httptest.NewRequest(method, "/v2/", strings.NewReader("body"))
+		} else {
+			r = httptest.NewRequest(method, "/v2/", nil)
+		}
+
+		h.ServeHTTP(rec, r)
+
+		return rec
+	}
+
+	BeforeEach(func() {
+		good = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("good"))
+		}))
+
+		// dead is a backend that refuses connections
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		dead = mustBackend("http://"+l.Addr().String(), 1)
+		l.Close()
+	})
+
+	AfterEach(func() {
+		good.Close()
+	})
+
+	Context("retries", func() {
+		It("retries an idempotent request on another backend", func() {
+			pool := []*proxy.Backend{dead, mustBackend(good.URL, 1)}
+			lb, _ := proxy.NewLoadBalancer(pool, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+			lb.SetRetryPolicy(proxy.RetryPolicy{Attempts: 1, BudgetRatio: 0.2, BudgetBurst: 10})
+
+			rec := serve(lb, http.MethodGet)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Body.String()).To(Equal("good"))
+			Expect(dead.Status().Failures).To(Equal(1))
+		})
+
+		It("does not retry a request with a body", func() {
+			pool := []*proxy.Backend{dead, mustBackend(good.URL, 1)}
+			lb, _ := proxy.NewLoadBalancer(pool, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+			lb.SetRetryPolicy(proxy.RetryPolicy{Attempts: 1, BudgetRatio: 0.2, BudgetBurst: 10})
+
+			Expect(serve(lb, http.MethodPost).Code).To(Equal(http.StatusBadGateway))
+		})
+
+		It("stops retrying after the attempts", func() {
+			lb, _ := proxy.NewLoadBalancer(
+				[]*proxy.Backend{dead},
+				proxy.RoundRobin, false, nil, proxy.TransportConfig{},
+			)
+			lb.SetRetryPolicy(proxy.RetryPolicy{Attempts: 2, BudgetRatio: 0.2, BudgetBurst: 10})
+
+			Expect(serve(lb, http.MethodGet).Code).To(Equal(http.StatusBadGateway))
+			Expect(dead.Status().Failures).To(Equal(3))
+		})
+
+		It("stops retrying when the budget is spent", func() {
+			lb, _ := proxy.NewLoadBalancer(
+				[]*proxy.Backend{dead},
+				proxy.RoundRobin, false, nil, proxy.TransportConfig{},
+			)
+			lb.SetRetryPolicy(proxy.RetryPolicy{Attempts: 1, BudgetRatio: 0.5, BudgetBurst: 1})
+
+			// the burst allows the first retry, then a retry is earned every second request
+			attempts := []int{}
+			for i := 0; i < 5; i++ {
+				before := dead.Status().Failures
+				Expect(serve(lb, http.MethodGet).Code).To(Equal(http.StatusBadGateway))
+				attempts = append(attempts, dead.Status().Failures-before)
+			}
+
+			Expect(attempts).To(Equal([]int{2, 1, 2, 1, 2}))
+		})
+
+		It("does not retry when the backend closes the connection after the request was sent", func() {
+			// closer reads each request then closes the connection without responding
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			defer l.Close()
+
+			var received int32
+
+			go func() {
+				for {
+					conn, err := l.Accept()
+					if err != nil {
+						return
+					}
+
+					if _, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+						atomic.AddInt32(&received, 1)
+					}
+
+					conn.Close()
+				}
+			}()
+
+			pool := []*proxy.Backend{mustBackend("http://"+l.Addr().String(), 1), mustBackend(good.URL, 1)}
+			lb, _ := proxy.NewLoadBalancer(pool, proxy.RoundRobin, false, nil, proxy.TransportConfig{})
+			lb.SetRetryPolicy(proxy.RetryPolicy{Attempts: 1, BudgetRatio: 0.2, BudgetBurst: 10})
+
+			Expect(serve(lb, http.MethodGet).Code).To(Equal(http.StatusBadGateway))
+			Expect(atomic.LoadInt32(&received)).To(Equal(int32(1)))
+		})
+
+		It("does not retry when disabled", func() {
+			lb, _ := proxy.NewLoadBalancer(
+				[]*proxy.Backend{dead},
+				proxy.RoundRobin, false, nil, proxy.TransportConfig{},
+			)
+
+			Expect(serve(lb, http.MethodGet).Code).To(Equal(http.StatusBadGateway))
+			Expect(dead.Status().Failures).To(Equal(1))
+		})
+	})
+
+	It("times out waiting for response headers without retrying", func() {
+		var requests int32
+
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			time.Sleep(200 * time.Millisecond)
+		}))
+		defer slow.Close()
+
+		lb, _ := proxy.NewLoadBalancer(
+			[]*proxy.Backend{mustBackend(slow.URL, 1)},
+			proxy.RoundRobin, false, nil,
+			proxy.TransportConfig{ResponseHeaderTimeout: 50 * time.Millisecond},
+		)
+		lb.SetRetryPolicy(proxy.RetryPolicy{Attempts: 2, BudgetRatio: 1, BudgetBurst: 10})
+
+		start := time.Now()
+		Expect(serve(lb, http.MethodGet).Code).To(Equal(http.StatusGatewayTimeout))
+		Expect(time.Since(start)).To(BeNumerically("<", 200*time.Millisecond))
+		Expect(atomic.LoadInt32(&requests)).To(BeEquivalentTo(1))
+	})
+
+	It("streams the response when the flush interval is negative", func() {
+		release := make(chan struct{})
+
+		stream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "12")
+			_, _ = w.Write([]byte("first\n"))
+			w.(http.Flusher).Flush()
+			<-release
+			_, _ = w.Write([]byte("last!\n"))
+		}))
+		defer stream.Close()
+
+		lb, _ := proxy.NewLoadBalancer(
+			[]*proxy.Backend{mustBackend(stream.URL, 1)},
+			proxy.RoundRobin, false, nil,
+			proxy.TransportConfig{FlushInterval: -1},
+		)
+
+		ts := httptest.NewServer(lb)
+		defer ts.Close()
+
+		resp, err := http.Get(ts.URL)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		defer close(release)
+
+		line, err := bufio.NewReader(resp.Body).ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		Expect(line).To(Equal("first\n"))
+	})
+})
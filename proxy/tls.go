@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrPinMismatch is returned when none of the backend's certificates match a pinned key.
+var ErrPinMismatch = errors.New("backend certificate does not match any pinned key")
+
+// ClientCertificate is a client certificate presented to the backends, the files are checked
+// on each handshake and the certificate is reloaded when either changes, if the new files can't
+// be loaded (eg. they are part way through being replaced) the previous certificate is used.
+type ClientCertificate struct {
+	CertFile string
+	KeyFile  string
+
+	lock    sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// LoadClientCertificate loads the certificate and key pair from PEM files.
+func LoadClientCertificate(certFile, keyFile string) (*ClientCertificate, error) {
+	c := &ClientCertificate{CertFile: certFile, KeyFile: keyFile}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *ClientCertificate) load() error {
+	certMod, keyMod, err := c.modTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return fmt.Errorf("loading client certificate: %w", err)
+	}
+
+	c.cert, c.certMod, c.keyMod = &cert, certMod, keyMod
+
+	return nil
+}
+
+func (c *ClientCertificate) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(c.CertFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("loading client certificate: %w", err)
+	}
+
+	keyInfo, err := os.Stat(c.KeyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("loading client certificate: %w", err)
+	}
+
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// Certificate returns the current certificate, reloading it first if the files have changed.
+func (c *ClientCertificate) Certificate() *tls.Certificate {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if certMod, keyMod, err := c.modTimes(); err == nil && (!certMod.Equal(c.certMod) || !keyMod.Equal(c.keyMod)) {
+		_ = c.load()
+	}
+
+	return c.cert
+}
+
+// GetClientCertificate satisfies tls.Config.GetClientCertificate.
+func (c *ClientCertificate) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.Certificate(), nil
+}
+
+// ParsePin returns the SHA-256 hash of a public key from a pin, either base64 or
+// "sha256/" followed by base64 (as output by `openssl x509 -pubkey | openssl pkey -pubin
+// -outform der | openssl dgst -sha256 -binary | base64`).
+func ParsePin(pin string) ([]byte, error) {
+	hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(pin), "sha256/"))
+	if err != nil {
+		return nil, fmt.Errorf("pin %q: %w", pin, err)
+	}
+
+	if len(hash) != sha256.Size {
+		return nil, fmt.Errorf("pin %q: expected a %d byte SHA-256 hash, got %d bytes", pin, sha256.Size, len(hash))
+	}
+
+	return hash, nil
+}
+
+// SPKIHash returns the SHA-256 hash of the certificate's public key (its SubjectPublicKeyInfo).
+func SPKIHash(cert *x509.Certificate) []byte {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	return hash[:]
+}
+
+// PinVerifier returns a tls.Config.VerifyPeerCertificate function that requires the backend to
+// have a pinned public key. When the certificate is verified the pin may be any certificate in a
+// verified chain (eg. the CA), when verification is skipped only the leaf is checked, as the rest
+// of the certificates presented by the backend are unverified.
+func PinVerifier(pins []string) (func([][]byte, [][]*x509.Certificate) error, error) {
+	hashes := make([][]byte, 0, len(pins))
+
+	for _, pin := range pins {
+		hash, err := ParsePin(pin)
+		if err != nil {
+			return nil, err
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	pinned := func(cert *x509.Certificate) bool {
+		spki := SPKIHash(cert)
+
+		for _, hash := range hashes {
+			if bytes.Equal(spki, hash) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if pinned(cert) {
+					return nil
+				}
+			}
+		}
+
+		if len(verifiedChains) > 0 || len(rawCerts) == 0 {
+			return ErrPinMismatch
+		}
+
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+
+		if pinned(leaf) {
+			return nil
+		}
+
+		return ErrPinMismatch
+	}, nil
+}
@@ -0,0 +1,284 @@
+package proxy_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/koshatul/auth-proxy/proxy"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// testCA issues certificates for the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA() *testCA {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).NotTo(HaveOccurred())
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate and key in PEM for the common name, DNS names are server names.
+func (ca *testCA) issue(commonName string, usage x509.ExtKeyUsage, dnsNames ...string) ([]byte, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).NotTo(HaveOccurred())
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	Expect(err).NotTo(HaveOccurred())
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	Expect(err).NotTo(HaveOccurred())
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+var _ = Describe("TLS", func() {
+	var (
+		ca      *testCA
+		dir     string
+		server  *httptest.Server
+		leaf    *x509.Certificate
+		clients chan string
+		names   chan string
+	)
+
+	writeFiles := func(certPEM, keyPEM []byte) (string, string) {
+		certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+		Expect(ioutil.WriteFile(certFile, certPEM, 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(keyFile, keyPEM, 0600)).To(Succeed())
+
+		return certFile, keyFile
+	}
+
+	// touch moves the modification time forward, so a rewrite within the file system's time
+	// resolution is still seen as a change
+	touch := func(files ...string) {
+		future := time.Now().Add(time.Minute)
+		for _, f := range files {
+			Expect(os.Chtimes(f, future, future)).To(Succeed())
+		}
+	}
+
+	get := func(tlsConfig *tls.Config) *httptest.ResponseRecorder {
+		lb, err := proxy.NewLoadBalancer(
+			[]*proxy.Backend{mustBackend(server.URL, 1)},
+			proxy.RoundRobin, false, tlsConfig, proxy.TransportConfig{},
+		)
+		Expect(err).NotTo(HaveOccurred())
+
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		return rec
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		dir, err = ioutil.TempDir("", "proxy-tls")
+		Expect(err).NotTo(HaveOccurred())
+
+		ca = newTestCA()
+		clients = make(chan string, 10)
+		names = make(chan string, 10)
+
+		serverPEM, serverKey := ca.issue("backend", x509.ExtKeyUsageServerAuth, "backend.internal")
+		serverCert, err := tls.X509KeyPair(serverPEM, serverKey)
+		Expect(err).NotTo(HaveOccurred())
+
+		leaf, err = x509.ParseCertificate(serverCert.Certificate[0])
+		Expect(err).NotTo(HaveOccurred())
+
+		// the CA is sent as part of the chain so it can be pinned
+		serverCert.Certificate = append(serverCert.Certificate, ca.cert.Raw)
+
+		server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			names <- r.TLS.ServerName
+			if len(r.TLS.PeerCertificates) > 0 {
+				clients <- r.TLS.PeerCertificates[0].Subject.CommonName
+			} else {
+				clients <- ""
+			}
+		}))
+		server.TLS = &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    ca.pool,
+		}
+		server.StartTLS()
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("presents the client certificate", func() {
+		cert, err := proxy.LoadClientCertificate(writeFiles(ca.issue("proxy", x509.ExtKeyUsageClientAuth)))
+		Expect(err).NotTo(HaveOccurred())
+
+		rec := get(&tls.Config{
+			RootCAs:              ca.pool,
+			ServerName:           "backend.internal",
+			GetClientCertificate: cert.GetClientCertificate,
+		})
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(<-clients).To(Equal("proxy"))
+	})
+
+	It("overrides the server name sent and verified", func() {
+		Expect(get(&tls.Config{RootCAs: ca.pool}).Code).To(Equal(http.StatusBadGateway))
+
+		Expect(get(&tls.Config{RootCAs: ca.pool, ServerName: "backend.internal"}).Code).To(Equal(http.StatusOK))
+		Expect(<-names).To(Equal("backend.internal"))
+	})
+
+	It("reloads the client certificate when the files change", func() {
+		certFile, keyFile := writeFiles(ca.issue("first", x509.ExtKeyUsageClientAuth))
+
+		cert, err := proxy.LoadClientCertificate(certFile, keyFile)
+		Expect(err).NotTo(HaveOccurred())
+
+		commonName := func() string {
+			c, err := x509.ParseCertificate(cert.Certificate().Certificate[0])
+			Expect(err).NotTo(HaveOccurred())
+
+			return c.Subject.CommonName
+		}
+
+		Expect(commonName()).To(Equal("first"))
+
+		writeFiles(ca.issue("second", x509.ExtKeyUsageClientAuth))
+		touch(certFile, keyFile)
+		Expect(commonName()).To(Equal("second"))
+
+		// a half written pair keeps the previous certificate
+		Expect(ioutil.WriteFile(keyFile, []byte("partial"), 0600)).To(Succeed())
+		touch(keyFile)
+		Expect(commonName()).To(Equal("second"))
+	})
+
+	It("requires both files to load", func() {
+		_, err := proxy.LoadClientCertificate(filepath.Join(dir, "missing.pem"), filepath.Join(dir, "missing-key.pem"))
+		Expect(err).To(MatchError(ContainSubstring("no such file or directory")))
+
+		certPEM, _ := ca.issue("proxy", x509.ExtKeyUsageClientAuth)
+		_, otherKey := ca.issue("other", x509.ExtKeyUsageClientAuth)
+		_, err = proxy.LoadClientCertificate(writeFiles(certPEM, otherKey))
+		Expect(err).To(MatchError(ContainSubstring("private key does not match public key")))
+	})
+
+	Context("pinning", func() {
+		It("accepts a backend with a pinned key", func() {
+			verify, err := proxy.PinVerifier([]string{
+				"sha256/" + base64.StdEncoding.EncodeToString(make([]byte, 32)),
+				"sha256/" + base64.StdEncoding.EncodeToString(proxy.SPKIHash(leaf)),
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			//nolint:gosec // the pin is checked instead
+			rec := get(&tls.Config{InsecureSkipVerify: true, VerifyPeerCertificate: verify})
+			Expect(rec.Code).To(Equal(http.StatusOK))
+		})
+
+		It("accepts a pinned CA key", func() {
+			verify, err := proxy.PinVerifier([]string{base64.StdEncoding.EncodeToString(proxy.SPKIHash(ca.cert))})
+			Expect(err).NotTo(HaveOccurred())
+
+			rec := get(&tls.Config{RootCAs: ca.pool, ServerName: "backend.internal", VerifyPeerCertificate: verify})
+			Expect(rec.Code).To(Equal(http.StatusOK))
+		})
+
+		It("rejects a backend without a pinned key", func() {
+			verify, err := proxy.PinVerifier([]string{base64.StdEncoding.EncodeToString(make([]byte, 32))})
+			Expect(err).NotTo(HaveOccurred())
+
+			//nolint:gosec // the pin is checked instead
+			rec := get(&tls.Config{InsecureSkipVerify: true, VerifyPeerCertificate: verify})
+			Expect(rec.Code).To(Equal(http.StatusBadGateway))
+		})
+
+		DescribeTable("rejects a pinned certificate added to another chain",
+			func(tlsConfig func() *tls.Config) {
+				// the backend's pinned certificate is sent after an unrelated leaf
+				otherPEM, otherKey := ca.issue("other", x509.ExtKeyUsageServerAuth, "backend.internal")
+				otherCert, err := tls.X509KeyPair(otherPEM, otherKey)
+				Expect(err).NotTo(HaveOccurred())
+				otherCert.Certificate = append(otherCert.Certificate, leaf.Raw)
+				server.TLS.Certificates = []tls.Certificate{otherCert}
+
+				verify, err := proxy.PinVerifier([]string{base64.StdEncoding.EncodeToString(proxy.SPKIHash(leaf))})
+				Expect(err).NotTo(HaveOccurred())
+
+				cfg := tlsConfig()
+				cfg.VerifyPeerCertificate = verify
+
+				rec := get(cfg)
+				Expect(rec.Code).To(Equal(http.StatusBadGateway))
+			},
+			Entry("without verification", func() *tls.Config {
+				return &tls.Config{InsecureSkipVerify: true} //nolint:gosec // the pin is checked instead
+			}),
+			Entry("with verification", func() *tls.Config {
+				return &tls.Config{RootCAs: ca.pool, ServerName: "backend.internal"}
+			}),
+		)
+
+		DescribeTable("rejects invalid pins",
+			func(pin, message string) {
+				_, err := proxy.PinVerifier([]string{pin})
+				Expect(err).To(MatchError(ContainSubstring(message)))
+			},
+			Entry("not base64", "sha256/not base64!", "illegal base64 data"),
+			Entry("wrong length", base64.StdEncoding.EncodeToString([]byte("short")), "expected a 32 byte SHA-256 hash, got 5 bytes"),
+		)
+	})
+})
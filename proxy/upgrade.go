@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/koshatul/auth-proxy/httpauth"
+)
+
+// DeadlineFunc returns the time after which an upgraded connection for the request must be closed.
+type DeadlineFunc func(r *http.Request) (time.Time, bool)
+
+// UpgradeHandler wraps a reverse proxy and enforces an idle timeout and an absolute deadline
+// on connections that switch protocols (eg. WebSocket), requests that are not upgrades are
+// passed through untouched.
+type UpgradeHandler struct {
+	Handler     http.Handler
+	IdleTimeout time.Duration
+	Deadline    DeadlineFunc
+}
+
+// ServeHTTP satisfies the http.Handler interface for UpgradeHandler.
+func (h *UpgradeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hj, ok := w.(http.Hijacker)
+	if !ok || !httpauth.IsUpgradeRequest(r) {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	var deadline time.Time
+
+	if h.Deadline != nil {
+		if t, ok := h.Deadline(r); ok {
+			deadline = t
+		}
+	}
+
+	h.Handler.ServeHTTP(&upgradeResponseWriter{
+		ResponseWriter: w,
+		hijacker:       hj,
+		idleTimeout:    h.IdleTimeout,
+		deadline:       deadline,
+	}, r)
+}
+
+// upgradeResponseWriter wraps the connection returned by Hijack so it can be closed
+// when it has been idle too long or the deadline passes.
+type upgradeResponseWriter struct {
+	http.ResponseWriter
+	hijacker    http.Hijacker
+	idleTimeout time.Duration
+	deadline    time.Time
+}
+
+// Hijack satisfies the http.Hijacker interface for upgradeResponseWriter.
+func (w *upgradeResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := w.hijacker.Hijack()
+	if err != nil {
+		return conn, brw, err
+	}
+
+	if w.idleTimeout <= 0 && w.deadline.IsZero() {
+		return conn, brw, nil
+	}
+
+	if !w.deadline.IsZero() && !time.Now().Before(w.deadline) {
+		_ = conn.Close()
+
+		return nil, nil, errors.New("upgrade deadline has passed")
+	}
+
+	uc := &upgradeConn{
+		Conn:        conn,
+		idleTimeout: w.idleTimeout,
+		deadline:    w.deadline,
+		done:        make(chan struct{}),
+	}
+	uc.touch()
+
+	go uc.watch()
+
+	return uc, brw, nil
+}
+
+// upgradeConn records the last time data was read or written so the watcher can
+// close it once it is idle or past its deadline.
+type upgradeConn struct {
+	net.Conn
+	idleTimeout time.Duration
+	deadline    time.Time
+	lastActive  int64
+	closeOnce   sync.Once
+	done        chan struct{}
+}
+
+func (c *upgradeConn) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+// Read satisfies the net.Conn interface for upgradeConn.
+func (c *upgradeConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.touch()
+	}
+
+	return n, err
+}
+
+// Write satisfies the net.Conn interface for upgradeConn.
+func (c *upgradeConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.touch()
+	}
+
+	return n, err
+}
+
+// Close satisfies the net.Conn interface for upgradeConn, it also stops the watcher.
+func (c *upgradeConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+
+	return c.Conn.Close()
+}
+
+// nextCheck returns how long until the connection could next be idle or expired.
+func (c *upgradeConn) nextCheck(now time.Time) time.Duration {
+	var wait time.Duration = -1
+
+	if c.idleTimeout > 0 {
+		wait = time.Unix(0, atomic.LoadInt64(&c.lastActive)).Add(c.idleTimeout).Sub(now)
+	}
+
+	if !c.deadline.IsZero() {
+		if d := c.deadline.Sub(now); wait < 0 || d < wait {
+			wait = d
+		}
+	}
+
+	if wait < 0 {
+		wait = 0
+	}
+
+	return wait
+}
+
+// expired returns true if the connection is idle or past its deadline.
+func (c *upgradeConn) expired(now time.Time) bool {
+	if !c.deadline.IsZero() && !now.Before(c.deadline) {
+		return true
+	}
+
+	return c.idleTimeout > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastActive))) >= c.idleTimeout
+}
+
+// watch closes the connection once it is idle or past its deadline.
+func (c *upgradeConn) watch() {
+	timer := time.NewTimer(c.nextCheck(time.Now()))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-timer.C:
+			if c.expired(now) {
+				_ = c.Close()
+
+				return
+			}
+
+			timer.Reset(c.nextCheck(now))
+		}
+	}
+}
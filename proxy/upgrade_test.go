@@ -0,0 +1,231 @@
+package proxy_test
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/koshatul/auth-proxy/httpauth"
+	"github.com/koshatul/auth-proxy/proxy"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	cache "github.com/patrickmn/go-cache"
+	"go.uber.org/zap"
+)
+
+const validToken string = "valid-token"
+
+var _ = Describe("upgrade", func() {
+
+	var (
+		backend     *httptest.Server
+		ts          *httptest.Server
+		tokenTTL    time.Duration
+		idleTimeout time.Duration
+		removeAuth  bool
+		backendUser string
+		backendURI  string
+	)
+
+	authFunc := func(username string, password string, r *http.Request) (string, bool) {
+		if username == validToken || password == validToken {
+			httpauth.SetSessionExpiry(r, time.Now().Add(tokenTTL))
+
+			return "test", true
+		}
+
+		return "", false
+	}
+
+	echoHandler := func(w http.ResponseWriter, r *http.Request) {
+		backendUser = r.Header.Get("X-Username")
+		backendURI = r.RequestURI + " " + r.Header.Get("Sec-WebSocket-Protocol")
+		upgrader := websocket.Upgrader{Subprotocols: []string{"echo"}}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			if err := conn.WriteMessage(mt, msg); err != nil {
+				return
+			}
+		}
+	}
+
+	startProxy := func() {
+		u, err := url.Parse(backend.URL)
+		Expect(err).NotTo(HaveOccurred())
+
+		ts = httptest.NewServer(&httpauth.BasicAuthHandler{
+			Handler: &proxy.UpgradeHandler{
+				Handler:     proxy.NewSingleHostReverseProxy(u, false, nil),
+				IdleTimeout: idleTimeout,
+				Deadline:    httpauth.SessionExpiry,
+			},
+			RemoveAuth: removeAuth,
+			BasicAuthWrapper: &httpauth.BasicAuthWrapper{
+				Cache:               cache.New(time.Minute, time.Minute),
+				Realm:               "im-a-test-realm",
+				AuthFunc:            authFunc,
+				Logger:              zap.NewNop(),
+				CacheDuration:       time.Minute,
+				TokenQueryParam:     "access_token",
+				TokenProtocolPrefix: "bearer.",
+			},
+		})
+	}
+
+	wsURL := func(query string) string {
+		return "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws" + query
+	}
+
+	expectEcho := func(conn *websocket.Conn) {
+		Expect(conn.WriteMessage(websocket.TextMessage, []byte("Hello World!"))).To(Succeed())
+		_, msg, err := conn.ReadMessage()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msg).To(Equal([]byte("Hello World!")))
+	}
+
+	BeforeEach(func() {
+		tokenTTL = time.Hour
+		idleTimeout = 0
+		removeAuth = true
+		backendUser = ""
+		backendURI = ""
+		backend = httptest.NewServer(http.HandlerFunc(echoHandler))
+	})
+
+	AfterEach(func() {
+		ts.Close()
+		backend.Close()
+	})
+
+	Context("should succeed", func() {
+
+		It("with basic authentication", func() {
+			startProxy()
+			h := http.Header{}
+			h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:"+validToken)))
+			conn, res, err := websocket.DefaultDialer.Dial(wsURL(""), h)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+			Expect(backendUser).To(Equal("test"))
+
+			expectEcho(conn)
+		})
+
+		It("with a token in the query string", func() {
+			startProxy()
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL("?access_token="+validToken), nil)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			expectEcho(conn)
+		})
+
+		It("with a token in the websocket protocol", func() {
+			startProxy()
+			dialer := &websocket.Dialer{Subprotocols: []string{"echo", "bearer." + validToken}}
+			conn, _, err := dialer.Dial(wsURL(""), nil)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			Expect(conn.Subprotocol()).To(Equal("echo"))
+
+			expectEcho(conn)
+		})
+
+		It("without forwarding the token when the authorization isn't removed", func() {
+			removeAuth = false
+			startProxy()
+			dialer := &websocket.Dialer{Subprotocols: []string{"echo", "bearer." + validToken}}
+			conn, _, err := dialer.Dial(wsURL("?room=1&access_token="+validToken), nil)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			expectEcho(conn)
+			Expect(backendURI).To(Equal("/ws?room=1 echo"))
+		})
+
+		It("without changing the rest of the query string", func() {
+			startProxy()
+			dialer := &websocket.Dialer{Subprotocols: []string{"echo", "bearer." + validToken}}
+			conn, _, err := dialer.Dial(wsURL("?b=1&a=x+y"), nil)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			Expect(backendURI).To(Equal("/ws?b=1&a=x+y echo"))
+
+			conn, _, err = websocket.DefaultDialer.Dial(wsURL("?b=1&access_token="+validToken+"&a=x%20y&c=%2F&access_token=again"), nil)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			Expect(backendURI).To(Equal("/ws?b=1&a=x%20y&c=%2F "))
+		})
+
+	})
+
+	Context("should fail", func() {
+
+		It("with no authentication", func() {
+			startProxy()
+			_, res, err := websocket.DefaultDialer.Dial(wsURL(""), nil)
+			Expect(err).To(MatchError(websocket.ErrBadHandshake))
+			Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("with an invalid token in the query string", func() {
+			startProxy()
+			_, res, err := websocket.DefaultDialer.Dial(wsURL("?access_token=invalid-token"), nil)
+			Expect(err).To(MatchError(websocket.ErrBadHandshake))
+			Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("when the connection is idle", func() {
+			idleTimeout = 100 * time.Millisecond
+			startProxy()
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL("?access_token="+validToken), nil)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			expectEcho(conn)
+
+			Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+			_, _, err = conn.ReadMessage()
+			Expect(err).To(HaveOccurred())
+			Expect(err).NotTo(MatchError(ContainSubstring("timeout")))
+		})
+
+		It("when the token expires", func() {
+			tokenTTL = 500 * time.Millisecond
+			startProxy()
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL("?access_token="+validToken), nil)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			start := time.Now()
+			Eventually(func() error {
+				if err := conn.WriteMessage(websocket.TextMessage, []byte("ping")); err != nil {
+					return err
+				}
+
+				_, _, err := conn.ReadMessage()
+
+				return err
+			}, 5*time.Second, 50*time.Millisecond).Should(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically(">=", 400*time.Millisecond))
+		})
+
+	})
+
+})
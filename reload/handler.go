@@ -0,0 +1,99 @@
+package reload
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// generation is a handler and the context its background work runs in, the context is
+// cancelled once the generation has been replaced and its in-flight requests have finished.
+type generation struct {
+	handler http.Handler
+	cancel  context.CancelFunc
+
+	refs    int64
+	retired int32
+	once    sync.Once
+}
+
+// acquire counts a request against the generation, it returns false if the generation
+// has already been replaced.
+func (g *generation) acquire() bool {
+	atomic.AddInt64(&g.refs, 1)
+
+	if atomic.LoadInt32(&g.retired) == 1 {
+		g.release()
+		return false
+	}
+
+	return true
+}
+
+func (g *generation) release() {
+	if atomic.AddInt64(&g.refs, -1) == 0 && atomic.LoadInt32(&g.retired) == 1 {
+		g.once.Do(g.cancel)
+	}
+}
+
+func (g *generation) retire() {
+	atomic.StoreInt32(&g.retired, 1)
+
+	if atomic.LoadInt64(&g.refs) == 0 {
+		g.once.Do(g.cancel)
+	}
+}
+
+// Handler is an http.Handler that serves requests with the most recently stored handler.
+type Handler struct {
+	current atomic.Value
+	lock    sync.Mutex
+}
+
+// ServeHTTP satisfies the http.Handler interface for Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for {
+		g, ok := h.current.Load().(*generation)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		if g.acquire() {
+			defer g.release()
+
+			g.handler.ServeHTTP(w, r)
+
+			return
+		}
+	}
+}
+
+// Store replaces the handler, cancel (which may be nil) is called once the previous handler's
+// in-flight requests have finished.
+func (h *Handler) Store(handler http.Handler, cancel context.CancelFunc) {
+	if cancel == nil {
+		cancel = func() {}
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	prev, _ := h.current.Load().(*generation)
+	h.current.Store(&generation{handler: handler, cancel: cancel})
+
+	if prev != nil {
+		prev.retire()
+	}
+}
+
+// Close cancels the current handler's context once its in-flight requests have finished.
+func (h *Handler) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if g, ok := h.current.Load().(*generation); ok {
+		g.retire()
+	}
+}
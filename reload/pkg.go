@@ -0,0 +1,4 @@
+// Package reload swaps a running http.Handler for one built from a new configuration, the
+// replacement is only installed if it builds successfully so a bad configuration never
+// replaces a working one.
+package reload
@@ -0,0 +1,168 @@
+package reload_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/koshatul/auth-proxy/reload"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+var _ = Describe("reload", func() {
+
+	text := func(body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		})
+	}
+
+	get := func(h http.Handler) (int, string) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		return w.Code, w.Body.String()
+	}
+
+	metrics := func() map[string]interface{} {
+		m := map[string]interface{}{}
+		Expect(json.Unmarshal([]byte(expvar.Get("config_reload").String()), &m)).To(Succeed())
+
+		return m
+	}
+
+	Describe("Handler", func() {
+
+		It("should be unavailable until a handler is stored", func() {
+			code, _ := get(&reload.Handler{})
+			Expect(code).To(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("should serve with the latest handler", func() {
+			h := &reload.Handler{}
+			h.Store(text("first"), nil)
+			_, body := get(h)
+			Expect(body).To(Equal("first"))
+
+			h.Store(text("second"), nil)
+			_, body = get(h)
+			Expect(body).To(Equal("second"))
+		})
+
+		It("should cancel the previous handler once its requests have finished", func() {
+			h := &reload.Handler{}
+			started := make(chan struct{})
+			release := make(chan struct{})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			h.Store(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				<-release
+				fmt.Fprint(w, "slow")
+			}), cancel)
+
+			done := make(chan string)
+
+			go func() {
+				_, body := get(h)
+				done <- body
+			}()
+
+			Eventually(started).Should(BeClosed())
+
+			h.Store(text("second"), nil)
+			_, body := get(h)
+			Expect(body).To(Equal("second"))
+			Consistently(ctx.Done()).ShouldNot(BeClosed())
+
+			close(release)
+			Eventually(done).Should(Receive(Equal("slow")))
+			Eventually(ctx.Done()).Should(BeClosed())
+		})
+
+		It("should cancel the current handler on close", func() {
+			h := &reload.Handler{}
+			ctx, cancel := context.WithCancel(context.Background())
+			h.Store(text("first"), cancel)
+
+			h.Close()
+			Eventually(ctx.Done()).Should(BeClosed())
+		})
+
+	})
+
+	Describe("Reloader", func() {
+
+		var (
+			handler  *reload.Handler
+			reloader *reload.Reloader
+			logobs   *observer.ObservedLogs
+			next     http.Handler
+			buildErr error
+			contexts []context.Context
+		)
+
+		BeforeEach(func() {
+			var logcore zapcore.Core
+			logcore, logobs = observer.New(zap.DebugLevel)
+			handler = &reload.Handler{}
+			contexts = nil
+			reloader = &reload.Reloader{
+				Handler: handler,
+				Logger:  zap.New(logcore),
+				Build: func(ctx context.Context) (http.Handler, error) {
+					contexts = append(contexts, ctx)
+
+					return next, buildErr
+				},
+			}
+
+			next, buildErr = text("first"), nil
+			Expect(reloader.Load(context.Background())).To(Succeed())
+		})
+
+		It("should install the new handler and cancel the old one", func() {
+			next = text("second")
+			reloader.Reload(context.Background(), "test")
+
+			_, body := get(handler)
+			Expect(body).To(Equal("second"))
+			Eventually(contexts[0].Done()).Should(BeClosed())
+			Expect(contexts[1].Err()).NotTo(HaveOccurred())
+
+			Expect(logobs.FilterMessage("configuration reloaded").Len()).To(Equal(1))
+			Expect(metrics()).To(HaveKeyWithValue("last_result", "success"))
+		})
+
+		It("should keep the running handler if the build fails", func() {
+			failures := metrics()["failure_total"].(float64)
+
+			next, buildErr = nil, errors.New("invalid backend")
+			reloader.Reload(context.Background(), "test")
+
+			_, body := get(handler)
+			Expect(body).To(Equal("first"))
+			Expect(contexts[0].Err()).NotTo(HaveOccurred())
+			Expect(contexts[1].Err()).To(HaveOccurred())
+
+			entries := logobs.FilterMessage("configuration reload failed, keeping the running configuration").All()
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].ContextMap()).To(HaveKeyWithValue("error", "invalid backend"))
+
+			m := metrics()
+			Expect(m["failure_total"]).To(Equal(failures + 1))
+			Expect(m).To(HaveKeyWithValue("last_result", "failure"))
+			Expect(m).To(HaveKeyWithValue("last_error", "invalid backend"))
+		})
+
+	})
+
+})
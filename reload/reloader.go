@@ -0,0 +1,93 @@
+package reload
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// nolint: gochecknoglobals // expvar metrics are process wide
+var (
+	metrics          = expvar.NewMap("config_reload")
+	metricSuccess    = new(expvar.Int)
+	metricFailure    = new(expvar.Int)
+	metricLastTime   = new(expvar.Int)
+	metricLastResult = new(expvar.String)
+	metricLastError  = new(expvar.String)
+)
+
+// nolint: gochecknoinits // expvar metrics are published once
+func init() {
+	metrics.Set("success_total", metricSuccess)
+	metrics.Set("failure_total", metricFailure)
+	metrics.Set("last_reload_unix", metricLastTime)
+	metrics.Set("last_result", metricLastResult)
+	metrics.Set("last_error", metricLastError)
+}
+
+// BuildFunc reads the configuration and builds and validates a handler from it, background work
+// started for the handler (eg. verification workers) should stop once ctx is done.
+type BuildFunc func(ctx context.Context) (http.Handler, error)
+
+// Reloader builds handlers with Build and installs them in Handler.
+type Reloader struct {
+	Handler *Handler
+	Build   BuildFunc
+	Logger  *zap.Logger
+
+	lock sync.Mutex
+}
+
+// Load builds the handler from the current configuration and installs it, if building fails the
+// running handler is kept and the error is returned.
+func (r *Reloader) Load(ctx context.Context) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	metricLastTime.Set(time.Now().Unix())
+
+	genCtx, cancel := context.WithCancel(ctx)
+
+	handler, err := r.Build(genCtx)
+	if err != nil {
+		cancel()
+
+		metricFailure.Add(1)
+		metricLastResult.Set("failure")
+		metricLastError.Set(err.Error())
+
+		return err
+	}
+
+	r.Handler.Store(handler, cancel)
+
+	metricSuccess.Add(1)
+	metricLastResult.Set("success")
+	metricLastError.Set("")
+
+	return nil
+}
+
+// Reload is Load with logging, it is used for reloads after startup.
+func (r *Reloader) Reload(ctx context.Context, trigger string) {
+	start := time.Now()
+
+	if err := r.Load(ctx); err != nil {
+		r.Logger.Error("configuration reload failed, keeping the running configuration",
+			zap.String("trigger", trigger),
+			zap.Duration("duration", time.Since(start)),
+			zap.Error(err),
+		)
+
+		return
+	}
+
+	r.Logger.Info("configuration reloaded",
+		zap.String("trigger", trigger),
+		zap.Duration("duration", time.Since(start)),
+	)
+}
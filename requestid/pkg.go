@@ -0,0 +1,4 @@
+// Package requestid generates (or accepts) an ID for each request that is stored in the
+// request context, forwarded to the backend and echoed in the response so log lines from
+// each component can be correlated.
+package requestid
@@ -0,0 +1,105 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	"go.uber.org/zap"
+)
+
+// DefaultHeader is the header the request ID is read from and written to.
+const DefaultHeader = "X-Request-ID"
+
+// DefaultPattern is the pattern an incoming request ID must match to be accepted.
+const DefaultPattern = `^[A-Za-z0-9._:-]{1,128}$`
+
+const idLength = 16
+
+// nolint: gochecknoglobals // compiled once
+var defaultPattern = regexp.MustCompile(DefaultPattern)
+
+type contextKey struct{}
+
+// Handler ensures every request has an ID, it is stored in the request context, set on the
+// request header (so it is forwarded to the backend) and on the response header.
+type Handler struct {
+	Handler http.Handler
+
+	// Header is the header the ID is read from and written to, defaults to DefaultHeader.
+	Header string
+
+	// TrustIncoming accepts the ID from the incoming request header if it matches Pattern.
+	TrustIncoming bool
+
+	// Pattern validates incoming IDs, defaults to DefaultPattern.
+	Pattern *regexp.Regexp
+}
+
+// ServeHTTP satisfies the http.Handler interface for Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	header := h.Header
+	if header == "" {
+		header = DefaultHeader
+	}
+
+	id := r.Header.Get(header)
+	if !h.TrustIncoming || !h.valid(id) {
+		id = New()
+	}
+
+	r.Header.Set(header, id)
+	w.Header().Set(header, id)
+
+	h.Handler.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+}
+
+func (h *Handler) valid(id string) bool {
+	if id == "" {
+		return false
+	}
+
+	if h.Pattern == nil {
+		return defaultPattern.MatchString(id)
+	}
+
+	return h.Pattern.MatchString(id)
+}
+
+// New returns a new random request ID.
+func New() string {
+	b := make([]byte, idLength)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// NewContext returns a copy of ctx carrying the request ID.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID carried by ctx, or an empty string if there is none.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+
+	return id
+}
+
+// FromRequest returns the request ID carried by the request context.
+func FromRequest(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+
+	return FromContext(r.Context())
+}
+
+// Field returns a zap field for the request ID carried by ctx.
+func Field(ctx context.Context) zap.Field {
+	return zap.String("request-id", FromContext(ctx))
+}
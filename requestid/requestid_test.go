@@ -0,0 +1,95 @@
+package requestid_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+
+	"github.com/koshatul/auth-proxy/requestid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("requestid", func() {
+
+	var (
+		seenID     string
+		seenHeader string
+	)
+
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenID = requestid.FromRequest(r)
+		seenHeader = r.Header.Get("X-Request-ID")
+	})
+
+	serve := func(h *requestid.Handler, incoming string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if incoming != "" {
+			header := h.Header
+			if header == "" {
+				header = requestid.DefaultHeader
+			}
+
+			req.Header.Set(header, incoming)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		return w
+	}
+
+	BeforeEach(func() {
+		seenID = ""
+		seenHeader = ""
+	})
+
+	It("should generate an ID when there is none", func() {
+		w := serve(&requestid.Handler{Handler: inner, TrustIncoming: true}, "")
+		Expect(seenID).To(MatchRegexp(`^[0-9a-f]{32}$`))
+		Expect(seenHeader).To(Equal(seenID))
+		Expect(w.Header().Get("X-Request-ID")).To(Equal(seenID))
+	})
+
+	It("should accept a valid incoming ID", func() {
+		w := serve(&requestid.Handler{Handler: inner, TrustIncoming: true}, "abc-123")
+		Expect(seenID).To(Equal("abc-123"))
+		Expect(seenHeader).To(Equal("abc-123"))
+		Expect(w.Header().Get("X-Request-ID")).To(Equal("abc-123"))
+	})
+
+	It("should replace an invalid incoming ID", func() {
+		serve(&requestid.Handler{Handler: inner, TrustIncoming: true}, "not valid\x00")
+		Expect(seenID).To(MatchRegexp(`^[0-9a-f]{32}$`))
+		Expect(seenHeader).To(Equal(seenID))
+	})
+
+	It("should replace an incoming ID when it is not trusted", func() {
+		serve(&requestid.Handler{Handler: inner}, "abc-123")
+		Expect(seenID).NotTo(Equal("abc-123"))
+		Expect(seenHeader).To(Equal(seenID))
+	})
+
+	It("should use a custom header and pattern", func() {
+		h := &requestid.Handler{
+			Handler:       inner,
+			Header:        "X-Correlation-ID",
+			TrustIncoming: true,
+			Pattern:       regexp.MustCompile(`^[0-9]+$`),
+		}
+
+		w := serve(h, "12345")
+		Expect(seenID).To(Equal("12345"))
+		Expect(w.Header().Get("X-Correlation-ID")).To(Equal("12345"))
+
+		serve(h, "abc")
+		Expect(seenID).NotTo(Equal("abc"))
+	})
+
+	It("should return an empty ID without a context", func() {
+		Expect(requestid.FromContext(context.Background())).To(BeEmpty())
+		Expect(requestid.FromRequest(nil)).To(BeEmpty())
+	})
+
+})
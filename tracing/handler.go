@@ -0,0 +1,87 @@
+package tracing
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/koshatul/auth-proxy/requestid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Handler starts a server span for each request, continuing the trace from an incoming
+// W3C traceparent header if there is one.
+type Handler struct {
+	Handler http.Handler
+
+	// ServerName is reported as the http.server_name attribute.
+	ServerName string
+}
+
+// ServeHTTP satisfies the http.Handler interface for Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	attrs := semconv.HTTPServerAttributesFromHTTPRequest(h.ServerName, "", r)
+	if id := requestid.FromRequest(r); id != "" {
+		attrs = append(attrs, attribute.String("request.id", id))
+	}
+
+	ctx, span := Tracer().Start(ctx, "HTTP "+r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...),
+	)
+	defer span.End()
+
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	h.Handler.ServeHTTP(sw, r.WithContext(ctx))
+
+	span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(sw.status)...)
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(sw.status))
+}
+
+// statusWriter records the response status, it passes through Hijack and Flush so
+// upgraded and streaming responses keep working.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+
+	w.status = http.StatusSwitchingProtocols
+	w.wroteHeader = true
+
+	return hj.Hijack()
+}
@@ -0,0 +1,161 @@
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/koshatul/auth-proxy/httpauth"
+	"github.com/koshatul/auth-proxy/legacy"
+	"github.com/koshatul/auth-proxy/proxy"
+	"github.com/koshatul/auth-proxy/requestid"
+	"github.com/koshatul/auth-proxy/tracing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	cache "github.com/patrickmn/go-cache"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const incomingParent string = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+var _ = Describe("tracing", func() {
+
+	var (
+		exporter    *tracetest.InMemoryExporter
+		provider    *sdktrace.TracerProvider
+		backend     *httptest.Server
+		ts          *httptest.Server
+		backendSeen http.Header
+	)
+
+	spanNamed := func(name string) tracetest.SpanStub {
+		for _, s := range exporter.GetSpans() {
+			if s.Name == name {
+				return s
+			}
+		}
+
+		Fail("span not found: " + name)
+
+		return tracetest.SpanStub{}
+	}
+
+	BeforeEach(func() {
+		exporter = tracetest.NewInMemoryExporter()
+		provider = tracing.NewTracerProvider(tracing.Config{SampleRatio: 1}, sdktrace.WithSyncer(exporter))
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+
+		backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			backendSeen = r.Header.Clone()
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		u, err := url.Parse(backend.URL)
+		Expect(err).NotTo(HaveOccurred())
+
+		users := map[string]legacy.AuthItem{"test": {Username: "test", Password: "test"}}
+		failFunc := func(string, string, *http.Request) (string, bool) { return "", false }
+
+		ts = httptest.NewServer(&requestid.Handler{
+			Handler: &tracing.Handler{
+				Handler: &httpauth.BasicAuthHandler{
+					Handler: proxy.NewSingleHostReverseProxy(u, false, nil),
+					BasicAuthWrapper: &httpauth.BasicAuthWrapper{
+						Cache:         cache.New(time.Minute, time.Minute),
+						Realm:         "im-a-test-realm",
+						AuthFunc:      legacy.AuthCheckFunc(zap.NewNop(), users, failFunc),
+						Logger:        zap.NewNop(),
+						CacheDuration: time.Minute,
+					},
+				},
+			},
+			TrustIncoming: true,
+		})
+	})
+
+	AfterEach(func() {
+		ts.Close()
+		backend.Close()
+		Expect(provider.Shutdown(context.Background())).To(Succeed())
+	})
+
+	get := func(parent, user, pass string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/v2/", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		if parent != "" {
+			req.Header.Set("traceparent", parent)
+		}
+
+		req.Header.Set(requestid.DefaultHeader, "trace-test-id")
+		req.SetBasicAuth(user, pass)
+
+		res, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		res.Body.Close()
+
+		return res
+	}
+
+	It("continues the incoming trace and forwards it to the backend", func() {
+		res := get(incomingParent, "test", "test")
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+		server := spanNamed("HTTP GET")
+		Expect(server.SpanKind).To(Equal(trace.SpanKindServer))
+		Expect(server.SpanContext.TraceID().String()).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+		Expect(server.Parent.SpanID().String()).To(Equal("00f067aa0ba902b7"))
+
+		auth := spanNamed("httpauth.authenticate")
+		Expect(auth.Parent.SpanID()).To(Equal(server.SpanContext.SpanID()))
+		Expect(spanNamed("httpauth.cache").Parent.SpanID()).To(Equal(auth.SpanContext.SpanID()))
+		Expect(spanNamed("legacy.authenticate").Parent.SpanID()).To(Equal(auth.SpanContext.SpanID()))
+
+		upstream := spanNamed("proxy.upstream")
+		Expect(upstream.SpanKind).To(Equal(trace.SpanKindClient))
+		Expect(upstream.Parent.SpanID()).To(Equal(server.SpanContext.SpanID()))
+
+		sc := trace.SpanContextFromContext(propagation.TraceContext{}.Extract(
+			context.Background(),
+			propagation.HeaderCarrier(backendSeen),
+		))
+		Expect(sc.TraceID()).To(Equal(server.SpanContext.TraceID()))
+		Expect(sc.SpanID()).To(Equal(upstream.SpanContext.SpanID()))
+	})
+
+	It("records the request ID and response status on the server span", func() {
+		res := get("", "test", "wrong")
+		Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+
+		server := spanNamed("HTTP GET")
+		Expect(server.Parent.IsValid()).To(BeFalse())
+
+		attrs := map[string]string{}
+		for _, kv := range server.Attributes {
+			attrs[string(kv.Key)] = kv.Value.Emit()
+		}
+
+		Expect(attrs).To(HaveKeyWithValue("request.id", "trace-test-id"))
+		Expect(attrs).To(HaveKeyWithValue("http.status_code", "401"))
+	})
+
+	It("does not sample new traces with a zero sample ratio", func() {
+		provider = tracing.NewTracerProvider(tracing.Config{SampleRatio: 0}, sdktrace.WithSyncer(exporter))
+		otel.SetTracerProvider(provider)
+
+		get("", "test", "test")
+		Expect(exporter.GetSpans()).To(BeEmpty())
+
+		get(incomingParent, "test", "test")
+		Expect(exporter.GetSpans()).NotTo(BeEmpty())
+	})
+
+})
@@ -0,0 +1,3 @@
+// Package tracing configures OpenTelemetry tracing with W3C trace context propagation and
+// provides the server span handler used in front of the proxy.
+package tracing
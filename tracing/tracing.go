@@ -0,0 +1,131 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName is the name of the tracer used by the proxy packages.
+const InstrumentationName = "github.com/koshatul/auth-proxy"
+
+// Config is the tracing configuration.
+type Config struct {
+	// Exporter is where spans are sent: none, stdout or otlp.
+	Exporter string
+
+	// Endpoint is the OTLP/HTTP collector address (host:port).
+	Endpoint string
+
+	// Insecure disables TLS when connecting to the OTLP collector.
+	Insecure bool
+
+	// ServiceName is reported as the service.name resource attribute.
+	ServiceName string
+
+	// SampleRatio is the fraction of new traces that are sampled, traces continued
+	// from an incoming traceparent follow the parent's decision.
+	SampleRatio float64
+
+	// Writer is where the stdout exporter writes, defaults to os.Stdout.
+	Writer io.Writer
+}
+
+// ShutdownFunc flushes and stops the exporter.
+type ShutdownFunc func(ctx context.Context) error
+
+// Setup installs the global W3C trace context propagator and a tracer provider for the
+// configured exporter, the returned function must be called to flush spans on exit.
+func Setup(ctx context.Context, cfg Config) (ShutdownFunc, error) {
+	if err := Validate(cfg); err != nil {
+		return nil, err
+	}
+
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+
+	switch strings.ToLower(cfg.Exporter) {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		w := cfg.Writer
+		if w == nil {
+			w = os.Stdout
+		}
+
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(w))
+	case "otlp":
+		opts := []otlptracehttp.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q (none, stdout, otlp)", cfg.Exporter)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	tp := NewTracerProvider(cfg, sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// Validate checks cfg without connecting to the collector.
+func Validate(cfg Config) error {
+	switch strings.ToLower(cfg.Exporter) {
+	case "", "none", "stdout", "otlp":
+	default:
+		return fmt.Errorf("unknown trace exporter %q (none, stdout, otlp)", cfg.Exporter)
+	}
+
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return fmt.Errorf("trace sample ratio %g is outside 0.0 - 1.0", cfg.SampleRatio)
+	}
+
+	return nil
+}
+
+// NewTracerProvider returns a tracer provider using the sampler and resource from cfg and the
+// supplied options (eg. `sdktrace.WithSyncer(tracetest.NewInMemoryExporter())` in tests).
+func NewTracerProvider(cfg Config, opts ...sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "auth-proxy"
+	}
+
+	sampler := sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))
+
+	return sdktrace.NewTracerProvider(append([]sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	}, opts...)...)
+}
+
+// Tracer returns the tracer used by the proxy packages from the global tracer provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(InstrumentationName)
+}
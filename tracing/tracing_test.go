@@ -0,0 +1,35 @@
+package tracing_test
+
+import (
+	"context"
+
+	"github.com/koshatul/auth-proxy/tracing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+
+	DescribeTable("Validate",
+		func(cfg tracing.Config, msg string) {
+			err := tracing.Validate(cfg)
+			if msg == "" {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(MatchError(ContainSubstring(msg)))
+			}
+		},
+		Entry("disabled", tracing.Config{Exporter: "none", SampleRatio: 1}, ""),
+		Entry("otlp", tracing.Config{Exporter: "OTLP", SampleRatio: 0.25}, ""),
+		Entry("unknown exporter", tracing.Config{Exporter: "zipkin"}, `unknown trace exporter "zipkin"`),
+		Entry("negative ratio", tracing.Config{Exporter: "stdout", SampleRatio: -0.5}, "outside 0.0 - 1.0"),
+		Entry("ratio above one", tracing.Config{Exporter: "stdout", SampleRatio: 2}, "outside 0.0 - 1.0"),
+	)
+
+	It("should not set up an invalid config", func() {
+		_, err := tracing.Setup(context.Background(), tracing.Config{Exporter: "zipkin"})
+		Expect(err).To(HaveOccurred())
+	})
+
+})